@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"path"
+	"strings"
+)
+
+// ipFilter decides which client addresses may use the proxy: addresses in a
+// denied network are always rejected and, if any network is allowed, only
+// the addresses in one of them are accepted.
+type ipFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+func newIPFilter(allow, deny []string) (*ipFilter, error) {
+	var f ipFilter
+	var err error
+	if f.allow, err = parsePrefixes(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parsePrefixes(deny); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// parsePrefixes parses CIDR networks or single addresses, the IPv4-mapped
+// IPv6 ones as IPv4, like the client addresses they are compared to.
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range values {
+		for _, entry := range strings.Split(value, ",") {
+			if entry = strings.TrimSpace(entry); entry == "" {
+				continue
+			}
+			if !strings.Contains(entry, "/") {
+				addr, err := netip.ParseAddr(entry)
+				if err != nil {
+					return nil, fmt.Errorf("invalid network %q", entry)
+				}
+				addr = addr.Unmap().WithZone("")
+				prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+				continue
+			}
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network %q", entry)
+			}
+			if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+				prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+		}
+	}
+	return prefixes, nil
+}
+
+// parseClientAddr parses the address of a client to compare it to the
+// networks of parsePrefixes: an IPv4-mapped IPv6 one as IPv4, and without
+// the zone, which no network contains.
+func parseClientAddr(ip string) (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
+
+// allowed tells whether the client address may use the proxy. An unknown
+// address, which cannot be told out of the denied networks, is rejected.
+func (f *ipFilter) allowed(ip string) bool {
+	addr, ok := parseClientAddr(ip)
+	if !ok {
+		return false
+	}
+	for _, prefix := range f.deny {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, prefix := range f.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// handler rejects with 403 the requests from the addresses not allowed.
+func (f *ipFilter) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := clientIP(r); !f.allowed(ip) {
+			timedLog(fmt.Sprintf("Rejected request from %s", ip))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestRule matches the requests by method and path. A nil methods matches
+// any method.
+type requestRule struct {
+	methods map[string]bool
+	pattern string
+}
+
+// parseRequestRules parses "METHODS pattern" entries, like "DELETE *" or
+// "GET,HEAD /api/*", with * for any method. A pattern ending with * matches
+// the paths starting with the rest of it, any other pattern the whole path,
+// with the wildcards of path.Match.
+func parseRequestRules(entries []string) ([]requestRule, error) {
+	rules := make([]requestRule, 0, len(entries))
+	for _, entry := range entries {
+		methods, pattern, found := strings.Cut(strings.TrimSpace(entry), " ")
+		pattern = strings.TrimSpace(pattern)
+		if _, err := path.Match(pattern, ""); !found || methods == "" || err != nil || (pattern != "*" && !strings.HasPrefix(pattern, "/")) {
+			return nil, fmt.Errorf("invalid request rule %q, expected \"METHODS pattern\"", entry)
+		}
+		rule := requestRule{pattern: pattern}
+		if methods != "*" {
+			rule.methods = make(map[string]bool)
+			for _, method := range strings.Split(methods, ",") {
+				if method = strings.ToUpper(strings.TrimSpace(method)); method != "" {
+					rule.methods[method] = true
+				}
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (rule requestRule) matches(method, requestPath string) bool {
+	if rule.methods != nil && !rule.methods[method] {
+		return false
+	}
+	if prefix, found := strings.CutSuffix(rule.pattern, "*"); found && !strings.ContainsAny(prefix, "*?[\\") {
+		return strings.HasPrefix(requestPath, prefix)
+	}
+	matched, _ := path.Match(rule.pattern, requestPath)
+	return matched
+}
+
+// upstreamPath returns the cleaned path of the request without the mount
+// path, as seen by the upstream, for the rules to match. The parameters of
+// the segments, after a ;, are removed and the backslashes taken for slashes
+// first, as some servers do, so that /api/..;/admin or /api/..\admin can't
+// get around the rules either.
+func upstreamPath(r *http.Request, mountPath string) string {
+	segments := strings.Split(strings.ReplaceAll(strings.TrimPrefix(r.URL.Path, mountPath), "\\", "/"), "/")
+	for i, segment := range segments {
+		segments[i], _, _ = strings.Cut(segment, ";")
+	}
+	requestPath := "/" + strings.Join(segments, "/")
+	cleaned := path.Clean(requestPath)
+	if cleaned != "/" && strings.HasSuffix(requestPath, "/") {
+		return cleaned + "/"
+	}
+	return cleaned
+}
+
+// requestFilter decides which requests may reach the upstream with the
+// identity of the token: requests matching a deny rule are always rejected
+// and, if there are allow rules, only the requests matching one of them are
+// accepted. The paths are those of the upstream, without the mount path, and
+// are cleaned first so that dot segments can't get around the rules.
+type requestFilter struct {
+	allow     []requestRule
+	deny      []requestRule
+	mountPath string
+}
+
+func newRequestFilter(allow, deny []string, mountPath string) (*requestFilter, error) {
+	f := requestFilter{mountPath: mountPath}
+	var err error
+	if f.allow, err = parseRequestRules(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseRequestRules(deny); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func (f *requestFilter) allowed(method, requestPath string) bool {
+	for _, rule := range f.deny {
+		if rule.matches(method, requestPath) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, rule := range f.allow {
+		if rule.matches(method, requestPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// handler rejects with 403 the requests not allowed.
+func (f *requestFilter) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestPath := upstreamPath(r, f.mountPath)
+		// Methods are case-sensitive, but some upstreams don't care.
+		if !f.allowed(strings.ToUpper(r.Method), requestPath) {
+			from := clientIP(r)
+			if user := authenticatedUser(r); user != "" {
+				from = user + " at " + from
+			}
+			timedLog(fmt.Sprintf("Rejected %s %s from %s", r.Method, requestPath, from))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readOnlyHandler rejects with 405 the requests with a method that could
+// change something on the upstream.
+func readOnlyHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.ToUpper(r.Method) {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		timedLog(fmt.Sprintf("Rejected %s %s from %s in read-only mode", r.Method, r.URL.Path, clientIP(r)))
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	})
+}
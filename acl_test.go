@@ -0,0 +1,287 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseRequestRules(t *testing.T) {
+	rules, err := parseRequestRules([]string{"get,Head /api/*", "* *", " DELETE  /admin "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 || !rules[0].methods["GET"] || !rules[0].methods["HEAD"] || len(rules[0].methods) != 2 || rules[0].pattern != "/api/*" {
+		t.Errorf("methods of the first rule: %v %q", rules[0].methods, rules[0].pattern)
+	}
+	if rules[1].methods != nil || rules[1].pattern != "*" {
+		t.Errorf("the * rule: %v %q", rules[1].methods, rules[1].pattern)
+	}
+	if rules[2].pattern != "/admin" {
+		t.Errorf("pattern %q", rules[2].pattern)
+	}
+
+	for _, entry := range []string{"GET", "/api/*", "GET api/*", "GET /api/[", " /api"} {
+		if _, err := parseRequestRules([]string{entry}); err == nil {
+			t.Errorf("%q is accepted", entry)
+		}
+	}
+}
+
+func TestUpstreamPath(t *testing.T) {
+	tests := []struct {
+		mountPath, target, path string
+	}{
+		{"/", "/", "/"},
+		{"/", "/api/", "/api/"},
+		{"/", "/api/users/../", "/api/"},
+		{"/", "//api//users", "/api/users"},
+		{"/", "/api/%2e%2e/admin", "/admin"},
+		{"/", "/api%2F..%2Fadmin", "/admin"},
+		{"/", "/api/..;/admin", "/admin"},
+		{"/", "/api;v=1/users;v=2", "/api/users"},
+		{"/", "/api/..%5Cadmin", "/admin"},
+		{"/app/", "/app/", "/"},
+		{"/app/", "/app/api/users", "/api/users"},
+		{"/app/", "/app/api/../../admin", "/admin"},
+		{"/app/", "/app/../app/api/users", "/app/api/users"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.target, nil)
+		if path := upstreamPath(r, test.mountPath); path != test.path {
+			t.Errorf("upstreamPath(%s, %s) = %s, want %s", test.target, test.mountPath, path, test.path)
+		}
+	}
+}
+
+func TestRequestFilter(t *testing.T) {
+	tests := []struct {
+		name        string
+		allow, deny []string
+		mountPath   string
+		requests    map[string]bool
+	}{
+		{
+			name:  "allowed prefix",
+			allow: []string{"GET,HEAD /api/*"},
+			requests: map[string]bool{
+				"GET /api/users":        true,
+				"GET /api/":             true,
+				"get /api/users":        true,
+				"head /api/users":       true,
+				"GET /api/a/./b":        true,
+				"GET /api":              false,
+				"GET /apix":             false,
+				"GET /apix/users":       false,
+				"POST /api/users":       false,
+				"GET /api/../admin":     false,
+				"GET /api/%2e%2e/admin": false,
+				"GET /api%2F..%2Fadmin": false,
+				"GET /api/..%2Fadmin":   false,
+				"GET /api/..;/admin":    false,
+				"GET /api/..%5Cadmin":   false,
+			},
+		},
+		{
+			name: "denied prefix",
+			deny: []string{"* /admin*"},
+			requests: map[string]bool{
+				"GET /public":             true,
+				"GET /admin":              false,
+				"POST /admin/users":       false,
+				"GET /administrator":      false,
+				"GET /public/../admin":    false,
+				"GET /%61dmin":            false,
+				"GET /admin;jsessionid=1": false,
+				"GET //admin":             false,
+			},
+		},
+		{
+			name: "denied method",
+			deny: []string{"DELETE *"},
+			requests: map[string]bool{
+				"GET /items/1":    true,
+				"DELETE /items/1": false,
+				"delete /items/1": false,
+			},
+		},
+		{
+			name:  "deny over allow",
+			allow: []string{"* /api/*"},
+			deny:  []string{"DELETE /api/*", "* /api/internal/*"},
+			requests: map[string]bool{
+				"PUT /api/items/1":               true,
+				"DELETE /api/items/1":            false,
+				"GET /api/internal/metrics":      false,
+				"GET /api/x/../internal/metrics": false,
+			},
+		},
+		{
+			name:  "whole path",
+			allow: []string{"GET /files/*.txt", "GET /health"},
+			requests: map[string]bool{
+				"GET /files/a.txt":   true,
+				"GET /health":        true,
+				"GET /files/a/b.txt": false,
+				"GET /files/a.pdf":   false,
+				"GET /health/x":      false,
+			},
+		},
+		{
+			name:      "mount path",
+			allow:     []string{"GET /api/*"},
+			mountPath: "/app/",
+			requests: map[string]bool{
+				"GET /app/api/users":        true,
+				"GET /app/admin":            false,
+				"GET /app/app/api/users":    false,
+				"GET /app/api/../../admin":  false,
+				"GET /app/../app/api/users": false,
+			},
+		},
+	}
+	for _, test := range tests {
+		mountPath := test.mountPath
+		if mountPath == "" {
+			mountPath = "/"
+		}
+		filter, err := newRequestFilter(test.allow, test.deny, mountPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler := filter.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		for request, allowed := range test.requests {
+			method, target, _ := strings.Cut(request, " ")
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+			if (recorder.Code == http.StatusOK) != allowed {
+				t.Errorf("%s: %s answered %d", test.name, request, recorder.Code)
+			}
+		}
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	prefixes, err := parsePrefixes([]string{"10.0.0.0/8, 192.168.1.10", "2001:db8::/32", "::ffff:172.16.0.0/108", "fe80::1%eth0", " "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.0/8", "192.168.1.10/32", "2001:db8::/32", "172.16.0.0/12", "fe80::1/128"}
+	if len(prefixes) != len(want) {
+		t.Fatalf("prefixes %v, want %v", prefixes, want)
+	}
+	for i, prefix := range prefixes {
+		if prefix.String() != want[i] {
+			t.Errorf("prefix %d = %s, want %s", i, prefix, want[i])
+		}
+	}
+	if prefixes, _ := parsePrefixes([]string{"10.1.2.3/8"}); prefixes[0].String() != "10.0.0.0/8" {
+		t.Errorf("10.1.2.3/8 parsed as %s", prefixes[0])
+	}
+	for _, value := range []string{"10.0.0.0/33", "10.0.0", "localhost", "10.0.0.0/8,nope"} {
+		if _, err := parsePrefixes([]string{value}); err == nil {
+			t.Errorf("%q is accepted", value)
+		}
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	tests := []struct {
+		name        string
+		allow, deny []string
+		clients     map[string]bool
+	}{
+		{
+			name:  "allowed networks",
+			allow: []string{"10.0.0.0/8", "192.168.1.10", "2001:db8::/32"},
+			clients: map[string]bool{
+				"10.1.2.3":         true,
+				"::ffff:10.0.0.1":  true,
+				"192.168.1.10":     true,
+				"192.168.1.11":     false,
+				"2001:db8::1":      true,
+				"2001:db9::1":      false,
+				"11.0.0.1":         false,
+				"":                 false,
+				"@":                false,
+				"not an address":   false,
+				"10.0.0.1:1234":    false,
+				"fe80::1%eth0":     false,
+				"::ffff:11.0.0.1":  false,
+				"2001:db8::1%eth0": true,
+			},
+		},
+		{
+			name: "denied networks",
+			deny: []string{"10.0.0.0/8", "::ffff:172.16.0.0/108", "fe80::/10"},
+			clients: map[string]bool{
+				"192.168.1.10":    true,
+				"10.0.0.1":        false,
+				"::ffff:10.0.0.1": false,
+				"172.16.0.1":      false,
+				"fe80::1%eth0":    false,
+				"2001:db8::1":     true,
+				// Unknown addresses might be denied ones.
+				"":  false,
+				"@": false,
+			},
+		},
+		{
+			name:  "deny over allow",
+			allow: []string{"10.0.0.0/8"},
+			deny:  []string{"10.0.0.0/24", "10.1.0.1"},
+			clients: map[string]bool{
+				"10.2.0.1":        true,
+				"10.0.0.1":        false,
+				"::ffff:10.0.0.1": false,
+				"10.1.0.1":        false,
+				"10.1.0.2":        true,
+			},
+		},
+	}
+	for _, test := range tests {
+		filter, err := newIPFilter(test.allow, test.deny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for client, allowed := range test.clients {
+			if filter.allowed(client) != allowed {
+				t.Errorf("%s: %q allowed %v, want %v", test.name, client, !allowed, allowed)
+			}
+		}
+	}
+
+	// The address of the client is the one of the connection, or of the
+	// PROXY protocol header if any: the one of a Unix socket is unknown.
+	filter, err := newIPFilter([]string{"10.0.0.0/8"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := filter.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for remoteAddr, allowed := range map[string]bool{"10.0.0.1:1234": true, "[::ffff:10.0.0.1]:1234": true, "11.0.0.1:1234": false, "@": false, "": false} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		if (recorder.Code == http.StatusOK) != allowed {
+			t.Errorf("client %q answered %d", remoteAddr, recorder.Code)
+		}
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	forwarding, err := newForwardedHeaders("append", false, []string{"10.0.0.0/8", "::ffff:192.168.0.0/112"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for remoteAddr, trusted := range map[string]bool{"10.0.0.1:1234": true, "[::ffff:10.0.0.1]:1234": true, "192.168.3.4:1234": true, "11.0.0.1:1234": false, "@": false} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("X-Forwarded-For", "203.0.113.1")
+		forwarding.apply(r)
+		if (r.Header.Get("X-Forwarded-For") != "") != trusted {
+			t.Errorf("client %q trusted %v, want %v", remoteAddr, !trusted, trusted)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"slices"
+
+	"github.com/ThalesIgnite/crypto11"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager obtains and renews the certificates of the listener for the
+// domains from an ACME CA, like Let's Encrypt. The certificates, and the
+// account key unless one is given, are kept in the cache directory, so that
+// they are not requested again at each start.
+func newACMEManager(domains []string, email, cacheDir, directoryURL string, accountKey crypto.Signer) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+		Client:     &acme.Client{Key: accountKey, DirectoryURL: directoryURL, UserAgent: "pkcs11-web-proxy"},
+	}
+}
+
+// tokenACMEAccountKey returns the key pair of the token with the label, to
+// sign the requests to the ACME CA with, generating a P-256 one the first
+// time. The identity the certificates are issued to then never leaves the
+// token either.
+func tokenACMEAccountKey(context *crypto11.Context, label string) (crypto.Signer, error) {
+	key, err := context.FindKeyPair(nil, []byte(label))
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		return key, nil
+	}
+	timedLog(fmt.Sprintf("Generating the ACME account key %q on the token", label))
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	key, err = context.GenerateECDSAKeyPairWithLabel(id, []byte(label), elliptic.P256())
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate the ACME account key on the token: %v", err)
+	}
+	return key, nil
+}
+
+// configureACME makes the listener serve the certificates of the manager and
+// answer the TLS-ALPN-01 challenges.
+func configureACME(config *tls.Config, manager *autocert.Manager) {
+	config.GetCertificate = manager.GetCertificate
+	if !slices.Contains(config.NextProtos, acme.ALPNProto) {
+		config.NextProtos = append(config.NextProtos, acme.ALPNProto)
+	}
+}
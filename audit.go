@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditRecord is a line of the audit log, telling who performed which request
+// with the identity of the token.
+type auditRecord struct {
+	Time       time.Time `json:"time"`
+	User       string    `json:"user,omitempty"`
+	ClientCert string    `json:"client_cert,omitempty"`
+	ClientIP   string    `json:"client_ip"`
+	Method     string    `json:"method"`
+	URL        string    `json:"url"`
+	Host       string    `json:"host"`
+	Upstream   string    `json:"upstream,omitempty"`
+	Route      string    `json:"route,omitempty"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+type auditRecordKey struct{}
+
+// auditRecordOf returns the audit record of the request being served, for the
+// handlers to complete it.
+func auditRecordOf(r *http.Request) *auditRecord {
+	record, _ := r.Context().Value(auditRecordKey{}).(*auditRecord)
+	return record
+}
+
+const auditMACField = `,"mac":"`
+
+// auditLog appends a JSON line per request to a file. With a key, each line
+// ends with an HMAC-SHA256 of its content chained to the one of the previous
+// line, so that altered, reordered or removed lines can be detected with the
+// verify-audit-log command, except for the lines removed from the end.
+type auditLog struct {
+	mu      sync.Mutex
+	file    *os.File
+	key     []byte
+	lastMAC string
+}
+
+func readAuditLogKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) < 16 {
+		return nil, fmt.Errorf("the audit log key in %s is too short, use at least 16 bytes", path)
+	}
+	return key, nil
+}
+
+func openAuditLog(path string, key []byte) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l := &auditLog{file: file, key: key}
+	if key != nil {
+		if l.lastMAC, err = lastAuditMAC(path); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// lastAuditMAC returns the MAC of the last line of the log, to continue the
+// chain from.
+func lastAuditMAC(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	offset := info.Size() - 64*1024
+	if offset < 0 {
+		offset = 0
+	}
+	tail, err := io.ReadAll(io.NewSectionReader(file, offset, info.Size()-offset))
+	if err != nil {
+		return "", err
+	}
+	lines := bytes.Split(bytes.TrimRight(tail, "\n"), []byte("\n"))
+	last := lines[len(lines)-1]
+	if len(last) == 0 {
+		return "", nil
+	}
+	_, mac, ok := splitAuditMAC(last)
+	if !ok {
+		return "", fmt.Errorf("the last line of %s is not signed", path)
+	}
+	return mac, nil
+}
+
+// splitAuditMAC separates the content of a signed line from its MAC.
+func splitAuditMAC(line []byte) ([]byte, string, bool) {
+	index := bytes.LastIndex(line, []byte(auditMACField))
+	if index < 0 || !bytes.HasSuffix(line, []byte(`"}`)) {
+		return nil, "", false
+	}
+	content := append(append([]byte{}, line[:index]...), '}')
+	return content, string(line[index+len(auditMACField) : len(line)-2]), true
+}
+
+func auditMAC(key []byte, previous string, content []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(previous))
+	mac.Write([]byte("\n"))
+	mac.Write(content)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (l *auditLog) write(record *auditRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var mac string
+	if l.key != nil {
+		mac = auditMAC(l.key, l.lastMAC, line)
+		line = append(line[:len(line)-1], auditMACField+mac+`"}`...)
+	}
+	if n, err := l.file.Write(append(line, '\n')); err != nil {
+		timedLog(fmt.Sprintf("Cannot write to the audit log: %v", err))
+		// The chain goes on from the last complete line: a partial one
+		// would make the next ones fail the verification.
+		if n > 0 {
+			if info, err := l.file.Stat(); err == nil {
+				l.file.Truncate(info.Size() - int64(n))
+			}
+		}
+		return
+	}
+	if l.key != nil {
+		l.lastMAC = mac
+	}
+}
+
+// handler records each request in the audit log once it has been served.
+func (l *auditLog) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record := &auditRecord{
+			Time:     time.Now().UTC(),
+			User:     authenticatedUser(r),
+			ClientIP: clientIP(r),
+			Method:   r.Method,
+			URL:      r.URL.RequestURI(),
+			Host:     r.Host,
+		}
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			record.ClientCert = r.TLS.PeerCertificates[0].Subject.String()
+		}
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			record.Status = recorder.status
+			if record.Status == 0 {
+				record.Status = http.StatusOK
+			}
+			record.Bytes = recorder.bytes
+			record.DurationMs = time.Since(record.Time).Milliseconds()
+			l.write(record)
+		}()
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), auditRecordKey{}, record)))
+	})
+}
+
+// statusRecorder records the status and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 || w.status < http.StatusOK {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// runVerifyAuditLog checks the audit-log with the key of audit-log-key-file.
+func runVerifyAuditLog(c *config) error {
+	key, err := readAuditLogKey(c.auditLogKeyFile)
+	if err != nil {
+		return err
+	}
+	return verifyAuditLog(c.auditLogPath, key)
+}
+
+// verifyAuditLog checks the chain of MACs of the audit log, reporting the
+// first line that doesn't match. The number of lines and the last MAC it
+// prints are what to keep elsewhere to detect lines removed from the end
+// later.
+func verifyAuditLog(path string, key []byte) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	previous := ""
+	lines := 0
+	for scanner.Scan() {
+		lines++
+		content, mac, ok := splitAuditMAC(scanner.Bytes())
+		if !ok {
+			return fmt.Errorf("line %d is not signed", lines)
+		}
+		if !hmac.Equal([]byte(auditMAC(key, previous, content)), []byte(mac)) {
+			return fmt.Errorf("line %d was altered, or lines before it were removed or reordered", lines)
+		}
+		previous = mac
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d lines verified, the last one with the MAC %s\n", path, lines, previous)
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testAuditKey = []byte("0123456789abcdef")
+
+// writeAuditRecords appends count records to the log, the first one numbered
+// from.
+func writeAuditRecords(t *testing.T, path string, from, count int) {
+	t.Helper()
+	l, err := openAuditLog(path, testAuditKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.file.Close()
+	for i := from; i < from+count; i++ {
+		l.write(&auditRecord{Time: time.Unix(int64(i), 0).UTC(), User: "user" + strconv.Itoa(i), Method: http.MethodGet, URL: "/" + strconv.Itoa(i), Status: http.StatusOK})
+	}
+}
+
+func readAuditLines(t *testing.T, path string) [][]byte {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.SplitAfter(bytes.TrimSuffix(content, []byte("\n")), []byte("\n"))
+}
+
+func writeAuditLines(t *testing.T, path string, lines [][]byte) {
+	t.Helper()
+	if err := os.WriteFile(path, bytes.Join(lines, nil), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuditLogChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeAuditRecords(t, path, 0, 5)
+	if err := verifyAuditLog(path, testAuditKey); err != nil {
+		t.Fatal(err)
+	}
+	// Reopening the log continues the chain from its last line.
+	writeAuditRecords(t, path, 5, 5)
+	if err := verifyAuditLog(path, testAuditKey); err != nil {
+		t.Fatal(err)
+	}
+	lines := readAuditLines(t, path)
+	if len(lines) != 10 {
+		t.Fatalf("%d lines, want 10", len(lines))
+	}
+	if err := verifyAuditLog(path, []byte("another key of 16 bytes")); err == nil {
+		t.Error("the log verifies with another key")
+	}
+
+	tamper := func(name string, change func([][]byte) [][]byte, line int) {
+		tampered := change(append([][]byte{}, lines...))
+		writeAuditLines(t, path, tampered)
+		err := verifyAuditLog(path, testAuditKey)
+		if line == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+			return
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), "line "+strconv.Itoa(line)+" ") {
+			t.Errorf("%s: error %v, want one about line %d", name, err, line)
+		}
+	}
+	tamper("altered", func(lines [][]byte) [][]byte {
+		lines[3] = bytes.Replace(lines[3], []byte(`"user3"`), []byte(`"mallory"`), 1)
+		return lines
+	}, 4)
+	tamper("reordered", func(lines [][]byte) [][]byte {
+		lines[3], lines[4] = lines[4], lines[3]
+		return lines
+	}, 4)
+	tamper("removed", func(lines [][]byte) [][]byte {
+		return append(lines[:3], lines[4:]...)
+	}, 4)
+	tamper("removed first", func(lines [][]byte) [][]byte {
+		return lines[1:]
+	}, 1)
+	tamper("unsigned", func(lines [][]byte) [][]byte {
+		lines[6] = []byte(`{"time":"1970-01-01T00:00:06Z","client_ip":"","method":"GET"}` + "\n")
+		return lines
+	}, 7)
+	// The chain has no anchor: what remains after removing the last lines
+	// is still valid, as documented.
+	tamper("truncated", func(lines [][]byte) [][]byte {
+		return lines[:7]
+	}, 0)
+}
+
+func TestAuditLogFailedWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := openAuditLog(path, testAuditKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.write(&auditRecord{Method: http.MethodGet, URL: "/written"})
+	mac := l.lastMAC
+	// A record that cannot be written leaves the chain where it was.
+	l.file.Close()
+	l.write(&auditRecord{Method: http.MethodGet, URL: "/lost"})
+	if l.lastMAC != mac {
+		t.Error("a failed write advances the chain")
+	}
+	if l.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer l.file.Close()
+	l.write(&auditRecord{Method: http.MethodGet, URL: "/written/after"})
+	if err := verifyAuditLog(path, testAuditKey); err != nil {
+		t.Error(err)
+	}
+	if lines := readAuditLines(t, path); len(lines) != 2 {
+		t.Errorf("%d lines, want 2", len(lines))
+	}
+}
+
+func TestOpenAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := os.WriteFile(path, []byte(`{"method":"GET"}`+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// An unsigned log cannot be continued with a key, but can without.
+	if _, err := openAuditLog(path, testAuditKey); err == nil {
+		t.Error("the chain continues from an unsigned line")
+	}
+	l, err := openAuditLog(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.write(&auditRecord{Method: http.MethodGet})
+	l.file.Close()
+	if lines := readAuditLines(t, path); len(lines) != 2 || bytes.Contains(lines[1], []byte(auditMACField)) {
+		t.Errorf("unsigned log: %q", lines)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type authenticatedUserKey struct{}
+
+// authenticatedUser returns the name of the user the request was
+// authenticated as, if any.
+func authenticatedUser(r *http.Request) string {
+	user, _ := r.Context().Value(authenticatedUserKey{}).(string)
+	return user
+}
+
+// htpasswd holds the users allowed to use the proxy, read from an Apache
+// htpasswd file. The bcrypt, apr1 (MD5) and SHA-1 hash formats are supported.
+type htpasswd map[string]string
+
+func loadHtpasswd(path string) (htpasswd, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	users := make(htpasswd)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		user, hash, found := strings.Cut(entry, ":")
+		if !found || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, line)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "$apr1$") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("%s:%d: unsupported hash format for user %s, use bcrypt, apr1 or SHA-1", path, line, user)
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("%s: no users found", path)
+	}
+	return users, nil
+}
+
+func (h htpasswd) check(user, password string) bool {
+	hash, ok := h[user]
+	if !ok {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, "$apr1$"), "$")
+		return subtle.ConstantTimeCompare([]byte(apr1(password, salt)), []byte(hash)) == 1
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte("{SHA}"+base64.StdEncoding.EncodeToString(sum[:])), []byte(hash)) == 1
+	}
+	return false
+}
+
+// apr1 computes the Apache variant of the MD5-crypt password hash.
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	h := md5.New()
+	h.Write([]byte(password + magic + salt))
+	alternate := md5.Sum([]byte(password + salt + password))
+	for i := len(password); i > 0; i -= 16 {
+		h.Write(alternate[:min(i, 16)])
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write([]byte{password[0]})
+		}
+	}
+	final := h.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write([]byte(password))
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write([]byte(password))
+		}
+		if i&1 != 0 {
+			round.Write(final)
+		} else {
+			round.Write([]byte(password))
+		}
+		final = round.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var encoded strings.Builder
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			encoded.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, group := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(final[group[0]])<<16|uint32(final[group[1]])<<8|uint32(final[group[2]]), 4)
+	}
+	to64(uint32(final[11]), 2)
+	return magic + salt + "$" + encoded.String()
+}
+
+// basicAuthHandler only lets through the requests with the credentials of
+// one of the users, since the proxy hands out the identity of the token to
+// anyone who can reach it. The credentials are not forwarded to the upstream.
+func basicAuthHandler(next http.Handler, users htpasswd, realm string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || !users.check(user, password) {
+			if ok {
+				timedLog(fmt.Sprintf("Authentication failed for user %q from %s", user, clientIP(r)))
+			}
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		r.Header.Del("Authorization")
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authenticatedUserKey{}, user)))
+	})
+}
+
+// loadCertPool reads the PEM encoded certificates in path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return pool, nil
+}
+
+// clientCertHandler identifies the users by the common name of the
+// certificate they presented to the TLS listener, unless they authenticate
+// otherwise too.
+func clientCertHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			user := r.TLS.PeerCertificates[0].Subject.CommonName
+			if user == "" {
+				user = r.TLS.PeerCertificates[0].Subject.String()
+			}
+			r = r.WithContext(context.WithValue(r.Context(), authenticatedUserKey{}, user))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
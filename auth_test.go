@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The apr1 vectors are the output of openssl passwd -apr1, which implements
+// the same algorithm as htpasswd -m, and the SHA-1 ones of htpasswd -s.
+func TestApr1(t *testing.T) {
+	tests := []struct {
+		password, salt, hash string
+	}{
+		{"password", "r31.....", "$apr1$r31.....$ARC3pREO82RIm0aQ2zszC0"},
+		{"password", "Xt3", "$apr1$Xt3$tg/viwC/mvPZ4hVteobIU/"},
+		{"correct horse battery staple", "r31.....", "$apr1$r31.....$RSm0VOy2/jdarTt.BqnSF0"},
+		{"correct horse battery staple", "Xt3", "$apr1$Xt3$Xdp7qItBpwgT9deAKy59V0"},
+		{"p", "r31.....", "$apr1$r31.....$62j9A.IWRbUKY5/Cx1uKR1"},
+		{"p", "Xt3", "$apr1$Xt3$n40RL2w.npxg3DyjYTQl9/"},
+		{"ünïcødé-Pässwörd!", "r31.....", "$apr1$r31.....$8V/tWbgra6NRodKlipkw6."},
+		{"ünïcødé-Pässwörd!", "Xt3", "$apr1$Xt3$6ceWYMPa9IETrfKIehZoc1"},
+	}
+	for _, test := range tests {
+		if hash := apr1(test.password, test.salt); hash != test.hash {
+			t.Errorf("apr1(%q, %q) = %s, want %s", test.password, test.salt, hash, test.hash)
+		}
+	}
+}
+
+func TestHtpasswdCheck(t *testing.T) {
+	users := htpasswd{
+		"apr1":   "$apr1$r31.....$RSm0VOy2/jdarTt.BqnSF0",
+		"sha":    "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+		"sha2":   "{SHA}q/eq1kOINtvlJqojGr3i0O73TUI=",
+		"bcrypt": "$2y$05$UvfFHqvoLvtjRUd.Kdy3BOt6ndIpE6w1mZZ/J5ksx9M490lM6hdj2",
+	}
+	tests := []struct {
+		user, password string
+		ok             bool
+	}{
+		{"apr1", "correct horse battery staple", true},
+		{"apr1", "correct horse battery stapl", false},
+		{"sha", "password", true},
+		{"sha", "Password", false},
+		{"sha2", "correct horse battery staple", true},
+		{"bcrypt", "password", true},
+		{"bcrypt", "password ", false},
+		{"nobody", "password", false},
+	}
+	for _, test := range tests {
+		if ok := users.check(test.user, test.password); ok != test.ok {
+			t.Errorf("check(%q, %q) = %v, want %v", test.user, test.password, ok, test.ok)
+		}
+	}
+}
+
+func TestLoadHtpasswd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	content := "# users\n\nalice:$apr1$Xt3$tg/viwC/mvPZ4hVteobIU/\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	users, err := loadHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || !users.check("alice", "password") || !users.check("bob", "password") {
+		t.Errorf("loadHtpasswd = %v", users)
+	}
+
+	for _, content := range []string{"alice:password\n", "alice\n", "# nobody\n"} {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadHtpasswd(path); err == nil {
+			t.Errorf("loadHtpasswd accepted %q", content)
+		}
+	}
+}
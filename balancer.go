@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+)
+
+// upstream is one of the destinations requests are balanced across. Backup
+// upstreams only get requests when none of the others is healthy.
+type upstream struct {
+	id       string
+	url      *url.URL
+	proxy    *httputil.ReverseProxy
+	backup   bool
+	weight   int
+	healthy  atomic.Bool
+	inFlight atomic.Int64
+}
+
+// balancer spreads the requests across the healthy upstreams, either in turn
+// (round-robin) or to the one with the fewest requests in flight
+// (least-connections). With session affinity, the clients keep being sent
+// to the same upstream as long as it is healthy, remembered with a cookie or
+// derived from a hash of their IP address.
+//
+// If weighted, the upstreams get a share of the requests proportional to
+// their weight, e.g. to send a small percentage of them to a canary.
+type balancer struct {
+	upstreams  []*upstream
+	strategy   string
+	weighted   bool
+	sticky     string
+	cookieName string
+	counter    atomic.Uint64
+}
+
+// upstreamID returns the identifier of the upstream stored in the affinity
+// cookie, stable across restarts as long as the URL doesn't change.
+func upstreamID(u *url.URL) string {
+	h := fnv.New32a()
+	h.Write([]byte(u.String()))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+func (b *balancer) pick(r *http.Request) *upstream {
+	candidates := b.candidates()
+	switch b.sticky {
+	case "cookie":
+		if cookie, err := r.Cookie(b.cookieName); err == nil {
+			for _, candidate := range candidates {
+				if candidate.id == cookie.Value {
+					return candidate
+				}
+			}
+		}
+	case "ip-hash":
+		h := fnv.New32a()
+		h.Write([]byte(clientIP(r)))
+		return candidates[h.Sum32()%uint32(len(candidates))]
+	}
+	return b.next(candidates)
+}
+
+// stick sets the affinity cookie sending the client to u, unless the request
+// already carries it.
+func (b *balancer) stick(w http.ResponseWriter, r *http.Request, u *upstream) {
+	if b.sticky != "cookie" {
+		return
+	}
+	if cookie, err := r.Cookie(b.cookieName); err == nil && cookie.Value == u.id {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     b.cookieName,
+		Value:    u.id,
+		Path:     "/",
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// unstick removes the affinity cookie from a request forwarded to the
+// upstream, which has no use for it.
+func (b *balancer) unstick(r *http.Request) {
+	if _, err := r.Cookie(b.cookieName); err == nil && b.sticky == "cookie" {
+		removeCookies(r, b.cookieName)
+	}
+}
+
+// next picks one of the candidates according to the balancing strategy.
+func (b *balancer) next(candidates []*upstream) *upstream {
+	start := int((b.counter.Add(1) - 1) % uint64(len(candidates)))
+	if b.strategy != "least-connections" {
+		if b.weighted {
+			if u := weightedPick(candidates); u != nil {
+				return u
+			}
+		}
+		return candidates[start]
+	}
+	// Start from a rotating index, so that ties are broken fairly.
+	best := candidates[start]
+	for i := 1; i < len(candidates); i++ {
+		candidate := candidates[(start+i)%len(candidates)]
+		if b.weighted {
+			// Compare the requests in flight per unit of weight.
+			if candidate.inFlight.Load()*int64(best.weight) < best.inFlight.Load()*int64(candidate.weight) {
+				best = candidate
+			}
+		} else if candidate.inFlight.Load() < best.inFlight.Load() {
+			best = candidate
+		}
+	}
+	return best
+}
+
+// weightedPick picks one of the candidates at random with a probability
+// proportional to its weight, or returns nil if all the weights are zero.
+func weightedPick(candidates []*upstream) *upstream {
+	total := 0
+	for _, u := range candidates {
+		total += u.weight
+	}
+	if total == 0 {
+		return nil
+	}
+	n := rand.Intn(total)
+	for _, u := range candidates {
+		if n < u.weight {
+			return u
+		}
+		n -= u.weight
+	}
+	return nil
+}
+
+// candidates returns the healthy primary upstreams, falling back to the
+// healthy backup ones and, if everything is down, to all the primary ones.
+func (b *balancer) candidates() []*upstream {
+	var primaries, backups, healthyBackups []*upstream
+	for _, u := range b.upstreams {
+		if u.backup {
+			backups = append(backups, u)
+			if u.healthy.Load() {
+				healthyBackups = append(healthyBackups, u)
+			}
+			continue
+		}
+		if u.healthy.Load() {
+			primaries = append(primaries, u)
+		}
+	}
+	if len(primaries) > 0 {
+		return primaries
+	}
+	if len(healthyBackups) > 0 {
+		return healthyBackups
+	}
+	for _, u := range b.upstreams {
+		if !u.backup {
+			primaries = append(primaries, u)
+		}
+	}
+	if len(primaries) == 0 {
+		return backups
+	}
+	return primaries
+}
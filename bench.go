@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseConcurrencyLevels parses a comma-separated list of positive numbers.
+func parseConcurrencyLevels(value string) ([]int, error) {
+	var levels []int
+	for _, part := range strings.Split(value, ",") {
+		level, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || level < 1 {
+			return nil, fmt.Errorf("invalid concurrency level %q", part)
+		}
+		levels = append(levels, level)
+	}
+	return levels, nil
+}
+
+// runBench measures the signatures of the key of the certificate at
+// certificate-index at each level of bench-concurrency.
+func runBench(c *config) error {
+	pinVal, err := c.tokenPin()
+	if err != nil {
+		return err
+	}
+	levels, err := parseConcurrencyLevels(c.benchConcurrency)
+	if err != nil {
+		return err
+	}
+	benchSigner(&c.pkcs11path, &c.tokenSerial, pinVal, c.pkcs11MaxSessions, c.certificateIndex, levels, c.benchDuration)
+	return nil
+}
+
+// benchSigner measures the signatures per second and the latency of the
+// selected key of the token, signing SHA-256 digests like in a TLS handshake
+// for the duration at each concurrency level, to tell how many handshakes the
+// token can sustain and how many sessions are worth opening.
+func benchSigner(pkcs11path, tokenSerial *string, pinVal string, maxSessions, index int, levels []int, duration time.Duration) {
+	context, err := configureToken(*pkcs11path, *tokenSerial, pinVal, maxSessions)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	certificates, err := context.FindAllPairedCertificates()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if index >= len(certificates) {
+		log.Fatalf("Certificate index %d is out of range. Run '%s -token-serial ... [-pin/-pin-file] ... list-certificates' to find the index.\n", index, os.Args[0])
+	}
+	signer := certificates[index].PrivateKey.(crypto.Signer)
+	var opts crypto.SignerOpts = crypto.SHA256
+	mechanism := "ECDSA"
+	if _, ok := signer.Public().(*rsa.PublicKey); ok {
+		mechanism = "RSA PKCS#1 v1.5"
+	}
+	fmt.Printf("Benchmarking %s signatures with the key of %v, %v per concurrency level\n", mechanism, certificates[index].Leaf.Subject, duration)
+
+	for _, level := range levels {
+		benchLevel(signer, opts, level, duration)
+	}
+}
+
+// benchLevel signs with the given number of concurrent signers for the
+// duration, and prints the throughput and latency percentiles.
+func benchLevel(signer crypto.Signer, opts crypto.SignerOpts, level int, duration time.Duration) {
+	digest := sha256.Sum256([]byte("pkcs11-web-proxy"))
+	var mu sync.Mutex
+	var latencies []time.Duration
+	failures := 0
+	var firstErr error
+	deadline := time.Now().Add(duration)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < level; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				signStart := time.Now()
+				_, err := signer.Sign(rand.Reader, digest[:], opts)
+				latency := time.Since(signStart)
+				mu.Lock()
+				if err != nil {
+					failures++
+					if firstErr == nil {
+						firstErr = err
+					}
+				} else {
+					latencies = append(latencies, latency)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	if len(latencies) == 0 {
+		fmt.Printf("Concurrency %d: no signature succeeded, %d errors: %v\n", level, failures, firstErr)
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))].Round(100 * time.Microsecond)
+	}
+	fmt.Printf("Concurrency %d: %.1f signatures/s, latency p50 %v, p90 %v, p99 %v, max %v, %d errors\n",
+		level, float64(len(latencies))/elapsed.Seconds(), percentile(0.5), percentile(0.9), percentile(0.99), percentile(1), failures)
+	if firstErr != nil {
+		fmt.Printf("  First error: %v\n", firstErr)
+	}
+}
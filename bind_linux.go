@@ -0,0 +1,20 @@
+package main
+
+import (
+	"syscall"
+)
+
+// bindToInterface returns a dialer control function binding the sockets to the
+// given network interface.
+func bindToInterface(name string) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var bindErr error
+		err := c.Control(func(fd uintptr) {
+			bindErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, name)
+		})
+		if err != nil {
+			return err
+		}
+		return bindErr
+	}, nil
+}
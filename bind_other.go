@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// bindToInterface returns a dialer control function binding the sockets to the
+// given network interface.
+func bindToInterface(name string) (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, errors.New("binding to a network interface is only supported on Linux, use -bind-source-ip instead")
+}
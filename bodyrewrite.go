@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// bodyReplacement is a string of a response body to replace.
+type bodyReplacement struct {
+	from, to []byte
+}
+
+// rewritableBody tells whether the body of the response is HTML, CSS or
+// JavaScript, whose absolute URLs of the upstream are rewritten, and is not
+// compressed or with an encoding the proxy can decode.
+func rewritableBody(resp *http.Response) bool {
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "", "identity", "gzip", "br", "zstd":
+	default:
+		return false
+	}
+	if resp.Request.Method == http.MethodHead || resp.StatusCode < http.StatusOK ||
+		resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified || resp.StatusCode == http.StatusPartialContent {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "text/html", "application/xhtml+xml", "text/css", "text/javascript", "application/javascript", "application/x-javascript":
+		return true
+	}
+	return false
+}
+
+// bodyReplacements returns the absolute and scheme-relative URLs of the
+// upstreams to replace with the ones of the proxy, for a client that reached
+// the proxy at origin. The URLs escaped in JavaScript strings are replaced
+// too.
+func (rw *urlRewriter) bodyReplacements(origin string, upstream *url.URL) []bodyReplacement {
+	local := origin + strings.TrimSuffix(rw.mountPath, "/")
+	var replacements []bodyReplacement
+	add := func(from *url.URL, to string) {
+		host := from.Host
+		if from.Port() != "" && from.Port() == urlPort(&url.URL{Scheme: from.Scheme}) {
+			host = from.Hostname()
+		}
+		path := strings.TrimSuffix(from.EscapedPath(), "/")
+		_, toRelative, isAbsolute := strings.Cut(to, ":")
+		if !isAbsolute {
+			toRelative = to
+		}
+		for _, pair := range [][2]string{
+			{from.Scheme + "://" + host + path, to},
+			{"//" + host + path, toRelative},
+		} {
+			replacements = append(replacements,
+				bodyReplacement{[]byte(pair[0]), []byte(pair[1])},
+				bodyReplacement{[]byte(strings.ReplaceAll(pair[0], "/", `\/`)), []byte(strings.ReplaceAll(pair[1], "/", `\/`))})
+		}
+	}
+	for _, other := range append([]*url.URL{upstream}, rw.upstreams...) {
+		add(other, local)
+	}
+	for _, route := range rw.routes {
+		add(route.from, route.to)
+	}
+	return replacements
+}
+
+// rewriteBody replaces the URLs of the upstreams in the body of the response
+// while it is streamed to the client. A compressed body is decoded, and
+// encoded again unless reencode is false.
+func (rw *urlRewriter) rewriteBody(resp *http.Response, upstream *url.URL, reencode bool) error {
+	encoding := strings.ToLower(resp.Header.Get("Content-Encoding"))
+	if encoding == "identity" {
+		encoding = ""
+	}
+	var body io.ReadCloser = resp.Body
+	if encoding != "" {
+		decoded, err := newDecoder(encoding, resp.Body)
+		if err != nil {
+			return err
+		}
+		body = readCloser{decoded, resp.Body}
+	}
+	body = newReplacingReader(body, rw.bodyReplacements(clientOrigin(resp.Request), upstream))
+	if encoding != "" && reencode {
+		body = encodeBody(body, encoding)
+	} else {
+		resp.Header.Del("Content-Encoding")
+	}
+	resp.Body = body
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	if etag := resp.Header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("Etag", "W/"+etag)
+	}
+	return nil
+}
+
+// encodeBody compresses body with the content encoding while it is read.
+func encodeBody(body io.ReadCloser, encoding string) io.ReadCloser {
+	reader, writer := io.Pipe()
+	go func() {
+		encoder, err := newEncoder(encoding, writer)
+		if err == nil {
+			_, err = io.Copy(encoder, body)
+			if closeErr := encoder.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		writer.CloseWithError(err)
+	}()
+	return &encodedBody{PipeReader: reader, body: body}
+}
+
+// encodedBody is the compressed body of encodeBody. Closing it stops the
+// compression.
+type encodedBody struct {
+	*io.PipeReader
+	body io.ReadCloser
+}
+
+func (b *encodedBody) Close() error {
+	b.PipeReader.Close()
+	return b.body.Close()
+}
+
+// replacingReader replaces strings in a stream. A string only matches when
+// it is not followed by a character that may continue a host name or a path
+// segment, so that https://upstream doesn't match https://upstream.other or
+// https://upstream:8443.
+type replacingReader struct {
+	src          io.ReadCloser
+	replacements []bodyReplacement
+	longest      int
+	first        [256]bool
+	in, out      []byte
+	buf          []byte
+	err          error
+}
+
+func newReplacingReader(src io.ReadCloser, replacements []bodyReplacement) *replacingReader {
+	r := &replacingReader{src: src, replacements: replacements, buf: make([]byte, 32*1024)}
+	for _, replacement := range replacements {
+		r.longest = max(r.longest, len(replacement.from))
+		r.first[replacement.from[0]] = true
+	}
+	return r
+}
+
+func (r *replacingReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		n, err := r.src.Read(r.buf)
+		r.in = append(r.in, r.buf[:n]...)
+		r.err = err
+		r.process(err != nil)
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// process moves the input to the output, replacing the matches, and keeps
+// the end of the input that may start a match until more is read.
+func (r *replacingReader) process(final bool) {
+	i, done := 0, 0
+	for i < len(r.in) {
+		if !final && len(r.in)-i <= r.longest {
+			break
+		}
+		if !r.first[r.in[i]] {
+			i++
+			continue
+		}
+		replacement := r.match(r.in[i:], final)
+		if replacement == nil {
+			i++
+			continue
+		}
+		r.out = append(r.out, r.in[done:i]...)
+		r.out = append(r.out, replacement.to...)
+		i += len(replacement.from)
+		done = i
+	}
+	if final {
+		i = len(r.in)
+	}
+	r.out = append(r.out, r.in[done:i]...)
+	r.in = append(r.in[:0], r.in[i:]...)
+}
+
+func (r *replacingReader) match(data []byte, final bool) *bodyReplacement {
+	for i := range r.replacements {
+		replacement := &r.replacements[i]
+		if !bytes.HasPrefix(data, replacement.from) {
+			continue
+		}
+		if len(data) == len(replacement.from) {
+			if final {
+				return replacement
+			}
+			continue
+		}
+		if next := data[len(replacement.from)]; !continuesURL(next) {
+			return replacement
+		}
+	}
+	return nil
+}
+
+func continuesURL(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == ':' || c == '_' || c == '%'
+}
+
+func (r *replacingReader) Close() error {
+	return r.src.Close()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// chunkReader returns the data in reads of at most size bytes, the last one
+// along with io.EOF.
+type chunkReader struct {
+	data string
+	size int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data[:min(r.size, len(r.data))])
+	r.data = r.data[n:]
+	if len(r.data) == 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestReplacingReader(t *testing.T) {
+	replacements := []bodyReplacement{
+		{[]byte("https://upstream.example.com/app"), []byte("http://localhost:8080")},
+		{[]byte("https://upstream.example.com"), []byte("http://localhost:8080")},
+		{[]byte(`https:\/\/upstream.example.com`), []byte(`http:\/\/localhost:8080`)},
+		{[]byte("//upstream.example.com"), []byte("//localhost:8080")},
+	}
+	tests := []struct {
+		in, out string
+	}{
+		{"", ""},
+		{"no URL here", "no URL here"},
+		{`<a href="https://upstream.example.com/page">`, `<a href="http://localhost:8080/page">`},
+		{"https://upstream.example.com/app/page", "http://localhost:8080/page"},
+		{"https://upstream.example.com/application", "http://localhost:8080/application"},
+		{"at the end https://upstream.example.com", "at the end http://localhost:8080"},
+		{"https://upstream.example.com", "http://localhost:8080"},
+		{"https://upstream.example.com/app", "http://localhost:8080"},
+		{"https://upstream.example.com https://upstream.example.com", "http://localhost:8080 http://localhost:8080"},
+		{"https://upstream.example.com/https://upstream.example.com/", "http://localhost:8080/http://localhost:8080/"},
+		{`"https:\/\/upstream.example.com\/api"`, `"http:\/\/localhost:8080\/api"`},
+		{`<script src="//upstream.example.com/s.js">`, `<script src="//localhost:8080/s.js">`},
+		{"https://upstream.example.com.other/", "https://upstream.example.com.other/"},
+		{"https://upstream.example.com:8443/", "https://upstream.example.com:8443/"},
+		{"https://upstream.example.company", "https://upstream.example.company"},
+		{"cut at the end https://upstream.exam", "cut at the end https://upstream.exam"},
+	}
+	for _, test := range tests {
+		for size := 1; size <= len(test.in)+1; size++ {
+			r := newReplacingReader(io.NopCloser(&chunkReader{test.in, size}), replacements)
+			out, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("%q in reads of %d: %v", test.in, size, err)
+			}
+			if string(out) != test.out {
+				t.Errorf("%q in reads of %d = %q, want %q", test.in, size, out, test.out)
+			}
+		}
+	}
+}
+
+func TestReplacingReaderSmallReads(t *testing.T) {
+	replacements := []bodyReplacement{{[]byte("https://upstream"), []byte("http://local")}}
+	in := strings.Repeat("x https://upstream/ https://upstream.other ", 2000) + "https://upstream"
+	want := strings.Repeat("x http://local/ https://upstream.other ", 2000) + "http://local"
+
+	// The replacements are larger than the reads of the client, and the
+	// matches straddle the 32 KiB reads of the source.
+	r := newReplacingReader(io.NopCloser(iotest.DataErrReader(strings.NewReader(in))), replacements)
+	out, err := io.ReadAll(iotest.OneByteReader(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != want {
+		t.Errorf("got %d bytes, want %d", len(out), len(want))
+	}
+}
+
+func TestReplacingReaderError(t *testing.T) {
+	replacements := []bodyReplacement{{[]byte("https://upstream"), []byte("http://local")}}
+	r := newReplacingReader(io.NopCloser(io.MultiReader(strings.NewReader("a https://upstream"), iotest.ErrReader(iotest.ErrTimeout))), replacements)
+	out, err := io.ReadAll(r)
+	if err != iotest.ErrTimeout {
+		t.Errorf("error %v, want %v", err, iotest.ErrTimeout)
+	}
+	// What was read is flushed before the error.
+	if string(out) != "a http://local" {
+		t.Errorf("got %q", out)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var errCircuitOpen = errors.New("circuit breaker is open, the upstream is failing")
+
+// circuitBreaker stops sending requests to the upstream after a number of
+// consecutive failures, for a cooldown period. Once it expires a single trial
+// request is let through: if it succeeds the circuit is closed again. This
+// protects the token from a storm of doomed handshake attempts.
+type circuitBreaker struct {
+	next      http.RoundTripper
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+func newCircuitBreaker(next http.RoundTripper, threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{next: next, threshold: threshold, cooldown: cooldown}
+}
+
+func (b *circuitBreaker) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !b.allow() {
+		return nil, errCircuitOpen
+	}
+	resp, err := b.next.RoundTrip(req)
+	b.record(err)
+	return resp, err
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.trial {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if errors.Is(err, context.Canceled) {
+		// The client went away, this says nothing about the upstream
+		return
+	}
+	if err == nil {
+		if b.failures >= b.threshold {
+			timedLog("Circuit breaker closed, the upstream is reachable again")
+			circuitBreakerOpen.Set(0)
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		if b.failures == b.threshold {
+			timedLog(fmt.Sprintf("Circuit breaker open after %d consecutive upstream failures", b.failures))
+			circuitBreakerOpen.Set(1)
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// retryAfter returns the number of seconds until the next trial request.
+func (b *circuitBreaker) retryAfter() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	seconds := int(time.Until(b.openUntil).Seconds() + 1)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// responseCache is a shared HTTP cache (RFC 7234) of the upstream responses
+// to GET requests, bounded in size and evicting the least recently used
+// entries. Only responses with an explicit freshness lifetime or a validator
+// are stored, and stale ones are revalidated with a conditional request.
+// Bodies too large to be kept in memory go to the disk store, if any.
+type responseCache struct {
+	maxSize      int64
+	maxEntrySize int64
+	maxTTL       time.Duration
+	disk         *diskStore
+
+	mu       sync.Mutex
+	size     int64
+	diskSize int64
+	entries  map[string]*list.Element
+	lru      *list.List
+}
+
+// cacheEntry is a stored response. Entries are never modified once stored:
+// a revalidation replaces them.
+type cacheEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	vary    map[string]string
+	stored  time.Time
+	expires time.Time
+
+	// Only set for the entries whose body is in the disk store.
+	onDisk bool
+	size   int64
+	digest []byte
+}
+
+func newResponseCache(maxSize, maxEntrySize int64, maxTTL time.Duration, disk *diskStore) (*responseCache, error) {
+	c := &responseCache{
+		maxSize:      maxSize,
+		maxEntrySize: maxEntrySize,
+		maxTTL:       maxTTL,
+		disk:         disk,
+		entries:      make(map[string]*list.Element),
+		lru:          list.New(),
+	}
+	if disk != nil {
+		entries, err := disk.load()
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			c.entries[entry.key] = c.lru.PushFront(entry)
+			c.diskSize += entry.size
+		}
+		c.evictLocked()
+	}
+	return c, nil
+}
+
+// get returns the entry stored for key, if it was stored for a request with
+// the same values of the headers the response varies on.
+func (c *responseCache) get(key string, req *http.Request) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*cacheEntry)
+	for name, value := range entry.vary {
+		if req.Header.Get(name) != value {
+			return nil
+		}
+	}
+	c.lru.MoveToFront(element)
+	return entry
+}
+
+func (c *responseCache) put(entry *cacheEntry) {
+	if entry.onDisk {
+		if err := c.disk.writeMeta(entry); err != nil {
+			timedLog(fmt.Sprintf("Cannot store the cached response for %s: %v", entry.key, err))
+			c.remove(entry.key)
+			return
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// A body on disk has already replaced the one of the previous entry.
+	c.removeLocked(entry.key, !entry.onDisk)
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	if entry.onDisk {
+		c.diskSize += entry.size
+	} else {
+		c.size += entry.cost()
+	}
+	c.evictLocked()
+}
+
+// evictLocked removes the least recently used entries of the memory and disk
+// stores until they fit their maximum size.
+func (c *responseCache) evictLocked() {
+	for c.size > c.maxSize || (c.disk != nil && c.diskSize > c.disk.maxSize) {
+		onDisk := c.size <= c.maxSize
+		element := c.lru.Back()
+		for element != nil && element.Value.(*cacheEntry).onDisk != onDisk {
+			element = element.Prev()
+		}
+		if element == nil {
+			return
+		}
+		c.removeLocked(element.Value.(*cacheEntry).key, true)
+	}
+}
+
+func (c *responseCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key, true)
+}
+
+func (c *responseCache) removeLocked(key string, deleteFiles bool) {
+	element, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.lru.Remove(element)
+	delete(c.entries, key)
+	entry := element.Value.(*cacheEntry)
+	if entry.onDisk {
+		c.diskSize -= entry.size
+		if deleteFiles {
+			c.disk.remove(key)
+		}
+	} else {
+		c.size -= entry.cost()
+	}
+}
+
+// cost estimates the memory taken by the entry.
+func (e *cacheEntry) cost() int64 {
+	cost := int64(len(e.key) + len(e.body))
+	for name, values := range e.header {
+		for _, value := range values {
+			cost += int64(len(name) + len(value))
+		}
+	}
+	return cost
+}
+
+// response builds the response to req from the entry, answering 304 to
+// conditional requests matching its ETag.
+func (c *responseCache) response(e *cacheEntry, req *http.Request) (*http.Response, error) {
+	status := e.status
+	var body io.ReadCloser = io.NopCloser(bytes.NewReader(e.body))
+	length := int64(len(e.body))
+	if etag := e.header.Get("Etag"); etag != "" && matchesETag(req.Header.Get("If-None-Match"), etag) {
+		status, body, length = http.StatusNotModified, http.NoBody, 0
+	} else if e.onDisk {
+		file, err := c.disk.open(e)
+		if err != nil {
+			c.remove(e.key)
+			return nil, err
+		}
+		file.corrupted = func() {
+			timedLog(fmt.Sprintf("Cached response for %s is corrupted, removing it", e.key))
+			c.remove(e.key)
+		}
+		body, length = file, e.size
+		c.disk.touch(e.key)
+	}
+	header := e.header.Clone()
+	header.Set("Age", strconv.Itoa(int(time.Since(e.stored).Seconds())))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: length,
+		Request:       req,
+	}, nil
+}
+
+func matchesETag(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// cachingTransport serves the GET requests from the cache when possible,
+// sparing the round trip to the upstream.
+type cachingTransport struct {
+	next  http.RoundTripper
+	cache *responseCache
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := req.URL.String()
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		// Unsafe methods invalidate the stored response.
+		resp, err := t.next.RoundTrip(req)
+		if err == nil && resp.StatusCode < 400 {
+			t.cache.remove(key)
+		}
+		return resp, err
+	}
+	if _, noStore := parseCacheControl(req.Header)["no-store"]; noStore || req.Method != http.MethodGet ||
+		req.Header.Get("Authorization") != "" || req.Header.Get("Range") != "" || req.Header.Get("Upgrade") != "" {
+		cacheRequests.WithLabelValues("bypass").Inc()
+		return t.next.RoundTrip(req)
+	}
+
+	entry := t.cache.get(key, req)
+	if entry == nil {
+		cacheRequests.WithLabelValues("miss").Inc()
+		resp, err := t.next.RoundTrip(req)
+		return t.store(key, req, resp, err)
+	}
+	if _, noCache := parseCacheControl(req.Header)["no-cache"]; !noCache && time.Now().Before(entry.expires) {
+		if resp, err := t.cache.response(entry, req); err == nil {
+			cacheRequests.WithLabelValues("hit").Inc()
+			return resp, nil
+		}
+		cacheRequests.WithLabelValues("miss").Inc()
+		resp, err := t.next.RoundTrip(req)
+		return t.store(key, req, resp, err)
+	}
+
+	etag, lastModified := entry.header.Get("Etag"), entry.header.Get("Last-Modified")
+	if (etag == "" && lastModified == "") || req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+		cacheRequests.WithLabelValues("miss").Inc()
+		resp, err := t.next.RoundTrip(req)
+		return t.store(key, req, resp, err)
+	}
+	conditional := req.Clone(req.Context())
+	if etag != "" {
+		conditional.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		conditional.Header.Set("If-Modified-Since", lastModified)
+	}
+	resp, err := t.next.RoundTrip(conditional)
+	if err != nil || resp.StatusCode != http.StatusNotModified {
+		cacheRequests.WithLabelValues("miss").Inc()
+		return t.store(key, req, resp, err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	cacheRequests.WithLabelValues("revalidated").Inc()
+
+	refreshed := *entry
+	refreshed.header = entry.header.Clone()
+	for name, values := range resp.Header {
+		refreshed.header[name] = values
+	}
+	refreshed.stored, refreshed.expires = t.freshness(resp.Header)
+	t.cache.put(&refreshed)
+	return t.cache.response(&refreshed, req)
+}
+
+// store arranges for the response to be stored once its body has been read
+// completely, if it is cacheable.
+func (t *cachingTransport) store(key string, req *http.Request, resp *http.Response, err error) (*http.Response, error) {
+	if err != nil || !t.cacheable(resp) {
+		return resp, err
+	}
+	entry := &cacheEntry{
+		key:    key,
+		status: resp.StatusCode,
+		header: resp.Header.Clone(),
+		vary:   make(map[string]string),
+	}
+	removeHopByHopHeaders(entry.header)
+	for _, name := range strings.Split(strings.Join(resp.Header.Values("Vary"), ","), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			entry.vary[http.CanonicalHeaderKey(name)] = req.Header.Get(name)
+		}
+	}
+	entry.stored, entry.expires = t.freshness(resp.Header)
+	resp.Body = &cachingBody{ReadCloser: resp.Body, cache: t.cache, entry: entry}
+	return resp, nil
+}
+
+func (t *cachingTransport) cacheable(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent, http.StatusMultipleChoices,
+		http.StatusMovedPermanently, http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusGone,
+		http.StatusRequestURITooLong, http.StatusNotImplemented:
+	default:
+		return false
+	}
+	directives := parseCacheControl(resp.Header)
+	if _, ok := directives["no-store"]; ok {
+		return false
+	}
+	if _, ok := directives["private"]; ok {
+		return false
+	}
+	if resp.Header.Get("Set-Cookie") != "" || strings.Contains(resp.Header.Get("Vary"), "*") ||
+		resp.ContentLength > t.cache.maxStoredSize() {
+		return false
+	}
+	_, maxAge := directives["max-age"]
+	_, sMaxAge := directives["s-maxage"]
+	return maxAge || sMaxAge || resp.Header.Get("Expires") != "" ||
+		resp.Header.Get("Etag") != "" || resp.Header.Get("Last-Modified") != ""
+}
+
+// freshness returns when the response was generated and until when it is
+// fresh, capped to the maximum TTL.
+func (t *cachingTransport) freshness(header http.Header) (stored, expires time.Time) {
+	now := time.Now()
+	stored = now
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		stored = now.Add(-time.Duration(age) * time.Second)
+	}
+
+	directives := parseCacheControl(header)
+	var lifetime time.Duration
+	if _, noCache := directives["no-cache"]; noCache {
+		return stored, stored
+	} else if value, ok := directives["s-maxage"]; ok {
+		seconds, _ := strconv.Atoi(value)
+		lifetime = time.Duration(seconds) * time.Second
+	} else if value, ok := directives["max-age"]; ok {
+		seconds, _ := strconv.Atoi(value)
+		lifetime = time.Duration(seconds) * time.Second
+	} else if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		lifetime = expires.Sub(date)
+	}
+	if lifetime > t.cache.maxTTL {
+		lifetime = t.cache.maxTTL
+	}
+	return stored, stored.Add(lifetime)
+}
+
+// parseCacheControl parses the directives of the Cache-Control header.
+func parseCacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, directive := range strings.Split(strings.Join(header.Values("Cache-Control"), ","), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if name != "" {
+			directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+	return directives
+}
+
+// maxStoredSize returns the size of the largest body that can be cached.
+func (c *responseCache) maxStoredSize() int64 {
+	if c.disk != nil && c.disk.maxEntrySize > c.maxEntrySize {
+		return c.disk.maxEntrySize
+	}
+	return c.maxEntrySize
+}
+
+// cachingBody passes the response body through, storing the entry with it
+// once read completely. Bodies larger than the memory limit are spilled to
+// the disk store, if any, and those too large for it are not stored.
+type cachingBody struct {
+	io.ReadCloser
+	cache    *responseCache
+	entry    *cacheEntry
+	buf      []byte
+	spill    *os.File
+	hash     hash.Hash
+	size     int64
+	overflow bool
+	finished bool
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.overflow && !b.finished {
+		b.write(p[:n])
+		if err == io.EOF && !b.overflow {
+			b.finish()
+		}
+	}
+	return n, err
+}
+
+func (b *cachingBody) write(p []byte) {
+	b.size += int64(len(p))
+	if b.spill == nil {
+		if b.size <= b.cache.maxEntrySize {
+			b.buf = append(b.buf, p...)
+			return
+		}
+		if b.cache.disk == nil || b.size > b.cache.disk.maxEntrySize {
+			b.overflow, b.buf = true, nil
+			return
+		}
+		spill, err := b.cache.disk.create()
+		if err != nil {
+			timedLog(fmt.Sprintf("Cannot store the cached response for %s: %v", b.entry.key, err))
+			b.overflow, b.buf = true, nil
+			return
+		}
+		b.spill, b.hash = spill, sha256.New()
+		p = append(b.buf, p...)
+		b.buf = nil
+	}
+	if b.size > b.cache.disk.maxEntrySize {
+		b.discard()
+		return
+	}
+	if _, err := b.spill.Write(p); err != nil {
+		timedLog(fmt.Sprintf("Cannot store the cached response for %s: %v", b.entry.key, err))
+		b.discard()
+		return
+	}
+	b.hash.Write(p)
+}
+
+// discard gives up storing the body.
+func (b *cachingBody) discard() {
+	b.overflow = true
+	if b.spill != nil {
+		b.spill.Close()
+		os.Remove(b.spill.Name())
+		b.spill = nil
+	}
+}
+
+func (b *cachingBody) finish() {
+	b.finished = true
+	if b.spill == nil {
+		b.entry.body = b.buf
+		b.cache.put(b.entry)
+		return
+	}
+	b.entry.onDisk, b.entry.size, b.entry.digest = true, b.size, b.hash.Sum(nil)
+	if err := b.cache.disk.commit(b.spill, b.entry); err != nil {
+		timedLog(fmt.Sprintf("Cannot store the cached response for %s: %v", b.entry.key, err))
+		return
+	}
+	b.spill = nil
+	b.cache.put(b.entry)
+}
+
+func (b *cachingBody) Close() error {
+	b.discard()
+	return b.ReadCloser.Close()
+}
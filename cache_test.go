@@ -0,0 +1,335 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeUpstream answers the requests with respond, recording them.
+type fakeUpstream struct {
+	requests []*http.Request
+	respond  func(*http.Request) *http.Response
+}
+
+func (u *fakeUpstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	u.requests = append(u.requests, req)
+	return u.respond(req), nil
+}
+
+func upstreamResponse(req *http.Request, status int, body string, header ...string) *http.Response {
+	resp := &http.Response{
+		StatusCode:    status,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	for i := 0; i < len(header); i += 2 {
+		resp.Header.Add(header[i], header[i+1])
+	}
+	return resp
+}
+
+// fetch sends a GET request for the URL through the transport, reading the
+// body completely as the proxy does.
+func fetch(t *testing.T, transport http.RoundTripper, url string, header ...string) (*http.Response, string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	for i := 0; i < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func newTestCache(t *testing.T, maxSize, maxEntrySize int64, disk *diskStore) *responseCache {
+	t.Helper()
+	cache, err := newResponseCache(maxSize, maxEntrySize, time.Hour, disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+func TestCacheFreshness(t *testing.T) {
+	date := time.Now().UTC().Truncate(time.Second)
+	tests := []struct {
+		name     string
+		header   []string
+		lifetime time.Duration
+		age      time.Duration
+	}{
+		{"max-age", []string{"Cache-Control", "max-age=60"}, time.Minute, 0},
+		{"s-maxage first", []string{"Cache-Control", "max-age=60, s-maxage=120"}, 2 * time.Minute, 0},
+		{"quoted", []string{"Cache-Control", `max-age="30"`}, 30 * time.Second, 0},
+		{"no-cache", []string{"Cache-Control", "no-cache, max-age=60"}, 0, 0},
+		{"expires", []string{"Date", date.Format(http.TimeFormat), "Expires", date.Add(10 * time.Minute).Format(http.TimeFormat)}, 10 * time.Minute, 0},
+		{"expired", []string{"Date", date.Format(http.TimeFormat), "Expires", "0"}, 0, 0},
+		{"max-age over expires", []string{"Cache-Control", "max-age=5", "Expires", date.Add(time.Hour).Format(http.TimeFormat)}, 5 * time.Second, 0},
+		{"capped", []string{"Cache-Control", "max-age=86400"}, time.Hour, 0},
+		{"validator only", []string{"Etag", `"v1"`}, 0, 0},
+		{"age", []string{"Cache-Control", "max-age=60", "Age", "20"}, time.Minute, 20 * time.Second},
+	}
+	transport := &cachingTransport{cache: newTestCache(t, 1<<20, 1<<20, nil)}
+	for _, test := range tests {
+		header := make(http.Header)
+		for i := 0; i < len(test.header); i += 2 {
+			header.Add(test.header[i], test.header[i+1])
+		}
+		before := time.Now()
+		stored, expires := transport.freshness(header)
+		after := time.Now()
+		if lifetime := expires.Sub(stored); lifetime != test.lifetime {
+			t.Errorf("%s: lifetime %v, want %v", test.name, lifetime, test.lifetime)
+		}
+		if stored.Before(before.Add(-test.age)) || stored.After(after.Add(-test.age)) {
+			t.Errorf("%s: stored %v ago, want %v", test.name, after.Sub(stored), test.age)
+		}
+	}
+}
+
+func TestCacheable(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		header    []string
+		cacheable bool
+	}{
+		{"max-age", http.StatusOK, []string{"Cache-Control", "max-age=60"}, true},
+		{"etag", http.StatusOK, []string{"Etag", `"v1"`}, true},
+		{"last-modified", http.StatusOK, []string{"Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT"}, true},
+		{"no lifetime nor validator", http.StatusOK, nil, false},
+		{"not found", http.StatusNotFound, []string{"Cache-Control", "max-age=60"}, true},
+		{"server error", http.StatusInternalServerError, []string{"Cache-Control", "max-age=60"}, false},
+		{"no-store", http.StatusOK, []string{"Cache-Control", "max-age=60, no-store"}, false},
+		{"private", http.StatusOK, []string{"Cache-Control", "private, max-age=60"}, false},
+		{"set-cookie", http.StatusOK, []string{"Cache-Control", "max-age=60", "Set-Cookie", "a=b"}, false},
+		{"vary star", http.StatusOK, []string{"Cache-Control", "max-age=60", "Vary", "*"}, false},
+	}
+	transport := &cachingTransport{cache: newTestCache(t, 1<<20, 1<<20, nil)}
+	for _, test := range tests {
+		resp := upstreamResponse(nil, test.status, "body", test.header...)
+		if cacheable := transport.cacheable(resp); cacheable != test.cacheable {
+			t.Errorf("%s: cacheable %v, want %v", test.name, cacheable, test.cacheable)
+		}
+	}
+	resp := upstreamResponse(nil, http.StatusOK, strings.Repeat("x", 2<<20), "Cache-Control", "max-age=60")
+	if transport.cacheable(resp) {
+		t.Error("a body larger than the maximum entry size is cacheable")
+	}
+}
+
+func TestCachingTransport(t *testing.T) {
+	version := 1
+	upstream := &fakeUpstream{respond: func(req *http.Request) *http.Response {
+		switch req.URL.Path {
+		case "/fresh":
+			return upstreamResponse(req, http.StatusOK, "fresh "+strconv.Itoa(version), "Cache-Control", "max-age=60", "Etag", `"f`+strconv.Itoa(version)+`"`)
+		case "/vary":
+			return upstreamResponse(req, http.StatusOK, "lang "+req.Header.Get("Accept-Language"), "Cache-Control", "max-age=60", "Vary", "Accept-Language")
+		}
+		return upstreamResponse(req, http.StatusNotFound, "")
+	}}
+	transport := &cachingTransport{next: upstream, cache: newTestCache(t, 1<<20, 1<<20, nil)}
+
+	if _, body := fetch(t, transport, "http://upstream/fresh"); body != "fresh 1" {
+		t.Errorf("miss: %q", body)
+	}
+	version = 2
+	resp, body := fetch(t, transport, "http://upstream/fresh")
+	if body != "fresh 1" || len(upstream.requests) != 1 || resp.Header.Get("Age") == "" {
+		t.Errorf("hit: %q after %d requests, Age %q", body, len(upstream.requests), resp.Header.Get("Age"))
+	}
+	if resp, _ := fetch(t, transport, "http://upstream/fresh", "If-None-Match", `"f1"`); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("conditional hit: status %d", resp.StatusCode)
+	}
+	if _, body := fetch(t, transport, "http://upstream/fresh", "Cache-Control", "no-cache"); body != "fresh 2" || len(upstream.requests) != 2 {
+		t.Errorf("no-cache request: %q after %d requests", body, len(upstream.requests))
+	}
+	if _, body := fetch(t, transport, "http://upstream/fresh", "Authorization", "Bearer x"); body != "fresh 2" || len(upstream.requests) != 3 {
+		t.Errorf("authorized request: %q after %d requests", body, len(upstream.requests))
+	}
+
+	upstream.requests = nil
+	for _, test := range []struct{ language, body string }{{"en", "lang en"}, {"it", "lang it"}, {"it", "lang it"}, {"en", "lang en"}} {
+		if _, body := fetch(t, transport, "http://upstream/vary", "Accept-Language", test.language); body != test.body {
+			t.Errorf("vary %s: %q, want %q", test.language, body, test.body)
+		}
+	}
+	// Only the last response is kept for a URL: the second it is a hit.
+	if len(upstream.requests) != 3 {
+		t.Errorf("vary: %d requests to the upstream, want 3", len(upstream.requests))
+	}
+
+	upstream.requests = nil
+	post := httptest.NewRequest(http.MethodPost, "http://upstream/fresh", nil)
+	if resp, err := transport.RoundTrip(post); err != nil {
+		t.Fatal(err)
+	} else {
+		resp.Body.Close()
+	}
+	if _, body := fetch(t, transport, "http://upstream/fresh"); body != "fresh 2" || len(upstream.requests) != 2 {
+		t.Errorf("after a POST: %q after %d requests", body, len(upstream.requests))
+	}
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	modified := false
+	upstream := &fakeUpstream{respond: func(req *http.Request) *http.Response {
+		if !modified && req.Header.Get("If-None-Match") == `"v1"` {
+			return upstreamResponse(req, http.StatusNotModified, "", "Etag", `"v1"`, "Cache-Control", "max-age=60")
+		}
+		if modified {
+			return upstreamResponse(req, http.StatusOK, "version 2", "Etag", `"v2"`, "Cache-Control", "max-age=0")
+		}
+		return upstreamResponse(req, http.StatusOK, "version 1", "Etag", `"v1"`, "Cache-Control", "max-age=0", "X-Version", "1")
+	}}
+	transport := &cachingTransport{next: upstream, cache: newTestCache(t, 1<<20, 1<<20, nil)}
+
+	fetch(t, transport, "http://upstream/")
+	resp, body := fetch(t, transport, "http://upstream/")
+	if body != "version 1" || resp.StatusCode != http.StatusOK || resp.Header.Get("X-Version") != "1" {
+		t.Errorf("revalidated: %d %q", resp.StatusCode, body)
+	}
+	if len(upstream.requests) != 2 || upstream.requests[1].Header.Get("If-None-Match") != `"v1"` {
+		t.Fatalf("revalidation: %d requests", len(upstream.requests))
+	}
+	// The 304 made it fresh for another minute.
+	if _, body := fetch(t, transport, "http://upstream/"); body != "version 1" || len(upstream.requests) != 2 {
+		t.Errorf("after the revalidation: %q after %d requests", body, len(upstream.requests))
+	}
+
+	modified = true
+	transport.cache.remove("http://upstream/")
+	fetch(t, transport, "http://upstream/")
+	if _, body := fetch(t, transport, "http://upstream/"); body != "version 2" {
+		t.Errorf("modified: %q", body)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	cache := newTestCache(t, 300, 300, nil)
+	body := strings.Repeat("x", 80)
+	for _, key := range []string{"a", "b", "c"} {
+		cache.put(&cacheEntry{key: key, status: http.StatusOK, header: make(http.Header), body: []byte(body)})
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	// a becomes the most recently used, b is evicted.
+	cache.get("a", req)
+	cache.put(&cacheEntry{key: "d", status: http.StatusOK, header: make(http.Header), body: []byte(body)})
+	for key, kept := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if (cache.get(key, req) != nil) != kept {
+			t.Errorf("entry %s kept: %v, want %v", key, !kept, kept)
+		}
+	}
+	if cache.size > cache.maxSize {
+		t.Errorf("size %d over %d", cache.size, cache.maxSize)
+	}
+}
+
+func TestCacheDiskSpill(t *testing.T) {
+	dir := t.TempDir()
+	disk, err := newDiskStore(dir, 1<<20, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodies := map[string]string{"/small": strings.Repeat("s", 50), "/large": strings.Repeat("l", 500), "/huge": strings.Repeat("h", 2000)}
+	upstream := &fakeUpstream{respond: func(req *http.Request) *http.Response {
+		return upstreamResponse(req, http.StatusOK, bodies[req.URL.Path], "Cache-Control", "max-age=60")
+	}}
+	// Unknown lengths, read in small chunks, reach the limits while stored.
+	upstream.respond = func(respond func(*http.Request) *http.Response) func(*http.Request) *http.Response {
+		return func(req *http.Request) *http.Response {
+			resp := respond(req)
+			resp.ContentLength = -1
+			return resp
+		}
+	}(upstream.respond)
+	transport := &cachingTransport{next: upstream, cache: newTestCache(t, 1000, 100, disk)}
+
+	for path, body := range bodies {
+		if _, got := fetch(t, transport, "http://upstream"+path); got != body {
+			t.Errorf("%s: got %d bytes, want %d", path, len(got), len(body))
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if entry := transport.cache.get("http://upstream/small", req); entry == nil || entry.onDisk {
+		t.Error("the small body is not in memory")
+	}
+	if entry := transport.cache.get("http://upstream/large", req); entry == nil || !entry.onDisk {
+		t.Error("the large body is not on disk")
+	}
+	if transport.cache.get("http://upstream/huge", req) != nil {
+		t.Error("the body too large for the disk is stored")
+	}
+	temporary, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if len(temporary) > 0 {
+		t.Errorf("temporary files left: %v", temporary)
+	}
+
+	requests := len(upstream.requests)
+	if _, body := fetch(t, transport, "http://upstream/large"); body != bodies["/large"] || len(upstream.requests) != requests {
+		t.Errorf("disk hit: %d bytes after %d requests", len(body), len(upstream.requests)-requests)
+	}
+
+	// The disk entries survive a restart.
+	reloaded := newTestCache(t, 1000, 100, disk)
+	if entry := reloaded.get("http://upstream/large", req); entry == nil || entry.size != 500 {
+		t.Fatal("the disk entry is not reloaded")
+	}
+
+	// A corrupted body fails at its end and is removed.
+	if err := os.WriteFile(disk.path("http://upstream/large")+".body", []byte(strings.Repeat("L", 500)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, "http://upstream/large", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(resp.Body); err != errCorruptedCache {
+		t.Errorf("corrupted body: error %v", err)
+	}
+	resp.Body.Close()
+	if transport.cache.get("http://upstream/large", req) != nil {
+		t.Error("the corrupted entry is kept")
+	}
+}
+
+func TestCacheDiskEviction(t *testing.T) {
+	disk, err := newDiskStore(t.TempDir(), 1000, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &fakeUpstream{respond: func(req *http.Request) *http.Response {
+		return upstreamResponse(req, http.StatusOK, strings.Repeat("x", 400), "Cache-Control", "max-age=60")
+	}}
+	transport := &cachingTransport{next: upstream, cache: newTestCache(t, 1000, 100, disk)}
+	for _, path := range []string{"/a", "/b", "/c"} {
+		fetch(t, transport, "http://upstream"+path)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if transport.cache.get("http://upstream/a", req) != nil || transport.cache.get("http://upstream/c", req) == nil {
+		t.Error("the least recently used disk entry is not the one evicted")
+	}
+	if transport.cache.diskSize > disk.maxSize {
+		t.Errorf("disk size %d over %d", transport.cache.diskSize, disk.maxSize)
+	}
+	if _, err := os.Stat(disk.path("http://upstream/a") + ".body"); !os.IsNotExist(err) {
+		t.Error("the files of the evicted entry are left")
+	}
+}
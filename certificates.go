@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/miekg/pkcs11"
+)
+
+// configureToken opens the token for the commands working on its keys. A
+// maxSessions of 0 keeps the crypto11 default.
+func configureToken(pkcs11path, tokenSerial, pin string, maxSessions int) (*crypto11.Context, error) {
+	return crypto11.Configure(&crypto11.Config{
+		Path:        pkcs11path,
+		TokenSerial: tokenSerial,
+		Pin:         pin,
+		MaxSessions: maxSessions,
+	})
+}
+
+// certificateToken is the token holding one of the certificates of
+// openAllTokens.
+type certificateToken struct {
+	presentToken
+	context *crypto11.Context
+}
+
+// openAllTokens opens all the tokens of the module with the config, and
+// returns the certificates of all of them, in the order of the slots, along
+// with the token of each. The tokens that cannot be opened, like those with
+// another PIN, are skipped.
+func openAllTokens(config crypto11.Config) ([]tls.Certificate, []certificateToken, error) {
+	tokens, err := presentTokens(config.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var certificates []tls.Certificate
+	var certificateTokens []certificateToken
+	for _, token := range tokens {
+		config.TokenSerial = token.serial
+		context, err := crypto11.Configure(&config)
+		if err != nil {
+			timedLog(fmt.Sprintf("Skipping the token %s (%s): %v", token.serial, token.label, err))
+			continue
+		}
+		tokenCertificates, err := context.FindAllPairedCertificates()
+		if err != nil {
+			timedLog(fmt.Sprintf("Skipping the token %s (%s): %v", token.serial, token.label, err))
+			context.Close()
+			continue
+		}
+		for _, cert := range tokenCertificates {
+			certificates = append(certificates, cert)
+			certificateTokens = append(certificateTokens, certificateToken{presentToken: token, context: context})
+		}
+	}
+	if len(certificateTokens) == 0 {
+		return nil, nil, fmt.Errorf("no certificate found on the %d tokens of the module", len(tokens))
+	}
+	return certificates, certificateTokens, nil
+}
+
+// pairedCertificate returns the certificate of the token at the index of
+// list-certificates, with its private key.
+func pairedCertificate(context *crypto11.Context, index int) (tls.Certificate, error) {
+	certificates, err := context.FindAllPairedCertificates()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if index >= len(certificates) {
+		return tls.Certificate{}, fmt.Errorf("certificate index %d is out of range. Run '%s -token-serial ... [-pin/-pin-file] ... list-certificates' to find the index", index, os.Args[0])
+	}
+	return certificates[index], nil
+}
+
+// certificateInfo describes a certificate of the token for list-certificates.
+type certificateInfo struct {
+	Index        int       `json:"index"`
+	Token        string    `json:"token,omitempty"`
+	Subject      string    `json:"subject"`
+	Issuer       string    `json:"issuer"`
+	Serial       string    `json:"serial"`
+	SHA256       string    `json:"sha256"`
+	Key          string    `json:"key"`
+	ExtKeyUsages []string  `json:"ext_key_usages"`
+	NotBefore    time.Time `json:"not_before"`
+	NotAfter     time.Time `json:"not_after"`
+	Expired      bool      `json:"expired"`
+}
+
+var extKeyUsageNames = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:             "Any",
+	x509.ExtKeyUsageServerAuth:      "Server Authentication",
+	x509.ExtKeyUsageClientAuth:      "Client Authentication",
+	x509.ExtKeyUsageCodeSigning:     "Code Signing",
+	x509.ExtKeyUsageEmailProtection: "Email Protection",
+	x509.ExtKeyUsageTimeStamping:    "Time Stamping",
+	x509.ExtKeyUsageOCSPSigning:     "OCSP Signing",
+}
+
+func describeCertificate(index int, cert *x509.Certificate) certificateInfo {
+	fingerprint := sha256.Sum256(cert.Raw)
+	info := certificateInfo{
+		Index:        index,
+		Subject:      cert.Subject.String(),
+		Issuer:       cert.Issuer.String(),
+		Serial:       strings.ToUpper(cert.SerialNumber.Text(16)),
+		SHA256:       formatFingerprint(fingerprint[:]),
+		Key:          describePublicKey(cert.PublicKey),
+		ExtKeyUsages: []string{},
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+		Expired:      time.Now().After(cert.NotAfter),
+	}
+	for _, usage := range cert.ExtKeyUsage {
+		if name, ok := extKeyUsageNames[usage]; ok {
+			info.ExtKeyUsages = append(info.ExtKeyUsages, name)
+		} else {
+			info.ExtKeyUsages = append(info.ExtKeyUsages, fmt.Sprintf("%d", usage))
+		}
+	}
+	for _, oid := range cert.UnknownExtKeyUsage {
+		info.ExtKeyUsages = append(info.ExtKeyUsages, oid.String())
+	}
+	return info
+}
+
+// formatFingerprint returns the digest as colon-separated hex bytes.
+func formatFingerprint(digest []byte) string {
+	parts := make([]string, len(digest))
+	for i, b := range digest {
+		parts[i] = strings.ToUpper(hex.EncodeToString([]byte{b}))
+	}
+	return strings.Join(parts, ":")
+}
+
+func describePublicKey(key crypto.PublicKey) string {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "EC " + key.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return "unknown"
+}
+
+// selectedCertificates returns the certificates of the token of -token-serial,
+// or of all the tokens of the module with the token of each if allTokens.
+func selectedCertificates(pkcs11path, tokenSerial, pinVal string, allTokens bool) ([]tls.Certificate, []certificateToken, error) {
+	if allTokens {
+		return openAllTokens(crypto11.Config{Path: pkcs11path, Pin: pinVal})
+	}
+	context, err := configureToken(pkcs11path, tokenSerial, pinVal, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	certificates, err := context.FindAllPairedCertificates()
+	return certificates, nil, err
+}
+
+// runListCertificates prints the certificates of list-certificates.
+func runListCertificates(c *config) error {
+	pinVal, err := c.tokenPin()
+	if err != nil {
+		return err
+	}
+	listCertificates(&c.pkcs11path, &c.tokenSerial, pinVal, c.allTokens, c.jsonOutput)
+	return nil
+}
+
+// listCertificates prints the certificates of the token, or of all the tokens
+// grouped by token if allTokens.
+func listCertificates(pkcs11path, tokenSerial *string, pinVal string, allTokens, jsonOutput bool) {
+	certificates, tokens, err := selectedCertificates(*pkcs11path, *tokenSerial, pinVal, allTokens)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	infos := make([]certificateInfo, 0, len(certificates))
+	for index, cert := range certificates {
+		info := describeCertificate(index, cert.Leaf)
+		if tokens != nil {
+			info.Token = tokens[index].serial
+		}
+		infos = append(infos, info)
+	}
+	if jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(infos)
+		return
+	}
+	for index, info := range infos {
+		if tokens != nil && (index == 0 || tokens[index].serial != tokens[index-1].serial) {
+			if index > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("Token %s (%s):\n", tokens[index].serial, tokens[index].label)
+		}
+		fmt.Printf("Certificate index %d: %s\n", info.Index, info.Subject)
+		fmt.Printf("  Issuer:   %s\n", info.Issuer)
+		fmt.Printf("  Serial:   %s\n", info.Serial)
+		fmt.Printf("  SHA-256:  %s\n", info.SHA256)
+		fmt.Printf("  Key:      %s\n", info.Key)
+		if len(info.ExtKeyUsages) > 0 {
+			fmt.Printf("  Usages:   %s\n", strings.Join(info.ExtKeyUsages, ", "))
+		}
+		validity := fmt.Sprintf("%s to %s", info.NotBefore.Format(time.DateOnly), info.NotAfter.Format(time.DateOnly))
+		if info.Expired {
+			validity += " (expired)"
+		}
+		fmt.Printf("  Valid:    %s\n", validity)
+	}
+}
+
+// runShowCertificate prints the certificate at certificate-index, with its
+// chain.
+func runShowCertificate(c *config) error {
+	pinVal, err := c.tokenPin()
+	if err != nil {
+		return err
+	}
+	showCertificate(&c.pkcs11path, &c.tokenSerial, pinVal, c.allTokens, c.certificateIndex)
+	return nil
+}
+
+// showCertificate prints the selected certificate as PEM, followed by the
+// certificates of its chain found on the token.
+func showCertificate(pkcs11path, tokenSerial *string, pinVal string, allTokens bool, index int) {
+	certificates, tokens, err := selectedCertificates(*pkcs11path, *tokenSerial, pinVal, allTokens)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if index >= len(certificates) {
+		log.Fatalf("Certificate index %d is out of range. Run '%s -token-serial ... [-pin/-pin-file] ... list-certificates' to find the index.\n", index, os.Args[0])
+	}
+	serial := *tokenSerial
+	if tokens != nil {
+		serial = tokens[index].serial
+	}
+	others, err := tokenCertificates(*pkcs11path, serial)
+	if err != nil {
+		timedLog(fmt.Sprintf("Unable to look for the chain on the token: %v", err))
+	}
+	for _, cert := range certificateChain(certificates[index].Leaf, others) {
+		pem.Encode(os.Stdout, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+}
+
+// certificateChain returns the certificate followed by its issuers among the
+// candidates, up to a self-signed one or a missing issuer.
+func certificateChain(leaf *x509.Certificate, candidates []*x509.Certificate) []*x509.Certificate {
+	chain := []*x509.Certificate{leaf}
+	for current := leaf; len(chain) <= len(candidates); {
+		if bytes.Equal(current.RawIssuer, current.RawSubject) && current.CheckSignatureFrom(current) == nil {
+			break
+		}
+		var issuer *x509.Certificate
+		for _, candidate := range candidates {
+			if bytes.Equal(candidate.RawSubject, current.RawIssuer) && !candidate.Equal(current) && current.CheckSignatureFrom(candidate) == nil {
+				issuer = candidate
+				break
+			}
+		}
+		if issuer == nil {
+			break
+		}
+		chain = append(chain, issuer)
+		current = issuer
+	}
+	return chain
+}
+
+// tokenCertificates returns all the certificates stored on the token, paired
+// with a key or not, like the CA certificates of the chain.
+func tokenCertificates(pkcs11path, tokenSerial string) ([]*x509.Certificate, error) {
+	ctx, slot, err := openToken(pkcs11path, tokenSerial)
+	if err != nil {
+		return nil, err
+	}
+	defer ctx.Destroy()
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, err
+	}
+	defer ctx.CloseSession(session)
+
+	handles, err := findObjects(ctx, session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE),
+		pkcs11.NewAttribute(pkcs11.CKA_CERTIFICATE_TYPE, pkcs11.CKC_X_509),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var certificates []*x509.Certificate
+	for _, handle := range handles {
+		attributes, err := ctx.GetAttributeValue(session, handle, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil)})
+		if err != nil || len(attributes) == 0 {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(attributes[0].Value); err == nil {
+			certificates = append(certificates, cert)
+		}
+	}
+	return certificates, nil
+}
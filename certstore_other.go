@@ -0,0 +1,19 @@
+//go:build !windows
+
+package main
+
+import (
+	"crypto"
+	"crypto/tls"
+	"errors"
+)
+
+// windowsCertificates returns the certificates of a Windows certificate store,
+// which only exist on Windows.
+func windowsCertificates(storeName, thumbprint, pin string) ([]tls.Certificate, error) {
+	return nil, errors.New("-backend windows is only supported on Windows")
+}
+
+func windowsCapabilities(key crypto.PrivateKey) *tokenCapabilities {
+	return nil
+}
@@ -0,0 +1,324 @@
+//go:build windows
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/miekg/pkcs11"
+	"golang.org/x/sys/windows"
+)
+
+var (
+	ncrypt              = windows.NewLazySystemDLL("ncrypt.dll")
+	procNCryptSignHash  = ncrypt.NewProc("NCryptSignHash")
+	procNCryptSetProp   = ncrypt.NewProc("NCryptSetProperty")
+	advapi32            = windows.NewLazySystemDLL("advapi32.dll")
+	procCryptCreateHash = advapi32.NewProc("CryptCreateHash")
+	procCryptSetHash    = advapi32.NewProc("CryptSetHashParam")
+	procCryptSignHash   = advapi32.NewProc("CryptSignHashW")
+	procCryptDestroy    = advapi32.NewProc("CryptDestroyHash")
+	procCryptSetProv    = advapi32.NewProc("CryptSetProvParam")
+)
+
+const (
+	bcryptPadPKCS1 = 0x2
+	bcryptPadPSS   = 0x8
+
+	capiHashValue    = 2
+	capiKeyExchange  = 1
+	capiKeyXchgPIN   = 32
+	capiSignaturePIN = 33
+)
+
+var cngHashAlgorithms = map[crypto.Hash]string{
+	crypto.SHA1:   "SHA1",
+	crypto.SHA256: "SHA256",
+	crypto.SHA384: "SHA384",
+	crypto.SHA512: "SHA512",
+}
+
+var capiHashAlgorithms = map[crypto.Hash]uint32{
+	crypto.SHA1:    0x8004, // CALG_SHA1
+	crypto.SHA256:  0x800c, // CALG_SHA_256
+	crypto.SHA384:  0x800d, // CALG_SHA_384
+	crypto.SHA512:  0x800e, // CALG_SHA_512
+	crypto.MD5SHA1: 0x8008, // CALG_SSL3_SHAMD5
+}
+
+// windowsCertificates returns the certificates of the personal store of the
+// user or of the machine that have a private key, or the one with the SHA-1
+// thumbprint, with their chain. The keys are used through their CNG key
+// storage provider, or their legacy CAPI provider, like the smart card ones.
+func windowsCertificates(storeName, thumbprint, pin string) ([]tls.Certificate, error) {
+	var location uint32
+	var engine windows.Handle
+	switch storeName {
+	case "user":
+		location = windows.CERT_SYSTEM_STORE_CURRENT_USER
+	case "machine":
+		location = windows.CERT_SYSTEM_STORE_LOCAL_MACHINE
+		engine = 1 // HCCE_LOCAL_MACHINE
+	default:
+		return nil, fmt.Errorf("invalid certificate store %q, use user or machine", storeName)
+	}
+	thumbprint = strings.ToLower(strings.NewReplacer(" ", "", ":", "").Replace(thumbprint))
+
+	name, err := windows.UTF16PtrFromString("MY")
+	if err != nil {
+		return nil, err
+	}
+	store, err := windows.CertOpenStore(windows.CERT_STORE_PROV_SYSTEM_W, 0, 0, location|windows.CERT_STORE_OPEN_EXISTING_FLAG|windows.CERT_STORE_READONLY_FLAG, uintptr(unsafe.Pointer(name)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot open the %s certificate store: %v", storeName, err)
+	}
+	defer windows.CertCloseStore(store, 0)
+
+	var certificates []tls.Certificate
+	var context *windows.CertContext
+	for {
+		context, err = windows.CertEnumCertificatesInStore(store, context)
+		if err != nil {
+			break
+		}
+		raw := bytes.Clone(unsafe.Slice(context.EncodedCert, context.Length))
+		fingerprint := sha1.Sum(raw)
+		if thumbprint != "" && hex.EncodeToString(fingerprint[:]) != thumbprint {
+			continue
+		}
+		leaf, err := x509.ParseCertificate(raw)
+		if err != nil {
+			continue
+		}
+		// The context stays referenced by the cached key of the signer.
+		duplicate := windows.CertDuplicateCertificateContext(context)
+		signer, err := windowsKey(duplicate, leaf.PublicKey, pin)
+		if err != nil {
+			windows.CertFreeCertificateContext(duplicate)
+			if thumbprint != "" {
+				// The enumeration only frees the context it moves past.
+				windows.CertFreeCertificateContext(context)
+				return nil, fmt.Errorf("unable to use the key of %v: %v", leaf.Subject, err)
+			}
+			continue
+		}
+		cert := tls.Certificate{Certificate: [][]byte{raw}, Leaf: leaf, PrivateKey: signer}
+		cert.Certificate = append(cert.Certificate, windowsChain(engine, context)...)
+		timedLog(fmt.Sprintf("Certificate %d of the %s store: %v (thumbprint %x)", len(certificates), storeName, leaf.Subject, fingerprint))
+		certificates = append(certificates, cert)
+	}
+	if len(certificates) == 0 {
+		if thumbprint != "" {
+			return nil, fmt.Errorf("no certificate with the thumbprint %s in the %s store", thumbprint, storeName)
+		}
+		return nil, fmt.Errorf("no certificate with a private key in the %s store", storeName)
+	}
+	return certificates, nil
+}
+
+// windowsChain returns the intermediate certificates of the chain Windows
+// builds for the certificate, without the root.
+func windowsChain(engine windows.Handle, context *windows.CertContext) [][]byte {
+	var chainContext *windows.CertChainContext
+	para := windows.CertChainPara{Size: uint32(unsafe.Sizeof(windows.CertChainPara{}))}
+	if err := windows.CertGetCertificateChain(engine, context, nil, 0, &para, 0, 0, &chainContext); err != nil {
+		timedLog(fmt.Sprintf("Unable to build the chain of the certificate: %v", err))
+		return nil
+	}
+	defer windows.CertFreeCertificateChain(chainContext)
+	if chainContext.ChainCount == 0 {
+		return nil
+	}
+	chain := *chainContext.Chains
+	var intermediates [][]byte
+	for _, element := range unsafe.Slice(chain.Elements, chain.NumElements)[1:] {
+		raw := bytes.Clone(unsafe.Slice(element.CertContext.EncodedCert, element.CertContext.Length))
+		if cert, err := x509.ParseCertificate(raw); err == nil && !bytes.Equal(cert.RawSubject, cert.RawIssuer) {
+			intermediates = append(intermediates, raw)
+		}
+	}
+	return intermediates
+}
+
+// windowsKey acquires the private key of the certificate, preferring its CNG
+// key to the CAPI one, and gives it the PIN if any. Without it, Windows asks
+// for the PIN of smart cards itself.
+func windowsKey(context *windows.CertContext, public crypto.PublicKey, pin string) (*windowsSigner, error) {
+	var handle windows.Handle
+	var keySpec uint32
+	var callerFree bool
+	if err := windows.CryptAcquireCertificatePrivateKey(context, windows.CRYPT_ACQUIRE_CACHE_FLAG|windows.CRYPT_ACQUIRE_PREFER_NCRYPT_KEY_FLAG, nil, &handle, &keySpec, &callerFree); err != nil {
+		return nil, err
+	}
+	s := &windowsSigner{handle: handle, keySpec: keySpec, public: public}
+	switch public.(type) {
+	case *rsa.PublicKey:
+	case *ecdsa.PublicKey:
+		if s.capi() {
+			return nil, errors.New("CAPI providers have no ECDSA keys")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key %s", describePublicKey(public))
+	}
+	if pin == "" {
+		return s, nil
+	}
+	if s.capi() {
+		property := uintptr(capiSignaturePIN)
+		if keySpec == capiKeyExchange {
+			property = capiKeyXchgPIN
+		}
+		value := append([]byte(pin), 0)
+		if r, _, err := procCryptSetProv.Call(uintptr(handle), property, uintptr(unsafe.Pointer(&value[0])), 0); r == 0 {
+			return nil, fmt.Errorf("cannot set the PIN: %v", err)
+		}
+		return s, nil
+	}
+	property, err := windows.UTF16PtrFromString("SmartCardPin")
+	if err != nil {
+		return nil, err
+	}
+	value, err := windows.UTF16FromString(pin)
+	if err != nil {
+		return nil, err
+	}
+	if r, _, _ := procNCryptSetProp.Call(uintptr(handle), uintptr(unsafe.Pointer(property)), uintptr(unsafe.Pointer(&value[0])), uintptr(len(value)*2), 0); r != 0 {
+		return nil, fmt.Errorf("cannot set the PIN: %v", windows.Errno(r))
+	}
+	return s, nil
+}
+
+// windowsCapabilities describes what the key can sign, like probeToken does
+// for the PKCS#11 tokens: the CAPI providers make no RSA-PSS signatures.
+func windowsCapabilities(key crypto.PrivateKey) *tokenCapabilities {
+	s, ok := key.(*windowsSigner)
+	if !ok {
+		return nil
+	}
+	mechanisms := map[uint]pkcs11.MechanismInfo{pkcs11.CKM_RSA_PKCS: {}}
+	if !s.capi() {
+		mechanisms[pkcs11.CKM_RSA_PKCS_PSS] = pkcs11.MechanismInfo{}
+		mechanisms[pkcs11.CKM_ECDSA] = pkcs11.MechanismInfo{}
+	}
+	return &tokenCapabilities{mechanisms: mechanisms, canSign: true}
+}
+
+// windowsSigner signs with a key of the certificate store, one signature at
+// a time, as the smart card providers are not safe for concurrent use.
+type windowsSigner struct {
+	mu      sync.Mutex
+	handle  windows.Handle
+	keySpec uint32
+	public  crypto.PublicKey
+}
+
+// capi tells whether the key is a legacy CAPI one rather than a CNG one.
+func (s *windowsSigner) capi() bool {
+	return s.keySpec != windows.CERT_NCRYPT_KEY_SPEC
+}
+
+func (s *windowsSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *windowsSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.capi() {
+		return s.capiSign(digest, opts)
+	}
+	return s.cngSign(digest, opts)
+}
+
+func (s *windowsSigner) cngSign(digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var padding unsafe.Pointer
+	var flags uintptr
+	if key, ok := s.public.(*rsa.PublicKey); ok {
+		var algorithm *uint16
+		if name, ok := cngHashAlgorithms[opts.HashFunc()]; ok {
+			algorithm, _ = windows.UTF16PtrFromString(name)
+		} else if opts.HashFunc() != crypto.MD5SHA1 {
+			return nil, fmt.Errorf("unsupported hash %v", opts.HashFunc())
+		}
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			salt := pss.SaltLength
+			switch salt {
+			case rsa.PSSSaltLengthEqualsHash:
+				salt = opts.HashFunc().Size()
+			case rsa.PSSSaltLengthAuto:
+				salt = (key.N.BitLen()-1+7)/8 - 2 - opts.HashFunc().Size()
+			}
+			padding = unsafe.Pointer(&struct {
+				algorithm *uint16
+				salt      uint32
+			}{algorithm, uint32(salt)})
+			flags = bcryptPadPSS
+		} else {
+			padding = unsafe.Pointer(&struct{ algorithm *uint16 }{algorithm})
+			flags = bcryptPadPKCS1
+		}
+	}
+
+	var size uint32
+	if r, _, _ := procNCryptSignHash.Call(uintptr(s.handle), uintptr(padding), uintptr(unsafe.Pointer(&digest[0])), uintptr(len(digest)), 0, 0, uintptr(unsafe.Pointer(&size)), flags); r != 0 {
+		return nil, fmt.Errorf("NCryptSignHash: %v", windows.Errno(r))
+	}
+	signature := make([]byte, size)
+	if r, _, _ := procNCryptSignHash.Call(uintptr(s.handle), uintptr(padding), uintptr(unsafe.Pointer(&digest[0])), uintptr(len(digest)), uintptr(unsafe.Pointer(&signature[0])), uintptr(size), uintptr(unsafe.Pointer(&size)), flags); r != 0 {
+		return nil, fmt.Errorf("NCryptSignHash: %v", windows.Errno(r))
+	}
+	signature = signature[:size]
+	if _, ok := s.public.(*ecdsa.PublicKey); ok {
+		// CNG returns R||S, Go expects the ASN.1 encoding.
+		half := len(signature) / 2
+		return asn1.Marshal(struct{ R, S *big.Int }{new(big.Int).SetBytes(signature[:half]), new(big.Int).SetBytes(signature[half:])})
+	}
+	return signature, nil
+}
+
+func (s *windowsSigner) capiSign(digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		return nil, errors.New("CAPI providers make no RSA-PSS signatures")
+	}
+	algorithm, ok := capiHashAlgorithms[opts.HashFunc()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash %v", opts.HashFunc())
+	}
+	var hash uintptr
+	if r, _, err := procCryptCreateHash.Call(uintptr(s.handle), uintptr(algorithm), 0, 0, uintptr(unsafe.Pointer(&hash))); r == 0 {
+		return nil, fmt.Errorf("CryptCreateHash: %v", err)
+	}
+	defer procCryptDestroy.Call(hash)
+	if r, _, err := procCryptSetHash.Call(hash, capiHashValue, uintptr(unsafe.Pointer(&digest[0])), 0); r == 0 {
+		return nil, fmt.Errorf("CryptSetHashParam: %v", err)
+	}
+	var size uint32
+	if r, _, err := procCryptSignHash.Call(hash, uintptr(s.keySpec), 0, 0, 0, uintptr(unsafe.Pointer(&size))); r == 0 {
+		return nil, fmt.Errorf("CryptSignHash: %v", err)
+	}
+	signature := make([]byte, size)
+	if r, _, err := procCryptSignHash.Call(hash, uintptr(s.keySpec), 0, 0, uintptr(unsafe.Pointer(&signature[0])), uintptr(unsafe.Pointer(&size))); r == 0 {
+		return nil, fmt.Errorf("CryptSignHash: %v", err)
+	}
+	// CAPI returns the signature little-endian.
+	signature = signature[:size]
+	for i, j := 0, len(signature)-1; i < j; i, j = i+1, j-1 {
+		signature[i], signature[j] = signature[j], signature[i]
+	}
+	return signature, nil
+}
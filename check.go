@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// runCheckUpstream checks the destination URLs before the proxy is started
+// with the same options.
+func runCheckUpstream(c *config) error {
+	pinVal, err := c.tokenPin()
+	if err != nil {
+		return err
+	}
+	timedLog("Reverse proxy is starting")
+	client, err := connectUpstream(c, pinVal)
+	if err != nil {
+		return err
+	}
+	if !checkUpstream(client.destUrls, client.tlsConfig, client.options, client.transport, c.checkUpstreamRequest, c.checkUpstreamTimeout) {
+		return errors.New("the upstream checks failed")
+	}
+	return nil
+}
+
+// checkUpstream performs a TLS handshake with each destination with the
+// certificate of the token, printing what was negotiated and the CAs the
+// server accepts client certificates from, and optionally sends a HEAD
+// request, so that the configuration can be validated before going live. It
+// returns whether all the checks passed.
+func checkUpstream(destUrls []*url.URL, tlsConfig *tls.Config, options upstreamOptions, transport http.RoundTripper, request bool, timeout time.Duration) bool {
+	ok := true
+	for _, destUrl := range destUrls {
+		fmt.Printf("Checking %s\n", destUrl)
+		if !checkHandshake(destUrl, tlsConfig, options, timeout) {
+			ok = false
+			continue
+		}
+		if request && !checkRequest(destUrl, transport, timeout) {
+			ok = false
+		}
+	}
+	return ok
+}
+
+func checkHandshake(destUrl *url.URL, tlsConfig *tls.Config, options upstreamOptions, timeout time.Duration) bool {
+	if destUrl.Scheme != "https" {
+		fmt.Printf("  Not a TLS destination, the client certificate is not used\n")
+		return true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	port := destUrl.Port()
+	if port == "" {
+		port = "443"
+	}
+	addr := net.JoinHostPort(destUrl.Hostname(), port)
+	conn, err := options.dialUpstream(ctx, "tcp", addr, "https")
+	if err != nil {
+		fmt.Printf("  Connection failed: %s (%v)\n", classifyUpstreamError(err).message, err)
+		return false
+	}
+	defer conn.Close()
+	fmt.Printf("  Connected to %s\n", conn.RemoteAddr())
+
+	config := tlsConfig.Clone()
+	config.ServerName = destUrl.Hostname()
+	cert := config.Certificates[0]
+	requested := false
+	config.GetClientCertificate = func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		requested = true
+		fmt.Printf("  Client certificate requested, acceptable CAs: %s\n", formatAcceptableCAs(info.AcceptableCAs))
+		if err := info.SupportsCertificate(&cert); err != nil {
+			fmt.Printf("  Warning: the server may not accept the certificate of the token: %v\n", err)
+		}
+		fmt.Printf("  Offering certificate %v\n", cert.Leaf.Subject)
+		return &cert, nil
+	}
+	tlsConn := tls.Client(conn, config)
+	start := time.Now()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		fmt.Printf("  Handshake failed: %s\n  %s\n", describeHandshakeError(err), classifyUpstreamError(err).message)
+		return false
+	}
+	elapsed := time.Since(start)
+	state := tlsConn.ConnectionState()
+	if state.Version == tls.VersionTLS13 && requested {
+		// The client completes a TLS 1.3 handshake before the server checks
+		// its certificate, which is rejected later with an alert.
+		tlsConn.SetReadDeadline(time.Now().Add(time.Second))
+		var netErr net.Error
+		if _, err := tlsConn.Read(make([]byte, 1)); err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+			fmt.Printf("  Handshake failed: %s\n  %s\n", describeHandshakeError(err), classifyUpstreamError(err).message)
+			return false
+		}
+	}
+	fmt.Printf("  Handshake completed in %v: %s, %s, ALPN %q\n", elapsed.Round(time.Millisecond),
+		tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), state.NegotiatedProtocol)
+	if len(state.PeerCertificates) > 0 {
+		server := state.PeerCertificates[0]
+		fmt.Printf("  Server certificate: %v, issued by %v, valid until %s\n", server.Subject, server.Issuer, server.NotAfter.Format(time.DateOnly))
+	}
+	if !requested {
+		// With TLS 1.3 the server may still ask for it later, after the
+		// request, like for per-directory client certificates.
+		fmt.Printf("  Warning: the server didn't request a client certificate during the handshake\n")
+	}
+	return true
+}
+
+func checkRequest(destUrl *url.URL, transport http.RoundTripper, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, destUrl.String(), nil)
+	if err != nil {
+		fmt.Printf("  Request failed: %v\n", err)
+		return false
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		fmt.Printf("  Request failed: %s (%v)\n", classifyUpstreamError(err).message, err)
+		return false
+	}
+	resp.Body.Close()
+	fmt.Printf("  HEAD %s: %s over %s\n", destUrl, resp.Status, resp.Proto)
+	return true
+}
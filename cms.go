@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"time"
+)
+
+var (
+	oidData             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidRSAEncryption    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidDigestAlgorithms = map[crypto.Hash]asn1.ObjectIdentifier{
+		crypto.SHA1:   {1, 3, 14, 3, 2, 26},
+		crypto.SHA256: {2, 16, 840, 1, 101, 3, 4, 2, 1},
+		crypto.SHA384: {2, 16, 840, 1, 101, 3, 4, 2, 2},
+		crypto.SHA512: {2, 16, 840, 1, 101, 3, 4, 2, 3},
+	}
+	oidECDSASignatures = map[crypto.Hash]asn1.ObjectIdentifier{
+		crypto.SHA1:   {1, 2, 840, 10045, 4, 1},
+		crypto.SHA256: {1, 2, 840, 10045, 4, 3, 2},
+		crypto.SHA384: {1, 2, 840, 10045, 4, 3, 3},
+		crypto.SHA512: {1, 2, 840, 10045, 4, 3, 4},
+	}
+)
+
+// The structures of RFC 5652.
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo cmsEncapsulatedContentInfo
+	Certificates     asn1.RawValue
+	SignerInfos      []cmsSignerInfo `asn1:"set"`
+}
+
+type cmsEncapsulatedContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     []byte `asn1:"optional,explicit,tag:0"`
+}
+
+type cmsSignerInfo struct {
+	Version            int
+	SID                cmsIssuerAndSerialNumber
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttributes   asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type cmsIssuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+// cmsSignedAttributes returns the DER encoded attributes signed instead of
+// the content, sorted as required for a SET OF.
+func cmsSignedAttributes(digest []byte, signingTime time.Time) ([]byte, error) {
+	values := []struct {
+		oid   asn1.ObjectIdentifier
+		value interface{}
+	}{
+		{oidContentType, oidData},
+		{oidSigningTime, signingTime.UTC()},
+		{oidMessageDigest, digest},
+	}
+	var encoded [][]byte
+	for _, v := range values {
+		der, err := asn1.Marshal(v.value)
+		if err != nil {
+			return nil, err
+		}
+		attribute, err := asn1.Marshal(cmsAttribute{Type: v.oid, Values: []asn1.RawValue{{FullBytes: der}}})
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, attribute)
+	}
+	sort.Slice(encoded, func(i, j int) bool { return bytes.Compare(encoded[i], encoded[j]) < 0 })
+	return bytes.Join(encoded, nil), nil
+}
+
+// signedDataCMS returns a DER encoded CMS SignedData signing the digest of
+// the content with the key of the first certificate of the chain, which is
+// embedded. The content is embedded too if given, otherwise the signature is
+// detached. If tsa is not nil, the signature is timestamped by it.
+func signedDataCMS(digest, content []byte, hash crypto.Hash, signer crypto.Signer, chain []*x509.Certificate, tsa *timestampAuthority) ([]byte, error) {
+	digestAlgorithm := pkix.AlgorithmIdentifier{Algorithm: oidDigestAlgorithms[hash], Parameters: asn1.NullRawValue}
+	var signatureAlgorithm pkix.AlgorithmIdentifier
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		signatureAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}
+	case *ecdsa.PublicKey:
+		signatureAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidECDSASignatures[hash]}
+	default:
+		return nil, fmt.Errorf("unsupported key %s", describePublicKey(signer.Public()))
+	}
+
+	attributes, err := cmsSignedAttributes(digest, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	// The signature covers the attributes with their universal SET tag, not
+	// the implicit one they have in the SignerInfo.
+	signedAttributes, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: attributes})
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write(signedAttributes)
+	signature, err := signer.Sign(rand.Reader, h.Sum(nil), hash)
+	if err != nil {
+		return nil, err
+	}
+
+	var unsignedAttributes asn1.RawValue
+	if tsa != nil {
+		token, err := tsa.timestamp(signature)
+		if err != nil {
+			return nil, err
+		}
+		attribute, err := asn1.Marshal(cmsAttribute{Type: oidTimeStampToken, Values: []asn1.RawValue{{FullBytes: token}}})
+		if err != nil {
+			return nil, err
+		}
+		unsignedAttributes = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: attribute}
+	}
+
+	var certificates []byte
+	for _, cert := range chain {
+		certificates = append(certificates, cert.Raw...)
+	}
+	signedData, err := asn1.Marshal(cmsSignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{digestAlgorithm},
+		EncapContentInfo: cmsEncapsulatedContentInfo{ContentType: oidData, Content: content},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certificates},
+		SignerInfos: []cmsSignerInfo{{
+			Version:            1,
+			SID:                cmsIssuerAndSerialNumber{Issuer: asn1.RawValue{FullBytes: chain[0].RawIssuer}, SerialNumber: chain[0].SerialNumber},
+			DigestAlgorithm:    digestAlgorithm,
+			SignedAttributes:   asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attributes},
+			SignatureAlgorithm: signatureAlgorithm,
+			Signature:          signature,
+			UnsignedAttributes: unsignedAttributes,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(cmsContentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData},
+	})
+}
+
+// runCMSSign prints the CMS signature of the file argument of cms-sign.
+func runCMSSign(c *config) error {
+	pinVal, err := c.tokenPin()
+	if err != nil {
+		return err
+	}
+	opts, err := signatureOptions(c.signatureHash, false)
+	if err != nil {
+		return err
+	}
+	tsa, err := c.timestampAuthority()
+	if err != nil {
+		return err
+	}
+	return cmsSign(&c.pkcs11path, &c.tokenSerial, pinVal, c.certificateIndex, c.args[0], opts.HashFunc(), c.cmsAttached, tsa)
+}
+
+// cmsSign writes to stdout a DER encoded CMS signature of the file made by
+// the key of the certificate at the index, embedding the certificate and its
+// chain found on the token, and the file if attached.
+func cmsSign(pkcs11path, tokenSerial *string, pinVal string, index int, file string, hash crypto.Hash, attached bool, tsa *timestampAuthority) error {
+	context, err := configureToken(*pkcs11path, *tokenSerial, pinVal, 0)
+	if err != nil {
+		return err
+	}
+	cert, err := pairedCertificate(context, index)
+	if err != nil {
+		return err
+	}
+	others, err := tokenCertificates(*pkcs11path, *tokenSerial)
+	if err != nil {
+		timedLog(fmt.Sprintf("Unable to look for the chain on the token: %v", err))
+	}
+	var digest, content []byte
+	if attached {
+		if content, err = os.ReadFile(file); err != nil {
+			return err
+		}
+		h := hash.New()
+		h.Write(content)
+		digest = h.Sum(nil)
+	} else if digest, err = hashFile(file, hash); err != nil {
+		return err
+	}
+	signature, err := signedDataCMS(digest, content, hash, cert.PrivateKey.(crypto.Signer), certificateChain(cert.Leaf, others), tsa)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(signature)
+	return err
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// parseSignedDataCMS returns the SignedData of a DER encoded CMS signature,
+// failing the test if there is more than one SignerInfo.
+func parseSignedDataCMS(t *testing.T, signature []byte) *cmsSignedData {
+	t.Helper()
+	var contentInfo cmsContentInfo
+	if rest, err := asn1.Unmarshal(signature, &contentInfo); err != nil || len(rest) != 0 {
+		t.Fatalf("ContentInfo: %v, %d trailing bytes", err, len(rest))
+	}
+	if !contentInfo.ContentType.Equal(oidSignedData) {
+		t.Fatalf("content type %v", contentInfo.ContentType)
+	}
+	var signedData cmsSignedData
+	if rest, err := asn1.Unmarshal(contentInfo.Content.Bytes, &signedData); err != nil || len(rest) != 0 {
+		t.Fatalf("SignedData: %v, %d trailing bytes", err, len(rest))
+	}
+	if len(signedData.SignerInfos) != 1 {
+		t.Fatalf("%d SignerInfos", len(signedData.SignerInfos))
+	}
+	return &signedData
+}
+
+// cmsAttributeValue returns the DER encoded value of the attribute, among
+// the DER encoded attributes.
+func cmsAttributeValue(t *testing.T, attributes []byte, oid asn1.ObjectIdentifier) []byte {
+	t.Helper()
+	for rest := attributes; len(rest) > 0; {
+		var attribute cmsAttribute
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &attribute); err != nil {
+			t.Fatal(err)
+		}
+		if attribute.Type.Equal(oid) {
+			if len(attribute.Values) != 1 {
+				t.Fatalf("attribute %v with %d values", oid, len(attribute.Values))
+			}
+			return attribute.Values[0].FullBytes
+		}
+	}
+	t.Fatalf("no attribute %v", oid)
+	return nil
+}
+
+func TestCMSSignedAttributes(t *testing.T) {
+	digest := bytes.Repeat([]byte{0xff}, 32)
+	signingTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600))
+	attributes, err := cmsSignedAttributes(digest, signingTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A SET OF is the DER of its elements in increasing order.
+	var encoded [][]byte
+	for rest := attributes; len(rest) > 0; {
+		var value asn1.RawValue
+		if rest, err = asn1.Unmarshal(rest, &value); err != nil {
+			t.Fatal(err)
+		}
+		encoded = append(encoded, value.FullBytes)
+	}
+	if len(encoded) != 3 {
+		t.Fatalf("%d attributes", len(encoded))
+	}
+	for i := 1; i < len(encoded); i++ {
+		if bytes.Compare(encoded[i-1], encoded[i]) >= 0 {
+			t.Errorf("attribute %d is not sorted", i)
+		}
+	}
+
+	var contentType asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(cmsAttributeValue(t, attributes, oidContentType), &contentType); err != nil || !contentType.Equal(oidData) {
+		t.Errorf("content type %v, %v", contentType, err)
+	}
+	var messageDigest []byte
+	if _, err := asn1.Unmarshal(cmsAttributeValue(t, attributes, oidMessageDigest), &messageDigest); err != nil || !bytes.Equal(messageDigest, digest) {
+		t.Errorf("message digest %x, %v", messageDigest, err)
+	}
+	// The signing time is in UTC, as a UTCTime until 2050.
+	value := cmsAttributeValue(t, attributes, oidSigningTime)
+	var decoded time.Time
+	if _, err := asn1.Unmarshal(value, &decoded); err != nil || !decoded.Equal(signingTime) || value[0] != asn1.TagUTCTime || !bytes.HasSuffix(value, []byte("020405Z")) {
+		t.Errorf("signing time %x: %v, %v", value, decoded, err)
+	}
+}
+
+func TestSignedDataCMS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("signed content\n")
+	for _, key := range []crypto.Signer{rsaKey, ecKey} {
+		cert := testCertificate(t, key, "signer")
+		for _, hash := range []crypto.Hash{crypto.SHA256, crypto.SHA384} {
+			h := hash.New()
+			h.Write(content)
+			digest := h.Sum(nil)
+			for _, attached := range []bool{false, true} {
+				name := describePublicKey(key.Public()) + " " + hash.String()
+				var embedded []byte
+				if attached {
+					name, embedded = name+" attached", content
+				}
+				signature, err := signedDataCMS(digest, embedded, hash, key, []*x509.Certificate{cert.Leaf}, nil)
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				signedData := parseSignedDataCMS(t, signature)
+				if !signedData.EncapContentInfo.ContentType.Equal(oidData) || !bytes.Equal(signedData.EncapContentInfo.Content, embedded) {
+					t.Errorf("%s: encapsulated content %q", name, signedData.EncapContentInfo.Content)
+				}
+				if !bytes.Equal(signedData.Certificates.Bytes, cert.Leaf.Raw) {
+					t.Errorf("%s: the certificate is not embedded", name)
+				}
+				signerInfo := signedData.SignerInfos[0]
+				if signerInfo.SID.SerialNumber.Cmp(cert.Leaf.SerialNumber) != 0 || !bytes.Equal(signerInfo.SID.Issuer.FullBytes, cert.Leaf.RawIssuer) {
+					t.Errorf("%s: the SignerInfo does not identify the certificate", name)
+				}
+				if !signerInfo.DigestAlgorithm.Algorithm.Equal(oidDigestAlgorithms[hash]) {
+					t.Errorf("%s: digest algorithm %v", name, signerInfo.DigestAlgorithm.Algorithm)
+				}
+				if signerInfo.SignedAttributes.Class != asn1.ClassContextSpecific || signerInfo.SignedAttributes.Tag != 0 {
+					t.Errorf("%s: signed attributes tagged %d/%d", name, signerInfo.SignedAttributes.Class, signerInfo.SignedAttributes.Tag)
+				}
+				var messageDigest []byte
+				if _, err := asn1.Unmarshal(cmsAttributeValue(t, signerInfo.SignedAttributes.Bytes, oidMessageDigest), &messageDigest); err != nil || !bytes.Equal(messageDigest, digest) {
+					t.Errorf("%s: message digest %x, want %x", name, messageDigest, digest)
+				}
+
+				// The signature is over the attributes tagged as a universal
+				// SET, not over their implicit tag in the SignerInfo.
+				set := append([]byte{0x31}, signerInfo.SignedAttributes.FullBytes[1:]...)
+				h := hash.New()
+				h.Write(set)
+				if err := verifyCMSSignature(key.Public(), hash, h.Sum(nil), signerInfo.Signature); err != nil {
+					t.Errorf("%s: %v", name, err)
+				}
+				h.Reset()
+				h.Write(signerInfo.SignedAttributes.FullBytes)
+				if verifyCMSSignature(key.Public(), hash, h.Sum(nil), signerInfo.Signature) == nil {
+					t.Errorf("%s: the signature is over the implicitly tagged attributes", name)
+				}
+			}
+		}
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := signedDataCMS(make([]byte, 32), nil, crypto.SHA256, edKey, nil, nil); err == nil {
+		t.Error("a signature with an Ed25519 key is accepted")
+	}
+}
+
+// TestSignedDataCMSOpenSSL verifies the signatures with openssl cms, when
+// installed.
+func TestSignedDataCMSOpenSSL(t *testing.T) {
+	openssl, err := exec.LookPath("openssl")
+	if err != nil {
+		t.Skip("openssl is not installed")
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	content := []byte("signed content\r\nwith a binary \x00 byte\n")
+	contentFile := filepath.Join(dir, "content")
+	if err := os.WriteFile(contentFile, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []crypto.Signer{rsaKey, ecKey} {
+		cert := testCertificate(t, key, "signer")
+		certFile := filepath.Join(dir, "signer.pem")
+		if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Leaf.Raw}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		digest, err := hashFile(contentFile, crypto.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, attached := range []bool{false, true} {
+			name := describePublicKey(key.Public())
+			args := []string{"cms", "-verify", "-inform", "DER", "-binary", "-purpose", "any", "-CAfile", certFile, "-in", filepath.Join(dir, "signature.p7s")}
+			var embedded []byte
+			if attached {
+				name, embedded = name+" attached", content
+			} else {
+				args = append(args, "-content", contentFile)
+			}
+			signature, err := signedDataCMS(digest, embedded, crypto.SHA256, key, []*x509.Certificate{cert.Leaf}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "signature.p7s"), signature, 0600); err != nil {
+				t.Fatal(err)
+			}
+			var stdout, stderr bytes.Buffer
+			command := exec.Command(openssl, args...)
+			command.Stdout, command.Stderr = &stdout, &stderr
+			if err := command.Run(); err != nil {
+				t.Errorf("%s: openssl cms -verify: %v: %s", name, err, stderr.Bytes())
+				continue
+			}
+			if !bytes.Equal(stdout.Bytes(), content) {
+				t.Errorf("%s: openssl verified %q", name, stdout.Bytes())
+			}
+		}
+	}
+}
+
+// verifyCMSSignature verifies a signature of signedDataCMS over the digest.
+func verifyCMSSignature(public crypto.PublicKey, hash crypto.Hash, digest, signature []byte) error {
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(public, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(public, digest, signature) {
+			return errors.New("the ECDSA signature does not verify")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// encoder is a streaming compressor.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressHandler compresses the responses with brotli or gzip for the
+// clients accepting it, which pays off when the proxy sits between a fast
+// upstream and clients on a slow VPN link. Responses already compressed,
+// smaller than minSize or of a type that doesn't compress well are sent as
+// they are.
+func compressHandler(next http.Handler, minSize int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: minSize}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding returns the preferred encoding among the ones accepted
+// by the client, br or gzip, or an empty string if it accepts neither.
+func negotiateEncoding(acceptEncoding string) string {
+	accepted := acceptedEncodings(acceptEncoding)
+	if accepted["br"] {
+		return "br"
+	}
+	if accepted["gzip"] {
+		return "gzip"
+	}
+	return ""
+}
+
+func acceptedEncodings(acceptEncoding string) map[string]bool {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			q, _ = strconv.ParseFloat(value, 64)
+		}
+		if name == "*" {
+			accepted["gzip"] = accepted["gzip"] || q > 0
+			continue
+		}
+		accepted[name] = q > 0
+	}
+	return accepted
+}
+
+// compressible tells whether the content type is worth compressing.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "application/wasm", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// compressWriter buffers the beginning of the response until it knows whether
+// to compress it.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status      int
+	buf         []byte
+	decided     bool
+	passthrough bool
+	encoder     encoder
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	if status < http.StatusOK {
+		if status == http.StatusSwitchingProtocols {
+			w.decided, w.passthrough = true, true
+			w.status = status
+		}
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status = status
+	if !w.eligible() {
+		w.decide(false)
+		return
+	}
+	if length, err := strconv.Atoi(w.Header().Get("Content-Length")); err == nil && length < w.minSize {
+		w.decide(false)
+	}
+}
+
+// eligible tells whether the response can be compressed, regardless of its
+// size.
+func (w *compressWriter) eligible() bool {
+	header := w.Header()
+	switch w.status {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+	return header.Get("Content-Encoding") == "" && header.Get("Content-Range") == "" &&
+		!strings.Contains(header.Get("Cache-Control"), "no-transform") && compressible(header.Get("Content-Type"))
+}
+
+// decide sends the headers, compressed or not, and the buffered beginning of
+// the body.
+func (w *compressWriter) decide(compress bool) error {
+	w.decided = true
+	if compress {
+		header := w.Header()
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", w.encoding)
+		header.Add("Vary", "Accept-Encoding")
+		if etag := header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("Etag", "W/"+etag)
+		}
+		if w.encoding == "br" {
+			w.encoder = brotli.NewWriter(w.ResponseWriter)
+		} else {
+			w.encoder = gzip.NewWriter(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	_, err := w.write(buf)
+	return err
+}
+
+func (w *compressWriter) write(p []byte) (int, error) {
+	if w.encoder != nil {
+		return w.encoder.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.decided {
+		return w.write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= w.minSize {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush sends what has been written so far, compressing it if possible
+// whatever its size, since the response is being streamed.
+func (w *compressWriter) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.decide(true)
+	}
+	if w.encoder != nil {
+		w.encoder.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *compressWriter) Close() error {
+	if w.passthrough {
+		return nil
+	}
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.decide(len(w.buf) >= w.minSize)
+	}
+	if w.encoder != nil {
+		return w.encoder.Close()
+	}
+	return nil
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// decompressResponse decodes the responses compressed by the upstream with an
+// encoding the client doesn't accept.
+func decompressResponse(resp *http.Response) error {
+	encoding := strings.ToLower(resp.Header.Get("Content-Encoding"))
+	if (encoding != "gzip" && encoding != "br" && encoding != "zstd") || acceptedEncodings(resp.Request.Header.Get("Accept-Encoding"))[encoding] ||
+		resp.Request.Method == http.MethodHead || resp.ContentLength == 0 || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	decoded, err := newDecoder(encoding, resp.Body)
+	if err != nil {
+		return err
+	}
+	resp.Body = readCloser{decoded, resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	return nil
+}
+
+// newDecoder returns a reader decoding body from the gzip, br or zstd
+// content encoding.
+func newDecoder(encoding string, body io.Reader) (io.Reader, error) {
+	switch encoding {
+	case "br":
+		return brotli.NewReader(body), nil
+	case "zstd":
+		decoder, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return gzip.NewReader(body)
+}
+
+// newEncoder returns a writer encoding to w with the gzip, br or zstd content
+// encoding.
+func newEncoder(encoding string, w io.Writer) (encoder, error) {
+	switch encoding {
+	case "br":
+		return brotli.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	return gzip.NewWriter(w), nil
+}
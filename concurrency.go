@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// concurrencyLimiter bounds the number of requests proxied at the same time.
+// Further requests wait in a bounded queue, and are rejected with 503 when
+// it is full or they waited too long, which keeps the latency predictable
+// when the token is slow.
+type concurrencyLimiter struct {
+	slots        chan struct{}
+	queue        chan struct{}
+	queueTimeout time.Duration
+}
+
+func newConcurrencyLimiter(maxInFlight, maxQueued int, queueTimeout time.Duration) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		slots:        make(chan struct{}, maxInFlight),
+		queue:        make(chan struct{}, maxQueued),
+		queueTimeout: queueTimeout,
+	}
+}
+
+// acquire waits for a free slot, returning false if the request is rejected.
+func (l *concurrencyLimiter) acquire(r *http.Request) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	select {
+	case l.queue <- struct{}{}:
+	default:
+		return false
+	}
+	queuedRequests.Inc()
+	defer func() {
+		<-l.queue
+		queuedRequests.Dec()
+	}()
+
+	var timeout <-chan time.Time
+	if l.queueTimeout > 0 {
+		timer := time.NewTimer(l.queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timeout:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func (l *concurrencyLimiter) release() {
+	<-l.slots
+}
+
+// concurrencyLimitHandler proxies the requests within the concurrency limit.
+func concurrencyLimitHandler(next http.Handler, limiter *concurrencyLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !limiter.acquire(r) {
+			rejectedRequests.Inc()
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Service unavailable, too many requests in progress", http.StatusServiceUnavailable)
+			return
+		}
+		defer limiter.release()
+		next.ServeHTTP(w, r)
+	})
+}
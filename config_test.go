@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"strings"
+	"testing"
+)
+
+// testConfig parses the arguments like the command line.
+func testConfig(t *testing.T, arguments ...string) *config {
+	t.Helper()
+	flags := flag.NewFlagSet("pkcs11-web-proxy", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	c, err := parseConfig(flags, arguments)
+	if err != nil {
+		t.Fatalf("%q: %v", arguments, err)
+	}
+	return c
+}
+
+func TestParseConfig(t *testing.T) {
+	c := testConfig(t, "-token-serial", "0123", "-destination-url", "https://a.example.com", "-destination-url", "https://b.example.com", "sign", "document.pdf")
+	if c.tokenSerial != "0123" || c.command != "sign" || len(c.args) != 1 || c.args[0] != "document.pdf" {
+		t.Errorf("token %q, command %q, arguments %q", c.tokenSerial, c.command, c.args)
+	}
+	if len(c.destinationUrls) != 2 || c.destinationUrls[1] != "https://b.example.com" {
+		t.Errorf("destination URLs %q", c.destinationUrls)
+	}
+	// The defaults.
+	if c.listenAddress != "127.0.0.1" || c.listenPort != 8080 || c.mountPath != "/" || c.listenTLSCertificateIndex != -1 || c.backend != "pkcs11" {
+		t.Errorf("defaults %+v", c)
+	}
+	if c := testConfig(t); c.command != "" || c.args != nil {
+		t.Errorf("command %q, arguments %q without any", c.command, c.args)
+	}
+
+	flags := flag.NewFlagSet("pkcs11-web-proxy", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	if _, err := parseConfig(flags, []string{"-listen-port", "http"}); err == nil {
+		t.Error("an invalid port is accepted")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	token := []string{"-pkcs11-path", "/usr/lib/opensc-pkcs11.so", "-token-serial", "0123", "-pin", "1234"}
+	proxy := append(token, "-destination-url", "https://upstream.example.com")
+	// Full slices, for the appends of the tests to copy them.
+	proxy = proxy[:len(proxy):len(proxy)]
+	noPin := token[:4:4]
+	tests := []struct {
+		name      string
+		arguments []string
+		// err is part of the error, or empty if the config is valid.
+		err string
+	}{
+		{"proxy", proxy, ""},
+		{"check-upstream", append(proxy, "check-upstream"), ""},
+		{"an unknown command runs the proxy", append(token, "serve"), "destination-url is required"},
+		{"no module", []string{"-token-serial", "0123", "-pin", "1234"}, "pkcs11-path is required"},
+		{"no token", []string{"-pkcs11-path", "/usr/lib/opensc-pkcs11.so", "-pin", "1234"}, "token-serial is required"},
+		{"no PIN", noPin, "Either pin or pin-file is required"},
+		{"both PINs", append(token, "-pin-file", "pin.txt"), "Both pin and pin-file are set"},
+
+		{"gen-local-ca", []string{"gen-local-ca", "proxy.example.com"}, ""},
+		{"verify-audit-log", []string{"-audit-log", "audit.log", "-audit-log-key-file", "audit.key", "verify-audit-log"}, ""},
+		{"verify-audit-log without key", []string{"-audit-log", "audit.log", "verify-audit-log"}, "audit-log-key-file are required"},
+		{"token-info without PIN", append(noPin, "token-info"), ""},
+		{"unblock-pin", append(noPin, "-so-pin", "12345678", "-new-pin", "4321", "unblock-pin"), ""},
+		{"unblock-pin without PUK", append(noPin, "-new-pin", "4321", "unblock-pin"), "Either so-pin or so-pin-file is required"},
+		{"change-pin", append(token, "-new-pin", "4321", "change-pin"), ""},
+		{"change-pin with both new PINs", append(token, "-new-pin", "4321", "-new-pin-file", "pin.txt", "change-pin"), "Both new-pin and new-pin-file are set"},
+		{"list-certificates", append(token, "list-certificates"), ""},
+		{"import-cert", append(token, "import-cert", "cert.pem"), ""},
+		{"import-cert without file", append(token, "import-cert"), "import-cert requires the certificate file"},
+		{"sign", append(token, "-signature-hash", "sha384", "-signature-pss", "sign", "document.pdf"), ""},
+		{"sign with a timestamp", append(token, "-tsa-url", "http://timestamp.example.com", "-timestamp-file", "document.tsr", "sign", "document.pdf"), ""},
+		{"sign without timestamp file", append(token, "-tsa-url", "http://timestamp.example.com", "sign", "document.pdf"), "both tsa-url and timestamp-file"},
+		{"sign with an unknown hash", append(token, "-signature-hash", "md5", "sign", "document.pdf"), "md5"},
+		{"verify without signature", append(token, "verify", "document.pdf"), "verify requires the signed file and the signature"},
+		{"cms-sign with PSS", append(token, "-signature-pss", "cms-sign", "document.pdf"), "signature-pss cannot be used with cms-sign"},
+		{"smime-sign", append(token, "smime-sign", "message.eml"), ""},
+		{"TSA of another scheme", append(token, "-tsa-url", "ftp://timestamp.example.com", "smime-sign", "message.eml"), "invalid TSA URL"},
+		{"remote-signer without certificate", append(token, "remote-signer"), "remote-signer requires remote-signer-cert"},
+		{"desktop notification without delay", append(token, "-touch-desktop-notification", "ssh-agent"), "touch-desktop-notification requires touch-notify-after"},
+
+		{"remote signer", []string{"-remote-signer-url", "https://card-host:8443", "-remote-signer-client-cert", "client.pem", "-remote-signer-client-key", "client.key", "-destination-url", "https://upstream.example.com"}, ""},
+		{"remote signer without client certificate", []string{"-remote-signer-url", "https://card-host:8443", "-destination-url", "https://upstream.example.com"}, "remote-signer-url requires remote-signer-client-cert"},
+		{"command of a remote signer", []string{"-remote-signer-url", "https://card-host:8443", "sign", "document.pdf"}, "sign works on a local token"},
+		{"TPM backend", []string{"-backend", "tpm", "-tpm-key-handle", "0x81010002", "-tpm-certificate", "cert.pem", "-destination-url", "https://upstream.example.com"}, ""},
+		{"TPM backend with two keys", []string{"-backend", "tpm", "-tpm-key-handle", "0x81010002", "-tpm-key-public", "key.pub", "-tpm-key-private", "key.priv", "-tpm-certificate", "cert.pem"}, "either tpm-key-handle or tpm-key-public"},
+		{"Windows backend", []string{"-backend", "windows", "-destination-url", "https://upstream.example.com"}, ""},
+		{"command of the Windows backend", []string{"-backend", "windows", "list-certificates"}, "list-certificates works on a PKCS#11 token"},
+		{"unknown backend", []string{"-backend", "piv"}, `invalid backend "piv"`},
+		{"all tokens", []string{"-pkcs11-path", "/usr/lib/opensc-pkcs11.so", "-all-tokens", "-pin", "1234", "list-certificates"}, ""},
+		{"all tokens and a serial", append(token, "-all-tokens", "list-certificates"), "token-serial and backup-token-serial cannot be used with all-tokens"},
+		{"command of one token", []string{"-pkcs11-path", "/usr/lib/opensc-pkcs11.so", "-all-tokens", "-pin", "1234", "gen-csr"}, "gen-csr works on one token"},
+
+		{"no destination", token, "destination-url is required"},
+		{"unknown health check", append(proxy, "-health-check", "icmp"), "health-check must be one of"},
+		{"weights", append(proxy, "-destination-url", "https://canary.example.com", "-destination-weight", "95", "-destination-weight", "5"), ""},
+		{"missing weight", append(proxy, "-destination-url", "https://canary.example.com", "-destination-weight", "95"), "destination-weight must be given once per destination-url"},
+		{"negative weight", append(proxy, "-destination-weight", "-1"), `invalid destination-weight "-1"`},
+		{"two upstream credentials", append(proxy, "-upstream-bearer-token-file", "token.txt", "-upstream-basic-auth-command", "pass"), "Only one of upstream-bearer-token-file"},
+		{"OIDC and htpasswd", append(proxy, "-oidc-issuer", "https://idp.example.com", "-oidc-client-id", "proxy", "-oidc-redirect-url", "http://localhost:8080/.pkcs11-web-proxy/oidc/callback", "-htpasswd-file", "users"), "oidc-issuer cannot be used with htpasswd-file"},
+		{"PROXY protocol sources without it", append(proxy, "-listen-proxy-protocol-source", "10.0.0.0/8"), "listen-proxy-protocol-source requires listen-proxy-protocol"},
+		{"PROXY protocol to an h2c upstream", append(token, "-destination-url", "h2c://upstream.example.com", "-upstream-proxy-protocol", "v2"), "cannot be used with h2c upstreams"},
+		{"relative mount path", append(proxy, "-mount-path", "app/"), "mount-path must start with /"},
+		{"mount path without trailing slash", append(proxy, "-mount-path", "/app"), ""},
+		{"mount path of the proxy", append(proxy, "-mount-path", "/.pkcs11-web-proxy/app/"), "cannot be under /.pkcs11-web-proxy/"},
+		{"log headers without requests", append(proxy, "-log-headers"), "log-headers requires log-requests"},
+		{"ACME without TLS", append(proxy, "-acme-domain", "proxy.example.com", "-acme-cache-dir", "acme", "-acme-accept-tos"), "acme-domain requires listen-tls"},
+		{"ACME without terms of service", append(proxy, "-listen-tls", "-acme-domain", "proxy.example.com", "-acme-cache-dir", "acme"), "acme-domain requires acme-cache-dir and acme-accept-tos"},
+		{"listener key without certificate", append(proxy, "-listen-tls", "-listen-tls-key", "key.pem"), "listen-tls-key and listen-tls-cert must be used together"},
+		{"HTTP/3 without TLS", append(proxy, "-listen-http3"), "listen-tls is required when listen-http3 is set"},
+		{"HTTP/3 through a proxy", append(proxy, "-upstream-http3", "-upstream-proxy", "http://proxy:3128"), "upstream-http3 cannot be used with upstream-proxy"},
+		{"two DNS resolvers", append(proxy, "-dns-server", "192.0.2.53", "-dns-over-https", "https://dns.example.com/dns-query"), "Both dns-server and dns-over-https are set"},
+		{"unknown renegotiation", append(proxy, "-renegotiation", "always"), `invalid renegotiation policy "always"`},
+	}
+	for _, test := range tests {
+		err := testConfig(t, test.arguments...).validate()
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.err != "" && err == nil:
+			t.Errorf("%s: valid, want %q", test.name, test.err)
+		case err != nil && !strings.Contains(err.Error(), test.err):
+			t.Errorf("%s: %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestConfigWeights(t *testing.T) {
+	c := testConfig(t, "-destination-url", "https://a.example.com", "-destination-url", "https://b.example.com")
+	if weights, err := c.weights(); err != nil || len(weights) != 2 || weights[0] != 0 || weights[1] != 0 {
+		t.Errorf("weights without destination-weight %v: %v", weights, err)
+	}
+	c = testConfig(t, "-destination-url", "https://a.example.com", "-destination-url", "https://b.example.com", "-destination-weight", "95", "-destination-weight", "5")
+	if weights, err := c.weights(); err != nil || len(weights) != 2 || weights[0] != 95 || weights[1] != 5 {
+		t.Errorf("weights %v: %v", weights, err)
+	}
+}
+
+func TestConfigCredential(t *testing.T) {
+	if credential, err := testConfig(t).credential(); credential != nil || err != nil {
+		t.Errorf("credential %+v without one: %v", credential, err)
+	}
+	credential, err := testConfig(t, "-upstream-basic-auth-command", "pass show upstream", "-upstream-credential-refresh", "1m").credential()
+	if err != nil || credential.scheme != "Basic" || credential.command != "pass show upstream" || credential.file != "" || credential.refresh.Minutes() != 1 {
+		t.Errorf("credential %+v: %v", credential, err)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// cookieRules tells what to do with an attribute of the cookies set by the
+// upstream, by cookie name. The "*" name applies to the cookies not listed.
+type cookieRules map[string]string
+
+// parseCookieRules parses name=action entries, the action being one of
+// actions.
+func parseCookieRules(flagName string, entries []string, actions ...string) (cookieRules, error) {
+	rules := make(cookieRules, len(entries))
+	for _, entry := range entries {
+		name, action, found := strings.Cut(entry, "=")
+		valid := false
+		for _, candidate := range actions {
+			valid = valid || action == candidate
+		}
+		if !found || name == "" || !valid {
+			return nil, fmt.Errorf("invalid %s rule %q, expected name=%s", flagName, entry, strings.Join(actions, "|"))
+		}
+		rules[name] = action
+	}
+	return rules, nil
+}
+
+func (r cookieRules) action(name, fallback string) string {
+	if action, ok := r[name]; ok {
+		return action
+	}
+	if action, ok := r["*"]; ok {
+		return action
+	}
+	return fallback
+}
+
+// cookiePolicy adjusts the attributes of the cookies set by the upstream.
+// By default the Secure flag is removed, so that the cookies work on the
+// plain HTTP listener, except from the SameSite=None ones, which browsers
+// refuse without it, and the other attributes are kept.
+type cookiePolicy struct {
+	secure   cookieRules
+	httpOnly cookieRules
+	domain   cookieRules
+	sameSite cookieRules
+	// warned holds the names of the cookies already reported as refused.
+	warned sync.Map
+}
+
+func newCookiePolicy(secure, httpOnly, domain, sameSite []string) (*cookiePolicy, error) {
+	var p cookiePolicy
+	var err error
+	if p.secure, err = parseCookieRules("cookie-secure", secure, "keep", "strip", "add"); err != nil {
+		return nil, err
+	}
+	if p.httpOnly, err = parseCookieRules("cookie-httponly", httpOnly, "keep", "strip", "add"); err != nil {
+		return nil, err
+	}
+	if p.domain, err = parseCookieRules("cookie-domain", domain, "keep", "strip", "rewrite"); err != nil {
+		return nil, err
+	}
+	if p.sameSite, err = parseCookieRules("cookie-samesite", sameSite, "keep", "relax", "strict", "lax", "none", "unset"); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// apply adjusts the cookie set in the response to a request the client sent
+// to host.
+func (p *cookiePolicy) apply(cookie *http.Cookie, host string) {
+	secure := p.secure.action(cookie.Name, "")
+	switch secure {
+	case "", "strip":
+		cookie.Secure = false
+	case "add":
+		cookie.Secure = true
+	}
+	switch p.httpOnly.action(cookie.Name, "keep") {
+	case "strip":
+		cookie.HttpOnly = false
+	case "add":
+		cookie.HttpOnly = true
+	}
+	if cookie.Domain != "" {
+		switch p.domain.action(cookie.Name, "keep") {
+		case "strip":
+			cookie.Domain = ""
+		case "rewrite":
+			cookie.Domain = cookieDomain(host)
+		}
+	}
+	switch p.sameSite.action(cookie.Name, "keep") {
+	case "relax":
+		// The requests coming back from another site, like the redirects of
+		// a single sign-on, don't carry Strict cookies.
+		if cookie.SameSite == http.SameSiteStrictMode {
+			cookie.SameSite = http.SameSiteLaxMode
+		}
+	case "strict":
+		cookie.SameSite = http.SameSiteStrictMode
+	case "lax":
+		cookie.SameSite = http.SameSiteLaxMode
+	case "none":
+		cookie.SameSite = http.SameSiteNoneMode
+	case "unset":
+		cookie.SameSite = http.SameSiteDefaultMode
+	}
+	if cookie.SameSite == http.SameSiteNoneMode && !cookie.Secure {
+		if secure == "" {
+			cookie.Secure = true
+		} else if _, warned := p.warned.LoadOrStore(cookie.Name, true); !warned {
+			timedLog(fmt.Sprintf("Warning: the cookie %s is SameSite=None without the Secure flag, which browsers refuse: set -cookie-secure %s=add", cookie.Name, cookie.Name))
+		}
+	}
+}
+
+// cookieDomain returns the Domain attribute for the cookies to be sent back
+// to host. A cookie for an IP address or a single label name like localhost
+// is left without a Domain, since browsers refuse most of them.
+func cookieDomain(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	if net.ParseIP(strings.Trim(host, "[]")) != nil || !strings.Contains(host, ".") {
+		return ""
+	}
+	return host
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestParseCookieRules(t *testing.T) {
+	rules, err := parseCookieRules("cookie-secure", []string{"session=keep", "*=add", "a=b=strip"}, "keep", "strip", "add")
+	if err == nil {
+		t.Errorf("the name a=b is accepted: %v", rules)
+	}
+	rules, err = parseCookieRules("cookie-secure", []string{"session=keep", "*=add"}, "keep", "strip", "add")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules.action("session", "strip") != "keep" || rules.action("other", "strip") != "add" {
+		t.Errorf("rules %v", rules)
+	}
+	if action := (cookieRules{}).action("session", "strip"); action != "strip" {
+		t.Errorf("action without rules %q", action)
+	}
+	for _, entry := range []string{"session", "=keep", "session=", "session=remove", "session=Keep"} {
+		if _, err := parseCookieRules("cookie-secure", []string{entry}, "keep", "strip", "add"); err == nil {
+			t.Errorf("%q is accepted", entry)
+		}
+	}
+}
+
+func TestCookiePolicy(t *testing.T) {
+	tests := []struct {
+		name                               string
+		secure, httpOnly, domain, sameSite []string
+		host                               string
+		cookie, want                       http.Cookie
+	}{
+		{
+			name:   "defaults",
+			cookie: http.Cookie{Name: "session", Secure: true, HttpOnly: true, Domain: "upstream.example.com", SameSite: http.SameSiteStrictMode},
+			want:   http.Cookie{Name: "session", HttpOnly: true, Domain: "upstream.example.com", SameSite: http.SameSiteStrictMode},
+		},
+		{
+			name:   "kept by name",
+			secure: []string{"session=keep", "*=add"},
+			cookie: http.Cookie{Name: "session", Secure: true},
+			want:   http.Cookie{Name: "session", Secure: true},
+		},
+		{
+			name:   "default of the others",
+			secure: []string{"session=keep", "*=add"},
+			cookie: http.Cookie{Name: "tracking"},
+			want:   http.Cookie{Name: "tracking", Secure: true},
+		},
+		{
+			name:     "HttpOnly",
+			httpOnly: []string{"session=add", "*=strip"},
+			cookie:   http.Cookie{Name: "session"},
+			want:     http.Cookie{Name: "session", HttpOnly: true},
+		},
+		{
+			name:     "HttpOnly of the others",
+			httpOnly: []string{"session=add", "*=strip"},
+			cookie:   http.Cookie{Name: "csrf", HttpOnly: true},
+			want:     http.Cookie{Name: "csrf"},
+		},
+		{
+			name:   "Domain stripped",
+			domain: []string{"*=strip"},
+			cookie: http.Cookie{Name: "session", Domain: "upstream.example.com"},
+			want:   http.Cookie{Name: "session"},
+		},
+		{
+			name:   "Domain rewritten",
+			domain: []string{"*=rewrite"},
+			host:   "proxy.example.com:8080",
+			cookie: http.Cookie{Name: "session", Domain: ".upstream.example.com"},
+			want:   http.Cookie{Name: "session", Domain: "proxy.example.com"},
+		},
+		{
+			name:   "Domain rewritten on localhost",
+			domain: []string{"*=rewrite"},
+			host:   "localhost:8080",
+			cookie: http.Cookie{Name: "session", Domain: "upstream.example.com"},
+			want:   http.Cookie{Name: "session"},
+		},
+		{
+			name:   "Domain rewritten on an IP address",
+			domain: []string{"*=rewrite"},
+			host:   "[::1]:8080",
+			cookie: http.Cookie{Name: "session", Domain: "upstream.example.com"},
+			want:   http.Cookie{Name: "session"},
+		},
+		{
+			name:   "no Domain to rewrite",
+			domain: []string{"*=rewrite"},
+			host:   "proxy.example.com",
+			cookie: http.Cookie{Name: "session"},
+			want:   http.Cookie{Name: "session"},
+		},
+		{
+			name:     "Strict relaxed",
+			sameSite: []string{"*=relax"},
+			cookie:   http.Cookie{Name: "session", SameSite: http.SameSiteStrictMode},
+			want:     http.Cookie{Name: "session", SameSite: http.SameSiteLaxMode},
+		},
+		{
+			name:     "None not relaxed",
+			sameSite: []string{"*=relax"},
+			cookie:   http.Cookie{Name: "session", Secure: true, SameSite: http.SameSiteNoneMode},
+			want:     http.Cookie{Name: "session", Secure: true, SameSite: http.SameSiteNoneMode},
+		},
+		{
+			name:     "SameSite unset",
+			sameSite: []string{"session=unset"},
+			cookie:   http.Cookie{Name: "session", SameSite: http.SameSiteLaxMode},
+			want:     http.Cookie{Name: "session"},
+		},
+		{
+			name:     "SameSite of another cookie",
+			sameSite: []string{"session=strict"},
+			cookie:   http.Cookie{Name: "other", SameSite: http.SameSiteLaxMode},
+			want:     http.Cookie{Name: "other", SameSite: http.SameSiteLaxMode},
+		},
+		// Browsers refuse the SameSite=None cookies without Secure: the flag
+		// is kept, or added, unless a rule says otherwise.
+		{
+			name:   "SameSite=None keeps Secure",
+			cookie: http.Cookie{Name: "session", Secure: true, SameSite: http.SameSiteNoneMode},
+			want:   http.Cookie{Name: "session", Secure: true, SameSite: http.SameSiteNoneMode},
+		},
+		{
+			name:     "SameSite=None adds Secure",
+			sameSite: []string{"session=none"},
+			cookie:   http.Cookie{Name: "session", SameSite: http.SameSiteLaxMode},
+			want:     http.Cookie{Name: "session", Secure: true, SameSite: http.SameSiteNoneMode},
+		},
+		{
+			name:   "SameSite=None stripped as told",
+			secure: []string{"session=strip"},
+			cookie: http.Cookie{Name: "session", Secure: true, SameSite: http.SameSiteNoneMode},
+			want:   http.Cookie{Name: "session", SameSite: http.SameSiteNoneMode},
+		},
+	}
+	for _, test := range tests {
+		policy, err := newCookiePolicy(test.secure, test.httpOnly, test.domain, test.sameSite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cookie := test.cookie
+		policy.apply(&cookie, test.host)
+		if cookie.String() != test.want.String() || cookie.Secure != test.want.Secure {
+			t.Errorf("%s: %s, want %s", test.name, cookie.String(), test.want.String())
+		}
+	}
+
+	if _, err := newCookiePolicy(nil, nil, nil, []string{"*=relaxed"}); err == nil {
+		t.Error("an invalid SameSite action is accepted")
+	}
+}
+
+func TestCookiePath(t *testing.T) {
+	upstream, _ := url.Parse("https://upstream.example.com/base/")
+	rw := &urlRewriter{mountPath: "/app/"}
+	for path, rewritten := range map[string]string{
+		"/base/":       "/app/",
+		"/base":        "/app/",
+		"/base/admin":  "/app/admin",
+		"/":            "/app/",
+		"/basement":    "/app/",
+		"/other/admin": "/app/",
+	} {
+		if got := rw.cookiePath(path, upstream); got != rewritten {
+			t.Errorf("cookiePath(%q) = %q, want %q", path, got, rewritten)
+		}
+	}
+}
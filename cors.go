@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// corsPolicy is the Cross-Origin Resource Sharing policy the proxy enforces
+// in place of the upstream, for the single page applications in development
+// calling the upstream API from another origin.
+type corsPolicy struct {
+	origins          []string
+	methods          string
+	headers          string
+	exposeHeaders    string
+	allowCredentials bool
+	maxAge           time.Duration
+}
+
+func (c *corsPolicy) allowedOrigin(origin string) bool {
+	for _, allowed := range c.origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// setHeaders sets the CORS headers of the response to a request from origin,
+// replacing the ones of the upstream.
+func (c *corsPolicy) setHeaders(header http.Header, origin string) {
+	for name := range header {
+		if strings.HasPrefix(name, "Access-Control-") {
+			header.Del(name)
+		}
+	}
+	if c.allowCredentials || len(c.origins) != 1 || c.origins[0] != "*" {
+		// Credentials can't be allowed with the * wildcard.
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Add("Vary", "Origin")
+	} else {
+		header.Set("Access-Control-Allow-Origin", "*")
+	}
+	if c.allowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if c.exposeHeaders != "" {
+		header.Set("Access-Control-Expose-Headers", c.exposeHeaders)
+	}
+}
+
+// corsHandler answers the preflight requests locally and adds the CORS
+// headers to the responses to the allowed origins.
+func corsHandler(next http.Handler, c *corsPolicy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !c.allowedOrigin(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			header := w.Header()
+			c.setHeaders(header, origin)
+			header.Set("Access-Control-Allow-Methods", c.methods)
+			if c.headers != "" {
+				header.Set("Access-Control-Allow-Headers", c.headers)
+			} else if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+				header.Set("Access-Control-Allow-Headers", requested)
+				header.Add("Vary", "Access-Control-Request-Headers")
+			}
+			if c.maxAge > 0 {
+				header.Set("Access-Control-Max-Age", fmt.Sprint(int64(c.maxAge/time.Second)))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(&corsWriter{ResponseWriter: w, policy: c, origin: origin}, r)
+	})
+}
+
+// corsWriter sets the CORS headers when the response headers are sent.
+type corsWriter struct {
+	http.ResponseWriter
+	policy      *corsPolicy
+	origin      string
+	wroteHeader bool
+}
+
+func (w *corsWriter) WriteHeader(status int) {
+	if !w.wroteHeader && status >= http.StatusOK {
+		w.wroteHeader = true
+		w.policy.setHeaders(w.Header(), w.origin)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *corsWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *corsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamCredential is an application-level credential sent to upstreams
+// that require one on top of the client certificate: a bearer token or
+// basic credentials (user:password), read from a file or printed by a
+// command, and read again every refresh interval so that they can be
+// rotated without restarting the proxy.
+type upstreamCredential struct {
+	scheme  string
+	file    string
+	command string
+	refresh time.Duration
+
+	mu      sync.Mutex
+	value   string
+	fetched time.Time
+}
+
+func (c *upstreamCredential) fetch() (string, error) {
+	var output []byte
+	var err error
+	if c.command != "" {
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.Command("cmd", "/C", c.command)
+		} else {
+			cmd = exec.Command("sh", "-c", c.command)
+		}
+		cmd.Stderr = os.Stderr
+		output, err = cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("upstream credential command failed: %v", err)
+		}
+	} else {
+		output, err = os.ReadFile(c.file)
+		if err != nil {
+			return "", fmt.Errorf("cannot read the upstream credential: %v", err)
+		}
+	}
+	credential := strings.TrimSpace(string(output))
+	if credential == "" {
+		return "", fmt.Errorf("the upstream credential is empty")
+	}
+	if c.scheme == "Basic" {
+		if !strings.Contains(credential, ":") {
+			return "", fmt.Errorf("the upstream basic credentials must be user:password")
+		}
+		credential = base64.StdEncoding.EncodeToString([]byte(credential))
+	}
+	return c.scheme + " " + credential, nil
+}
+
+// header returns the value of the Authorization header, fetching the
+// credential again if it is older than the refresh interval. If that fails,
+// the previous one keeps being used.
+func (c *upstreamCredential) header() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.value == "" || (c.refresh > 0 && time.Since(c.fetched) > c.refresh) {
+		value, err := c.fetch()
+		if err != nil {
+			if c.value == "" {
+				return "", err
+			}
+			timedLog(fmt.Sprintf("Keeping the previous upstream credential: %v", err))
+		} else {
+			c.value = value
+		}
+		c.fetched = time.Now()
+	}
+	return c.value, nil
+}
+
+// credentialTransport sets the Authorization header of the requests to the
+// upstream credential.
+type credentialTransport struct {
+	next       http.RoundTripper
+	credential *upstreamCredential
+}
+
+func (t *credentialTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	value, err := t.credential.header()
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", value)
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// parseDistinguishedName parses a subject like "CN=name,O=organization,C=IT".
+// A comma can be escaped with a backslash.
+func parseDistinguishedName(value string) (pkix.Name, error) {
+	var name pkix.Name
+	var parts []string
+	var current strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] == '\\' && i+1 < len(value):
+			i++
+			current.WriteByte(value[i])
+		case value[i] == ',':
+			parts = append(parts, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(value[i])
+		}
+	}
+	parts = append(parts, current.String())
+
+	for _, part := range parts {
+		key, attribute, ok := strings.Cut(part, "=")
+		key = strings.TrimSpace(key)
+		attribute = strings.TrimSpace(attribute)
+		if !ok || attribute == "" {
+			return name, fmt.Errorf("invalid subject attribute %q, expected KEY=value", part)
+		}
+		switch strings.ToUpper(key) {
+		case "CN":
+			name.CommonName = attribute
+		case "O":
+			name.Organization = append(name.Organization, attribute)
+		case "OU":
+			name.OrganizationalUnit = append(name.OrganizationalUnit, attribute)
+		case "C":
+			name.Country = append(name.Country, attribute)
+		case "ST":
+			name.Province = append(name.Province, attribute)
+		case "L":
+			name.Locality = append(name.Locality, attribute)
+		case "STREET":
+			name.StreetAddress = append(name.StreetAddress, attribute)
+		case "POSTALCODE":
+			name.PostalCode = append(name.PostalCode, attribute)
+		case "SERIALNUMBER":
+			name.SerialNumber = attribute
+		default:
+			return name, fmt.Errorf("unsupported subject attribute %q, use CN, O, OU, C, ST, L, STREET, POSTALCODE or SERIALNUMBER", key)
+		}
+	}
+	return name, nil
+}
+
+// addSubjectAltName adds the name to the request as an IP address, an email
+// address, a URI or a DNS name, depending on how it looks.
+func addSubjectAltName(template *x509.CertificateRequest, name string) error {
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = append(template.IPAddresses, ip)
+		return nil
+	}
+	if strings.Contains(name, "://") {
+		uri, err := url.Parse(name)
+		if err != nil {
+			return fmt.Errorf("invalid URI %q: %v", name, err)
+		}
+		template.URIs = append(template.URIs, uri)
+		return nil
+	}
+	if strings.Contains(name, "@") {
+		template.EmailAddresses = append(template.EmailAddresses, name)
+		return nil
+	}
+	template.DNSNames = append(template.DNSNames, name)
+	return nil
+}
+
+// runGenCSR prints the request of gen-csr, for the key of csr-key-label or of
+// the certificate at certificate-index.
+func runGenCSR(c *config) error {
+	pinVal, err := c.tokenPin()
+	if err != nil {
+		return err
+	}
+	return genCSR(&c.pkcs11path, &c.tokenSerial, pinVal, c.certificateIndex, c.csrKeyLabel, c.csrSubject, c.csrAltNames)
+}
+
+// genCSR prints a PKCS#10 certificate request signed with a private key of the
+// token, the one of the certificate at the index or the one with the label if
+// given, to renew the certificate or to get one for a new key. By default the
+// request copies the subject and the alternative names of the certificate.
+func genCSR(pkcs11path, tokenSerial *string, pinVal string, index int, keyLabel, subject string, altNames []string) error {
+	context, err := configureToken(*pkcs11path, *tokenSerial, pinVal, 0)
+	if err != nil {
+		return err
+	}
+	template := &x509.CertificateRequest{}
+	var signer crypto.Signer
+	if keyLabel != "" {
+		key, err := context.FindKeyPair(nil, []byte(keyLabel))
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			return fmt.Errorf("no key pair with label %q on the token", keyLabel)
+		}
+		signer = key
+	} else {
+		cert, err := pairedCertificate(context, index)
+		if err != nil {
+			return err
+		}
+		leaf := cert.Leaf
+		signer = cert.PrivateKey.(crypto.Signer)
+		template.Subject = leaf.Subject
+		template.DNSNames = leaf.DNSNames
+		template.EmailAddresses = leaf.EmailAddresses
+		template.IPAddresses = leaf.IPAddresses
+		template.URIs = leaf.URIs
+	}
+
+	if subject != "" {
+		if template.Subject, err = parseDistinguishedName(subject); err != nil {
+			return err
+		}
+	}
+	if len(altNames) > 0 {
+		template.DNSNames, template.EmailAddresses, template.IPAddresses, template.URIs = nil, nil, nil, nil
+		for _, name := range altNames {
+			if err := addSubjectAltName(template, name); err != nil {
+				return err
+			}
+		}
+	}
+	if template.Subject.CommonName == "" && len(template.DNSNames)+len(template.EmailAddresses)+len(template.IPAddresses)+len(template.URIs) == 0 {
+		return fmt.Errorf("the request needs a subject or alternative names, set them with -csr-subject and -csr-san")
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, signer)
+	if err != nil {
+		return err
+	}
+	return pem.Encode(os.Stdout, &pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
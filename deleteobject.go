@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+var objectClasses = map[string][]uint{
+	"certificate": {pkcs11.CKO_CERTIFICATE},
+	"key":         {pkcs11.CKO_PRIVATE_KEY, pkcs11.CKO_PUBLIC_KEY},
+	"all":         {pkcs11.CKO_CERTIFICATE, pkcs11.CKO_PRIVATE_KEY, pkcs11.CKO_PUBLIC_KEY},
+}
+
+var objectClassNames = map[uint]string{
+	pkcs11.CKO_CERTIFICATE: "certificate",
+	pkcs11.CKO_PRIVATE_KEY: "private key",
+	pkcs11.CKO_PUBLIC_KEY:  "public key",
+}
+
+type tokenObject struct {
+	handle pkcs11.ObjectHandle
+	class  uint
+	label  string
+	id     []byte
+	cert   *x509.Certificate
+}
+
+func (o tokenObject) String() string {
+	description := fmt.Sprintf("%s %q with ID %X", objectClassNames[o.class], o.label, o.id)
+	if o.cert != nil {
+		description += fmt.Sprintf(": %v, valid until %s", o.cert.Subject, o.cert.NotAfter.Format(time.DateOnly))
+		if time.Now().After(o.cert.NotAfter) {
+			description += " (expired)"
+		}
+	}
+	return description
+}
+
+// runDeleteObject deletes the objects of object-type with object-label and
+// object-id.
+func runDeleteObject(c *config) error {
+	pinVal, err := c.tokenPin()
+	if err != nil {
+		return err
+	}
+	return deleteObjects(c.pkcs11path, c.tokenSerial, pinVal, c.objectType, c.objectLabel, c.objectID, c.dryRun, c.assumeYes)
+}
+
+// deleteObjects destroys the objects of the token of the type with the label
+// and the ID, after listing them and asking for confirmation unless
+// assumeYes. Deleting a private key can't be undone, so only certificates are
+// deleted unless the type says otherwise.
+func deleteObjects(pkcs11path, tokenSerial, pinVal, objectType, label, hexID string, dryRun, assumeYes bool) error {
+	classes, ok := objectClasses[objectType]
+	if !ok {
+		return fmt.Errorf("invalid object type %q, use certificate, key or all", objectType)
+	}
+	if label == "" && hexID == "" {
+		return errors.New("delete-object requires -object-label or -object-id")
+	}
+	var id []byte
+	if hexID != "" {
+		var err error
+		if id, err = hex.DecodeString(strings.ReplaceAll(hexID, ":", "")); err != nil {
+			return fmt.Errorf("invalid object ID %q: %v", hexID, err)
+		}
+	}
+
+	ctx, slot, err := openToken(pkcs11path, tokenSerial)
+	if err != nil {
+		return err
+	}
+	defer ctx.Destroy()
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return err
+	}
+	defer ctx.CloseSession(session)
+	if err := ctx.Login(session, pkcs11.CKU_USER, pinVal); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+		return err
+	}
+	defer ctx.Logout(session)
+
+	var objects []tokenObject
+	for _, class := range classes {
+		template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, class)}
+		if label != "" {
+			template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, label))
+		}
+		if id != nil {
+			template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, id))
+		}
+		found, err := findObjects(ctx, session, template)
+		if err != nil {
+			return err
+		}
+		for _, handle := range found {
+			objects = append(objects, describeObject(ctx, session, handle, class))
+		}
+	}
+	if len(objects) == 0 {
+		fmt.Printf("No %s matches\n", objectType)
+		return nil
+	}
+	for _, object := range objects {
+		fmt.Printf("  %v\n", object)
+	}
+	if dryRun {
+		fmt.Printf("Dry run: %d objects would be deleted\n", len(objects))
+		return nil
+	}
+	if !assumeYes {
+		fmt.Printf("Delete these %d objects from the token? This cannot be undone. [y/N] ", len(objects))
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			fmt.Println("Nothing deleted")
+			return nil
+		}
+	}
+	for _, object := range objects {
+		if err := ctx.DestroyObject(session, object.handle); err != nil {
+			return fmt.Errorf("cannot delete the %v: %v", object, err)
+		}
+		fmt.Printf("Deleted the %s %q\n", objectClassNames[object.class], object.label)
+	}
+	fmt.Println("Run list-certificates to check the certificate indexes, which may have changed")
+	return nil
+}
+
+func findObjects(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, template []*pkcs11.Attribute) ([]pkcs11.ObjectHandle, error) {
+	if err := ctx.FindObjectsInit(session, template); err != nil {
+		return nil, err
+	}
+	var handles []pkcs11.ObjectHandle
+	for {
+		found, _, err := ctx.FindObjects(session, 64)
+		if err != nil {
+			ctx.FindObjectsFinal(session)
+			return nil, err
+		}
+		if len(found) == 0 {
+			break
+		}
+		handles = append(handles, found...)
+	}
+	return handles, ctx.FindObjectsFinal(session)
+}
+
+func describeObject(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, handle pkcs11.ObjectHandle, class uint) tokenObject {
+	object := tokenObject{handle: handle, class: class}
+	template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil), pkcs11.NewAttribute(pkcs11.CKA_ID, nil)}
+	if class == pkcs11.CKO_CERTIFICATE {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil))
+	}
+	attributes, err := ctx.GetAttributeValue(session, handle, template)
+	if err != nil {
+		return object
+	}
+	for _, attribute := range attributes {
+		switch attribute.Type {
+		case pkcs11.CKA_LABEL:
+			object.label = string(attribute.Value)
+		case pkcs11.CKA_ID:
+			object.id = attribute.Value
+		case pkcs11.CKA_VALUE:
+			object.cert, _ = x509.ParseCertificate(attribute.Value)
+		}
+	}
+	return object
+}
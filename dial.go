@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// upstreamProxy returns the function selecting the HTTP proxy to reach the
+// upstream with: the given proxy URL or, if empty, the one configured in the
+// HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables.
+func upstreamProxy(proxyURL string) (func(*http.Request) (*url.URL, error), error) {
+	if proxyURL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	parsed, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy URL: %v", err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported upstream proxy scheme %q", parsed.Scheme)
+	}
+	return http.ProxyURL(parsed), nil
+}
+
+// dialUpstream opens a connection to the upstream address, tunneling through
+// the configured HTTP proxy if any. It is used by the transports that don't
+// support proxies on their own.
+func (o upstreamOptions) dialUpstream(ctx context.Context, network, addr, scheme string) (net.Conn, error) {
+	if o.proxy != nil {
+		proxyURL, err := o.proxy(&http.Request{URL: &url.URL{Scheme: scheme, Host: addr}})
+		if err != nil {
+			return nil, err
+		}
+		if proxyURL != nil {
+			return o.dialConnect(ctx, proxyURL, addr)
+		}
+	}
+	return o.dialContext(ctx, network, addr)
+}
+
+func (o upstreamOptions) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	addrs, err := o.resolveAddr(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, addr := range addrs {
+		conn, err := o.dialAddr(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (o upstreamOptions) dialAddr(ctx context.Context, network, addr string) (net.Conn, error) {
+	if o.socks5 != nil {
+		return o.socks5.DialContext(ctx, network, addr)
+	}
+	return o.netDialer().DialContext(ctx, network, addr)
+}
+
+// netDialer returns the dialer for direct connections, bound to the configured
+// source address and interface.
+func (o upstreamOptions) netDialer() *net.Dialer {
+	dialer := &net.Dialer{Control: o.bindControl, Timeout: o.dialTimeout}
+	if o.sourceIP != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: o.sourceIP}
+	}
+	return dialer
+}
+
+// resolveAddr returns the addresses to try to reach addr on, in order. Unless
+// an override, a custom resolver or an address family preference applies,
+// addr is returned as is and left to be resolved when dialing.
+func (o upstreamOptions) resolveAddr(ctx context.Context, addr string) ([]string, error) {
+	addr = o.resolveOverride(addr)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return []string{addr}, nil
+	}
+	resolver := o.resolver
+	if resolver == nil {
+		if o.ipFamily == "" || o.ipFamily == "auto" {
+			return []string{addr}, nil
+		}
+		resolver = systemResolver{}
+	}
+	ips, _, err := resolver.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips = orderByFamily(ips, o.ipFamily)
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no %s address found for %s", strings.TrimSuffix(o.ipFamily, "-only"), host)
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	return addrs, nil
+}
+
+// orderByFamily filters or reorders the addresses according to the address
+// family preference: auto, prefer-ipv4, prefer-ipv6, ipv4-only or ipv6-only.
+func orderByFamily(ips []net.IP, family string) []net.IP {
+	var ipv4, ipv6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			ipv4 = append(ipv4, ip)
+		} else {
+			ipv6 = append(ipv6, ip)
+		}
+	}
+	switch family {
+	case "prefer-ipv4":
+		return append(ipv4, ipv6...)
+	case "prefer-ipv6":
+		return append(ipv6, ipv4...)
+	case "ipv4-only":
+		return ipv4
+	case "ipv6-only":
+		return ipv6
+	}
+	return ips
+}
+
+// resolveOverride replaces the host of addr with the IP set with -resolve, if any.
+func (o upstreamOptions) resolveOverride(addr string) string {
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		if ip, ok := o.resolve[strings.ToLower(host)]; ok {
+			return net.JoinHostPort(ip, port)
+		}
+	}
+	return addr
+}
+
+// parseResolveOverrides parses host:ip entries into a map from host name to
+// address.
+func parseResolveOverrides(entries []string) (map[string]string, error) {
+	overrides := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		host, ip, found := strings.Cut(entry, ":")
+		if !found || host == "" || net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("invalid resolve entry %q, expected host:ip", entry)
+		}
+		overrides[strings.ToLower(host)] = ip
+	}
+	return overrides, nil
+}
+
+// socks5Dialer parses a host:port[,user,password] SOCKS5 endpoint
+// specification.
+func socks5Dialer(spec string, forward proxy.Dialer) (proxy.ContextDialer, error) {
+	parts := strings.Split(spec, ",")
+	var auth *proxy.Auth
+	switch len(parts) {
+	case 1:
+	case 3:
+		auth = &proxy.Auth{User: parts[1], Password: parts[2]}
+	default:
+		return nil, fmt.Errorf("invalid SOCKS5 endpoint %q, expected host:port[,user,password]", spec)
+	}
+	if _, _, err := net.SplitHostPort(parts[0]); err != nil {
+		return nil, fmt.Errorf("invalid SOCKS5 endpoint %q: %v", spec, err)
+	}
+	dialer, err := proxy.SOCKS5("tcp", parts[0], auth, forward)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.(proxy.ContextDialer), nil
+}
+
+// dialConnect opens a tunnel to addr through the HTTP proxy with the CONNECT
+// method.
+func (o upstreamOptions) dialConnect(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		if proxyURL.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "443")
+		} else {
+			proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+		}
+	}
+	conn, err := o.dialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	connectReq := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		connectReq.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err := connectReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, connectReq)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy refused the tunnel: %s", resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// The proxy already sent bytes of the tunnel, read along with the
+		// response.
+		return &bufferedConn{Conn: conn, reader: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were read ahead in a reader.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
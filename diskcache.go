@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// diskStore keeps the bodies of the cached responses too large to be held in
+// memory in a directory, each next to a metadata file so that the cache
+// survives restarts. The SHA-256 digest of every body is checked while it is
+// served.
+type diskStore struct {
+	dir          string
+	maxSize      int64
+	maxEntrySize int64
+}
+
+// diskEntry is the metadata of a cached response stored on disk.
+type diskEntry struct {
+	Key     string            `json:"key"`
+	Status  int               `json:"status"`
+	Header  http.Header       `json:"header"`
+	Vary    map[string]string `json:"vary"`
+	Stored  time.Time         `json:"stored"`
+	Expires time.Time         `json:"expires"`
+	Size    int64             `json:"size"`
+	Digest  string            `json:"digest"`
+}
+
+func newDiskStore(dir string, maxSize, maxEntrySize int64) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create the cache directory: %v", err)
+	}
+	return &diskStore{dir: dir, maxSize: maxSize, maxEntrySize: maxEntrySize}, nil
+}
+
+// path returns the path of the files of the entry for key, without extension.
+func (d *diskStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:]))
+}
+
+// create opens a temporary file to write a response body to, while it is
+// being received.
+func (d *diskStore) create() (*os.File, error) {
+	return os.CreateTemp(d.dir, "*.tmp")
+}
+
+// commit moves the completely received body in place for the entry.
+func (d *diskStore) commit(tmp *os.File, entry *cacheEntry) error {
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), d.path(entry.key)+".body")
+}
+
+func (d *diskStore) writeMeta(entry *cacheEntry) error {
+	meta, err := json.Marshal(&diskEntry{
+		Key:     entry.key,
+		Status:  entry.status,
+		Header:  entry.header,
+		Vary:    entry.vary,
+		Stored:  entry.stored,
+		Expires: entry.expires,
+		Size:    entry.size,
+		Digest:  hex.EncodeToString(entry.digest),
+	})
+	if err != nil {
+		return err
+	}
+	tmp, err := d.create()
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(meta); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), d.path(entry.key)+".meta")
+}
+
+func (d *diskStore) remove(key string) {
+	path := d.path(key)
+	os.Remove(path + ".meta")
+	os.Remove(path + ".body")
+}
+
+// touch records the use of the entry, to evict the least recently used ones
+// first after a restart too.
+func (d *diskStore) touch(key string) {
+	now := time.Now()
+	os.Chtimes(d.path(key)+".meta", now, now)
+}
+
+// open returns the body of the entry, failing at the end of it if it doesn't
+// match the stored digest.
+func (d *diskStore) open(entry *cacheEntry) (*verifyingReader, error) {
+	file, err := os.Open(d.path(entry.key) + ".body")
+	if err != nil {
+		return nil, err
+	}
+	if info, err := file.Stat(); err != nil || info.Size() != entry.size {
+		file.Close()
+		return nil, fmt.Errorf("cached body of %s has the wrong size", entry.key)
+	}
+	return &verifyingReader{file: file, hash: sha256.New(), entry: entry}, nil
+}
+
+// load returns the entries found in the directory, least recently used
+// first, discarding the incomplete ones.
+func (d *diskStore) load() ([]*cacheEntry, error) {
+	files, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*cacheEntry
+	used := make(map[*cacheEntry]time.Time)
+	for _, file := range files {
+		name := filepath.Join(d.dir, file.Name())
+		if strings.HasSuffix(name, ".tmp") {
+			os.Remove(name)
+			continue
+		}
+		if !strings.HasSuffix(name, ".meta") {
+			continue
+		}
+		entry, err := d.loadEntry(name)
+		if err != nil {
+			timedLog(fmt.Sprintf("Discarding cached response %s: %v", file.Name(), err))
+			os.Remove(name)
+			os.Remove(strings.TrimSuffix(name, ".meta") + ".body")
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		used[entry] = info.ModTime()
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return used[entries[i]].Before(used[entries[j]])
+	})
+	return entries, nil
+}
+
+func (d *diskStore) loadEntry(name string) (*cacheEntry, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var meta diskEntry
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	digest, err := hex.DecodeString(meta.Digest)
+	if err != nil || len(digest) != sha256.Size {
+		return nil, errors.New("invalid digest")
+	}
+	if d.path(meta.Key)+".meta" != name {
+		return nil, errors.New("key doesn't match the file name")
+	}
+	info, err := os.Stat(strings.TrimSuffix(name, ".meta") + ".body")
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() != meta.Size {
+		return nil, errors.New("body has the wrong size")
+	}
+	if meta.Header == nil {
+		meta.Header = make(http.Header)
+	}
+	return &cacheEntry{
+		key:     meta.Key,
+		status:  meta.Status,
+		header:  meta.Header,
+		vary:    meta.Vary,
+		stored:  meta.Stored,
+		expires: meta.Expires,
+		onDisk:  true,
+		size:    meta.Size,
+		digest:  digest,
+	}, nil
+}
+
+// verifyingReader reads a body stored on disk, checking its digest at the
+// end so that a corrupted file is never served as a complete response.
+type verifyingReader struct {
+	file      *os.File
+	hash      hash.Hash
+	entry     *cacheEntry
+	corrupted func()
+	err       error
+}
+
+var errCorruptedCache = errors.New("cached response body is corrupted")
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.file.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(r.hash.Sum(nil), r.entry.digest) {
+		r.err = errCorruptedCache
+		if r.corrupted != nil {
+			r.corrupted()
+		}
+		return n, r.err
+	}
+	return n, err
+}
+
+func (r *verifyingReader) Close() error {
+	return r.file.Close()
+}
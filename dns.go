@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// upstreamResolver resolves the host name of the upstream. The returned TTL is
+// zero when unknown.
+type upstreamResolver interface {
+	lookup(ctx context.Context, host string) ([]net.IP, time.Duration, error)
+}
+
+// systemResolver uses the resolver of the operating system, which doesn't
+// report TTLs.
+type systemResolver struct{}
+
+func (systemResolver) lookup(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, 0, nil
+}
+
+// dnsResolver queries the given DNS servers, or a DNS-over-HTTPS endpoint,
+// instead of the system resolver.
+type dnsResolver struct {
+	servers []string
+	dohURL  string
+	client  *http.Client
+}
+
+func newDNSResolver(servers []string, dohURL string) (*dnsResolver, error) {
+	resolver := &dnsResolver{dohURL: dohURL, client: &http.Client{Timeout: 10 * time.Second}}
+	for _, server := range servers {
+		if net.ParseIP(server) != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return nil, fmt.Errorf("invalid DNS server %q: %v", server, err)
+		}
+		resolver.servers = append(resolver.servers, server)
+	}
+	return resolver, nil
+}
+
+func (r *dnsResolver) lookup(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	var ips []net.IP
+	var ttl time.Duration
+	var lastErr error
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		found, foundTTL, err := r.query(ctx, host, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(found) > 0 && (ttl == 0 || foundTTL < ttl) {
+			ttl = foundTTL
+		}
+		ips = append(ips, found...)
+	}
+	if len(ips) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no addresses found for %s", host)
+		}
+		return nil, 0, lastErr
+	}
+	return ips, ttl, nil
+}
+
+func (r *dnsResolver) query(ctx context.Context, host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	if r.dohURL != "" {
+		// RFC 8484 recommends an ID of 0 to make responses cacheable.
+		query.Header.ID = 0
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	raw, err := r.exchange(ctx, packed)
+	if err != nil {
+		return nil, 0, err
+	}
+	var response dnsmessage.Message
+	if err := response.Unpack(raw); err != nil {
+		return nil, 0, err
+	}
+	if response.Header.ID != query.Header.ID {
+		return nil, 0, errors.New("mismatched DNS response ID")
+	}
+	if response.Header.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("DNS lookup of %s failed: %v", host, response.Header.RCode)
+	}
+	var ips []net.IP
+	var ttl uint32
+	for _, answer := range response.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		default:
+			continue
+		}
+		if ttl == 0 || answer.Header.TTL < ttl {
+			ttl = answer.Header.TTL
+		}
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// exchange sends the packed query to the configured servers in turn and
+// returns the first packed response.
+func (r *dnsResolver) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if r.dohURL != "" {
+		return r.exchangeDoH(ctx, query)
+	}
+	var lastErr error
+	for _, server := range r.servers {
+		response, err := exchangeUDP(ctx, server, query)
+		if err == nil && len(response) > 2 && response[2]&0x02 != 0 {
+			// Truncated, retry over TCP
+			response, err = exchangeTCP(ctx, server, query)
+		}
+		if err == nil {
+			return response, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (r *dnsResolver) exchangeDoH(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.dohURL, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS-over-HTTPS request failed: %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+func exchangeUDP(ctx context.Context, server string, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(dnsDeadline(ctx))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	response := make([]byte, 65535)
+	n, err := conn.Read(response)
+	if err != nil {
+		return nil, err
+	}
+	return response[:n], nil
+}
+
+func exchangeTCP(ctx context.Context, server string, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(dnsDeadline(ctx))
+	message := append([]byte{byte(len(query) >> 8), byte(len(query))}, query...)
+	if _, err := conn.Write(message); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	response := make([]byte, int(length[0])<<8|int(length[1]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func dnsDeadline(ctx context.Context) time.Time {
+	if deadline, ok := ctx.Deadline(); ok {
+		return deadline
+	}
+	return time.Now().Add(5 * time.Second)
+}
+
+// cachingResolver caches the lookups of another resolver, clamping their TTL
+// between minTTL and maxTTL. With staleOnError, expired entries are still
+// used when the lookup fails.
+type cachingResolver struct {
+	next         upstreamResolver
+	minTTL       time.Duration
+	maxTTL       time.Duration
+	staleOnError bool
+
+	mu      sync.Mutex
+	entries map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+func newCachingResolver(next upstreamResolver, minTTL, maxTTL time.Duration, staleOnError bool) *cachingResolver {
+	return &cachingResolver{
+		next:         next,
+		minTTL:       minTTL,
+		maxTTL:       maxTTL,
+		staleOnError: staleOnError,
+		entries:      make(map[string]dnsCacheEntry),
+	}
+}
+
+func (r *cachingResolver) lookup(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	r.mu.Lock()
+	entry, cached := r.entries[host]
+	r.mu.Unlock()
+	if cached && time.Now().Before(entry.expires) {
+		return entry.ips, time.Until(entry.expires), nil
+	}
+
+	ips, ttl, err := r.next.lookup(ctx, host)
+	if err != nil {
+		if cached && r.staleOnError {
+			timedLog(fmt.Sprintf("DNS lookup of %s failed, using stale addresses: %v", host, err))
+			return entry.ips, 0, nil
+		}
+		return nil, 0, err
+	}
+	if ttl < r.minTTL {
+		ttl = r.minTTL
+	}
+	if r.maxTTL > 0 && ttl > r.maxTTL {
+		ttl = r.maxTTL
+	}
+	r.mu.Lock()
+	r.entries[host] = dnsCacheEntry{ips: ips, expires: time.Now().Add(ttl)}
+	r.mu.Unlock()
+	return ips, ttl, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+)
+
+// errorPageData is what the error page templates are executed with.
+type errorPageData struct {
+	Status     int
+	StatusText string
+	Message    string
+	RequestID  string
+}
+
+// executor is a parsed html/template or text/template template.
+type executor interface {
+	Execute(w io.Writer, data any) error
+}
+
+var defaultErrorPage = htmltemplate.Must(htmltemplate.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.StatusText}}</h1>
+<p>{{.Message}}</p>
+{{if .RequestID}}<p><small>Request ID: {{.RequestID}}</small></p>{{end}}
+</body>
+</html>
+`))
+
+// errorPages are the pages served for the errors of the proxy, read from a
+// directory with a template per status and format, like 502.html or
+// 503.json, and maintenance.html or maintenance.json for the maintenance
+// mode. The missing ones are replaced with built-in pages.
+type errorPages struct {
+	templates map[string]executor
+}
+
+func loadErrorPages(dir string) (*errorPages, error) {
+	pages := &errorPages{templates: make(map[string]executor)}
+	if dir == "" {
+		return pages, nil
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		name := filepath.Base(file)
+		var template executor
+		switch filepath.Ext(name) {
+		case ".html":
+			template, err = htmltemplate.ParseFiles(file)
+		case ".json":
+			template, err = texttemplate.ParseFiles(file)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		pages.templates[name] = template
+	}
+	return pages, nil
+}
+
+// prefersJSON tells whether the client asks for JSON rather than HTML, like
+// API clients do.
+func prefersJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "json") && !strings.Contains(accept, "text/html")
+}
+
+// write replies to the request with the page for the status, named name
+// in the directory.
+func (p *errorPages) write(w http.ResponseWriter, r *http.Request, name string, status int, message string) {
+	data := errorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    message,
+		RequestID:  r.Header.Get("X-Request-Id"),
+	}
+	format := "html"
+	if prefersJSON(r) {
+		format = "json"
+	}
+	var body bytes.Buffer
+	if template, ok := p.templates[name+"."+format]; ok {
+		if err := template.Execute(&body, data); err != nil {
+			timedLog("Cannot render the error page " + name + "." + format + ": " + err.Error())
+			body.Reset()
+		}
+	}
+	if body.Len() == 0 {
+		if format == "json" {
+			json.NewEncoder(&body).Encode(map[string]any{"status": status, "error": data.StatusText, "message": message, "request_id": data.RequestID})
+		} else {
+			defaultErrorPage.Execute(&body, data)
+		}
+	}
+	header := w.Header()
+	if format == "json" {
+		header.Set("Content-Type", "application/json")
+	} else {
+		header.Set("Content-Type", "text/html; charset=utf-8")
+	}
+	header.Set("Cache-Control", "no-store")
+	if data.RequestID != "" {
+		header.Set("X-Request-Id", data.RequestID)
+	}
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
+
+// ensureRequestID gives the request an X-Request-Id header, forwarded to the
+// upstream and shown on the error pages, unless the client sent one.
+func ensureRequestID(r *http.Request) {
+	if r.Header.Get("X-Request-Id") != "" {
+		return
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	r.Header.Set("X-Request-Id", hex.EncodeToString(id))
+}
+
+// maintenanceHandler answers all the requests with the maintenance page
+// while the file exists, for example while the token or the upstream is
+// being serviced.
+func maintenanceHandler(next http.Handler, file string, pages *errorPages) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := os.Stat(file); err == nil {
+			ensureRequestID(r)
+			w.Header().Set("Retry-After", "300")
+			pages.write(w, r, "maintenance", http.StatusServiceUnavailable, "The service is under maintenance, please try again later.")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
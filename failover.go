@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/thales-e-security/pool"
+)
+
+// tokenIdentity is the client certificate of one of the tokens of
+// failoverIdentity, with the slots of the token its key signs with.
+type tokenIdentity struct {
+	serial string
+	cert   tls.Certificate
+	slots  *signatureSlots
+}
+
+// failoverIdentity presents to the upstream the certificate of the first
+// working token of a prioritized list, like a primary card and a backup one
+// in a second reader. A token is given up when it fails to sign or when it
+// is removed, and is not used again until the proxy restarts: its sessions
+// do not survive the removal.
+type failoverIdentity struct {
+	identities []tokenIdentity
+	// present checks that the token of the serial is still there.
+	present func(serial string) error
+
+	mu      sync.Mutex
+	current int
+}
+
+// newFailoverIdentity wraps in place the keys of the identities, in order of
+// priority, to switch to the next one when they fail to sign.
+func newFailoverIdentity(pkcs11path string, identities []tokenIdentity) *failoverIdentity {
+	present := func(serial string) error {
+		ctx, _, err := openToken(pkcs11path, serial)
+		if err != nil {
+			return err
+		}
+		ctx.Destroy()
+		return nil
+	}
+	f := &failoverIdentity{identities: identities, present: present}
+	for i := range f.identities {
+		f.identities[i].cert.PrivateKey = &failoverSigner{Signer: f.identities[i].cert.PrivateKey.(crypto.Signer), identity: f, index: i}
+	}
+	return f
+}
+
+// backupIdentity opens a backup token like the one of the config, and returns
+// its certificate at the index, restricting the TLS parameters to what it
+// supports too.
+func backupIdentity(config crypto11.Config, serial string, index int, tlsConfig *tls.Config, rsaPSS string) (tokenIdentity, error) {
+	config.TokenSerial = serial
+	context, err := crypto11.Configure(&config)
+	if err != nil {
+		return tokenIdentity{}, err
+	}
+	cert, err := pairedCertificate(context, index)
+	if err != nil {
+		context.Close()
+		return tokenIdentity{}, err
+	}
+	capabilities, err := probeToken(context, config.Path, serial, cert.PrivateKey)
+	if err != nil {
+		timedLog(fmt.Sprintf("Unable to probe the capabilities of the backup token %s, TLS parameters will not be adjusted: %v", serial, err))
+	}
+	gateTLSFeatures(&cert, tlsConfig, capabilities, rsaPSS)
+	timedLog(fmt.Sprintf("Backup token %s presents %v", serial, cert.Leaf.Subject))
+	return tokenIdentity{serial: serial, cert: cert}, nil
+}
+
+func (f *failoverIdentity) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &f.identities[f.current].cert, nil
+}
+
+// fail switches to the token after the one at the index, if it is still the
+// current one.
+func (f *failoverIdentity) fail(index int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if index != f.current {
+		return
+	}
+	if f.current == len(f.identities)-1 {
+		timedLog(fmt.Sprintf("Token %s failed: %v. No backup token left", f.identities[index].serial, err))
+		return
+	}
+	f.current++
+	tokenFailovers.Inc()
+	timedLog(fmt.Sprintf("Token %s failed: %v. Switching to the backup token %s, presenting %v", f.identities[index].serial, err, f.identities[f.current].serial, f.identities[f.current].cert.Leaf.Subject))
+}
+
+// monitor checks every interval that the current token is still present, to
+// switch to the backup before a handshake fails.
+func (f *failoverIdentity) monitor(interval time.Duration) {
+	for range time.Tick(interval) {
+		f.mu.Lock()
+		index := f.current
+		f.mu.Unlock()
+		if err := f.present(f.identities[index].serial); err != nil {
+			f.fail(index, err)
+		}
+	}
+}
+
+// failoverSigner reports the failures of a token to its failoverIdentity.
+type failoverSigner struct {
+	crypto.Signer
+	identity *failoverIdentity
+	index    int
+}
+
+func (s *failoverSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	signature, err := s.Signer.Sign(rand, digest, opts)
+	// An exhausted session pool is a busy token, not a failing one.
+	if err != nil && !errors.Is(err, pool.ErrTimeout) {
+		s.identity.fail(s.index, err)
+	}
+	return signature, err
+}
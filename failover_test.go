@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thales-e-security/pool"
+)
+
+// failingSigner is a key whose token fails with err, if set.
+type failingSigner struct {
+	crypto.Signer
+	err error
+}
+
+func (s *failingSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.Signer.Sign(rand, digest, opts)
+}
+
+// testIdentities returns the identities of in-memory tokens, with the serials,
+// and their keys.
+func testIdentities(t *testing.T, serials ...string) ([]tokenIdentity, []*failingSigner) {
+	t.Helper()
+	var identities []tokenIdentity
+	var keys []*failingSigner
+	for _, serial := range serials {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert := testCertificate(t, key, serial)
+		signer := &failingSigner{Signer: key}
+		cert.PrivateKey = signer
+		identities = append(identities, tokenIdentity{serial: serial, cert: cert})
+		keys = append(keys, signer)
+	}
+	return identities, keys
+}
+
+// currentToken returns the serial of the token presented by the identity.
+func currentToken(t *testing.T, f *failoverIdentity) string {
+	t.Helper()
+	cert, err := f.getClientCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestFailoverIdentity(t *testing.T) {
+	identities, keys := testIdentities(t, "primary", "backup")
+	f := newFailoverIdentity("", identities)
+	digest := sha256.Sum256([]byte("handshake"))
+	sign := func(index int) error {
+		_, err := f.identities[index].cert.PrivateKey.(crypto.Signer).Sign(rand.Reader, digest[:], crypto.SHA256)
+		return err
+	}
+
+	if err := sign(0); err != nil || currentToken(t, f) != "primary" {
+		t.Fatalf("signature of the primary token: %v, presenting %s", err, currentToken(t, f))
+	}
+	// A busy token is not a failing one.
+	keys[0].err = fmt.Errorf("no session: %w", pool.ErrTimeout)
+	if err := sign(0); !errors.Is(err, pool.ErrTimeout) || currentToken(t, f) != "primary" {
+		t.Errorf("exhausted session pool: %v, presenting %s", err, currentToken(t, f))
+	}
+	keys[0].err = errors.New("CKR_DEVICE_REMOVED")
+	if err := sign(0); err == nil || currentToken(t, f) != "backup" {
+		t.Errorf("failed primary token: %v, presenting %s", err, currentToken(t, f))
+	}
+	if err := sign(1); err != nil {
+		t.Errorf("signature of the backup token: %v", err)
+	}
+
+	// The handshakes in flight on the primary token fail too, without
+	// moving past the backup; and a recovered primary is not used again,
+	// as its sessions are lost.
+	if err := sign(0); err == nil || currentToken(t, f) != "backup" {
+		t.Errorf("late failure of the primary token: %v, presenting %s", err, currentToken(t, f))
+	}
+	keys[0].err = nil
+	if sign(0); currentToken(t, f) != "backup" {
+		t.Errorf("recovered primary token: presenting %s", currentToken(t, f))
+	}
+	// With no backup left, the last token stays.
+	keys[1].err = errors.New("CKR_DEVICE_ERROR")
+	if err := sign(1); err == nil || currentToken(t, f) != "backup" {
+		t.Errorf("failed backup token: %v, presenting %s", err, currentToken(t, f))
+	}
+}
+
+func TestFailoverMonitor(t *testing.T) {
+	identities, _ := testIdentities(t, "primary", "backup", "spare")
+	f := newFailoverIdentity("", identities)
+	var mu sync.Mutex
+	removed := map[string]bool{}
+	f.present = func(serial string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if removed[serial] {
+			return fmt.Errorf("no token with serial %s", serial)
+		}
+		return nil
+	}
+	remove := func(serial string, want string) {
+		t.Helper()
+		mu.Lock()
+		removed[serial] = true
+		mu.Unlock()
+		for deadline := time.Now().Add(5 * time.Second); currentToken(t, f) != want; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("without %s, presenting %s instead of %s", serial, currentToken(t, f), want)
+			}
+		}
+	}
+	go f.monitor(time.Millisecond)
+
+	time.Sleep(10 * time.Millisecond)
+	if currentToken(t, f) != "primary" {
+		t.Fatalf("presenting %s with all the tokens present", currentToken(t, f))
+	}
+	// Removing a backup token does not matter until it is the current one.
+	remove("spare", "primary")
+	time.Sleep(10 * time.Millisecond)
+	if currentToken(t, f) != "primary" {
+		t.Errorf("presenting %s without a backup token", currentToken(t, f))
+	}
+	remove("primary", "backup")
+	remove("backup", "spare")
+	// The removed tokens coming back are not used again.
+	mu.Lock()
+	removed = map[string]bool{}
+	mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	if currentToken(t, f) != "spare" {
+		t.Errorf("presenting %s once the tokens are back", currentToken(t, f))
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// forwardedHeaders controls the X-Forwarded-For, X-Forwarded-Host,
+// X-Forwarded-Proto and, optionally, Forwarded (RFC 7239) headers telling the
+// upstream about the client. In append mode, the values set by the proxies in
+// front of this one are kept if they come from a trusted proxy, or from any
+// client if no trusted proxy is configured. In overwrite mode only this hop
+// is described, and in none mode the headers are removed.
+type forwardedHeaders struct {
+	mode      string
+	forwarded bool
+	trusted   []netip.Prefix
+}
+
+func newForwardedHeaders(mode string, forwarded bool, trustedProxies []string) (*forwardedHeaders, error) {
+	trusted, err := parsePrefixes(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return &forwardedHeaders{mode: mode, forwarded: forwarded, trusted: trusted}, nil
+}
+
+func (f *forwardedHeaders) trustedClient(r *http.Request) bool {
+	if len(f.trusted) == 0 {
+		return true
+	}
+	addr, ok := parseClientAddr(clientIP(r))
+	if !ok {
+		return false
+	}
+	for _, prefix := range f.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply sets the headers on the request from the client. It must be called
+// before the Host of the request is changed for the upstream. The client
+// address is appended to X-Forwarded-For by the reverse proxy itself.
+func (f *forwardedHeaders) apply(r *http.Request) {
+	if f.mode != "append" || !f.trustedClient(r) {
+		for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "Forwarded"} {
+			r.Header.Del(name)
+		}
+	}
+	if f.mode == "none" {
+		// A nil value keeps the reverse proxy from adding the header.
+		r.Header["X-Forwarded-For"] = nil
+		return
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	if r.Header.Get("X-Forwarded-Host") == "" {
+		r.Header.Set("X-Forwarded-Host", r.Host)
+	}
+	if r.Header.Get("X-Forwarded-Proto") == "" {
+		r.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if f.forwarded {
+		element := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedNode(clientIP(r)), quoteForwarded(r.Host), proto)
+		if previous := strings.Join(r.Header.Values("Forwarded"), ", "); previous != "" {
+			element = previous + ", " + element
+		}
+		r.Header.Set("Forwarded", element)
+	}
+}
+
+// forwardedNode formats an address for the Forwarded header, where IPv6
+// addresses are bracketed and quoted.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+func quoteForwarded(value string) string {
+	if strings.ContainsAny(value, ":[]\",;= ") {
+		return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+	}
+	return value
+}
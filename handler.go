@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// proxyErrorHandler replies to the client when the upstream could not be
+// reached, telling why, with the error pages if configured.
+func proxyErrorHandler(breaker *circuitBreaker, pages *errorPages) func(http.ResponseWriter, *http.Request, error) {
+	reply := func(w http.ResponseWriter, r *http.Request, status int, message string) {
+		if pages != nil {
+			pages.write(w, r, strconv.Itoa(status), status, message)
+		} else {
+			http.Error(w, message, status)
+		}
+	}
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		if breaker != nil && errors.Is(err, errCircuitOpen) {
+			w.Header().Set("Retry-After", strconv.Itoa(breaker.retryAfter()))
+			reply(w, r, http.StatusServiceUnavailable, "The upstream is failing, please try again later.")
+			return
+		}
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		failure := classifyUpstreamError(err)
+		log.Printf("http: proxy error (%s): %v", failure.kind, err)
+		upstreamErrors.WithLabelValues(failure.kind).Inc()
+		w.Header().Set("X-Proxy-Error", failure.kind)
+		reply(w, r, failure.status, failure.message)
+	}
+}
+
+// maxBodyHandler rejects with 413 the requests with a body larger than max
+// bytes: right away if they declare their length, or as soon as they exceed
+// it otherwise.
+func maxBodyHandler(next http.Handler, max int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > max {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = http.MaxBytesReader(w, r.Body, max)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withTimeout returns a copy of the request whose context is canceled after
+// the given timeout.
+func withTimeout(r *http.Request, timeout time.Duration) (*http.Request, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return r.WithContext(ctx), cancel
+}
+
+// clientIP returns the IP address of the client sending the request.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type clientHostKey struct{}
+
+// clientRequest is what the client sent the request to, before it is changed
+// for the upstream.
+type clientRequest struct {
+	scheme string
+	host   string
+	path   string
+}
+
+// withClientHost records the host, scheme and path the client sent the
+// request to, for the rewriting of the response.
+func withClientHost(r *http.Request) *http.Request {
+	client := clientRequest{scheme: "http", host: r.Host, path: r.URL.Path}
+	if r.TLS != nil {
+		client.scheme = "https"
+	}
+	return r.WithContext(context.WithValue(r.Context(), clientHostKey{}, client))
+}
+
+// clientHost returns the host the client sent the request to, as recorded by
+// withClientHost.
+func clientHost(r *http.Request) string {
+	client, _ := r.Context().Value(clientHostKey{}).(clientRequest)
+	return client.host
+}
+
+// clientOrigin returns the scheme and host the client sent the request to,
+// like http://127.0.0.1:8080.
+func clientOrigin(r *http.Request) string {
+	client, _ := r.Context().Value(clientHostKey{}).(clientRequest)
+	return client.scheme + "://" + client.host
+}
+
+// clientPath returns the path the client requested, as recorded by
+// withClientHost.
+func clientPath(r *http.Request) string {
+	client, _ := r.Context().Value(clientHostKey{}).(clientRequest)
+	return client.path
+}
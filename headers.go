@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// requestHeaderRules are the changes made to the request headers before
+// forwarding them to the upstream: the removed headers are deleted first,
+// then the set ones replace any value sent by the client.
+type requestHeaderRules struct {
+	set    http.Header
+	remove []string
+}
+
+func newRequestHeaderRules(set, remove []string) (*requestHeaderRules, error) {
+	rules := &requestHeaderRules{}
+	var err error
+	if rules.set, err = parseHeaders("request", set); err != nil {
+		return nil, err
+	}
+	for _, name := range remove {
+		rules.remove = append(rules.remove, http.CanonicalHeaderKey(strings.TrimSpace(name)))
+	}
+	return rules, nil
+}
+
+// parseHeaders parses "Name: value" entries.
+func parseHeaders(kind string, entries []string) (http.Header, error) {
+	header := make(http.Header)
+	for _, entry := range entries {
+		name, value, found := strings.Cut(entry, ":")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid %s header %q, expected \"Name: value\"", kind, entry)
+		}
+		header.Add(name, strings.TrimSpace(value))
+	}
+	return header, nil
+}
+
+// readHeadersFile reads the "Name: value" lines of a file, skipping the empty
+// ones and the comments starting with #.
+func readHeadersFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			entries = append(entries, line)
+		}
+	}
+	return entries, nil
+}
+
+func (rules *requestHeaderRules) apply(r *http.Request) {
+	for _, name := range rules.remove {
+		r.Header.Del(name)
+	}
+	for name, values := range rules.set {
+		if name == "Host" {
+			r.Host = values[0]
+			continue
+		}
+		r.Header[name] = values
+	}
+}
+
+// headerPolicy filters the headers passing through the proxy in one
+// direction, so that internal headers never leak: the headers matching a
+// strip pattern are removed and, if there are allow patterns, only the
+// headers matching one of them are kept. Patterns are case-insensitive and
+// can contain wildcards, e.g. X-Internal-*.
+type headerPolicy struct {
+	allow []string
+	strip []string
+}
+
+func newHeaderPolicy(allow, strip []string) (*headerPolicy, error) {
+	policy := &headerPolicy{}
+	for _, list := range []struct {
+		patterns []string
+		dest     *[]string
+	}{{allow, &policy.allow}, {strip, &policy.strip}} {
+		for _, pattern := range list.patterns {
+			pattern = strings.ToLower(strings.TrimSpace(pattern))
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid header pattern %q", pattern)
+			}
+			*list.dest = append(*list.dest, pattern)
+		}
+	}
+	return policy, nil
+}
+
+func matchesHeader(name string, patterns []string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *headerPolicy) apply(header http.Header) {
+	for name := range header {
+		if matchesHeader(name, p.strip) || (len(p.allow) > 0 && !matchesHeader(name, p.allow)) {
+			header.Del(name)
+		}
+	}
+}
+
+// hopByHopHeaders are the headers meaningful only for a single connection,
+// which a proxy must not forward (RFC 9110, section 7.6.1).
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers, including the ones
+// listed in the Connection header.
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// addVia appends the proxy to the Via header, with the version of the
+// protocol the message was received with.
+func addVia(header http.Header, protoMajor, protoMinor int, pseudonym string) {
+	version := fmt.Sprintf("%d.%d", protoMajor, protoMinor)
+	if protoMajor >= 2 {
+		version = fmt.Sprint(protoMajor)
+	}
+	via := version + " " + pseudonym
+	if previous := strings.Join(header.Values("Via"), ", "); previous != "" {
+		via = previous + ", " + via
+	}
+	header.Set("Via", via)
+}
+
+// cacheControlRule overrides the Cache-Control header of the responses to
+// the requests for the paths matching pattern.
+type cacheControlRule struct {
+	pattern string
+	value   string
+}
+
+// parseCacheControlRules parses pattern=value entries. A pattern ending with
+// a slash matches the paths under it, a pattern without slashes the last
+// segment of the path, like *.css, and any other pattern the whole path, with
+// the wildcards of path.Match.
+func parseCacheControlRules(entries []string) ([]cacheControlRule, error) {
+	rules := make([]cacheControlRule, 0, len(entries))
+	for _, entry := range entries {
+		pattern, value, found := strings.Cut(entry, "=")
+		pattern = strings.TrimSpace(pattern)
+		if _, err := path.Match(pattern, ""); !found || pattern == "" || err != nil {
+			return nil, fmt.Errorf("invalid Cache-Control override %q, expected pattern=value", entry)
+		}
+		rules = append(rules, cacheControlRule{pattern: pattern, value: strings.TrimSpace(value)})
+	}
+	return rules, nil
+}
+
+func (rule cacheControlRule) matches(requestPath string) bool {
+	if strings.HasSuffix(rule.pattern, "/") {
+		return strings.HasPrefix(requestPath, rule.pattern)
+	}
+	if !strings.Contains(rule.pattern, "/") {
+		requestPath = path.Base(requestPath)
+	}
+	matched, _ := path.Match(rule.pattern, requestPath)
+	return matched
+}
+
+// overrideCacheControl applies the first rule matching the path to the
+// headers of the response, replacing the caching headers of the upstream.
+func overrideCacheControl(header http.Header, requestPath string, rules []cacheControlRule) {
+	for _, rule := range rules {
+		if rule.matches(requestPath) {
+			header.Del("Expires")
+			header.Del("Pragma")
+			header.Set("Cache-Control", rule.value)
+			return
+		}
+	}
+}
+
+// headerRedactor formats the headers for the logs, hiding the values of the
+// ones carrying credentials unless they are to be logged in clear.
+type headerRedactor struct {
+	sensitive map[string]bool
+	clear     bool
+}
+
+func newHeaderRedactor(extra []string, clear bool) *headerRedactor {
+	h := &headerRedactor{sensitive: map[string]bool{
+		"Authorization":       true,
+		"Proxy-Authorization": true,
+		"Cookie":              true,
+		"Set-Cookie":          true,
+	}, clear: clear}
+	for _, name := range extra {
+		h.sensitive[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+	}
+	return h
+}
+
+// format returns the headers one per line, sorted by name. The scheme of the
+// authorization headers is kept.
+func (h *headerRedactor) format(header http.Header) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		for _, value := range header[name] {
+			if h.sensitive[http.CanonicalHeaderKey(name)] && !h.clear {
+				scheme, _, found := strings.Cut(value, " ")
+				if value = "[redacted]"; found && strings.HasSuffix(name, "Authorization") {
+					value = scheme + " [redacted]"
+				}
+			}
+			fmt.Fprintf(&b, "\n    %s: %s", name, value)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// healthChecker actively probes the upstreams, marking them as healthy or
+// not. The kind of check is tcp (connect), tls (full handshake with the
+// client certificate) or http (a HEAD request answered without a 5xx status).
+type healthChecker struct {
+	kind      string
+	path      string
+	interval  time.Duration
+	timeout   time.Duration
+	transport http.RoundTripper
+	tlsConfig *tls.Config
+	options   upstreamOptions
+}
+
+func (c *healthChecker) run(u *upstream) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		err := c.check(ctx, u)
+		cancel()
+		healthy := err == nil
+		if u.healthy.Swap(healthy) != healthy {
+			if healthy {
+				timedLog(fmt.Sprintf("Upstream %s is healthy again", u.url))
+			} else {
+				timedLog(fmt.Sprintf("Upstream %s is unhealthy: %v", u.url, err))
+			}
+		}
+		if healthy {
+			upstreamHealthy.WithLabelValues(u.url.String()).Set(1)
+		} else {
+			upstreamHealthy.WithLabelValues(u.url.String()).Set(0)
+		}
+		time.Sleep(c.interval)
+	}
+}
+
+func (c *healthChecker) check(ctx context.Context, u *upstream) error {
+	if c.kind == "http" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.url.JoinPath(c.path).String(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := c.transport.RoundTrip(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("health check returned %s", resp.Status)
+		}
+		return nil
+	}
+
+	port := u.url.Port()
+	if port == "" {
+		port = "443"
+		if u.url.Scheme == "http" {
+			port = "80"
+		}
+	}
+	conn, err := c.options.dialContext(ctx, "tcp", net.JoinHostPort(u.url.Hostname(), port))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if c.kind != "tls" || u.url.Scheme != "https" {
+		return nil
+	}
+	config := c.tlsConfig.Clone()
+	config.ServerName = u.url.Hostname()
+	tlsConn := tls.Client(conn, config)
+	start := time.Now()
+	err = tlsConn.HandshakeContext(ctx)
+	observeHandshake(time.Since(start), tlsConn.ConnectionState().DidResume, err)
+	return err
+}
+
+// upstreamsHandler serves the state of the upstreams on the admin API.
+func upstreamsHandler(b *balancer) http.HandlerFunc {
+	type upstreamState struct {
+		URL      string `json:"url"`
+		Backup   bool   `json:"backup"`
+		Weight   int    `json:"weight"`
+		Healthy  bool   `json:"healthy"`
+		InFlight int64  `json:"in_flight"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		states := make([]upstreamState, 0, len(b.upstreams))
+		for _, u := range b.upstreams {
+			states = append(states, upstreamState{
+				URL:      u.url.String(),
+				Backup:   u.backup,
+				Weight:   u.weight,
+				Healthy:  u.healthy.Load(),
+				InFlight: u.inFlight.Load(),
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		responseBody, _ := json.Marshal(states)
+		w.Write(responseBody)
+	}
+}
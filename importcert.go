@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ThalesIgnite/crypto11"
+)
+
+// readCertificates reads the certificates of a PEM file, or a single DER
+// encoded certificate.
+func readCertificates(file string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		cert, err := x509.ParseCertificate(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s is neither a PEM file nor a DER certificate: %v", file, err)
+		}
+		return []*x509.Certificate{cert}, nil
+	}
+	var certificates []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate in %s: %v", file, err)
+		}
+		certificates = append(certificates, cert)
+	}
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("no certificate found in %s", file)
+	}
+	return certificates, nil
+}
+
+// runImportCert writes the certificates of the file argument of import-cert
+// onto the token.
+func runImportCert(c *config) error {
+	pinVal, err := c.tokenPin()
+	if err != nil {
+		return err
+	}
+	return importCertificate(&c.pkcs11path, &c.tokenSerial, pinVal, c.args[0], c.importCertLabel)
+}
+
+// importCertificate writes the first certificate of the file onto the token
+// with the ID of the private key it was issued for, which pairs them, and the
+// label of the key unless one is given. The other certificates of the file,
+// like the intermediate CAs, are written too, so that show-certificate finds
+// the chain.
+func importCertificate(pkcs11path, tokenSerial *string, pinVal, file, label string) error {
+	certificates, err := readCertificates(file)
+	if err != nil {
+		return err
+	}
+	context, err := configureToken(*pkcs11path, *tokenSerial, pinVal, 0)
+	if err != nil {
+		return err
+	}
+	existing, err := tokenCertificates(*pkcs11path, *tokenSerial)
+	if err != nil {
+		return err
+	}
+
+	leaf := certificates[0]
+	keys, err := context.FindAllKeyPairs()
+	if err != nil {
+		return err
+	}
+	var key crypto11.Signer
+	for _, candidate := range keys {
+		if publicKeyEqual(candidate.Public(), leaf.PublicKey) {
+			key = candidate
+			break
+		}
+	}
+	if key == nil {
+		return fmt.Errorf("no private key of the token matches the public key of %v", leaf.Subject)
+	}
+	attributes, err := context.GetAttributes(key, []crypto11.AttributeType{crypto11.CkaId, crypto11.CkaLabel})
+	if err != nil {
+		return err
+	}
+	id := attributes[crypto11.CkaId].Value
+	if label == "" && attributes[crypto11.CkaLabel] != nil {
+		label = string(attributes[crypto11.CkaLabel].Value)
+	}
+	if label == "" {
+		label = leaf.Subject.CommonName
+	}
+
+	if containsCertificate(existing, leaf) {
+		return fmt.Errorf("%v is already on the token", leaf.Subject)
+	}
+	if err := context.ImportCertificateWithLabel(id, []byte(label), leaf); err != nil {
+		return fmt.Errorf("cannot write %v on the token: %v", leaf.Subject, err)
+	}
+	fmt.Printf("Imported %v with the label %q, paired with the private key with ID %X\n", leaf.Subject, label, id)
+	for _, cert := range existing {
+		if publicKeyEqual(cert.PublicKey, leaf.PublicKey) {
+			fmt.Printf("Warning: %v, valid until %s, is paired with the same key: the proxy may keep using it until it's deleted from the token with delete-object\n", cert.Subject, cert.NotAfter.Format(time.DateOnly))
+		}
+	}
+
+	for _, cert := range certificates[1:] {
+		if containsCertificate(existing, cert) {
+			continue
+		}
+		// Like the key identifier of the CA, which the certificates it issued
+		// carry as authority key identifier.
+		caID := cert.SubjectKeyId
+		if len(caID) == 0 {
+			digest := sha1.Sum(cert.RawSubjectPublicKeyInfo)
+			caID = digest[:]
+		}
+		if err := context.ImportCertificateWithLabel(caID, []byte(cert.Subject.CommonName), cert); err != nil {
+			return fmt.Errorf("cannot write %v on the token: %v", cert.Subject, err)
+		}
+		fmt.Printf("Imported the chain certificate %v\n", cert.Subject)
+	}
+
+	paired, err := context.FindAllPairedCertificates()
+	if err != nil {
+		return err
+	}
+	for index, cert := range paired {
+		if cert.Leaf.Equal(leaf) {
+			fmt.Printf("Use it with -certificate-index %d\n", index)
+			return nil
+		}
+	}
+	fmt.Printf("Warning: the token pairs the key with another certificate, delete it from the token with delete-object to use the new one\n")
+	return nil
+}
+
+func publicKeyEqual(a, b crypto.PublicKey) bool {
+	key, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(b)
+}
+
+func containsCertificate(certificates []*x509.Certificate, cert *x509.Certificate) bool {
+	for _, candidate := range certificates {
+		if candidate.Equal(cert) {
+			return true
+		}
+	}
+	return false
+}
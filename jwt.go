@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	jwtPath          = "/.pkcs11-web-proxy/jwt"
+	jwksPath         = "/.pkcs11-web-proxy/jwks"
+	maxJWTClaimsSize = 64 << 10
+)
+
+// jwtSigner signs the claims posted by the local applications with a key of
+// the token, making the proxy a hardware-backed token service.
+type jwtSigner struct {
+	signer   crypto.Signer
+	cert     *x509.Certificate
+	alg      string
+	hash     crypto.Hash
+	keyID    string
+	apiKey   []byte
+	issuer   string
+	lifetime time.Duration
+}
+
+func newJWTSigner(cert tls.Certificate, apiKey []byte, issuer string, lifetime time.Duration) (*jwtSigner, error) {
+	if len(apiKey) == 0 {
+		return nil, errors.New("the JWT API key is empty")
+	}
+	s := &jwtSigner{signer: cert.PrivateKey.(crypto.Signer), cert: cert.Leaf, apiKey: apiKey, issuer: issuer, lifetime: lifetime}
+	switch key := cert.Leaf.PublicKey.(type) {
+	case *rsa.PublicKey:
+		s.alg, s.hash = "RS256", crypto.SHA256
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			s.alg, s.hash = "ES256", crypto.SHA256
+		case elliptic.P384():
+			s.alg, s.hash = "ES384", crypto.SHA384
+		case elliptic.P521():
+			s.alg, s.hash = "ES512", crypto.SHA512
+		default:
+			return nil, fmt.Errorf("unsupported curve %s for JWT signatures", key.Curve.Params().Name)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key %s for JWT signatures", describePublicKey(cert.Leaf.PublicKey))
+	}
+	// The thumbprint of the certificate, like its x5t#S256 header.
+	fingerprint := sha256.Sum256(cert.Leaf.Raw)
+	s.keyID = base64.RawURLEncoding.EncodeToString(fingerprint[:])
+	return s, nil
+}
+
+// sign returns the compact JWS of the claims, adding the issued at and
+// expiration times unless given, and the issuer if configured.
+func (s *jwtSigner) sign(claims map[string]interface{}) (string, error) {
+	now := time.Now()
+	if _, ok := claims["iat"]; !ok {
+		claims["iat"] = now.Unix()
+	}
+	if _, ok := claims["exp"]; !ok && s.lifetime > 0 {
+		claims["exp"] = now.Add(s.lifetime).Unix()
+	}
+	if s.issuer != "" {
+		claims["iss"] = s.issuer
+	}
+	header, err := json.Marshal(map[string]string{"alg": s.alg, "typ": "JWT", "kid": s.keyID, "x5t#S256": s.keyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	h := s.hash.New()
+	h.Write([]byte(signingInput))
+	signature, err := s.signer.Sign(rand.Reader, h.Sum(nil), s.hash)
+	if err != nil {
+		return "", err
+	}
+	if key, ok := s.cert.PublicKey.(*ecdsa.PublicKey); ok {
+		if signature, err = jwsECDSASignature(signature, key.Curve); err != nil {
+			return "", err
+		}
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// jwsECDSASignature converts an ASN.1 ECDSA signature to the fixed size R||S
+// encoding of JWS.
+func jwsECDSASignature(signature []byte, curve elliptic.Curve) ([]byte, error) {
+	var sig struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(signature, &sig); err != nil {
+		return nil, fmt.Errorf("invalid ECDSA signature: %v", err)
+	}
+	size := (curve.Params().BitSize + 7) / 8
+	encoded := make([]byte, 2*size)
+	sig.R.FillBytes(encoded[:size])
+	sig.S.FillBytes(encoded[size:])
+	return encoded, nil
+}
+
+// authorizedBearer checks that the request has the API key as bearer token.
+func authorizedBearer(r *http.Request, apiKey []byte) bool {
+	key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(key), apiKey) == 1
+}
+
+func (s *jwtSigner) handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizedBearer(r, s.apiKey) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="pkcs11-web-proxy"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var claims map[string]interface{}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJWTClaimsSize))
+	decoder.UseNumber()
+	if err := decoder.Decode(&claims); err != nil || claims == nil {
+		http.Error(w, "The body must be a JSON object of claims", http.StatusBadRequest)
+		return
+	}
+	token, err := s.sign(claims)
+	if err != nil {
+		timedLog(fmt.Sprintf("Unable to sign a JWT for %s: %v", r.RemoteAddr, err))
+		http.Error(w, "Unable to sign the JWT", http.StatusInternalServerError)
+		return
+	}
+	timedLog(fmt.Sprintf("Signed a JWT for %s", r.RemoteAddr))
+	w.Header().Set("Content-Type", "application/jwt")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(token))
+}
+
+// jwksHandler serves the public key as a JSON Web Key Set, for the services
+// verifying the tokens.
+func (s *jwtSigner) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	jwk := map[string]interface{}{
+		"use": "sig",
+		"alg": s.alg,
+		"kid": s.keyID,
+		"x5c": []string{base64.StdEncoding.EncodeToString(s.cert.Raw)},
+	}
+	switch key := s.cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		jwk["kty"] = "RSA"
+		jwk["n"] = base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+		jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		jwk["kty"] = "EC"
+		jwk["crv"] = key.Curve.Params().Name
+		jwk["x"] = base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size)))
+		jwk["y"] = base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size)))
+	}
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	responseBody, _ := json.Marshal(map[string]interface{}{"keys": []interface{}{jwk}})
+	w.Write(responseBody)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// decodeJWS returns the decoded parts of a compact JWS.
+func decodeJWS(t *testing.T, token string) (map[string]interface{}, map[string]interface{}, []byte) {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("%d parts in %s", len(parts), token)
+	}
+	var header, claims map[string]interface{}
+	for i, v := range []*map[string]interface{}{&header, &claims} {
+		part, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoder := json.NewDecoder(bytes.NewReader(part))
+		decoder.UseNumber()
+		if err := decoder.Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header, claims, signature
+}
+
+// jwkPublicKey returns the public key of a JSON Web Key.
+func jwkPublicKey(t *testing.T, jwk map[string]string) crypto.PublicKey {
+	t.Helper()
+	decode := func(name string) *big.Int {
+		value, err := base64.RawURLEncoding.DecodeString(jwk[name])
+		if err != nil || len(value) == 0 {
+			t.Fatalf("JWK %s %q: %v", name, jwk[name], err)
+		}
+		return new(big.Int).SetBytes(value)
+	}
+	switch jwk["kty"] {
+	case "RSA":
+		return &rsa.PublicKey{N: decode("n"), E: int(decode("e").Int64())}
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[jwk["crv"]]
+		if !ok {
+			t.Fatalf("JWK curve %q", jwk["crv"])
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if x, _ := base64.RawURLEncoding.DecodeString(jwk["x"]); len(x) != size {
+			t.Errorf("JWK x of %d bytes, want %d", len(x), size)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: decode("x"), Y: decode("y")}
+	}
+	t.Fatalf("JWK type %q", jwk["kty"])
+	return nil
+}
+
+func TestJWTSigner(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		alg   string
+		curve elliptic.Curve
+	}{
+		{"RS256", nil},
+		{"ES256", elliptic.P256()},
+		{"ES384", elliptic.P384()},
+		{"ES512", elliptic.P521()},
+	}
+	for _, test := range tests {
+		var key crypto.Signer = rsaKey
+		if test.curve != nil {
+			if key, err = ecdsa.GenerateKey(test.curve, rand.Reader); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cert := testCertificate(t, key, "jwt")
+		signer, err := newJWTSigner(cert, []byte("api key"), "https://proxy.example.com", 5*time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := signer.sign(map[string]interface{}{"sub": "app", "iss": "https://forged.example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		header, claims, signature := decodeJWS(t, token)
+		if header["alg"] != test.alg || header["typ"] != "JWT" || header["kid"] != signer.keyID || header["x5t#S256"] != signer.keyID {
+			t.Errorf("%s: header %v", test.alg, header)
+		}
+		// The issuer of the proxy replaces the one of the application.
+		if claims["iss"] != "https://proxy.example.com" || claims["sub"] != "app" {
+			t.Errorf("%s: claims %v", test.alg, claims)
+		}
+		iat, _ := claims["iat"].(json.Number).Int64()
+		exp, _ := claims["exp"].(json.Number).Int64()
+		if now := time.Now().Unix(); iat < now-5 || iat > now || exp != iat+300 {
+			t.Errorf("%s: issued at %d, expiring at %d", test.alg, iat, exp)
+		}
+
+		signingInput := token[:strings.LastIndex(token, ".")]
+		h := signer.hash.New()
+		h.Write([]byte(signingInput))
+		digest := h.Sum(nil)
+		switch public := key.Public().(type) {
+		case *rsa.PublicKey:
+			if err := rsa.VerifyPKCS1v15(public, crypto.SHA256, digest, signature); err != nil {
+				t.Errorf("%s: %v", test.alg, err)
+			}
+		case *ecdsa.PublicKey:
+			// R||S, each of the size of the curve.
+			size := (public.Curve.Params().BitSize + 7) / 8
+			if len(signature) != 2*size {
+				t.Fatalf("%s: signature of %d bytes, want %d", test.alg, len(signature), 2*size)
+			}
+			r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+			if !ecdsa.Verify(public, digest, r, s) {
+				t.Errorf("%s: the signature does not verify", test.alg)
+			}
+		}
+
+		// The key set gives back the public key of the certificate.
+		recorder := httptest.NewRecorder()
+		signer.jwksHandler(recorder, httptest.NewRequest(http.MethodGet, jwksPath, nil))
+		var set struct {
+			Keys []map[string]interface{} `json:"keys"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &set); err != nil || len(set.Keys) != 1 || recorder.Header().Get("Content-Type") != "application/jwk-set+json" {
+			t.Fatalf("%s: key set %s: %v", test.alg, recorder.Body, err)
+		}
+		jwk := map[string]string{}
+		for name, value := range set.Keys[0] {
+			if value, ok := value.(string); ok {
+				jwk[name] = value
+			}
+		}
+		if jwk["alg"] != test.alg || jwk["kid"] != signer.keyID || jwk["use"] != "sig" {
+			t.Errorf("%s: JWK %v", test.alg, jwk)
+		}
+		if public := jwkPublicKey(t, jwk); !publicKeyEqual(public, key.Public()) {
+			t.Errorf("%s: the JWK is not the key of the certificate", test.alg)
+		}
+		if x5c, _ := set.Keys[0]["x5c"].([]interface{}); len(x5c) != 1 || x5c[0] != base64.StdEncoding.EncodeToString(cert.Leaf.Raw) {
+			t.Errorf("%s: x5c %v", test.alg, set.Keys[0]["x5c"])
+		}
+
+		// And a JOSE library verifies the tokens with it.
+		server := httptest.NewServer(http.HandlerFunc(signer.jwksHandler))
+		payload, err := oidc.NewRemoteKeySet(context.Background(), server.URL).VerifySignature(context.Background(), token)
+		server.Close()
+		if err != nil || !strings.Contains(string(payload), `"sub":"app"`) {
+			t.Errorf("%s: verified %s: %v", test.alg, payload, err)
+		}
+	}
+
+	// The times given by the application are kept.
+	signer, err := newJWTSigner(testCertificate(t, rsaKey, "jwt"), []byte("api key"), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := signer.sign(map[string]interface{}{"iat": json.Number("1700000000"), "exp": json.Number("1700000060"), "iss": "app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, claims, _ := decodeJWS(t, token); claims["iat"] != json.Number("1700000000") || claims["exp"] != json.Number("1700000060") || claims["iss"] != "app" {
+		t.Errorf("claims %v", claims)
+	}
+	if token, _ := signer.sign(map[string]interface{}{}); strings.Contains(token, "exp") {
+		t.Errorf("expiration without lifetime")
+	}
+}
+
+func TestNewJWTSigner(t *testing.T) {
+	p224Key, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, key := range map[string]crypto.Signer{"P-224": p224Key, "Ed25519": edKey} {
+		if _, err := newJWTSigner(testCertificate(t, key, "jwt"), []byte("api key"), "", 0); err == nil {
+			t.Errorf("a %s key is accepted", name)
+		}
+	}
+	if _, err := newJWTSigner(testCertificate(t, p224Key, "jwt"), nil, "", 0); err == nil {
+		t.Error("an empty API key is accepted")
+	}
+}
+
+func TestJWSECDSASignature(t *testing.T) {
+	// Small values are padded to the size of the curve.
+	der, err := asn1.Marshal(struct{ R, S *big.Int }{big.NewInt(1), big.NewInt(0x0203)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := jwsECDSASignature(der, elliptic.P256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, 64)
+	want[31], want[62], want[63] = 1, 2, 3
+	if !bytes.Equal(signature, want) {
+		t.Errorf("signature %x", signature)
+	}
+	if _, err := jwsECDSASignature([]byte("not DER"), elliptic.P256()); err == nil {
+		t.Error("an invalid signature is accepted")
+	}
+}
+
+func TestJWTHandler(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := newJWTSigner(testCertificate(t, key, "jwt"), []byte("api key"), "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, method, authorization, body string
+		status                            int
+	}{
+		{"signed", http.MethodPost, "Bearer api key", `{"sub":"app","n":12345678901234567890}`, http.StatusOK},
+		{"GET", http.MethodGet, "Bearer api key", "", http.StatusMethodNotAllowed},
+		{"no API key", http.MethodPost, "", `{}`, http.StatusUnauthorized},
+		{"wrong API key", http.MethodPost, "Bearer api keys", `{}`, http.StatusUnauthorized},
+		{"basic", http.MethodPost, "Basic api key", `{}`, http.StatusUnauthorized},
+		{"array", http.MethodPost, "Bearer api key", `["sub"]`, http.StatusBadRequest},
+		{"null", http.MethodPost, "Bearer api key", `null`, http.StatusBadRequest},
+		{"too large", http.MethodPost, "Bearer api key", `{"a":"` + strings.Repeat("a", maxJWTClaimsSize) + `"}`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, jwtPath, strings.NewReader(test.body))
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		recorder := httptest.NewRecorder()
+		signer.handler(recorder, r)
+		if recorder.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.name, recorder.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		if recorder.Header().Get("Content-Type") != "application/jwt" || recorder.Header().Get("Cache-Control") != "no-store" {
+			t.Errorf("%s: headers %v", test.name, recorder.Header())
+		}
+		// The numbers are signed as sent.
+		if _, claims, _ := decodeJWS(t, recorder.Body.String()); claims["n"] != json.Number("12345678901234567890") {
+			t.Errorf("%s: claims %v", test.name, claims)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+)
+
+const (
+	selfSignedValidity = 365 * 24 * time.Hour
+	selfSignedRenewal  = 30 * 24 * time.Hour
+)
+
+// listenerNames returns the host names and addresses the listener can be
+// reached at, for the certificate: the listen address, or the local host
+// names and addresses when listening on all of them, and localhost.
+func listenerNames(listenAddress string) []string {
+	names := []string{"localhost", "127.0.0.1", "::1"}
+	if ip := net.ParseIP(listenAddress); ip == nil || !ip.IsUnspecified() {
+		names = append(names, listenAddress)
+	} else {
+		if hostname, err := os.Hostname(); err == nil {
+			names = append(names, hostname)
+		}
+		if addrs, err := net.InterfaceAddrs(); err == nil {
+			for _, addr := range addrs {
+				if prefix, ok := addr.(*net.IPNet); ok && !prefix.IP.IsLinkLocalUnicast() {
+					names = append(names, prefix.IP.String())
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+	return slices.Compact(names)
+}
+
+// newCertificateTemplate returns a certificate for the names, split between
+// the DNS names and the IP addresses.
+func newCertificateTemplate(commonName string, names []string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	return template, nil
+}
+
+// encodeKeyPair returns the PEM encoding of a certificate and its key.
+func encodeKeyPair(der []byte, key *ecdsa.PrivateKey) ([]byte, []byte, error) {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// selfSignedCertificate returns a self-signed certificate for the names. With
+// a cache directory, the certificate is stored in it and reused across
+// restarts, so that the exception added to the browser keeps working, until
+// it is about to expire or the names change.
+func selfSignedCertificate(names []string, cacheDir string) (tls.Certificate, error) {
+	var certFile, keyFile string
+	if cacheDir != "" {
+		if err := os.MkdirAll(cacheDir, 0700); err != nil {
+			return tls.Certificate{}, fmt.Errorf("cannot create the certificate cache directory: %v", err)
+		}
+		certFile, keyFile = filepath.Join(cacheDir, "listener-cert.pem"), filepath.Join(cacheDir, "listener-key.pem")
+		if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+			if cert.Leaf == nil {
+				cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+			}
+			if cert.Leaf != nil && time.Until(cert.Leaf.NotAfter) > selfSignedRenewal && slices.Equal(certificateNames(cert.Leaf), names) {
+				return cert, nil
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			timedLog(fmt.Sprintf("Replacing the cached listener certificate: %v", err))
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template, err := newCertificateTemplate("pkcs11-web-proxy", names, selfSignedValidity)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	certPEM, keyPEM, err := encodeKeyPair(der, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if cacheDir != "" {
+		if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			return tls.Certificate{}, err
+		}
+		if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// certificateNames returns the sorted DNS names and IP addresses of a
+// certificate.
+func certificateNames(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	sort.Strings(names)
+	return names
+}
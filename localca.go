@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	localCAValidity = 10 * 365 * 24 * time.Hour
+	// Browsers reject the TLS certificates valid for longer than 825 days.
+	localCertificateValidity = 825 * 24 * time.Hour
+)
+
+// runGenLocalCA issues the listener certificate of gen-local-ca for the
+// names of the arguments, or for the listen address, from the local CA of
+// local-ca-dir.
+func runGenLocalCA(c *config) error {
+	dir := c.localCADir
+	if dir == "" {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return err
+		}
+		dir = filepath.Join(configDir, "pkcs11-web-proxy", "local-ca")
+	}
+	names := c.args
+	if len(names) == 0 {
+		names = listenerNames(c.listenAddress)
+	}
+	return genLocalCA(dir, names)
+}
+
+// genLocalCA issues a listener certificate for the names from a local CA kept
+// in dir, created the first time, and tells how to trust the CA on this
+// system. Once the CA is trusted, the certificates issued later for other
+// names are trusted too.
+func genLocalCA(dir string, names []string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	caCertFile, caKeyFile := filepath.Join(dir, "ca-cert.pem"), filepath.Join(dir, "ca-key.pem")
+	ca, err := tls.LoadX509KeyPair(caCertFile, caKeyFile)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if ca, err = createLocalCA(caCertFile, caKeyFile); err != nil {
+			return fmt.Errorf("cannot create the local CA: %v", err)
+		}
+		fmt.Printf("Created the local CA in %s\n", caCertFile)
+	case err != nil:
+		return fmt.Errorf("cannot load the local CA: %v", err)
+	default:
+		fmt.Printf("Using the local CA in %s\n", caCertFile)
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template, err := newCertificateTemplate(names[0], names, localCertificateValidity)
+	if err != nil {
+		return err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return err
+	}
+	certPEM, keyPEM, err := encodeKeyPair(der, key)
+	if err != nil {
+		return err
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("Issued a certificate for %s, valid until %s\n\n", strings.Join(names, ", "), template.NotAfter.Format("2006-01-02"))
+	fmt.Printf("Run the proxy with:\n\n  %s ... -listen-tls -listen-tls-cert %s -listen-tls-key %s\n\n", os.Args[0], certFile, keyFile)
+	fmt.Printf("and trust the local CA once, for instance with:\n\n%s\n", trustStoreHints(caCertFile))
+	fmt.Printf("Keep %s private: anyone reading it can impersonate any site to the browsers trusting the CA.\n", caKeyFile)
+	return nil
+}
+
+func createLocalCA(certFile, keyFile string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	commonName := "pkcs11-web-proxy local CA"
+	if hostname, err := os.Hostname(); err == nil {
+		commonName += " " + hostname
+	}
+	template, err := newCertificateTemplate(commonName, nil, localCAValidity)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template.IsCA = true
+	template.MaxPathLenZero = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	template.ExtKeyUsage = nil
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	certPEM, keyPEM, err := encodeKeyPair(der, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// trustStoreHints returns the commands adding the CA to the trust stores of
+// the system and of the browsers.
+func trustStoreHints(caCertFile string) string {
+	switch runtime.GOOS {
+	case "darwin":
+		return fmt.Sprintf("  sudo security add-trusted-cert -d -r trustRoot -k /Library/Keychains/System.keychain %s\n", caCertFile)
+	case "windows":
+		return fmt.Sprintf("  certutil -user -addstore Root %s\n", caCertFile)
+	}
+	return fmt.Sprintf(`  # Debian, Ubuntu
+  sudo cp %[1]s /usr/local/share/ca-certificates/pkcs11-web-proxy.crt && sudo update-ca-certificates
+  # Fedora, RHEL
+  sudo cp %[1]s /etc/pki/ca-trust/source/anchors/pkcs11-web-proxy.pem && sudo update-ca-trust
+  # Chromium and Chrome, which use their own store (certutil is in libnss3-tools or nss-tools)
+  certutil -d sql:$HOME/.pki/nssdb -A -t C,, -n pkcs11-web-proxy -i %[1]s
+  # Firefox: import it in Settings, Privacy & Security, View Certificates, Authorities
+`, caCertFile)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	fullHandshakes    atomic.Uint64
+	resumedHandshakes atomic.Uint64
+
+	tokenSignatures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pkcs11_web_proxy_token_signatures_total",
+		Help: "Signatures performed by the token, by result (ok, error, pool_exhausted or touch_timeout).",
+	}, []string{"result"})
+
+	tokenFailovers = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pkcs11_web_proxy_token_failovers_total",
+		Help: "Switches to a backup token after the current one failed or was removed.",
+	})
+
+	upstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pkcs11_web_proxy_upstream_errors_total",
+		Help: "Requests that failed to reach the upstream, by cause (token_signing_failed, client_certificate_rejected, tls_alert, upstream_certificate_unknown_ca, upstream_certificate_invalid, timeout, dns, connection_refused or error).",
+	}, []string{"kind"})
+
+	upstreamRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pkcs11_web_proxy_upstream_retries_total",
+		Help: "Requests to the upstream retried after a dropped connection or a 502/503 response.",
+	})
+
+	circuitBreakerOpen = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pkcs11_web_proxy_circuit_breaker_open",
+		Help: "Whether the circuit breaker is open (1) and requests to the upstream are being rejected.",
+	})
+
+	upstreamHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pkcs11_web_proxy_upstream_healthy",
+		Help: "Whether the upstream passes the health checks (1) or not (0).",
+	}, []string{"upstream"})
+
+	mirroredRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pkcs11_web_proxy_mirrored_requests_total",
+		Help: "Requests copied to the mirror URL, by result (ok, error or skipped).",
+	}, []string{"result"})
+
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pkcs11_web_proxy_cache_requests_total",
+		Help: "Requests looked up in the response cache, by result (hit, miss, revalidated or bypass).",
+	}, []string{"result"})
+
+	queuedRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pkcs11_web_proxy_queued_requests",
+		Help: "Requests waiting in the queue for the number of requests in flight to drop below the limit.",
+	})
+
+	rejectedRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pkcs11_web_proxy_rejected_requests_total",
+		Help: "Requests rejected with 503 because too many requests were in flight and the queue was full or they waited too long.",
+	})
+
+	tlsHandshakeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pkcs11_web_proxy_tls_handshake_duration_seconds",
+		Help:    "Duration of the successful TLS handshakes with the upstream, by type (full, requiring a signature from the token, or resumed).",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"type"})
+
+	tlsHandshakeFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pkcs11_web_proxy_tls_handshake_failures_total",
+		Help: "Failed TLS handshakes with the upstream, by cause (token_signing_failed, client_certificate_rejected, tls_alert, upstream_certificate_unknown_ca, upstream_certificate_invalid, timeout or error).",
+	}, []string{"cause"})
+
+	routeRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pkcs11_web_proxy_requests_total",
+		Help: "Requests served, by route (see -metrics-route, other for the unmatched paths), method and status code.",
+	}, []string{"route", "method", "code"})
+
+	routeRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pkcs11_web_proxy_request_duration_seconds",
+		Help:    "Time taken to serve the responses, until their body is sent, by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+
+	rateLimitedRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pkcs11_web_proxy_rate_limited_requests_total",
+		Help: "Requests rejected with 429 because the client exceeded the rate limit.",
+	})
+)
+
+func init() {
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "pkcs11_web_proxy_tls_full_handshakes_total",
+		Help: "Full TLS handshakes with the upstream, each requiring a signature from the token.",
+	}, func() float64 {
+		return float64(fullHandshakes.Load())
+	})
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "pkcs11_web_proxy_tls_resumed_handshakes_total",
+		Help: "TLS handshakes with the upstream that resumed a cached session.",
+	}, func() float64 {
+		return float64(resumedHandshakes.Load())
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "pkcs11_web_proxy_tls_resumption_hit_ratio",
+		Help: "Ratio of TLS handshakes with the upstream that resumed a cached session.",
+	}, func() float64 {
+		resumed := resumedHandshakes.Load()
+		total := resumed + fullHandshakes.Load()
+		if total == 0 {
+			return 0
+		}
+		return float64(resumed) / float64(total)
+	})
+}
+
+func recordHandshake(resumed bool) {
+	if resumed {
+		resumedHandshakes.Add(1)
+	} else {
+		fullHandshakes.Add(1)
+	}
+}
+
+// observeHandshake records the duration or the cause of the failure of a TLS
+// handshake with the upstream.
+func observeHandshake(duration time.Duration, resumed bool, err error) {
+	if err != nil {
+		tlsHandshakeFailures.WithLabelValues(classifyUpstreamError(err).kind).Inc()
+		return
+	}
+	handshakeType := "full"
+	if resumed {
+		handshakeType = "resumed"
+	}
+	tlsHandshakeDuration.WithLabelValues(handshakeType).Observe(duration.Seconds())
+}
+
+// metricsRoute is a group of paths of the upstream the metrics are tagged
+// with, matched like the paths of -allow-request.
+type metricsRoute struct {
+	name string
+	rule requestRule
+}
+
+const otherRoute = "other"
+
+// parseMetricsRoutes parses name=pattern entries, like api=/api/*.
+func parseMetricsRoutes(entries []string) ([]metricsRoute, error) {
+	routes := make([]metricsRoute, 0, len(entries))
+	for _, entry := range entries {
+		name, pattern, found := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		rules, err := parseRequestRules([]string{"* " + strings.TrimSpace(pattern)})
+		if !found || name == "" || name == otherRoute || err != nil {
+			return nil, fmt.Errorf("invalid metrics route %q, expected name=pattern", entry)
+		}
+		routes = append(routes, metricsRoute{name: name, rule: rules[0]})
+	}
+	return routes, nil
+}
+
+type routeKey struct{}
+
+// routeOf returns the name of the route of the request, for the logs.
+func routeOf(r *http.Request) string {
+	route, _ := r.Context().Value(routeKey{}).(string)
+	return route
+}
+
+// routeMetricsHandler counts the requests and measures their duration by
+// route, the first one matching the path, so that the slow or failing parts
+// of the upstream stand out.
+func routeMetricsHandler(next http.Handler, routes []metricsRoute, mountPath string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route := otherRoute
+		requestPath := upstreamPath(r, mountPath)
+		for _, candidate := range routes {
+			if candidate.rule.matches(r.Method, requestPath) {
+				route = candidate.name
+				break
+			}
+		}
+		if record := auditRecordOf(r); record != nil {
+			record.Route = route
+		}
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			status := recorder.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			routeRequests.WithLabelValues(route, metricsMethod(r.Method), strconv.Itoa(status)).Inc()
+			routeRequestDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+		}()
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), routeKey{}, route)))
+	})
+}
+
+// metricsMethod returns the method for the label, folding the unusual ones
+// so that the clients can't grow the number of series at will.
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "OTHER"
+}
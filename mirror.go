@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+// mirror sends a copy of the requests to a shadow upstream in the
+// background, discarding the responses. Requests with a body larger than
+// maxBody, protocol upgrades and requests arriving while concurrency copies
+// are already in flight are not mirrored, so that the users never wait for
+// the shadow upstream.
+type mirror struct {
+	target    *url.URL
+	director  func(*http.Request)
+	mountPath string
+	transport http.RoundTripper
+	maxBody   int64
+	timeout   time.Duration
+	slots     chan struct{}
+}
+
+func newMirror(target *url.URL, mountPath string, transport http.RoundTripper, maxBody int64, concurrency int, timeout time.Duration) *mirror {
+	return &mirror{
+		target:    target,
+		director:  httputil.NewSingleHostReverseProxy(target).Director,
+		mountPath: mountPath,
+		transport: transport,
+		maxBody:   maxBody,
+		timeout:   timeout,
+		slots:     make(chan struct{}, concurrency),
+	}
+}
+
+// send mirrors r, buffering its body so that it can still be forwarded to the
+// actual upstream.
+func (m *mirror) send(r *http.Request) {
+	if r.Header.Get("Upgrade") != "" {
+		return
+	}
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		buffered, err := io.ReadAll(io.LimitReader(r.Body, m.maxBody+1))
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(buffered), r.Body), r.Body}
+		if err != nil || int64(len(buffered)) > m.maxBody {
+			mirroredRequests.WithLabelValues("skipped").Inc()
+			return
+		}
+		body = buffered
+	}
+
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		mirroredRequests.WithLabelValues("skipped").Inc()
+		return
+	}
+
+	// The copy outlives the request it mirrors.
+	ctx, cancel := context.WithoutCancel(r.Context()), func() {}
+	if m.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, m.timeout)
+	}
+	out := r.Clone(ctx)
+	// Joined like the requests to the upstream, to send the same path and
+	// query.
+	m.director(out)
+	preserveRawPath(out, m.target, m.mountPath)
+	out.Host = m.target.Host
+	out.RequestURI = ""
+	out.Body = io.NopCloser(bytes.NewReader(body))
+	out.ContentLength = int64(len(body))
+	removeHopByHopHeaders(out.Header)
+
+	go func() {
+		defer func() { <-m.slots }()
+		defer cancel()
+		resp, err := m.transport.RoundTrip(out)
+		if err != nil {
+			mirroredRequests.WithLabelValues("error").Inc()
+			timedLog(fmt.Sprintf("Mirroring %s %s failed: %v", out.Method, out.URL, err))
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		mirroredRequests.WithLabelValues("ok").Inc()
+	}()
+}
+
+// readCloser reads from a reader while closing the original body.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,19 @@
+//go:build !tpm
+
+package main
+
+import (
+	"crypto"
+	"crypto/tls"
+	"errors"
+)
+
+// tpmCertificates returns a certificate with its key in the TPM, which needs
+// the tpm build tag.
+func tpmCertificates(device, keyHandle, publicFile, privateFile, parentHandle, certFile, auth string) ([]tls.Certificate, error) {
+	return nil, errors.New("this build does not support -backend tpm, rebuild it with -tags tpm (see the README)")
+}
+
+func tpmCapabilities(key crypto.PrivateKey) (*tokenCapabilities, error) {
+	return nil, errors.New("this build does not support -backend tpm")
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcCallbackPath   = "/.pkcs11-web-proxy/oidc/callback"
+	oidcSessionCookie  = "pkcs11-web-proxy-session"
+	oidcLoginCookie    = "pkcs11-web-proxy-login"
+	oidcLoginExpiresIn = 10 * time.Minute
+)
+
+// oidcAuth only lets through the users who logged in with the OpenID Connect
+// identity provider, with the authorization code flow and PKCE. The session
+// is kept in an encrypted cookie, whose key is generated at startup.
+type oidcAuth struct {
+	verifier        *oidc.IDTokenVerifier
+	config          oauth2.Config
+	userClaim       string
+	logClaims       []string
+	sessionDuration time.Duration
+	aead            cipher.AEAD
+}
+
+// oidcSession is the content of the session cookie.
+type oidcSession struct {
+	User    string            `json:"user"`
+	Claims  map[string]string `json:"claims,omitempty"`
+	Expires int64             `json:"exp"`
+}
+
+// oidcLogin is the content of the cookie tracking a login in progress.
+type oidcLogin struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Redirect string `json:"redirect"`
+	Expires  int64  `json:"exp"`
+}
+
+func newOIDCAuth(issuer, clientID, clientSecret, redirectURL, scopes, userClaim, logClaims string, sessionDuration time.Duration) (*oidcAuth, error) {
+	provider, err := oidc.NewProvider(context.Background(), issuer)
+	if err != nil {
+		return nil, fmt.Errorf("cannot discover the OIDC provider: %v", err)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	a := &oidcAuth{
+		verifier: provider.Verifier(&oidc.Config{ClientID: clientID}),
+		config: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  redirectURL,
+			Scopes:       []string{oidc.ScopeOpenID},
+		},
+		userClaim:       userClaim,
+		sessionDuration: sessionDuration,
+		aead:            aead,
+	}
+	for _, scope := range strings.Split(scopes, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" && scope != oidc.ScopeOpenID {
+			a.config.Scopes = append(a.config.Scopes, scope)
+		}
+	}
+	for _, claim := range strings.Split(logClaims, ",") {
+		if claim = strings.TrimSpace(claim); claim != "" {
+			a.logClaims = append(a.logClaims, claim)
+		}
+	}
+	return a, nil
+}
+
+// seal encrypts and authenticates v for a cookie.
+func (a *oidcAuth) seal(v any) (string, error) {
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, a.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(a.aead.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+func (a *oidcAuth) open(value string, v any) error {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(sealed) < a.aead.NonceSize() {
+		return errors.New("invalid cookie")
+	}
+	plaintext, err := a.aead.Open(nil, sealed[:a.aead.NonceSize()], sealed[a.aead.NonceSize():], nil)
+	if err != nil {
+		return errors.New("invalid cookie")
+	}
+	return json.Unmarshal(plaintext, v)
+}
+
+func (a *oidcAuth) setCookie(w http.ResponseWriter, r *http.Request, name string, v any, expires time.Time) error {
+	value, err := a.seal(v)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// handler lets through the requests with a valid session, logging the
+// claims of the user, and sends the others to the identity provider.
+func (a *oidcAuth) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var session oidcSession
+		if cookie, err := r.Cookie(oidcSessionCookie); err == nil && a.open(cookie.Value, &session) == nil && time.Now().Unix() < session.Expires {
+			timedLog(fmt.Sprintf("Request by %s%s: %s %s", session.User, formatClaims(session.Claims), r.Method, r.URL.String()))
+			removeCookies(r, oidcSessionCookie, oidcLoginCookie)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authenticatedUserKey{}, session.User)))
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "Unauthorized, log in first", http.StatusUnauthorized)
+			return
+		}
+
+		login := oidcLogin{
+			State:    randomString(),
+			Nonce:    randomString(),
+			Verifier: oauth2.GenerateVerifier(),
+			Redirect: r.URL.RequestURI(),
+			Expires:  time.Now().Add(oidcLoginExpiresIn).Unix(),
+		}
+		if err := a.setCookie(w, r, oidcLoginCookie, &login, time.Unix(login.Expires, 0)); err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, a.config.AuthCodeURL(login.State, oidc.Nonce(login.Nonce), oauth2.S256ChallengeOption(login.Verifier)), http.StatusFound)
+	})
+}
+
+// callback completes the login when the identity provider redirects the user
+// back to the proxy.
+func (a *oidcAuth) callback(w http.ResponseWriter, r *http.Request) {
+	var login oidcLogin
+	cookie, err := r.Cookie(oidcLoginCookie)
+	if err != nil || a.open(cookie.Value, &login) != nil || time.Now().Unix() >= login.Expires {
+		http.Error(w, "Login expired, try again", http.StatusBadRequest)
+		return
+	}
+	if r.URL.Query().Get("state") != login.State {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	if errorCode := r.URL.Query().Get("error"); errorCode != "" {
+		timedLog(fmt.Sprintf("OIDC login failed: %s %s", errorCode, r.URL.Query().Get("error_description")))
+		http.Error(w, "Login failed", http.StatusForbidden)
+		return
+	}
+
+	token, err := a.config.Exchange(r.Context(), r.URL.Query().Get("code"), oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		timedLog(fmt.Sprintf("OIDC code exchange failed: %v", err))
+		http.Error(w, "Login failed", http.StatusForbidden)
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		timedLog("OIDC token response without an ID token")
+		http.Error(w, "Login failed", http.StatusForbidden)
+		return
+	}
+	idToken, err := a.verifier.Verify(r.Context(), rawIDToken)
+	if err == nil && idToken.Nonce != login.Nonce {
+		err = errors.New("the nonce is not the one of the login")
+	}
+	if err != nil {
+		timedLog(fmt.Sprintf("Invalid OIDC ID token: %v", err))
+		http.Error(w, "Login failed", http.StatusForbidden)
+		return
+	}
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		http.Error(w, "Login failed", http.StatusForbidden)
+		return
+	}
+
+	session := oidcSession{User: fmt.Sprint(claims[a.userClaim]), Claims: make(map[string]string)}
+	if claims[a.userClaim] == nil {
+		session.User = idToken.Subject
+	}
+	for _, name := range a.logClaims {
+		if value, ok := claims[name]; ok {
+			session.Claims[name] = fmt.Sprint(value)
+		}
+	}
+	expires := time.Now().Add(a.sessionDuration)
+	session.Expires = expires.Unix()
+	if err := a.setCookie(w, r, oidcSessionCookie, &session, expires); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcLoginCookie, Path: "/", MaxAge: -1})
+	timedLog(fmt.Sprintf("OIDC login of %s%s", session.User, formatClaims(session.Claims)))
+
+	http.Redirect(w, r, localRedirect(login.Redirect), http.StatusFound)
+}
+
+// localRedirect returns the path to send the user back to after the login,
+// or / if the browsers could take it for another site: they read the
+// backslashes as slashes and drop the tabs and newlines.
+func localRedirect(redirect string) string {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") || strings.ContainsAny(redirect, "\t\r\n") {
+		return "/"
+	}
+	return redirect
+}
+
+func formatClaims(claims map[string]string) string {
+	if len(claims) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(claims))
+	for name := range claims {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, name+"="+claims[name])
+	}
+	return " (" + strings.Join(parts, ", ") + ")"
+}
+
+// removeCookies removes the cookies of the proxy from the request, so that
+// they are not forwarded to the upstream.
+func removeCookies(r *http.Request, names ...string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		keep := true
+		for _, name := range names {
+			if cookie.Name == name {
+				keep = false
+			}
+		}
+		if keep {
+			r.AddCookie(cookie)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCertificate returns a self-signed certificate of the key.
+func testCertificate(t *testing.T, key crypto.Signer, commonName string) tls.Certificate {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, Leaf: leaf, PrivateKey: key}
+}
+
+// fakeIssuer is an OpenID Connect identity provider, signing its ID tokens
+// with a jwtSigner and issuing one for each code of authorize.
+type fakeIssuer struct {
+	server   *httptest.Server
+	signer   *jwtSigner
+	clientID string
+	logins   map[string]url.Values
+	// nonce, if set, replaces the one of the logins in the ID tokens.
+	nonce string
+}
+
+func newFakeIssuer(t *testing.T, clientID string) *fakeIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &fakeIssuer{clientID: clientID, logins: make(map[string]url.Values)}
+	mux := http.NewServeMux()
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	if issuer.signer, err = newJWTSigner(testCertificate(t, key, "issuer"), []byte("unused"), issuer.server.URL, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                issuer.server.URL,
+			"authorization_endpoint":                issuer.server.URL + "/authorize",
+			"token_endpoint":                        issuer.server.URL + "/token",
+			"jwks_uri":                              issuer.server.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", issuer.signer.jwksHandler)
+	mux.HandleFunc("/token", issuer.token)
+	return issuer
+}
+
+// authorize logs the user in at the authorization URL of the proxy and
+// returns the code to send it back with.
+func (i *fakeIssuer) authorize(t *testing.T, location string) (code, state string) {
+	t.Helper()
+	authorization, err := url.Parse(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := authorization.Query()
+	if !strings.HasPrefix(location, i.server.URL+"/authorize?") || query.Get("client_id") != i.clientID || query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("authorization URL %s", location)
+	}
+	code = randomString()
+	i.logins[code] = query
+	return code, query.Get("state")
+}
+
+func (i *fakeIssuer) token(w http.ResponseWriter, r *http.Request) {
+	login, ok := i.logins[r.FormValue("code")]
+	delete(i.logins, r.FormValue("code"))
+	challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || r.FormValue("grant_type") != "authorization_code" || base64.RawURLEncoding.EncodeToString(challenge[:]) != login.Get("code_challenge") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+	nonce := login.Get("nonce")
+	if i.nonce != "" {
+		nonce = i.nonce
+	}
+	idToken, err := i.signer.sign(map[string]interface{}{"sub": "1234", "aud": i.clientID, "nonce": nonce, "email": "alice@example.com", "name": "Alice"})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "access", "token_type": "Bearer", "expires_in": 60, "id_token": idToken})
+}
+
+// oidcProxy is the OIDC authentication in front of an upstream handler
+// recording the requests it gets.
+type oidcProxy struct {
+	auth     *oidcAuth
+	handler  http.Handler
+	upstream []*http.Request
+}
+
+func newOIDCProxy(t *testing.T, issuer *fakeIssuer) *oidcProxy {
+	t.Helper()
+	auth, err := newOIDCAuth(issuer.server.URL, issuer.clientID, "secret", "http://localhost:8080"+oidcCallbackPath, "openid,email", "email", "sub,name", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &oidcProxy{auth: auth}
+	mux := http.NewServeMux()
+	mux.HandleFunc(oidcCallbackPath, auth.callback)
+	mux.Handle("/", auth.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.upstream = append(p.upstream, r)
+	})))
+	p.handler = mux
+	return p
+}
+
+func (p *oidcProxy) serve(method, target string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	recorder := httptest.NewRecorder()
+	p.handler.ServeHTTP(recorder, r)
+	return recorder
+}
+
+func responseCookie(recorder *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// login runs the login flow from a request to target, returning the response
+// to the callback.
+func (p *oidcProxy) login(t *testing.T, issuer *fakeIssuer, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	start := p.serve(http.MethodGet, target)
+	loginCookie := responseCookie(start, oidcLoginCookie)
+	if start.Code != http.StatusFound || loginCookie == nil {
+		t.Fatalf("request before the login: %d, login cookie %v", start.Code, loginCookie)
+	}
+	code, state := issuer.authorize(t, start.Header().Get("Location"))
+	return p.serve(http.MethodGet, oidcCallbackPath+"?"+url.Values{"code": {code}, "state": {state}}.Encode(), loginCookie)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newFakeIssuer(t, "proxy")
+	proxy := newOIDCProxy(t, issuer)
+
+	callback := proxy.login(t, issuer, "/orders?page=2")
+	session := responseCookie(callback, oidcSessionCookie)
+	if callback.Code != http.StatusFound || callback.Header().Get("Location") != "/orders?page=2" || session == nil {
+		t.Fatalf("callback: %d to %q, session %v", callback.Code, callback.Header().Get("Location"), session)
+	}
+	if cookie := responseCookie(callback, oidcLoginCookie); cookie == nil || cookie.MaxAge >= 0 {
+		t.Errorf("the login cookie is not removed: %v", cookie)
+	}
+
+	// The cookies of the proxy are not forwarded to the upstream.
+	response := proxy.serve(http.MethodPost, "/orders", session, &http.Cookie{Name: "upstream", Value: "kept"}, &http.Cookie{Name: oidcLoginCookie, Value: "stale"})
+	if response.Code != http.StatusOK || len(proxy.upstream) != 1 {
+		t.Fatalf("request with the session: %d", response.Code)
+	}
+	forwarded := proxy.upstream[0]
+	if cookies := forwarded.Cookies(); len(cookies) != 1 || cookies[0].Name != "upstream" || cookies[0].Value != "kept" {
+		t.Errorf("cookies forwarded to the upstream: %v", forwarded.Header["Cookie"])
+	}
+	if user := authenticatedUser(forwarded); user != "alice@example.com" {
+		t.Errorf("user %q", user)
+	}
+
+	// A tampered or expired session is no session.
+	value, _ := base64.RawURLEncoding.DecodeString(session.Value)
+	value[len(value)-1] ^= 1
+	tampered := &http.Cookie{Name: oidcSessionCookie, Value: base64.RawURLEncoding.EncodeToString(value)}
+	expired, err := proxy.auth.seal(&oidcSession{User: "alice@example.com", Expires: time.Now().Add(-time.Second).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, cookie := range map[string]*http.Cookie{"tampered": tampered, "expired": {Name: oidcSessionCookie, Value: expired}, "garbage": {Name: oidcSessionCookie, Value: "!"}} {
+		if response := proxy.serve(http.MethodGet, "/orders", cookie); response.Code != http.StatusFound || !strings.HasPrefix(response.Header().Get("Location"), issuer.server.URL) {
+			t.Errorf("%s session: %d to %q", name, response.Code, response.Header().Get("Location"))
+		}
+		if response := proxy.serve(http.MethodPost, "/orders", cookie); response.Code != http.StatusUnauthorized {
+			t.Errorf("%s session, POST: %d", name, response.Code)
+		}
+	}
+	if len(proxy.upstream) != 1 {
+		t.Errorf("%d requests reached the upstream, want 1", len(proxy.upstream))
+	}
+}
+
+func TestOIDCCallback(t *testing.T) {
+	issuer := newFakeIssuer(t, "proxy")
+	proxy := newOIDCProxy(t, issuer)
+	start := proxy.serve(http.MethodGet, "/")
+	loginCookie := responseCookie(start, oidcLoginCookie)
+	code, state := issuer.authorize(t, start.Header().Get("Location"))
+
+	if response := proxy.serve(http.MethodGet, oidcCallbackPath+"?code="+code+"&state=other", loginCookie); response.Code != http.StatusBadRequest {
+		t.Errorf("state mismatch: %d", response.Code)
+	}
+	if response := proxy.serve(http.MethodGet, oidcCallbackPath+"?code="+code+"&state="+state); response.Code != http.StatusBadRequest {
+		t.Errorf("no login cookie: %d", response.Code)
+	}
+	if response := proxy.serve(http.MethodGet, oidcCallbackPath+"?error=access_denied&state="+state, loginCookie); response.Code != http.StatusForbidden {
+		t.Errorf("login refused: %d", response.Code)
+	}
+	if response := proxy.serve(http.MethodGet, oidcCallbackPath+"?code=unknown&state="+state, loginCookie); response.Code != http.StatusForbidden {
+		t.Errorf("unknown code: %d", response.Code)
+	}
+
+	// A login cookie past its expiration, though with the state.
+	expired, err := proxy.auth.seal(&oidcLogin{State: state, Nonce: "n", Verifier: "v", Redirect: "/", Expires: time.Now().Add(-time.Second).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response := proxy.serve(http.MethodGet, oidcCallbackPath+"?code="+code+"&state="+state, &http.Cookie{Name: oidcLoginCookie, Value: expired}); response.Code != http.StatusBadRequest {
+		t.Errorf("expired login: %d", response.Code)
+	}
+
+	// An ID token for another login, with its nonce.
+	issuer.nonce = "another login"
+	if response := proxy.login(t, issuer, "/"); response.Code != http.StatusForbidden || responseCookie(response, oidcSessionCookie) != nil {
+		t.Errorf("nonce mismatch: %d", response.Code)
+	}
+}
+
+func TestOIDCRedirect(t *testing.T) {
+	issuer := newFakeIssuer(t, "proxy")
+	proxy := newOIDCProxy(t, issuer)
+	tests := map[string]string{
+		"/orders?page=2":       "/orders?page=2",
+		"/":                    "/",
+		"//evil.example":       "/",
+		"/\\evil.example":      "/",
+		"/\t/evil.example":     "/",
+		"https://evil.example": "/",
+		"evil.example":         "/",
+		"":                     "/",
+	}
+	for redirect, want := range tests {
+		start := proxy.serve(http.MethodGet, "/")
+		code, state := issuer.authorize(t, start.Header().Get("Location"))
+		var login oidcLogin
+		if err := proxy.auth.open(responseCookie(start, oidcLoginCookie).Value, &login); err != nil {
+			t.Fatal(err)
+		}
+		// The login cookie cannot be forged, but the redirect is the URL
+		// the user was sent to, by anyone.
+		login.Redirect = redirect
+		forged, err := proxy.auth.seal(&login)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := proxy.serve(http.MethodGet, oidcCallbackPath+"?code="+code+"&state="+state, &http.Cookie{Name: oidcLoginCookie, Value: forged})
+		if response.Code != http.StatusFound || response.Header().Get("Location") != want {
+			t.Errorf("redirect %q: %d to %q, want %q", redirect, response.Code, response.Header().Get("Location"), want)
+		}
+	}
+}
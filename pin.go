@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+)
+
+// readPinFile returns the PIN stored in the file, which is deleted once read
+// so that the PIN doesn't stay on disk.
+func readPinFile(file string) (string, error) {
+	pinBytes, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("Error reading pin file: %v", err)
+	}
+	if err := os.Remove(file); err != nil {
+		return "", fmt.Errorf("Error deleting pin file: %v", err)
+	}
+	return strings.TrimSpace(string(pinBytes)), nil
+}
+
+// checkPinFlags tells whether exactly one of the flag named name and of the
+// name-file one is set.
+func checkPinFlags(name, value, file string) error {
+	switch {
+	case value != "" && file != "":
+		return fmt.Errorf("Both %[1]s and %[1]s-file are set. Please use only one", name)
+	case value == "" && file == "":
+		return fmt.Errorf("Either %[1]s or %[1]s-file is required", name)
+	}
+	return nil
+}
+
+// pinFromFlags returns the PIN given with the flag named name or, read from
+// its file, with the name-file one.
+func pinFromFlags(name, value, file string) (string, error) {
+	if err := checkPinFlags(name, value, file); err != nil {
+		return "", err
+	}
+	if file != "" {
+		return readPinFile(file)
+	}
+	return value, nil
+}
+
+// checkPinLength tells whether the token accepts a PIN of this length, to fail
+// before using a login attempt.
+func checkPinLength(info pkcs11.TokenInfo, pin string) error {
+	if info.MaxPinLen == 0 || info.MaxPinLen == pkcs11.CK_UNAVAILABLE_INFORMATION {
+		return nil
+	}
+	if uint(len(pin)) < info.MinPinLen || uint(len(pin)) > info.MaxPinLen {
+		return fmt.Errorf("the token requires PINs of %d to %d characters", info.MinPinLen, info.MaxPinLen)
+	}
+	return nil
+}
+
+// runChangePin replaces the PIN of the token with the one of new-pin or
+// new-pin-file.
+func runChangePin(c *config) error {
+	pinVal, err := c.tokenPin()
+	if err != nil {
+		return err
+	}
+	newPinVal, err := pinFromFlags("new-pin", c.newPin, c.newPinFile)
+	if err != nil {
+		return err
+	}
+	return changePin(c.pkcs11path, c.tokenSerial, pinVal, newPinVal)
+}
+
+// changePin replaces the user PIN of the token, logging in with the current
+// one.
+func changePin(pkcs11path, tokenSerial, oldPin, newPin string) error {
+	ctx, slot, err := openToken(pkcs11path, tokenSerial)
+	if err != nil {
+		return err
+	}
+	defer ctx.Destroy()
+	info, err := ctx.GetTokenInfo(slot)
+	if err != nil {
+		return err
+	}
+	if err := checkPinLength(info, newPin); err != nil {
+		return err
+	}
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return err
+	}
+	defer ctx.CloseSession(session)
+	if err := ctx.SetPIN(session, oldPin, newPin); err != nil {
+		return describePinError(err)
+	}
+	fmt.Println("The PIN has been changed")
+	return nil
+}
+
+// runUnblockPin sets the PIN of new-pin or new-pin-file with the one of
+// so-pin or so-pin-file.
+func runUnblockPin(c *config) error {
+	soPinVal, err := pinFromFlags("so-pin", c.soPin, c.soPinFile)
+	if err != nil {
+		return err
+	}
+	newPinVal, err := pinFromFlags("new-pin", c.newPin, c.newPinFile)
+	if err != nil {
+		return err
+	}
+	return unblockPin(c.pkcs11path, c.tokenSerial, soPinVal, newPinVal)
+}
+
+// unblockPin sets a new user PIN with the security officer PIN, the PUK of
+// most smart cards, which also unlocks a PIN locked by too many wrong tries.
+func unblockPin(pkcs11path, tokenSerial, soPin, newPin string) error {
+	ctx, slot, err := openToken(pkcs11path, tokenSerial)
+	if err != nil {
+		return err
+	}
+	defer ctx.Destroy()
+	info, err := ctx.GetTokenInfo(slot)
+	if err != nil {
+		return err
+	}
+	if info.Flags&pkcs11.CKF_SO_PIN_LOCKED != 0 {
+		return errors.New("the SO PIN is locked: the token can only be reinitialized, losing its keys")
+	}
+	if info.Flags&pkcs11.CKF_SO_PIN_FINAL_TRY != 0 {
+		fmt.Println("Warning: this is the final try of the SO PIN, a wrong one will lock it")
+	}
+	if err := checkPinLength(info, newPin); err != nil {
+		return err
+	}
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return err
+	}
+	defer ctx.CloseSession(session)
+	if err := ctx.Login(session, pkcs11.CKU_SO, soPin); err != nil {
+		return describePinError(err)
+	}
+	defer ctx.Logout(session)
+	if err := ctx.InitPIN(session, newPin); err != nil {
+		return describePinError(err)
+	}
+	fmt.Println("The PIN has been unblocked and set")
+	return nil
+}
+
+func describePinError(err error) error {
+	var p11Err pkcs11.Error
+	if !errors.As(err, &p11Err) {
+		return err
+	}
+	switch p11Err {
+	case pkcs11.CKR_PIN_INCORRECT:
+		return fmt.Errorf("wrong PIN, run token-info to check the remaining tries (%v)", err)
+	case pkcs11.CKR_PIN_LOCKED:
+		return fmt.Errorf("the PIN is locked (%v)", err)
+	case pkcs11.CKR_PIN_LEN_RANGE, pkcs11.CKR_PIN_INVALID:
+		return fmt.Errorf("the token rejects the new PIN, check its length and characters (%v)", err)
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// prewarmConnections keeps count connections to the upstream open, so that
+// user requests don't wait for the token to sign a new handshake. Concurrent
+// HEAD requests are sent at startup and then every interval, which also keeps
+// the pooled connections from expiring.
+func prewarmConnections(transport http.RoundTripper, target *url.URL, count int, interval time.Duration) {
+	warm := func() {
+		start := time.Now()
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		failures := 0
+		for i := 0; i < count; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := prewarmRequest(transport, target); err != nil {
+					mu.Lock()
+					failures++
+					mu.Unlock()
+					timedLog(fmt.Sprintf("Pre-warming upstream connection failed: %v", err))
+				}
+			}()
+		}
+		wg.Wait()
+		timedLog(fmt.Sprintf("Pre-warmed %d upstream connections in %v", count-failures, time.Since(start)))
+	}
+
+	warm()
+	if interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		warm()
+	}
+}
+
+func prewarmRequest(transport http.RoundTripper, target *url.URL) error {
+	req, err := http.NewRequest(http.MethodHead, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
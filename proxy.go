@@ -0,0 +1,885 @@
+package main
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// upstreamClient reaches the upstreams with the certificates of the token,
+// for the proxy and check-upstream.
+type upstreamClient struct {
+	certificates []tls.Certificate
+	// cert is the certificate at -certificate-index presented to the
+	// upstreams, of the token of certContext and certTokenSerial.
+	cert            tls.Certificate
+	certContext     *crypto11.Context
+	certTokenSerial string
+	// tokenOf returns the token of the certificate at the index.
+	tokenOf func(index int) (*crypto11.Context, string)
+	// capabilitiesOf returns what the key of the certificate at the index
+	// can do.
+	capabilitiesOf func(index int, key crypto.PrivateKey) (*tokenCapabilities, error)
+	// tokenKey wraps the key of another certificate to sign with the slots
+	// of its token.
+	tokenKey func(index int, signer crypto.Signer) crypto.Signer
+
+	tlsConfig *tls.Config
+	destUrls  []*url.URL
+	mirrorUrl *url.URL
+	options   upstreamOptions
+	transport http.RoundTripper
+}
+
+// connectUpstream opens the token, or the backend or the remote signer of the
+// config, and sets up the transport to the destination URLs with its
+// certificate.
+func connectUpstream(c *config, pinVal string) (*upstreamClient, error) {
+	renegotiationSupport, err := parseRenegotiation(c.renegotiation)
+	if err != nil {
+		return nil, err
+	}
+	touch := c.touch()
+	tokenConfig := crypto11.Config{
+		Path:            c.pkcs11path,
+		TokenSerial:     c.tokenSerial,
+		Pin:             pinVal,
+		MaxSessions:     c.pkcs11MaxSessions,
+		PoolWaitTimeout: c.pkcs11PoolWaitTimeout,
+	}
+
+	var context *crypto11.Context
+	var certificates []tls.Certificate
+	var certificateTokens []certificateToken
+	if c.remoteSignerURL != "" {
+		remote, err := newRemoteSignerClient(c.remoteSignerURL, c.remoteSignerClientCert, c.remoteSignerClientKey, c.remoteSignerCA)
+		if err != nil {
+			return nil, err
+		}
+		certificates, err = remote.certificates()
+		if err != nil {
+			return nil, err
+		}
+		timedLog(fmt.Sprintf("Using the keys of the remote signer %s", c.remoteSignerURL))
+	} else if c.backend == "windows" {
+		// Without a PIN, Windows asks for the one of smart cards itself.
+		certificates, err = windowsCertificates(c.windowsStore, c.windowsThumbprint, pinVal)
+		if err != nil {
+			return nil, err
+		}
+	} else if c.backend == "tpm" {
+		// The PIN is the auth value of the key, if it has one.
+		certificates, err = tpmCertificates(c.tpmDevice, c.tpmKeyHandle, c.tpmKeyPublic, c.tpmKeyPrivate, c.tpmParentHandle, c.tpmCertificate, pinVal)
+		if err != nil {
+			return nil, err
+		}
+	} else if c.allTokens {
+		certificates, certificateTokens, err = openAllTokens(tokenConfig)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		context, err = crypto11.Configure(&tokenConfig)
+		if err != nil {
+			return nil, err
+		}
+		certificates, err = context.FindAllPairedCertificates()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.certificateIndex >= len(certificates) {
+		return nil, fmt.Errorf("Certificate index %d is out of range. Run '%s -token-serial ... [-pin/-pin-file] ... list-certificates' to find the index.", c.certificateIndex, os.Args[0])
+	}
+	cert := certificates[c.certificateIndex]
+	// tokenOf returns the token of the certificate at the index, which is the
+	// one of -token-serial unless -all-tokens is set.
+	tokenOf := func(index int) (*crypto11.Context, string) {
+		if certificateTokens == nil {
+			return context, c.tokenSerial
+		}
+		return certificateTokens[index].context, certificateTokens[index].serial
+	}
+	certContext, certTokenSerial := tokenOf(c.certificateIndex)
+	tlsConfig := &tls.Config{
+		Renegotiation: renegotiationSupport,
+	}
+	// capabilitiesOf returns what the key of the certificate at the index
+	// can do, as told by the remote signer or the backend, or as probed on
+	// the PKCS#11 token: only the pkcs11 backend has one.
+	capabilitiesOf := func(index int, key crypto.PrivateKey) (*tokenCapabilities, error) {
+		if c.remoteSignerURL != "" {
+			if capabilities := remoteKeyCapabilities(key); capabilities != nil {
+				return capabilities, nil
+			}
+			return nil, errors.New("the remote signer did not send them")
+		}
+		switch c.backend {
+		case "windows":
+			return windowsCapabilities(key), nil
+		case "tpm":
+			return tpmCapabilities(key)
+		}
+		context, serial := tokenOf(index)
+		return probeToken(context, c.pkcs11path, serial, key)
+	}
+	capabilities, err := capabilitiesOf(c.certificateIndex, cert.PrivateKey)
+	if err != nil {
+		timedLog(fmt.Sprintf("Unable to probe the token capabilities, TLS parameters will not be adjusted: %v", err))
+	}
+	gateTLSFeatures(&cert, tlsConfig, capabilities, c.rsaPSS)
+	identities := []tokenIdentity{{serial: certTokenSerial, cert: cert}}
+	for _, serial := range c.backupTokenSerials {
+		identity, err := backupIdentity(tokenConfig, serial, c.certificateIndex, tlsConfig, c.rsaPSS)
+		if err != nil {
+			timedLog(fmt.Sprintf("Not using the backup token %s: %v", serial, err))
+			continue
+		}
+		identities = append(identities, identity)
+	}
+	var failover *failoverIdentity
+	if len(identities) > 1 {
+		failover = newFailoverIdentity(c.pkcs11path, identities)
+	}
+	for i := range identities {
+		// The backups are other tokens, with their own slots.
+		identities[i].slots = newSignatureSlots(c.maxConcurrentSignatures)
+		identities[i].cert.PrivateKey = tokenSigner(identities[i].cert.PrivateKey.(crypto.Signer), identities[i].slots, c.signatureQueueTimeout, c.pkcs11PoolWaitTimeout, touch)
+	}
+	cert = identities[0].cert
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	// tokenKey wraps the key of another certificate to sign with the slots
+	// of its token, shared with the upstream certificate when on the same.
+	tokenSlots := map[string]*signatureSlots{certTokenSerial: identities[0].slots}
+	tokenKey := func(index int, signer crypto.Signer) crypto.Signer {
+		_, serial := tokenOf(index)
+		slots, ok := tokenSlots[serial]
+		if !ok {
+			slots = newSignatureSlots(c.maxConcurrentSignatures)
+			tokenSlots[serial] = slots
+		}
+		return tokenSigner(signer, slots, c.signatureQueueTimeout, c.pkcs11PoolWaitTimeout, touch)
+	}
+	if failover != nil {
+		tlsConfig.GetClientCertificate = failover.getClientCertificate
+		if c.tokenCheckInterval > 0 {
+			go failover.monitor(c.tokenCheckInterval)
+		}
+	}
+	configureSessionResumption(tlsConfig, c.tlsSessionCacheSize)
+	if c.debugTLS {
+		enableHandshakeDiagnostics(tlsConfig)
+	}
+	if c.keyLogFile != "" {
+		keyLog, err := os.OpenFile(c.keyLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening key log file: %v", err)
+		}
+		timedLog(fmt.Sprintf("Warning: writing TLS session secrets to %s, anyone reading it can decrypt the upstream traffic", c.keyLogFile))
+		tlsConfig.KeyLogWriter = keyLog
+	}
+
+	var destUrls []*url.URL
+	for _, destinationUrl := range append(c.destinationUrls, c.backupDestinationUrls...) {
+		destUrl, err := url.Parse(destinationUrl)
+		if err != nil {
+			return nil, err
+		}
+		if len(destUrls) > 0 && (destUrl.Scheme == "h2c") != (destUrls[0].Scheme == "h2c") {
+			return nil, errors.New("h2c:// and other destination URLs cannot be mixed")
+		}
+		destUrls = append(destUrls, destUrl)
+	}
+	var mirrorUrl *url.URL
+	if c.mirrorURL != "" {
+		mirrorUrl, err = url.Parse(c.mirrorURL)
+		if err != nil {
+			return nil, err
+		}
+		if (mirrorUrl.Scheme == "h2c") != (destUrls[0].Scheme == "h2c") {
+			return nil, errors.New("h2c:// and other destination URLs cannot be mixed")
+		}
+	}
+
+	options := upstreamOptions{
+		http2:                !c.noUpstreamHTTP2,
+		http2ReadIdleTimeout: c.upstreamHTTP2ReadIdleTimeout,
+		http2PingTimeout:     c.upstreamHTTP2PingTimeout,
+		ipFamily:             c.ipFamily,
+
+		dialTimeout:           c.dialTimeout,
+		tlsHandshakeTimeout:   c.tlsHandshakeTimeout,
+		responseHeaderTimeout: c.responseHeaderTimeout,
+
+		maxIdleConns:        c.maxIdleConns,
+		maxIdleConnsPerHost: c.maxIdleConnsPerHost,
+		maxConnsPerHost:     c.maxConnsPerHost,
+		idleConnTimeout:     c.idleConnTimeout,
+	}
+	if c.upstreamProxyProtocol != "" {
+		options.proxyProtocol = (c.upstreamProxyProtocol)[1] - '0'
+	}
+	options.resolve, err = parseResolveOverrides(c.resolveEntries)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.dnsServers) > 0 || c.dnsOverHTTPS != "" {
+		options.resolver, err = newDNSResolver(c.dnsServers, c.dnsOverHTTPS)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.dnsCache {
+		if options.resolver == nil {
+			options.resolver = systemResolver{}
+		}
+		options.resolver = newCachingResolver(options.resolver, c.dnsCacheMinTTL, c.dnsCacheMaxTTL, c.dnsCacheStaleOnError)
+	}
+	if c.bindSourceIP != "" {
+		options.sourceIP = net.ParseIP(c.bindSourceIP)
+		if options.sourceIP == nil {
+			return nil, fmt.Errorf("Invalid source IP %q", c.bindSourceIP)
+		}
+	}
+	if c.bindInterface != "" {
+		options.bindControl, err = bindToInterface(c.bindInterface)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// With the PROXY protocol the proxies of the environment are ignored,
+	// since the header would be sent to them.
+	if c.upstreamSOCKS5 != "" {
+		options.socks5, err = socks5Dialer(c.upstreamSOCKS5, options.netDialer())
+	} else if c.upstreamProxyProtocol == "" {
+		options.proxy, err = upstreamProxy(c.upstreamProxyURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var transport http.RoundTripper
+	if destUrls[0].Scheme == "h2c" {
+		timedLog("Using cleartext HTTP/2 (h2c) towards the upstream: the client certificate will not be used")
+		for _, destUrl := range destUrls {
+			destUrl.Scheme = "http"
+		}
+		if mirrorUrl != nil {
+			mirrorUrl.Scheme = "http"
+		}
+		transport = newH2CTransport(options)
+	} else if c.grpcMode {
+		transport = newHTTP2OnlyTransport(tlsConfig, options)
+	} else if c.upstreamHTTP3 {
+		timedLog("Using HTTP/3 towards the upstream")
+		if os.Getenv("HTTPS_PROXY") != "" || os.Getenv("https_proxy") != "" {
+			timedLog("Warning: HTTP/3 does not go through the proxy of HTTPS_PROXY, the upstream is reached directly")
+		}
+		transport, err = newH3Transport(tlsConfig, options)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		transport, err = newTransport(tlsConfig, options)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &upstreamClient{
+		certificates:    certificates,
+		cert:            cert,
+		certContext:     certContext,
+		certTokenSerial: certTokenSerial,
+		tokenOf:         tokenOf,
+		capabilitiesOf:  capabilitiesOf,
+		tokenKey:        tokenKey,
+		tlsConfig:       tlsConfig,
+		destUrls:        destUrls,
+		mirrorUrl:       mirrorUrl,
+		options:         options,
+		transport:       transport,
+	}, nil
+}
+
+// runProxy serves the destination URLs on the listener, with the identity of
+// the token towards them, until the server fails.
+func runProxy(c *config) error {
+	pinVal, err := c.tokenPin()
+	if err != nil {
+		return err
+	}
+	weights, err := c.weights()
+	if err != nil {
+		return err
+	}
+	credential, err := c.credential()
+	if err != nil {
+		return err
+	}
+	tsa, err := c.timestampAuthority()
+	if err != nil {
+		return err
+	}
+	if !strings.HasSuffix(c.mountPath, "/") {
+		c.mountPath += "/"
+	}
+
+	timedLog("Reverse proxy is starting")
+	client, err := connectUpstream(c, pinVal)
+	if err != nil {
+		return err
+	}
+
+	staticResponseHeaders, err := parseHeaders("response", c.setResponseHeaders)
+	if err != nil {
+		return err
+	}
+	if c.responseHeadersFile != "" {
+		entries, err := readHeadersFile(c.responseHeadersFile)
+		if err != nil {
+			return err
+		}
+		fileHeaders, err := parseHeaders("response", entries)
+		if err != nil {
+			return err
+		}
+		// The headers set on the command line take precedence.
+		for name, values := range fileHeaders {
+			if _, ok := staticResponseHeaders[name]; !ok {
+				staticResponseHeaders[name] = values
+			}
+		}
+	}
+	var pages *errorPages
+	if c.errorPagesDir != "" || c.maintenanceFile != "" {
+		if pages, err = loadErrorPages(c.errorPagesDir); err != nil {
+			return err
+		}
+	}
+	cacheControlRules, err := parseCacheControlRules(c.cacheControlOverrides)
+	if err != nil {
+		return err
+	}
+	routes, err := parseMetricsRoutes(c.metricsRoutes)
+	if err != nil {
+		return err
+	}
+	redactor := newHeaderRedactor(c.redactHeaders, c.logSensitiveHeaders)
+	pathRewrites, err := parsePathRewrites(c.rewritePaths)
+	if err != nil {
+		return err
+	}
+	rewriter := &urlRewriter{mountPath: c.mountPath, upstreams: client.destUrls}
+	if rewriter.routes, err = parseRewriteRoutes(c.locationMaps); err != nil {
+		return err
+	}
+	cookies, err := newCookiePolicy(c.cookieSecure, c.cookieHTTPOnly, c.cookieDomain, c.cookieSameSite)
+	if err != nil {
+		return err
+	}
+	responseHeaderPolicy, err := newHeaderPolicy(c.allowResponseHeaders, c.stripResponseHeaders)
+	if err != nil {
+		return err
+	}
+	upgrade := upgradeOptions{
+		idleTimeout:  c.websocketIdleTimeout,
+		pingInterval: c.websocketPingInterval,
+	}
+	if credential != nil {
+		if _, err := credential.header(); err != nil {
+			return err
+		}
+	}
+
+	var cache *responseCache
+	if c.cacheResponses {
+		var disk *diskStore
+		if c.cacheDir != "" {
+			disk, err = newDiskStore(c.cacheDir, c.cacheDiskMaxSize, c.cacheDiskMaxEntrySize)
+			if err != nil {
+				return err
+			}
+		}
+		cache, err = newResponseCache(c.cacheMaxSize, c.cacheMaxEntrySize, c.cacheMaxTTL, disk)
+		if err != nil {
+			return err
+		}
+	}
+	upstreams := &balancer{strategy: c.balance, weighted: len(c.destinationWeights) > 0, sticky: c.sticky, cookieName: c.stickyCookieName}
+	for i, destUrl := range client.destUrls {
+		destUrl := destUrl // captured by the closures of the proxy
+		if c.prewarmCount > 0 {
+			go prewarmConnections(client.transport, destUrl.JoinPath(c.prewarmPath), c.prewarmCount, c.prewarmInterval)
+		}
+
+		upstreamTransport := client.transport
+		if credential != nil {
+			upstreamTransport = &credentialTransport{next: upstreamTransport, credential: credential}
+		}
+		if c.retries > 0 {
+			upstreamTransport = newRetryTransport(upstreamTransport, c.retryMethods, c.retries, c.retryBackoff, c.retryMaxBackoff)
+		}
+
+		var breaker *circuitBreaker
+		if c.circuitBreakerFailures > 0 {
+			breaker = newCircuitBreaker(upstreamTransport, c.circuitBreakerFailures, c.circuitBreakerCooldown)
+			upstreamTransport = breaker
+		}
+		if cache != nil {
+			upstreamTransport = &cachingTransport{next: upstreamTransport, cache: cache}
+		}
+
+		proxy := httputil.NewSingleHostReverseProxy(destUrl)
+		director := proxy.Director
+		proxy.Director = func(req *http.Request) {
+			director(req)
+			preserveRawPath(req, destUrl, c.mountPath)
+			upstreams.unstick(req)
+		}
+		proxy.Transport = upstreamTransport
+		proxy.ErrorHandler = proxyErrorHandler(breaker, pages)
+		proxy.FlushInterval = c.flushInterval
+		if c.grpcMode {
+			proxy.FlushInterval = -1
+		}
+		rewriteResponse := modifyResponse(destUrl, cookies, rewriter)
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			wrapUpgradedConnection(resp, upgrade)
+			if c.logRequests && c.logHeaders {
+				timedLog(fmt.Sprintf("Response: %s for %s %s%s", resp.Status, resp.Request.Method, resp.Request.URL.String(), redactor.format(resp.Header)))
+			}
+			responseHeaderPolicy.apply(resp.Header)
+			rewriteHSTS(resp.Header, c.hsts, c.hstsMaxAge)
+			if c.via != "" {
+				addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor, c.via)
+			}
+			if c.compress {
+				if err := decompressResponse(resp); err != nil {
+					return err
+				}
+			}
+			if err := rewriteResponse(resp); err != nil {
+				return err
+			}
+			overrideCacheControl(resp.Header, clientPath(resp.Request), cacheControlRules)
+			if c.rewriteSecurityHeaders {
+				rewriter.rewriteSecurityHeaders(resp.Header, destUrl, resp.Request.URL, clientOrigin(resp.Request))
+			}
+			for name, values := range staticResponseHeaders {
+				resp.Header[name] = values
+			}
+			if c.rewriteBody && rewritableBody(resp) {
+				return rewriter.rewriteBody(resp, destUrl, c.rewriteBodyCompression == "reencode")
+			}
+			return nil
+		}
+		u := &upstream{id: upstreamID(destUrl), url: destUrl, proxy: proxy, backup: i >= len(c.destinationUrls), weight: 1}
+		if i < len(weights) && upstreams.weighted {
+			u.weight = weights[i]
+		}
+		u.healthy.Store(true)
+		upstreams.upstreams = append(upstreams.upstreams, u)
+	}
+
+	if c.healthCheck != "none" {
+		checker := &healthChecker{
+			kind:      c.healthCheck,
+			path:      c.healthCheckPath,
+			interval:  c.healthCheckInterval,
+			timeout:   c.healthCheckTimeout,
+			transport: client.transport,
+			tlsConfig: client.tlsConfig,
+			options:   client.options,
+		}
+		for _, u := range upstreams.upstreams {
+			go checker.run(u)
+		}
+	}
+
+	headerRules, err := newRequestHeaderRules(c.setRequestHeaders, c.removeRequestHeaders)
+	if err != nil {
+		return err
+	}
+	forwarding, err := newForwardedHeaders(c.forwardedMode, c.forwardedHeader, c.trustedProxies)
+	if err != nil {
+		return err
+	}
+	requestHeaderPolicy, err := newHeaderPolicy(c.allowRequestHeaders, c.stripRequestHeaders)
+	if err != nil {
+		return err
+	}
+
+	var shadow *mirror
+	if client.mirrorUrl != nil {
+		shadow = newMirror(client.mirrorUrl, c.mountPath, client.transport, c.mirrorMaxBody, c.mirrorMaxConcurrent, c.mirrorTimeout)
+	}
+
+	handler := func(b *balancer) func(http.ResponseWriter, *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			u := b.pick(r)
+			b.stick(w, r, u)
+			if record := auditRecordOf(r); record != nil {
+				record.Upstream = u.url.String()
+			}
+			if pages != nil {
+				ensureRequestID(r)
+			}
+			forwarding.apply(r)
+			r = withClientHost(r)
+			stripMountPath(r, c.mountPath)
+			if client.options.proxyProtocol != 0 {
+				r = withProxyProtocolSource(r)
+			}
+			if !c.noPreserveHost {
+				r.Host = u.url.Host
+			}
+			if c.rewriteBody && c.rewriteBodyCompression == "identity" {
+				r.Header.Del("Accept-Encoding")
+			}
+			requestHeaderPolicy.apply(r.Header)
+			headerRules.apply(r)
+			if c.via != "" {
+				addVia(r.Header, r.ProtoMajor, r.ProtoMinor, c.via)
+			}
+			if c.logRequests && c.logHeaders {
+				timedLog(fmt.Sprintf("Request: %s %s (route %s)%s", r.Method, r.URL.String(), routeOf(r), redactor.format(r.Header)))
+			} else if c.logRequests {
+				timedLog(fmt.Sprintf("Request: %s %s (route %s)", r.Method, r.URL.String(), routeOf(r)))
+			}
+			r = r.WithContext(httptrace.WithClientTrace(r.Context(), handshakeMetricsTrace()))
+			if c.debugTLS {
+				r = r.WithContext(httptrace.WithClientTrace(r.Context(), handshakeTrace()))
+			}
+			if c.requestTimeout > 0 {
+				var cancel func()
+				r, cancel = withTimeout(r, c.requestTimeout)
+				defer cancel()
+			}
+			if shadow != nil {
+				shadow.send(r)
+			}
+			u.inFlight.Add(1)
+			defer u.inFlight.Add(-1)
+			u.proxy.ServeHTTP(w, r)
+		}
+	}
+
+	var proxyHandler http.Handler = http.HandlerFunc(handler(upstreams))
+	if c.compress {
+		proxyHandler = compressHandler(proxyHandler, c.compressMinSize)
+	}
+	if c.maxRequestBody > 0 {
+		proxyHandler = maxBodyHandler(proxyHandler, c.maxRequestBody)
+	}
+	if c.maxInFlight > 0 {
+		proxyHandler = concurrencyLimitHandler(proxyHandler, newConcurrencyLimiter(c.maxInFlight, c.maxQueuedRequests, c.requestQueueTimeout))
+	}
+	if c.rateLimit > 0 {
+		proxyHandler = rateLimitHandler(proxyHandler, newRateLimiter(c.rateLimit, c.rateLimitBurst))
+	}
+	if c.readOnly {
+		proxyHandler = readOnlyHandler(proxyHandler)
+	}
+	if len(c.allowRequests) > 0 || len(c.denyRequests) > 0 {
+		filter, err := newRequestFilter(c.allowRequests, c.denyRequests, c.mountPath)
+		if err != nil {
+			return err
+		}
+		proxyHandler = filter.handler(proxyHandler)
+	}
+	proxyHandler = routeMetricsHandler(proxyHandler, routes, c.mountPath)
+	if c.auditLogPath != "" {
+		var key []byte
+		if c.auditLogKeyFile != "" {
+			key, err = readAuditLogKey(c.auditLogKeyFile)
+			if err != nil {
+				return err
+			}
+		}
+		audit, err := openAuditLog(c.auditLogPath, key)
+		if err != nil {
+			return err
+		}
+		proxyHandler = audit.handler(proxyHandler)
+	}
+	if c.htpasswdFile != "" {
+		users, err := loadHtpasswd(c.htpasswdFile)
+		if err != nil {
+			return err
+		}
+		proxyHandler = basicAuthHandler(proxyHandler, users, c.authRealm)
+	}
+	if c.oidcIssuer != "" {
+		var clientSecret []byte
+		if c.oidcClientSecretFile != "" {
+			clientSecret, err = os.ReadFile(c.oidcClientSecretFile)
+			if err != nil {
+				return err
+			}
+		}
+		auth, err := newOIDCAuth(c.oidcIssuer, c.oidcClientID, strings.TrimSpace(string(clientSecret)), c.oidcRedirectURL, c.oidcScopes, c.oidcUserClaim, c.oidcLogClaims, c.oidcSessionDuration)
+		if err != nil {
+			return err
+		}
+		proxyHandler = auth.handler(proxyHandler)
+		http.HandleFunc(oidcCallbackPath, auth.callback)
+	}
+	if c.listenClientCA != "" {
+		proxyHandler = clientCertHandler(proxyHandler)
+	}
+	if c.maintenanceFile != "" {
+		proxyHandler = maintenanceHandler(proxyHandler, c.maintenanceFile, pages)
+	}
+	if len(c.corsAllowOrigins) > 0 {
+		proxyHandler = corsHandler(proxyHandler, &corsPolicy{
+			origins:          c.corsAllowOrigins,
+			methods:          c.corsAllowMethods,
+			headers:          c.corsAllowHeaders,
+			exposeHeaders:    c.corsExposeHeaders,
+			allowCredentials: c.corsAllowCredentials,
+			maxAge:           c.corsMaxAge,
+		})
+	}
+	http.Handle(c.mountPath, proxyHandler)
+
+	type HealthResponse struct {
+		Status    string    `json:"status"`
+		Timestamp time.Time `json:"timestamp"`
+	}
+
+	http.HandleFunc("/.pkcs11-web-proxy/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/health+json")
+		responseBody, _ := json.Marshal(&HealthResponse{
+			Status:    "ok",
+			Timestamp: time.Now(),
+		})
+		w.Write(responseBody)
+	})
+
+	if c.sshAgentEnabled {
+		agentCertificates := make([]tls.Certificate, len(client.certificates))
+		for i, certificate := range client.certificates {
+			if i == c.certificateIndex {
+				agentCertificates[i] = client.cert
+				continue
+			}
+			certificate.PrivateKey = client.tokenKey(i, certificate.PrivateKey.(crypto.Signer))
+			agentCertificates[i] = certificate
+		}
+		go func() {
+			log.Fatalln(serveSSHAgent(newSSHAgent(agentCertificates), c.sshAgentSocket))
+		}()
+	}
+	http.Handle("/.pkcs11-web-proxy/metrics", promhttp.Handler())
+	if c.jwtAPIKeyFile != "" {
+		apiKey, err := os.ReadFile(c.jwtAPIKeyFile)
+		if err != nil {
+			return err
+		}
+		jwtCertificate := client.cert
+		if c.jwtCertificateIndex >= 0 {
+			if c.jwtCertificateIndex >= len(client.certificates) {
+				return fmt.Errorf("JWT certificate index %d is out of range. Run '%s -token-serial ... [-pin/-pin-file] ... list-certificates' to find the index.", c.jwtCertificateIndex, os.Args[0])
+			}
+			jwtCertificate = client.certificates[c.jwtCertificateIndex]
+			jwtCertificate.PrivateKey = client.tokenKey(c.jwtCertificateIndex, jwtCertificate.PrivateKey.(crypto.Signer))
+		}
+		jwt, err := newJWTSigner(jwtCertificate, []byte(strings.TrimSpace(string(apiKey))), c.jwtIssuer, c.jwtLifetime)
+		if err != nil {
+			return err
+		}
+		timedLog(fmt.Sprintf("Signing %s JWTs with the key of %v on %s", jwt.alg, jwtCertificate.Leaf.Subject, jwtPath))
+		http.HandleFunc(jwtPath, jwt.handler)
+		http.HandleFunc(jwksPath, jwt.jwksHandler)
+	}
+	if c.smimeAPIKeyFile != "" {
+		apiKey, err := os.ReadFile(c.smimeAPIKeyFile)
+		if err != nil {
+			return err
+		}
+		if len(strings.TrimSpace(string(apiKey))) == 0 {
+			return errors.New("the S/MIME API key is empty")
+		}
+		opts, err := signatureOptions(c.signatureHash, false)
+		if err != nil {
+			return err
+		}
+		smimeCertificate := client.cert
+		smimeContext, smimeTokenSerial := client.certContext, client.certTokenSerial
+		if c.smimeCertificateIndex >= 0 {
+			if c.smimeCertificateIndex >= len(client.certificates) {
+				return fmt.Errorf("S/MIME certificate index %d is out of range. Run '%s -token-serial ... [-pin/-pin-file] ... list-certificates' to find the index.", c.smimeCertificateIndex, os.Args[0])
+			}
+			smimeCertificate = client.certificates[c.smimeCertificateIndex]
+			smimeContext, smimeTokenSerial = client.tokenOf(c.smimeCertificateIndex)
+			smimeCertificate.PrivateKey = client.tokenKey(c.smimeCertificateIndex, smimeCertificate.PrivateKey.(crypto.Signer))
+		}
+		// The remote signer sends the chain, otherwise it is looked for on
+		// the token.
+		var others []*x509.Certificate
+		for _, der := range smimeCertificate.Certificate[1:] {
+			if chainCert, err := x509.ParseCertificate(der); err == nil {
+				others = append(others, chainCert)
+			}
+		}
+		if smimeContext != nil {
+			tokenOthers, err := tokenCertificates(c.pkcs11path, smimeTokenSerial)
+			if err != nil {
+				timedLog(fmt.Sprintf("Unable to look for the S/MIME chain on the token: %v", err))
+			}
+			others = append(others, tokenOthers...)
+		}
+		smime := &smimeSigner{
+			signer: smimeCertificate.PrivateKey.(crypto.Signer),
+			chain:  certificateChain(smimeCertificate.Leaf, others),
+			hash:   opts.HashFunc(),
+			tsa:    tsa,
+			apiKey: []byte(strings.TrimSpace(string(apiKey))),
+		}
+		timedLog(fmt.Sprintf("S/MIME signing with the key of %v on %s", smimeCertificate.Leaf.Subject, smimePath))
+		http.HandleFunc(smimePath, smime.handler)
+	}
+	http.HandleFunc("/.pkcs11-web-proxy/upstreams", upstreamsHandler(upstreams))
+
+	listenAddr := fmt.Sprintf("%s:%d", c.listenAddress, c.listenPort)
+	var listenerTLSConfig *tls.Config
+	if c.listenTLS {
+		if listenerTLSConfig, err = newListenerTLSConfig(c, client); err != nil {
+			return err
+		}
+	}
+
+	rootHandler := proxyRouter(http.DefaultServeMux, proxyHandler, c.mountPath)
+	if len(pathRewrites) > 0 {
+		rootHandler = pathRewriteHandler(rootHandler, pathRewrites)
+	}
+	if len(c.allowCIDRs) > 0 || len(c.denyCIDRs) > 0 {
+		filter, err := newIPFilter(c.allowCIDRs, c.denyCIDRs)
+		if err != nil {
+			return err
+		}
+		rootHandler = filter.handler(rootHandler)
+	}
+	if c.listenHTTP3 {
+		h3 := newHTTP3Server(listenAddr, rootHandler, listenerTLSConfig)
+		rootHandler = advertiseHTTP3(h3, rootHandler)
+		go func() {
+			timedLog(fmt.Sprintf("Listening on %s over HTTP/3", listenAddr))
+			log.Fatal(h3.ListenAndServe())
+		}()
+	}
+
+	server, err := newServer(listenAddr, rootHandler, listenerOptions{
+		tlsConfig:        listenerTLSConfig,
+		h2c:              c.listenH2C || c.grpcMode,
+		http2MaxStreams:  uint32(c.listenHTTP2MaxStreams),
+		http2IdleTimeout: c.listenHTTP2IdleTimeout,
+
+		readHeaderTimeout: c.listenReadHeaderTimeout,
+		readTimeout:       c.listenReadTimeout,
+		writeTimeout:      c.listenWriteTimeout,
+		idleTimeout:       c.listenIdleTimeout,
+		maxHeaderBytes:    c.listenMaxHeaderBytes,
+	})
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+	if c.listenProxyProtocol {
+		sources, err := parsePrefixes(c.proxyProtocolSources)
+		if err != nil {
+			return err
+		}
+		listener = proxyProtocolListener(listener, sources, c.listenReadHeaderTimeout)
+	}
+	if c.listenTLS {
+		timedLog(fmt.Sprintf("Listening on %s:%d over TLS", c.listenAddress, c.listenPort))
+		return server.ServeTLS(listener, "", "")
+	}
+	timedLog(fmt.Sprintf("Listening on %s:%d", c.listenAddress, c.listenPort))
+	return server.Serve(listener)
+}
+
+// newListenerTLSConfig returns the TLS configuration of the listener: a
+// certificate of the token, one from the ACME CA, the one of listen-tls-cert,
+// or a self-signed one.
+func newListenerTLSConfig(c *config, client *upstreamClient) (*tls.Config, error) {
+	listenerTLSConfig := &tls.Config{}
+	if c.listenTLSCertificateIndex >= 0 {
+		if c.listenTLSCertificateIndex >= len(client.certificates) {
+			return nil, fmt.Errorf("Listener certificate index %d is out of range. Run '%s -token-serial ... [-pin/-pin-file] ... list-certificates' to find the index.", c.listenTLSCertificateIndex, os.Args[0])
+		}
+		listenerCertificate := client.certificates[c.listenTLSCertificateIndex]
+		timedLog(fmt.Sprintf("Serving the certificate %v of the token on the TLS listener", listenerCertificate.Leaf.Subject))
+		listenerCapabilities, err := client.capabilitiesOf(c.listenTLSCertificateIndex, listenerCertificate.PrivateKey)
+		if err != nil {
+			timedLog(fmt.Sprintf("Unable to probe the token capabilities, TLS parameters of the listener will not be adjusted: %v", err))
+		}
+		gateTLSFeatures(&listenerCertificate, listenerTLSConfig, listenerCapabilities, c.rsaPSS)
+		listenerCertificate.PrivateKey = client.tokenKey(c.listenTLSCertificateIndex, listenerCertificate.PrivateKey.(crypto.Signer))
+		listenerTLSConfig.Certificates = []tls.Certificate{listenerCertificate}
+	} else if len(c.acmeDomains) > 0 {
+		var accountKey crypto.Signer
+		if c.acmeAccountKeyLabel != "" {
+			var err error
+			if accountKey, err = tokenACMEAccountKey(client.certContext, c.acmeAccountKeyLabel); err != nil {
+				return nil, err
+			}
+			accountKey = client.tokenKey(c.certificateIndex, accountKey)
+		}
+		manager := newACMEManager(c.acmeDomains, c.acmeEmail, c.acmeCacheDir, c.acmeDirectoryURL, accountKey)
+		configureACME(listenerTLSConfig, manager)
+		timedLog(fmt.Sprintf("Serving certificates from %s for %s on the TLS listener", c.acmeDirectoryURL, strings.Join(c.acmeDomains, ", ")))
+		if c.acmeHTTPAddr != "" {
+			challengeServer := &http.Server{Addr: c.acmeHTTPAddr, Handler: manager.HTTPHandler(nil), ReadHeaderTimeout: c.listenReadHeaderTimeout}
+			go func() {
+				timedLog(fmt.Sprintf("Answering the ACME HTTP-01 challenges on %s", c.acmeHTTPAddr))
+				log.Fatal(challengeServer.ListenAndServe())
+			}()
+		}
+	} else if c.listenTLSCertificate != "" {
+		listenerCertificate, err := tls.LoadX509KeyPair(c.listenTLSCertificate, c.listenTLSPrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading the listener certificate: %v", err)
+		}
+		listenerTLSConfig.Certificates = []tls.Certificate{listenerCertificate}
+	} else {
+		names := listenerNames(c.listenAddress)
+		listenerCertificate, err := selfSignedCertificate(names, c.listenTLSSelfSignedDir)
+		if err != nil {
+			return nil, fmt.Errorf("Error generating the listener certificate: %v", err)
+		}
+		fingerprint := sha256.Sum256(listenerCertificate.Certificate[0])
+		timedLog(fmt.Sprintf("Serving a self-signed certificate for %s on the TLS listener, SHA-256 fingerprint %X", strings.Join(names, ", "), fingerprint))
+		listenerTLSConfig.Certificates = []tls.Certificate{listenerCertificate}
+	}
+	if c.listenClientCA != "" {
+		var err error
+		listenerTLSConfig.ClientCAs, err = loadCertPool(c.listenClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading the listener client CA: %v", err)
+		}
+		listenerTLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return listenerTLSConfig, nil
+}
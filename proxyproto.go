@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// proxyProtocolListener accepts the PROXY protocol (v1 or v2) header sent by
+// an L4 load balancer in front of the proxy, so that the real address of the
+// client is used. Without sources, every connection must start with the
+// header. Otherwise only the connections from the sources must, and the
+// header is refused from the others, which are served as they are.
+func proxyProtocolListener(listener net.Listener, sources []netip.Prefix, timeout time.Duration) net.Listener {
+	return &proxyproto.Listener{
+		Listener:          listener,
+		ReadHeaderTimeout: timeout,
+		Policy: func(upstream net.Addr) (proxyproto.Policy, error) {
+			if len(sources) == 0 {
+				return proxyproto.REQUIRE, nil
+			}
+			// Compared like the clients of -allow-cidr, without the zone of
+			// a link-local address.
+			host, _, err := net.SplitHostPort(upstream.String())
+			if err != nil {
+				return proxyproto.REJECT, nil
+			}
+			if addr, ok := parseClientAddr(host); ok {
+				for _, prefix := range sources {
+					if prefix.Contains(addr) {
+						return proxyproto.REQUIRE, nil
+					}
+				}
+			}
+			return proxyproto.REJECT, nil
+		},
+	}
+}
+
+type proxyProtocolSourceKey struct{}
+
+// withProxyProtocolSource records the address of the client in the context of
+// the request, for the PROXY protocol header sent to the upstream.
+func withProxyProtocolSource(r *http.Request) *http.Request {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), proxyProtocolSourceKey{}, addr))
+}
+
+// writeProxyProtocolHeader starts the connection to the upstream with the
+// PROXY protocol header telling the address of the client. The connections
+// not opened for a client, such as the health checks, carry a LOCAL header.
+func writeProxyProtocolHeader(ctx context.Context, conn net.Conn, version byte) error {
+	header := &proxyproto.Header{Version: version, Command: proxyproto.LOCAL, TransportProtocol: proxyproto.UNSPEC}
+	source, _ := ctx.Value(proxyProtocolSourceKey{}).(*net.TCPAddr)
+	destination, _ := ctx.Value(http.LocalAddrContextKey).(*net.TCPAddr)
+	if source != nil && destination != nil {
+		header = proxyproto.HeaderProxyFromAddrs(version, source, destination)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+	_, err := header.WriteTo(conn)
+	return err
+}
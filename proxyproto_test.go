@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+)
+
+func TestProxyProtocolPolicy(t *testing.T) {
+	sources, err := parsePrefixes([]string{"10.0.0.0/8", "fe80::/10", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := proxyProtocolListener(nil, sources, time.Second).(*proxyproto.Listener).Policy
+	tests := map[net.Addr]proxyproto.Policy{
+		&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}:                  proxyproto.REQUIRE,
+		&net.TCPAddr{IP: net.ParseIP("::ffff:10.1.2.3"), Port: 1234}:           proxyproto.REQUIRE,
+		&net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 1234, Zone: "eth0"}:     proxyproto.REQUIRE,
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}:               proxyproto.REQUIRE,
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 1234}:               proxyproto.REJECT,
+		&net.TCPAddr{IP: net.ParseIP("11.0.0.1"), Port: 1234}:                  proxyproto.REJECT,
+		&net.TCPAddr{IP: net.ParseIP("::ffff:11.0.0.1"), Port: 1234}:           proxyproto.REJECT,
+		&net.UnixAddr{Name: "/run/pkcs11-web-proxy.sock", Net: "unix"}:         proxyproto.REJECT,
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234, Zone: "eth0"}: proxyproto.REQUIRE,
+	}
+	for addr, want := range tests {
+		if got, err := policy(addr); err != nil || got != want {
+			t.Errorf("policy of %s: %v, %v, want %v", addr, got, err, want)
+		}
+	}
+
+	policy = proxyProtocolListener(nil, nil, time.Second).(*proxyproto.Listener).Policy
+	if got, err := policy(&net.TCPAddr{IP: net.ParseIP("11.0.0.1"), Port: 1234}); err != nil || got != proxyproto.REQUIRE {
+		t.Errorf("policy without sources: %v, %v", got, err)
+	}
+}
+
+// readProxyProtocolHeader returns the header written by
+// writeProxyProtocolHeader with the context, as parsed by go-proxyproto.
+func readProxyProtocolHeader(t *testing.T, ctx context.Context, version byte) *proxyproto.Header {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	written := make(chan error, 1)
+	go func() {
+		written <- writeProxyProtocolHeader(ctx, client, version)
+		client.Close()
+	}()
+	header, err := proxyproto.Read(bufio.NewReader(server))
+	if err != nil {
+		t.Fatalf("v%d: %v", version, err)
+	}
+	io.Copy(io.Discard, server)
+	if err := <-written; err != nil {
+		t.Fatalf("v%d: %v", version, err)
+	}
+	return header
+}
+
+func TestWriteProxyProtocolHeader(t *testing.T) {
+	tests := []struct {
+		name                string
+		source, destination *net.TCPAddr
+		protocol            proxyproto.AddressFamilyAndProtocol
+	}{
+		{"IPv4", &net.TCPAddr{IP: net.ParseIP("203.0.113.7").To4(), Port: 51234}, &net.TCPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 8080}, proxyproto.TCPv4},
+		// A client of a dual-stack listener.
+		{"IPv4-mapped", &net.TCPAddr{IP: net.ParseIP("::ffff:203.0.113.7"), Port: 51234}, &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 8080}, proxyproto.TCPv4},
+		{"IPv6", &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 51234}, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 8080}, proxyproto.TCPv6},
+	}
+	for _, version := range []byte{1, 2} {
+		for _, test := range tests {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = test.source.String()
+			r = withProxyProtocolSource(r)
+			ctx, cancel := context.WithTimeout(context.WithValue(r.Context(), http.LocalAddrContextKey, test.destination), time.Second)
+			header := readProxyProtocolHeader(t, ctx, version)
+			cancel()
+			if header.Version != version || header.Command != proxyproto.PROXY || header.TransportProtocol != test.protocol {
+				t.Errorf("v%d %s: header %+v", version, test.name, header)
+				continue
+			}
+			source, sourceOK := header.SourceAddr.(*net.TCPAddr)
+			destination, destinationOK := header.DestinationAddr.(*net.TCPAddr)
+			if !sourceOK || !destinationOK || !source.IP.Equal(test.source.IP) || source.Port != test.source.Port || !destination.IP.Equal(test.destination.IP) || destination.Port != test.destination.Port {
+				t.Errorf("v%d %s: from %v to %v, want from %v to %v", version, test.name, header.SourceAddr, header.DestinationAddr, test.source, test.destination)
+			}
+		}
+
+		// The connections opened without a client, like the health checks,
+		// and the clients of a Unix socket tell no address.
+		unix := &net.UnixAddr{Name: "/run/pkcs11-web-proxy.sock", Net: "unix"}
+		for name, ctx := range map[string]context.Context{
+			"health check": context.WithValue(context.Background(), http.LocalAddrContextKey, tests[0].destination),
+			"Unix socket":  context.WithValue(withProxyProtocolSource(&http.Request{RemoteAddr: "@"}).Context(), http.LocalAddrContextKey, unix),
+		} {
+			header := readProxyProtocolHeader(t, ctx, version)
+			if header.Version != version || header.Command != proxyproto.LOCAL || header.TransportProtocol != proxyproto.UNSPEC {
+				t.Errorf("v%d %s: header %+v", version, name, header)
+			}
+		}
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		sources []string
+		header  bool
+		// remote is the address of the client seen by the proxy, or empty
+		// if the connection is refused.
+		remote string
+	}{
+		{"required header", nil, true, "203.0.113.7:51234"},
+		{"missing header", nil, false, ""},
+		{"header of a source", []string{"127.0.0.0/8"}, true, "203.0.113.7:51234"},
+		{"header of another client", []string{"10.0.0.0/8"}, true, ""},
+		{"another client without header", []string{"10.0.0.0/8"}, false, "127.0.0.1"},
+	} {
+		prefixes, err := parsePrefixes(test.sources)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener := proxyProtocolListener(tcpListener, prefixes, time.Second)
+		accepted := make(chan string, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				accepted <- ""
+				return
+			}
+			defer conn.Close()
+			// The header is read, and checked, with the first bytes.
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil || line != "GET / HTTP/1.0\r\n" {
+				accepted <- ""
+				return
+			}
+			accepted <- conn.RemoteAddr().String()
+		}()
+
+		conn, err := net.Dial("tcp", tcpListener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.header {
+			source := &net.TCPAddr{IP: net.ParseIP("203.0.113.7").To4(), Port: 51234}
+			ctx := context.WithValue(withProxyProtocolSource(&http.Request{RemoteAddr: source.String()}).Context(), http.LocalAddrContextKey, tcpListener.Addr())
+			if err := writeProxyProtocolHeader(ctx, conn, 2); err != nil {
+				t.Fatal(err)
+			}
+		}
+		conn.Write([]byte("GET / HTTP/1.0\r\n"))
+		remote := <-accepted
+		conn.Close()
+		listener.Close()
+		if host, _, err := net.SplitHostPort(remote); err == nil && test.remote == "127.0.0.1" {
+			remote = host
+		}
+		if remote != test.remote {
+			t.Errorf("%s: client %q, want %q", test.name, remote, test.remote)
+		}
+	}
+}
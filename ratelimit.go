@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter limits the rate of the requests of each client with a token
+// bucket, so that a single runaway script cannot use up the signing capacity
+// of the token.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	l := &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*tokenBucket)}
+	go l.cleanup()
+	return l
+}
+
+// allow takes a token from the bucket of the client, returning how long to
+// wait for the next one if it is empty.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// cleanup forgets the clients whose bucket has filled up again, as a new one
+// would be identical.
+func (l *rateLimiter) cleanup() {
+	for range time.Tick(time.Minute) {
+		l.mu.Lock()
+		for key, bucket := range l.buckets {
+			if bucket.tokens+time.Since(bucket.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// rateLimitHandler rejects with 429 the requests of the clients exceeding
+// the rate limit. Authenticated clients are told apart by user name, the
+// others by IP address.
+func rateLimitHandler(next http.Handler, limiter *rateLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := clientIP(r)
+		if user := authenticatedUser(r); user != "" {
+			key = "user:" + user
+		}
+		if ok, retryAfter := limiter.allow(key); !ok {
+			rateLimitedRequests.Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// remoteSignerTimeout bounds each request to the remote signer, which waits
+// for the token like a local signature.
+const remoteSignerTimeout = 30 * time.Second
+
+// remoteSignerClient uses the keys served by the remote-signer command of
+// the proxy running on the machine where the card is inserted.
+type remoteSignerClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+// newRemoteSignerClient connects to the remote signer at rawURL with the
+// client certificate of the files, checking its certificate against the CAs
+// of caFile, or of the system if empty.
+func newRemoteSignerClient(rawURL, certFile, keyFile, caFile string) (*remoteSignerClient, error) {
+	baseURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if baseURL.Scheme != "https" {
+		return nil, fmt.Errorf("the remote signer URL must be https://, got %s", rawURL)
+	}
+	clientCertificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load the remote signer client certificate: %v", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{clientCertificate}, MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		if config.RootCAs, err = loadCertPool(caFile); err != nil {
+			return nil, fmt.Errorf("cannot load the remote signer CA: %v", err)
+		}
+	}
+	return &remoteSignerClient{
+		baseURL: strings.TrimSuffix(baseURL.String(), "/"),
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: config, ForceAttemptHTTP2: true, MaxIdleConnsPerHost: 16},
+			Timeout:   remoteSignerTimeout,
+		},
+	}, nil
+}
+
+func (c *remoteSignerClient) do(method, path string, body, response interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("remote signer unreachable: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("remote signer error: %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// certificates returns the certificates of the remote token, in the order of
+// list-certificates, with signers using their remote keys.
+func (c *remoteSignerClient) certificates() ([]tls.Certificate, error) {
+	var keys []remoteKey
+	if err := c.do(http.MethodGet, remoteSignerKeysPath, nil, &keys); err != nil {
+		return nil, err
+	}
+	certificates := make([]tls.Certificate, 0, len(keys))
+	for _, key := range keys {
+		if len(key.Certificates) == 0 {
+			return nil, fmt.Errorf("the remote signer sent key %d without certificate", key.Index)
+		}
+		leaf, err := x509.ParseCertificate(key.Certificates[0])
+		if err != nil {
+			return nil, fmt.Errorf("the remote signer sent an invalid certificate for key %d: %v", key.Index, err)
+		}
+		signer := &remoteKeySigner{client: c, index: key.Index, public: leaf.PublicKey}
+		if key.Capabilities != nil {
+			signer.capabilities = key.Capabilities.tokenCapabilities()
+		}
+		certificates = append(certificates, tls.Certificate{
+			Certificate: key.Certificates,
+			Leaf:        leaf,
+			PrivateKey:  signer,
+		})
+	}
+	return certificates, nil
+}
+
+// remoteKeySigner signs with a key of the remote token.
+type remoteKeySigner struct {
+	client       *remoteSignerClient
+	index        int
+	public       crypto.PublicKey
+	capabilities *tokenCapabilities
+}
+
+// remoteKeyCapabilities returns what the remote token can do with the key, as
+// probed by the remote signer, or nil if it did not tell.
+func remoteKeyCapabilities(key crypto.PrivateKey) *tokenCapabilities {
+	s, ok := key.(*remoteKeySigner)
+	if !ok {
+		return nil
+	}
+	return s.capabilities
+}
+
+func (s *remoteKeySigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *remoteKeySigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	request := remoteSignRequest{Hash: opts.HashFunc().String(), Digest: digest}
+	if pss, ok := opts.(*rsa.PSSOptions); ok {
+		saltLength := pss.SaltLength
+		request.PSSSaltLength = &saltLength
+	}
+	var response remoteSignResponse
+	if err := s.client.do(http.MethodPost, fmt.Sprintf("%s/%d/sign", remoteSignerKeysPath, s.index), request, &response); err != nil {
+		return nil, err
+	}
+	return response.Signature, nil
+}
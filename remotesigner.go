@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/miekg/pkcs11"
+)
+
+// The remote signer protocol: GET /v1/keys lists the keys of the token with
+// their certificate chain, and POST /v1/keys/<index>/sign signs a digest with
+// one of them.
+const remoteSignerKeysPath = "/v1/keys"
+
+type remoteKey struct {
+	Index int    `json:"index"`
+	Key   string `json:"key"`
+	// The DER certificates, the one of the key first.
+	Certificates [][]byte `json:"certificates"`
+	// What the token can do with the key, for the clients to adjust their
+	// TLS parameters like with a local token. Absent if it was not probed.
+	Capabilities *remoteCapabilities `json:"capabilities,omitempty"`
+}
+
+type remoteCapabilities struct {
+	CanSign    bool              `json:"can_sign"`
+	Mechanisms []remoteMechanism `json:"mechanisms"`
+}
+
+// remoteMechanism is a PKCS#11 mechanism of the token, with its CK_MECHANISM_INFO.
+type remoteMechanism struct {
+	Mechanism  uint `json:"mechanism"`
+	MinKeySize uint `json:"min_key_size"`
+	MaxKeySize uint `json:"max_key_size"`
+	Flags      uint `json:"flags"`
+}
+
+func newRemoteCapabilities(capabilities *tokenCapabilities) *remoteCapabilities {
+	if capabilities == nil {
+		return nil
+	}
+	remote := &remoteCapabilities{CanSign: capabilities.canSign, Mechanisms: []remoteMechanism{}}
+	for mechanism, info := range capabilities.mechanisms {
+		remote.Mechanisms = append(remote.Mechanisms, remoteMechanism{Mechanism: mechanism, MinKeySize: info.MinKeySize, MaxKeySize: info.MaxKeySize, Flags: info.Flags})
+	}
+	sort.Slice(remote.Mechanisms, func(i, j int) bool { return remote.Mechanisms[i].Mechanism < remote.Mechanisms[j].Mechanism })
+	return remote
+}
+
+func (c *remoteCapabilities) tokenCapabilities() *tokenCapabilities {
+	capabilities := &tokenCapabilities{mechanisms: make(map[uint]pkcs11.MechanismInfo, len(c.Mechanisms)), canSign: c.CanSign}
+	for _, mechanism := range c.Mechanisms {
+		capabilities.mechanisms[mechanism.Mechanism] = pkcs11.MechanismInfo{MinKeySize: mechanism.MinKeySize, MaxKeySize: mechanism.MaxKeySize, Flags: mechanism.Flags}
+	}
+	return capabilities
+}
+
+type remoteSignRequest struct {
+	Hash   string `json:"hash"`
+	Digest []byte `json:"digest"`
+	// Set for RSA-PSS signatures, with the salt length of rsa.PSSOptions.
+	PSSSaltLength *int `json:"pss_salt_length,omitempty"`
+}
+
+type remoteSignResponse struct {
+	Signature []byte `json:"signature"`
+}
+
+var remoteSignerHashes = map[string]crypto.Hash{
+	crypto.SHA1.String():   crypto.SHA1,
+	crypto.SHA256.String(): crypto.SHA256,
+	crypto.SHA384.String(): crypto.SHA384,
+	crypto.SHA512.String(): crypto.SHA512,
+}
+
+// remoteSigner exposes the keys of the token to other machines, which
+// authenticate with a client certificate: the keys never leave the card, only
+// the digests to sign and the signatures cross the network.
+type remoteSigner struct {
+	keys           []remoteKey
+	signers        []crypto.Signer
+	allowedClients map[string]bool
+}
+
+// newRemoteSigner serves the certificates, with the chains found among the
+// others and the capabilities of their keys, nil if unknown, and signs with
+// their keys. If allowedClients is not empty, only the clients with one of
+// these common names are served.
+func newRemoteSigner(certificates []tls.Certificate, capabilities []*tokenCapabilities, others []*x509.Certificate, allowedClients []string) *remoteSigner {
+	s := &remoteSigner{allowedClients: map[string]bool{}}
+	for index, cert := range certificates {
+		key := remoteKey{Index: index, Key: describePublicKey(cert.Leaf.PublicKey), Capabilities: newRemoteCapabilities(capabilities[index])}
+		for _, chainCert := range certificateChain(cert.Leaf, others) {
+			key.Certificates = append(key.Certificates, chainCert.Raw)
+		}
+		s.keys = append(s.keys, key)
+		s.signers = append(s.signers, cert.PrivateKey.(crypto.Signer))
+	}
+	for _, client := range allowedClients {
+		s.allowedClients[client] = true
+	}
+	return s
+}
+
+func (s *remoteSigner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		http.Error(w, "Client certificate required", http.StatusUnauthorized)
+		return
+	}
+	client := r.TLS.PeerCertificates[0].Subject.CommonName
+	if len(s.allowedClients) > 0 && !s.allowedClients[client] {
+		timedLog(fmt.Sprintf("Rejected the remote signer client %q from %s", client, r.RemoteAddr))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if r.URL.Path == remoteSignerKeysPath {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		responseBody, _ := json.Marshal(s.keys)
+		w.Write(responseBody)
+		return
+	}
+
+	indexValue, ok := strings.CutPrefix(r.URL.Path, remoteSignerKeysPath+"/")
+	if ok {
+		indexValue, ok = strings.CutSuffix(indexValue, "/sign")
+	}
+	index, err := strconv.Atoi(indexValue)
+	if !ok || err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if index < 0 || index >= len(s.signers) {
+		http.Error(w, "Unknown key", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var request remoteSignRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	hash, ok := remoteSignerHashes[request.Hash]
+	if !ok || len(request.Digest) != hash.Size() {
+		http.Error(w, "Invalid hash or digest", http.StatusBadRequest)
+		return
+	}
+	var opts crypto.SignerOpts = hash
+	if request.PSSSaltLength != nil {
+		opts = &rsa.PSSOptions{SaltLength: *request.PSSSaltLength, Hash: hash}
+	}
+	signature, err := s.signers[index].Sign(rand.Reader, request.Digest, opts)
+	if err != nil {
+		timedLog(fmt.Sprintf("Unable to sign for the remote signer client %q from %s with key %d: %v", client, r.RemoteAddr, index, err))
+		http.Error(w, "Unable to sign", http.StatusBadGateway)
+		return
+	}
+	timedLog(fmt.Sprintf("Signed a %s digest for the remote signer client %q from %s with key %d", hash, client, r.RemoteAddr, index))
+	w.Header().Set("Content-Type", "application/json")
+	responseBody, _ := json.Marshal(remoteSignResponse{Signature: signature})
+	w.Write(responseBody)
+}
+
+// runRemoteSigner serves the keys of the token to the proxies of
+// remote-signer-url, until it fails.
+func runRemoteSigner(c *config) error {
+	pinVal, err := c.tokenPin()
+	if err != nil {
+		return err
+	}
+	context, err := configureToken(c.pkcs11path, c.tokenSerial, pinVal, c.pkcs11MaxSessions)
+	if err != nil {
+		return err
+	}
+	return serveRemoteSigner(context, c.pkcs11path, c.tokenSerial, c.remoteSignerAddr, c.remoteSignerCert, c.remoteSignerKey, c.remoteSignerClientCA, c.remoteSignerAllowClients, c.maxConcurrentSignatures, c.signatureQueueTimeout, c.pkcs11PoolWaitTimeout, c.touch())
+}
+
+// serveRemoteSigner serves the keys of the token on addr over TLS with the
+// certificate and key files, to the clients with a certificate issued by
+// one of the CAs of the clientCAFile.
+func serveRemoteSigner(context *crypto11.Context, pkcs11path, tokenSerial, addr, certFile, keyFile, clientCAFile string, allowedClients []string, maxConcurrentSignatures int, signatureQueueTimeout, poolWaitTimeout time.Duration, touch touchPolicy) error {
+	serverCertificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load the remote signer certificate: %v", err)
+	}
+	clientCAs, err := loadCertPool(clientCAFile)
+	if err != nil {
+		return fmt.Errorf("cannot load the remote signer client CA: %v", err)
+	}
+	certificates, err := context.FindAllPairedCertificates()
+	if err != nil {
+		return err
+	}
+	others, err := tokenCertificates(pkcs11path, tokenSerial)
+	if err != nil {
+		timedLog(fmt.Sprintf("Unable to look for the chains on the token: %v", err))
+	}
+	// One token signs for all the keys.
+	slots := newSignatureSlots(maxConcurrentSignatures)
+	capabilities := make([]*tokenCapabilities, len(certificates))
+	for i := range certificates {
+		if capabilities[i], err = probeToken(context, pkcs11path, tokenSerial, certificates[i].PrivateKey); err != nil {
+			timedLog(fmt.Sprintf("Unable to probe the token capabilities of key %d, the clients will not adjust their TLS parameters: %v", i, err))
+		}
+		certificates[i].PrivateKey = tokenSigner(certificates[i].PrivateKey.(crypto.Signer), slots, signatureQueueTimeout, poolWaitTimeout, touch)
+		timedLog(fmt.Sprintf("Serving key %d of %v", i, certificates[i].Leaf.Subject))
+	}
+
+	server := &http.Server{
+		Addr:    addr,
+		Handler: newRemoteSigner(certificates, capabilities, others, allowedClients),
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{serverCertificate},
+			ClientCAs:    clientCAs,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			MinVersion:   tls.VersionTLS12,
+		},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	timedLog(fmt.Sprintf("Remote signer listening on %s", addr))
+	return server.ListenAndServeTLS("", "")
+}
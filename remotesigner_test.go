@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+// writeClientFiles writes the certificate of the key and the key in PEM
+// files, returning their paths.
+func writeClientFiles(t *testing.T, cert tls.Certificate) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Leaf.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestRemoteSigner(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A token making RSA signatures, but not RSA-PSS ones.
+	rsaCapabilities := &tokenCapabilities{mechanisms: map[uint]pkcs11.MechanismInfo{
+		pkcs11.CKM_RSA_PKCS:        {MinKeySize: 1024, MaxKeySize: 4096, Flags: pkcs11.CKF_SIGN},
+		pkcs11.CKM_SHA256_RSA_PKCS: {MinKeySize: 1024, MaxKeySize: 4096, Flags: pkcs11.CKF_SIGN},
+	}, canSign: true}
+	certificates := []tls.Certificate{testCertificate(t, rsaKey, "rsa"), testCertificate(t, ecKey, "ec")}
+	signer := newRemoteSigner(certificates, []*tokenCapabilities{rsaCapabilities, nil}, nil, []string{"client"})
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCertificate := testCertificate(t, clientKey, "client")
+	otherCertificate := testCertificate(t, clientKey, "other")
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCertificate.Leaf)
+	clientCAs.AddCert(otherCertificate.Leaf)
+	server := httptest.NewUnstartedServer(signer)
+	server.TLS = &tls.Config{ClientCAs: clientCAs, ClientAuth: tls.RequireAndVerifyClientCert}
+	server.StartTLS()
+	defer server.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := writeClientFiles(t, clientCertificate)
+	client, err := newRemoteSignerClient(server.URL, certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := client.certificates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remote) != 2 || !remote[0].Leaf.Equal(certificates[0].Leaf) || !remote[1].Leaf.Equal(certificates[1].Leaf) {
+		t.Fatalf("certificates of the remote signer: %d", len(remote))
+	}
+
+	// The capabilities probed by the remote signer gate the TLS features
+	// like those of a local token.
+	capabilities := remoteKeyCapabilities(remote[0].PrivateKey)
+	if capabilities == nil || !capabilities.canSign || len(capabilities.mechanisms) != 2 || capabilities.mechanisms[pkcs11.CKM_RSA_PKCS] != rsaCapabilities.mechanisms[pkcs11.CKM_RSA_PKCS] {
+		t.Fatalf("capabilities of the RSA key: %+v", capabilities)
+	}
+	config := &tls.Config{}
+	gateTLSFeatures(&remote[0], config, capabilities, "auto")
+	if config.MaxVersion != tls.VersionTLS12 {
+		t.Errorf("without RSA-PSS on the remote token, TLS is capped at %x", config.MaxVersion)
+	}
+	if capabilities := remoteKeyCapabilities(remote[1].PrivateKey); capabilities != nil {
+		t.Errorf("capabilities of the unprobed key: %+v", capabilities)
+	}
+
+	digest := sha256.Sum256([]byte("signed remotely"))
+	rsaSigner := remote[0].PrivateKey.(crypto.Signer)
+	signature, err := rsaSigner.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Errorf("PKCS#1 v1.5 signature: %v", err)
+	}
+	// The salt length of the options crosses the network: the verification
+	// with another one fails.
+	for _, saltLength := range []int{rsa.PSSSaltLengthEqualsHash, 20, rsa.PSSSaltLengthAuto} {
+		signature, err := rsaSigner.Sign(rand.Reader, digest[:], &rsa.PSSOptions{SaltLength: saltLength, Hash: crypto.SHA256})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rsa.VerifyPSS(&rsaKey.PublicKey, crypto.SHA256, digest[:], signature, &rsa.PSSOptions{SaltLength: saltLength}); err != nil {
+			t.Errorf("RSA-PSS signature with the salt length %d: %v", saltLength, err)
+		}
+		other := rsa.PSSSaltLengthEqualsHash
+		if saltLength == rsa.PSSSaltLengthEqualsHash {
+			other = 20
+		}
+		if rsa.VerifyPSS(&rsaKey.PublicKey, crypto.SHA256, digest[:], signature, &rsa.PSSOptions{SaltLength: other}) == nil {
+			t.Errorf("RSA-PSS signature with the salt length %d verifies with %d", saltLength, other)
+		}
+	}
+	signature, err = remote[1].PrivateKey.(crypto.Signer).Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(&ecKey.PublicKey, digest[:], signature) {
+		t.Error("the ECDSA signature does not verify")
+	}
+
+	if _, err := rsaSigner.Sign(rand.Reader, digest[:20], crypto.SHA256); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("digest of the wrong size: %v", err)
+	}
+	unknown := &remoteKeySigner{client: client, index: 2, public: rsaKey.Public()}
+	if _, err := unknown.Sign(rand.Reader, digest[:], crypto.SHA256); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("unknown key: %v", err)
+	}
+
+	certFile, keyFile = writeClientFiles(t, otherCertificate)
+	other, err := newRemoteSignerClient(server.URL, certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.certificates(); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("client not allowed: %v", err)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// stripMountPath removes the local prefix the upstream is served under from
+// the path of the request, which the mux only routes to the proxy when it
+// starts with the prefix.
+func stripMountPath(r *http.Request, mountPath string) {
+	if mountPath == "/" {
+		return
+	}
+	prefix := strings.TrimSuffix(mountPath, "/")
+	r.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+	if r.URL.RawPath != "" {
+		if rawPath, found := strings.CutPrefix(r.URL.RawPath, prefix); found {
+			r.URL.RawPath = rawPath
+		} else {
+			r.URL.RawPath = ""
+		}
+	}
+}
+
+// preserveRawPath makes the request forwarded to the upstream carry the path
+// and query exactly as the client escaped them, like %2F, %20 or ;, which the
+// parsing and encoding of the URL could otherwise normalize. It is called
+// after the reverse proxy has joined the path of the upstream to the one of
+// the request, and leaves the requests whose path was rewritten alone.
+func preserveRawPath(req *http.Request, upstream *url.URL, mountPath string) {
+	rawPath, rawQuery, _ := strings.Cut(req.RequestURI, "?")
+	if !strings.HasPrefix(rawPath, "/") {
+		return
+	}
+	if mountPath != "/" {
+		var found bool
+		if rawPath, found = strings.CutPrefix(rawPath, strings.TrimSuffix(mountPath, "/")); !found {
+			return
+		}
+	}
+	joined := strings.TrimSuffix(upstream.EscapedPath(), "/") + rawPath
+	if strings.HasSuffix(upstream.EscapedPath(), "/") && rawPath == "/" && upstream.EscapedPath() != "/" {
+		joined = upstream.EscapedPath()
+	}
+	if path, err := url.PathUnescape(joined); err != nil || path != req.URL.Path {
+		return
+	}
+	if req.URL.EscapedPath() != joined {
+		req.URL.RawPath = joined
+		if req.URL.EscapedPath() != joined {
+			// Not a valid encoding for net/url: send the path as it is.
+			req.URL.Opaque = joined
+		}
+	}
+	if upstream.RawQuery == "" {
+		req.URL.RawQuery = rawQuery
+		req.URL.ForceQuery = strings.HasSuffix(req.RequestURI, "?")
+	}
+	// A parsed form would make the reverse proxy encode the query again.
+	req.Form = nil
+}
+
+// proxyRouter sends the requests under the mount path straight to the proxy,
+// since the mux would redirect the ones whose path is not clean, like //a or
+// /a/../b, which the upstream may expect as they are. The other requests,
+// including the ones for the endpoints of the proxy, go through the mux.
+func proxyRouter(mux http.Handler, proxy http.Handler, mountPath string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, mountPath) && !strings.HasPrefix(r.URL.Path, "/.pkcs11-web-proxy/") {
+			proxy.ServeHTTP(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// pathRewrite replaces the request paths matching a regular expression, with
+// the $1 style references to its capture groups.
+type pathRewrite struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// parsePathRewrites parses pattern=replacement entries, like ^/v1/(.*)=/$1.
+func parsePathRewrites(entries []string) ([]pathRewrite, error) {
+	rules := make([]pathRewrite, 0, len(entries))
+	for _, entry := range entries {
+		pattern, replacement, found := strings.Cut(entry, "=")
+		if !found || pattern == "" || replacement == "" {
+			return nil, fmt.Errorf("invalid path rewrite %q, expected pattern=replacement", entry)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path rewrite %q: %v", entry, err)
+		}
+		rules = append(rules, pathRewrite{pattern: re, replacement: replacement})
+	}
+	return rules, nil
+}
+
+// pathRewriteHandler rewrites the escaped path of the requests with the first
+// matching rule, before they are routed, so that the result is handled like a
+// path sent by the client. A query in the replacement is put before the one of
+// the request. The endpoints of the proxy are left alone.
+func pathRewriteHandler(next http.Handler, rules []pathRewrite) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/.pkcs11-web-proxy/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		escaped := r.URL.EscapedPath()
+		for _, rule := range rules {
+			if !rule.pattern.MatchString(escaped) {
+				continue
+			}
+			rewritten, query, hasQuery := strings.Cut(rule.pattern.ReplaceAllString(escaped, rule.replacement), "?")
+			path, err := url.PathUnescape(rewritten)
+			if err != nil || !strings.HasPrefix(rewritten, "/") {
+				timedLog(fmt.Sprintf("Path rewrite of %s to %s is not a valid path", escaped, rewritten))
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+			u := *r.URL
+			u.Path, u.RawPath = path, rewritten
+			if hasQuery && u.RawQuery != "" && query != "" {
+				u.RawQuery = query + "&" + u.RawQuery
+			} else if hasQuery && query != "" {
+				u.RawQuery = query
+			}
+			rewrittenRequest := new(http.Request)
+			*rewrittenRequest = *r
+			rewrittenRequest.URL = &u
+			r = rewrittenRequest
+			break
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rewriteRoute maps the URLs under an upstream location to a local one.
+type rewriteRoute struct {
+	from *url.URL
+	to   string
+}
+
+// urlRewriter maps the URLs of the upstreams found in the responses, like in
+// the redirects, to the ones of the proxy. The URLs of the destinations are
+// mapped under the mount path, those of the other hosts according to the
+// additional routes, and the others are left as they are.
+type urlRewriter struct {
+	mountPath string
+	upstreams []*url.URL
+	routes    []rewriteRoute
+}
+
+// parseRewriteRoutes parses upstream=local entries, like
+// https://sso.example.com=http://127.0.0.1:8081.
+func parseRewriteRoutes(entries []string) ([]rewriteRoute, error) {
+	routes := make([]rewriteRoute, 0, len(entries))
+	for _, entry := range entries {
+		from, to, found := strings.Cut(entry, "=")
+		fromURL, err := url.Parse(from)
+		if !found || err != nil || fromURL.Host == "" || (fromURL.Scheme != "http" && fromURL.Scheme != "https") || to == "" {
+			return nil, fmt.Errorf("invalid location map %q, expected upstream-url=local-url", entry)
+		}
+		routes = append(routes, rewriteRoute{from: fromURL, to: strings.TrimSuffix(to, "/")})
+	}
+	return routes, nil
+}
+
+// rewrite maps a URL found in the response to a request to base, sent to
+// the destination upstream. Relative references are left alone, since the
+// client resolves them against the local URL.
+func (rw *urlRewriter) rewrite(value string, upstream, base *url.URL) string {
+	ref, err := url.Parse(value)
+	if err != nil || (ref.Scheme != "" && ref.Scheme != "http" && ref.Scheme != "https") {
+		return value
+	}
+	if ref.Host == "" {
+		if ref.Scheme != "" || !strings.HasPrefix(ref.Path, "/") {
+			return value
+		}
+		if rest, ok := underPath(ref.EscapedPath(), upstream); ok {
+			return strings.TrimSuffix(rw.mountPath, "/") + rest + querySuffix(ref)
+		}
+		return value
+	}
+
+	// The URLs of the other destinations are mapped too, for the
+	// redirects between the balanced upstreams.
+	target := base.ResolveReference(ref)
+	for _, other := range append([]*url.URL{upstream}, rw.upstreams...) {
+		if sameOrigin(target, other) {
+			if rest, ok := underPath(target.EscapedPath(), other); ok {
+				return strings.TrimSuffix(rw.mountPath, "/") + rest + querySuffix(target)
+			}
+		}
+	}
+	for _, route := range rw.routes {
+		if sameOrigin(target, route.from) {
+			if rest, ok := underPath(target.EscapedPath(), route.from); ok {
+				return route.to + rest + querySuffix(target)
+			}
+		}
+	}
+	return value
+}
+
+// rewriteHeaders maps the URLs of the headers of a response pointing the
+// client to another resource.
+func (rw *urlRewriter) rewriteHeaders(header http.Header, upstream, base *url.URL) {
+	for _, name := range []string{"Location", "Content-Location"} {
+		if value := header.Get(name); value != "" {
+			header.Set(name, rw.rewrite(value, upstream, base))
+		}
+	}
+	if value := header.Get("Refresh"); value != "" {
+		header.Set("Refresh", rw.rewriteRefresh(value, upstream, base))
+	}
+	if values := header.Values("Link"); len(values) > 0 {
+		header.Del("Link")
+		for _, value := range values {
+			header.Add("Link", rw.rewriteLink(value, upstream, base))
+		}
+	}
+}
+
+// rewriteRefresh maps the URL of a Refresh header, like 5; url=/next.
+func (rw *urlRewriter) rewriteRefresh(value string, upstream, base *url.URL) string {
+	index := strings.Index(strings.ToLower(value), "url=")
+	if index < 0 {
+		return value
+	}
+	target := strings.TrimSpace(value[index+len("url="):])
+	quote := ""
+	if len(target) >= 2 && (target[0] == '\'' || target[0] == '"') && target[len(target)-1] == target[0] {
+		quote = target[:1]
+		target = target[1 : len(target)-1]
+	}
+	return value[:index+len("url=")] + quote + rw.rewrite(target, upstream, base) + quote
+}
+
+// rewriteLink maps the URLs between angle brackets of a Link header, like
+// </style.css>; rel=preload, <https://upstream/next>; rel=next.
+func (rw *urlRewriter) rewriteLink(value string, upstream, base *url.URL) string {
+	var rewritten strings.Builder
+	for {
+		before, rest, found := strings.Cut(value, "<")
+		target, after, closed := strings.Cut(rest, ">")
+		if !found || !closed {
+			rewritten.WriteString(value)
+			return rewritten.String()
+		}
+		rewritten.WriteString(before + "<" + rw.rewrite(target, upstream, base) + ">")
+		value = after
+	}
+}
+
+// cookiePath maps the Path attribute of a cookie set by the upstream. A path
+// above the one of the destination covers all of the mount path.
+func (rw *urlRewriter) cookiePath(path string, upstream *url.URL) string {
+	if rest, ok := underPath(path, upstream); ok {
+		return strings.TrimSuffix(rw.mountPath, "/") + rest
+	}
+	return rw.mountPath
+}
+
+// underPath returns the part of the escaped path after the path of the
+// upstream, which the reverse proxy prepends to the paths of the requests.
+// The empty path of a URL like https://upstream is its root.
+func underPath(path string, upstream *url.URL) (string, bool) {
+	if path == "" {
+		path = "/"
+	}
+	prefix := strings.TrimSuffix(upstream.EscapedPath(), "/")
+	if prefix == "" {
+		return path, true
+	}
+	if path == prefix {
+		return "/", true
+	}
+	if rest, found := strings.CutPrefix(path, prefix); found && strings.HasPrefix(rest, "/") {
+		return rest, true
+	}
+	return "", false
+}
+
+func querySuffix(u *url.URL) string {
+	suffix := ""
+	if u.ForceQuery || u.RawQuery != "" {
+		suffix = "?" + u.RawQuery
+	}
+	if u.Fragment != "" {
+		suffix += "#" + u.EscapedFragment()
+	}
+	return suffix
+}
+
+// sameOrigin tells whether the URLs have the same scheme, host and port,
+// considering the default ports of the schemes.
+func sameOrigin(a, b *url.URL) bool {
+	return strings.EqualFold(a.Scheme, b.Scheme) && strings.EqualFold(a.Hostname(), b.Hostname()) && urlPort(a) == urlPort(b)
+}
+
+func urlPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	if strings.EqualFold(u.Scheme, "https") {
+		return "443"
+	}
+	return "80"
+}
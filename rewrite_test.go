@@ -0,0 +1,215 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+)
+
+// testURLRewriter maps the URLs of two balanced upstreams under /app/, and
+// those of two other hosts.
+func testURLRewriter(t *testing.T, mountPath string) (*urlRewriter, *url.URL, *url.URL) {
+	t.Helper()
+	upstream, _ := url.Parse("https://upstream.example.com/base/")
+	other, _ := url.Parse("https://other.example.com:8443/")
+	routes, err := parseRewriteRoutes([]string{"https://sso.example.com=http://127.0.0.1:8081/", "https://idp.example.com/auth=/idp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, _ := url.Parse("https://upstream.example.com/base/page")
+	return &urlRewriter{mountPath: mountPath, upstreams: []*url.URL{upstream, other}, routes: routes}, upstream, base
+}
+
+func TestURLRewriter(t *testing.T) {
+	tests := []struct {
+		value, rewritten string
+	}{
+		{"https://upstream.example.com/base/next?x=1#top", "/app/next?x=1#top"},
+		{"https://upstream.example.com/base/", "/app/"},
+		{"https://upstream.example.com/base", "/app/"},
+		{"https://upstream.example.com/base/next?", "/app/next?"},
+		{"HTTPS://Upstream.Example.COM/base/next", "/app/next"},
+		// Explicit default ports are the same origin, other ports are not.
+		{"https://upstream.example.com:443/base/next", "/app/next"},
+		{"https://upstream.example.com:8443/base/next", "https://upstream.example.com:8443/base/next"},
+		{"http://upstream.example.com/base/next", "http://upstream.example.com/base/next"},
+		// Scheme-relative URLs take the scheme of the request.
+		{"//upstream.example.com/base/next", "/app/next"},
+		{"//other.example.com:8443/next", "/app/next"},
+		{"//evil.example.com/base/next", "//evil.example.com/base/next"},
+		// The prefix of the upstream is a whole segment.
+		{"https://upstream.example.com/basement", "https://upstream.example.com/basement"},
+		{"https://upstream.example.com/other/next", "https://upstream.example.com/other/next"},
+		{"/base/next", "/app/next"},
+		{"/base", "/app/"},
+		{"/other/next", "/other/next"},
+		{"/basement", "/basement"},
+		// The escaping of the upstream is kept.
+		{"https://upstream.example.com/base/a%2Fb%20c?q=%2F&r=a+b", "/app/a%2Fb%20c?q=%2F&r=a+b"},
+		{"/base/%E2%82%AC#a%20b", "/app/%E2%82%AC#a%20b"},
+		{"https://upstream.example.com/base/%zz", "https://upstream.example.com/base/%zz"},
+		// The other balanced upstream.
+		{"https://other.example.com:8443/next", "/app/next"},
+		{"https://other.example.com/next", "https://other.example.com/next"},
+		// The sibling hosts of the routes.
+		{"https://sso.example.com/login?next=/", "http://127.0.0.1:8081/login?next=/"},
+		{"https://sso.example.com:443/", "http://127.0.0.1:8081/"},
+		{"https://sso.example.com", "http://127.0.0.1:8081/"},
+		{"https://idp.example.com/auth/realms/x", "/idp/realms/x"},
+		{"https://idp.example.com/auth", "/idp/"},
+		{"https://idp.example.com/authz", "https://idp.example.com/authz"},
+		{"https://evil.example.com/base/next", "https://evil.example.com/base/next"},
+		// The relative references are resolved by the client.
+		{"next", "next"},
+		{"../next", "../next"},
+		{"?x=1", "?x=1"},
+		{"#top", "#top"},
+		{"mailto:admin@upstream.example.com", "mailto:admin@upstream.example.com"},
+		{"javascript:alert(1)", "javascript:alert(1)"},
+		{"", ""},
+	}
+	rw, upstream, base := testURLRewriter(t, "/app/")
+	for _, test := range tests {
+		if rewritten := rw.rewrite(test.value, upstream, base); rewritten != test.rewritten {
+			t.Errorf("rewrite(%q) = %q, want %q", test.value, rewritten, test.rewritten)
+		}
+	}
+
+	rw, upstream, base = testURLRewriter(t, "/")
+	for value, rewritten := range map[string]string{
+		"https://upstream.example.com/base/next": "/next",
+		"https://upstream.example.com/base":      "/",
+		"/base/next?x=1":                         "/next?x=1",
+		"https://other.example.com:8443/":        "/",
+		"https://other.example.com:8443":         "/",
+	} {
+		if got := rw.rewrite(value, upstream, base); got != rewritten {
+			t.Errorf("at /, rewrite(%q) = %q, want %q", value, got, rewritten)
+		}
+	}
+}
+
+func TestRewriteHeaders(t *testing.T) {
+	rw, upstream, base := testURLRewriter(t, "/app/")
+	refreshes := map[string]string{
+		"5; url=https://upstream.example.com/base/next": "5; url=/app/next",
+		"0;URL=/base/next":                       "0;URL=/app/next",
+		"0; url='/base/next?x=1'":                "0; url='/app/next?x=1'",
+		`0; Url="https://sso.example.com/login"`: `0; Url="http://127.0.0.1:8081/login"`,
+		"0; url=https://evil.example.com/":       "0; url=https://evil.example.com/",
+		"0; url='/base/unterminated":             "0; url='/base/unterminated",
+		"5":                                      "5",
+	}
+	for value, rewritten := range refreshes {
+		if got := rw.rewriteRefresh(value, upstream, base); got != rewritten {
+			t.Errorf("rewriteRefresh(%q) = %q, want %q", value, got, rewritten)
+		}
+	}
+	links := map[string]string{
+		"</base/style.css>; rel=preload; as=style":                                   "</app/style.css>; rel=preload; as=style",
+		"</base/a>; rel=preload, <https://upstream.example.com/base/next>; rel=next": "</app/a>; rel=preload, </app/next>; rel=next",
+		"<https://cdn.example.com/font.woff2>; rel=preconnect":                       "<https://cdn.example.com/font.woff2>; rel=preconnect",
+		`<https://idp.example.com/auth/>; rel="https://example.com/rel<x>"`:          `</idp/>; rel="https://example.com/rel<x>"`,
+		"</base/unterminated; rel=next":                                              "</base/unterminated; rel=next",
+		"":                                                                           "",
+	}
+	for value, rewritten := range links {
+		if got := rw.rewriteLink(value, upstream, base); got != rewritten {
+			t.Errorf("rewriteLink(%q) = %q, want %q", value, got, rewritten)
+		}
+	}
+
+	header := http.Header{}
+	header.Set("Location", "https://upstream.example.com/base/next")
+	header.Set("Content-Location", "/base/page.json")
+	header.Set("Refresh", "0; url=/base/next")
+	header.Add("Link", "</base/a.css>; rel=preload")
+	header.Add("Link", "</base/b.js>; rel=preload")
+	rw.rewriteHeaders(header, upstream, base)
+	if header.Get("Location") != "/app/next" || header.Get("Content-Location") != "/app/page.json" || header.Get("Refresh") != "0; url=/app/next" {
+		t.Errorf("rewritten headers %v", header)
+	}
+	if links := header.Values("Link"); len(links) != 2 || links[0] != "</app/a.css>; rel=preload" || links[1] != "</app/b.js>; rel=preload" {
+		t.Errorf("rewritten links %q", links)
+	}
+}
+
+func TestUnderPath(t *testing.T) {
+	tests := []struct {
+		path, upstream, rest string
+		ok                   bool
+	}{
+		{"/a", "https://u/", "/a", true},
+		{"/a", "https://u", "/a", true},
+		{"/base", "https://u/base/", "/", true},
+		{"/base/", "https://u/base", "/", true},
+		{"/base/a", "https://u/base", "/a", true},
+		{"/basement", "https://u/base", "", false},
+		{"", "https://u/", "/", true},
+		{"", "https://u/base", "", false},
+		{"/a%2Fb", "https://u/a%2Fb/", "/", true},
+		{"/a/b", "https://u/a%2Fb/", "", false},
+	}
+	for _, test := range tests {
+		upstream, _ := url.Parse(test.upstream)
+		if rest, ok := underPath(test.path, upstream); rest != test.rest || ok != test.ok {
+			t.Errorf("underPath(%q, %q) = %q, %v", test.path, test.upstream, rest, ok)
+		}
+	}
+}
+
+func TestPreserveRawPath(t *testing.T) {
+	tests := []struct {
+		name      string
+		mountPath string
+		upstream  string
+		target    string
+		// rewrite, if set, replaces the path of the request before the
+		// proxy, like -path-rewrite.
+		rewrite    string
+		requestURI string
+	}{
+		{"escaped slash", "/", "/", "/a%2Fb", "", "/a%2Fb"},
+		{"double slash", "/", "/", "//a", "", "//a"},
+		{"parameters", "/", "/", "/a;b=c/d;e", "", "/a;b=c/d;e"},
+		{"unreserved escaped", "/", "/", "/%7Euser/%41", "", "/%7Euser/%41"},
+		{"escaped query", "/", "/", "/a%20b?q=%2F&r=a+b&s", "", "/a%20b?q=%2F&r=a+b&s"},
+		{"empty query", "/", "/", "/a?", "", "/a?"},
+		{"upstream path", "/", "/base/", "/a%2Fb", "", "/base/a%2Fb"},
+		{"upstream root", "/", "/base/", "/", "", "/base/"},
+		{"upstream query", "/", "/base/?k=v", "/a%2Fb?x=%2F", "", "/base/a%2Fb?k=v&x=%2F"},
+		{"mount path", "/app/", "/", "/app/a%2Fb?x=%2F", "", "/a%2Fb?x=%2F"},
+		{"mount path double slash", "/app/", "/base", "/app//a;b", "", "/base//a;b"},
+		{"mount path root", "/app/", "/base/", "/app/", "", "/base/"},
+		{"rewritten", "/", "/", "/a%2Fb", "/rewritten", "/rewritten"},
+	}
+	for _, test := range tests {
+		var requestURI string
+		upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestURI = r.RequestURI
+		}))
+		upstream, err := url.Parse(upstreamServer.URL + test.upstream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy := httputil.NewSingleHostReverseProxy(upstream)
+		director := proxy.Director
+		proxy.Director = func(req *http.Request) {
+			director(req)
+			preserveRawPath(req, upstream, test.mountPath)
+		}
+		r := httptest.NewRequest(http.MethodGet, test.target, nil)
+		stripMountPath(r, test.mountPath)
+		if test.rewrite != "" {
+			r.URL.Path, r.URL.RawPath = test.rewrite, ""
+		}
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, r)
+		upstreamServer.Close()
+		if recorder.Code != http.StatusOK || requestURI != test.requestURI {
+			t.Errorf("%s: %s sent as %q (%d), want %q", test.name, test.target, requestURI, recorder.Code, test.requestURI)
+		}
+	}
+}
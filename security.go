@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// rewriteHSTS applies the Strict-Transport-Security handling to the headers of
+// a response. Relayed to the local listener, the header of the upstream
+// applies to the host name of the proxy, and to all of its subdomains with
+// includeSubDomains, making the browser refuse it over plain HTTP or with a
+// certificate it doesn't trust until the header expires. In strip mode the
+// header is removed, while in rewrite mode only its max-age is kept, capped
+// at maxAge.
+func rewriteHSTS(header http.Header, mode string, maxAge time.Duration) {
+	value := header.Get("Strict-Transport-Security")
+	if value == "" || mode == "keep" {
+		return
+	}
+	if mode == "strip" {
+		header.Del("Strict-Transport-Security")
+		return
+	}
+	age := int64(maxAge / time.Second)
+	for _, directive := range strings.Split(value, ";") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if strings.EqualFold(name, "max-age") {
+			var upstreamAge int64
+			if _, err := fmt.Sscan(strings.Trim(arg, `"`), &upstreamAge); err == nil && upstreamAge < age {
+				age = upstreamAge
+			}
+		}
+	}
+	header.Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d", age))
+}
+
+// rewriteSecurityHeaders translates the origins of the upstreams referenced
+// by the Content-Security-Policy and X-Frame-Options headers to the origin
+// the client reached the proxy at, so that the browser doesn't block the
+// proxied resources.
+func (rw *urlRewriter) rewriteSecurityHeaders(header http.Header, upstream, base *url.URL, origin string) {
+	local, err := url.Parse(origin)
+	if err != nil {
+		return
+	}
+	for _, name := range []string{"Content-Security-Policy", "Content-Security-Policy-Report-Only"} {
+		values := header.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		header.Del(name)
+		for _, value := range values {
+			header.Add(name, rw.rewriteCSP(value, upstream, base, local))
+		}
+	}
+	if value := header.Get("X-Frame-Options"); len(value) > len("allow-from ") && strings.EqualFold(value[:len("allow-from ")], "allow-from ") {
+		header.Set("X-Frame-Options", value[:len("allow-from ")]+rw.rewriteSource(strings.TrimSpace(value[len("allow-from "):]), upstream, local))
+	}
+}
+
+// rewriteCSP rewrites the source expressions of a policy, and the URL of its
+// report-uri directive.
+func (rw *urlRewriter) rewriteCSP(policy string, upstream, base, local *url.URL) string {
+	directives := strings.Split(policy, ";")
+	for i, directive := range directives {
+		tokens := strings.Fields(directive)
+		if len(tokens) == 0 {
+			continue
+		}
+		for j, token := range tokens[1:] {
+			if strings.EqualFold(tokens[0], "report-uri") {
+				tokens[j+1] = rw.rewrite(token, upstream, base)
+			} else {
+				tokens[j+1] = rw.rewriteSource(token, upstream, local)
+			}
+		}
+		directives[i] = " " + strings.Join(tokens, " ")
+	}
+	return strings.TrimSpace(strings.Join(directives, ";"))
+}
+
+// rewriteSource translates a CSP host source, like https://upstream,
+// wss://upstream:443/path or upstream, referencing the host of an upstream to
+// the origin of the proxy, or to the one of its -location-map route.
+func (rw *urlRewriter) rewriteSource(source string, upstream, local *url.URL) string {
+	if strings.HasPrefix(source, "'") {
+		return source
+	}
+	scheme, rest, hasScheme := strings.Cut(source, "://")
+	if !hasScheme {
+		rest = source
+	}
+	host, _, _ := strings.Cut(rest, "/")
+	hostname := host
+	if index := strings.LastIndexByte(host, ':'); index >= 0 && !strings.HasSuffix(host, "]") {
+		hostname = host[:index]
+	}
+	if hostname == "" {
+		return source
+	}
+
+	target := local
+	matched := false
+	for _, other := range append([]*url.URL{upstream}, rw.upstreams...) {
+		matched = matched || strings.EqualFold(other.Hostname(), strings.Trim(hostname, "[]"))
+	}
+	for _, route := range rw.routes {
+		if !matched && strings.EqualFold(route.from.Hostname(), strings.Trim(hostname, "[]")) {
+			if to, err := url.Parse(route.to); err == nil && to.Host != "" {
+				target, matched = to, true
+			}
+		}
+	}
+	if !matched {
+		return source
+	}
+	if !hasScheme {
+		return target.Host
+	}
+	switch strings.ToLower(scheme) {
+	case "ws", "wss":
+		if target.Scheme == "https" {
+			return "wss://" + target.Host
+		}
+		return "ws://" + target.Host
+	}
+	return target.Scheme + "://" + target.Host
+}
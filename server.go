@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// listenerOptions holds the settings of the local listener.
+type listenerOptions struct {
+	tlsConfig        *tls.Config
+	h2c              bool
+	http2MaxStreams  uint32
+	http2IdleTimeout time.Duration
+
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+}
+
+// newServer creates the local HTTP server. HTTP/2 is offered over TLS and,
+// when enabled, in cleartext (h2c) on plain HTTP listeners. The server is TLS
+// enabled when options.tlsConfig is set.
+func newServer(addr string, handler http.Handler, options listenerOptions) (*http.Server, error) {
+	h2s := &http2.Server{
+		MaxConcurrentStreams: options.http2MaxStreams,
+		IdleTimeout:          options.http2IdleTimeout,
+	}
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		TLSConfig:         options.tlsConfig,
+		ReadHeaderTimeout: options.readHeaderTimeout,
+		ReadTimeout:       options.readTimeout,
+		WriteTimeout:      options.writeTimeout,
+		IdleTimeout:       options.idleTimeout,
+		MaxHeaderBytes:    options.maxHeaderBytes,
+	}
+	if options.tlsConfig != nil {
+		if err := http2.ConfigureServer(server, h2s); err != nil {
+			return nil, err
+		}
+	} else if options.h2c {
+		server.Handler = h2c.NewHandler(handler, h2s)
+	}
+	return server, nil
+}
+
+// newHTTP3Server creates a QUIC/HTTP3 server listening on the same address as
+// the TCP listener.
+func newHTTP3Server(addr string, handler http.Handler, tlsConfig *tls.Config) *http3.Server {
+	return &http3.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+	}
+}
+
+// advertiseHTTP3 adds the Alt-Svc header pointing to the HTTP/3 server to the
+// responses served over TCP.
+func advertiseHTTP3(h3 *http3.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = h3.SetQUICHeaders(w.Header())
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/thales-e-security/pool"
+)
+
+// meteredSigner records the outcome of the signatures performed by the token,
+// telling apart the failures due to the exhaustion of the crypto11 session
+// pool or to a missing touch from the generic ones.
+type meteredSigner struct {
+	crypto.Signer
+	poolWaitTimeout time.Duration
+}
+
+func (s *meteredSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	signature, err := s.Signer.Sign(rand, digest, opts)
+	switch {
+	case err == nil:
+		tokenSignatures.WithLabelValues("ok").Inc()
+	case errors.Is(err, errTouchTimeout):
+		tokenSignatures.WithLabelValues("touch_timeout").Inc()
+	case errors.Is(err, pool.ErrTimeout):
+		tokenSignatures.WithLabelValues("pool_exhausted").Inc()
+		return nil, fmt.Errorf("no PKCS#11 session available within %v, the session pool is exhausted (consider raising -pkcs11-max-sessions): %w", s.poolWaitTimeout, err)
+	default:
+		tokenSignatures.WithLabelValues("error").Inc()
+	}
+	return signature, err
+}
+
+// signatureSlots bounds the number of concurrent signatures performed by a
+// token, with no bound if maxConcurrent is 0. Many tokens fail with
+// CKR_DEVICE_ERROR when several TLS handshakes sign in parallel.
+type signatureSlots struct {
+	slots chan struct{}
+	// waiting counts the signatures given up by the touch timeout that still
+	// wait for the token, which takes no other signature until they are done.
+	waiting atomic.Int32
+}
+
+func newSignatureSlots(maxConcurrent int) *signatureSlots {
+	s := &signatureSlots{}
+	if maxConcurrent > 0 {
+		s.slots = make(chan struct{}, maxConcurrent)
+	}
+	return s
+}
+
+func (s *signatureSlots) acquire(queueTimeout time.Duration) error {
+	if s.waiting.Load() > 0 {
+		return fmt.Errorf("%w: a previous signature still waits for a touch", errTouchTimeout)
+	}
+	if s.slots == nil {
+		return nil
+	}
+	if queueTimeout > 0 {
+		timer := time.NewTimer(queueTimeout)
+		defer timer.Stop()
+		select {
+		case s.slots <- struct{}{}:
+		case <-timer.C:
+			return fmt.Errorf("timed out after %v waiting for the token to be available for signing", queueTimeout)
+		}
+	} else {
+		s.slots <- struct{}{}
+	}
+	return nil
+}
+
+func (s *signatureSlots) release() {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+// limitedSigner signs with a slot of the token, which it keeps until the token
+// is done signing, even when the signature is given up by the touch timeout.
+type limitedSigner struct {
+	crypto.Signer
+	slots        *signatureSlots
+	queueTimeout time.Duration
+	touch        touchPolicy
+}
+
+func (s *limitedSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if err := s.slots.acquire(s.queueTimeout); err != nil {
+		return nil, err
+	}
+	return s.touch.sign(s.Signer, rand, digest, opts, s.slots)
+}
+
+// tokenSigner wraps a key of the token to sign with the slots of the token,
+// waiting for a touch as configured, and to record the signatures.
+func tokenSigner(signer crypto.Signer, slots *signatureSlots, queueTimeout, poolWaitTimeout time.Duration, touch touchPolicy) crypto.Signer {
+	return &meteredSigner{Signer: &limitedSigner{Signer: signer, slots: slots, queueTimeout: queueTimeout, touch: touch}, poolWaitTimeout: poolWaitTimeout}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var signatureHashes = map[string]crypto.Hash{
+	"sha1":   crypto.SHA1,
+	"sha256": crypto.SHA256,
+	"sha384": crypto.SHA384,
+	"sha512": crypto.SHA512,
+}
+
+// signatureOptions returns the options to sign with the hash named name,
+// with RSA-PSS instead of PKCS#1 v1.5 if pss.
+func signatureOptions(name string, pss bool) (crypto.SignerOpts, error) {
+	hash, ok := signatureHashes[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("invalid hash %q, use sha1, sha256, sha384 or sha512", name)
+	}
+	if pss {
+		return &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hash}, nil
+	}
+	return hash, nil
+}
+
+func hashFile(file string, hash crypto.Hash) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := hash.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// runSign prints the signature of the file argument of sign, writing its
+// timestamp token to timestamp-file with tsa-url.
+func runSign(c *config) error {
+	pinVal, err := c.tokenPin()
+	if err != nil {
+		return err
+	}
+	opts, err := signatureOptions(c.signatureHash, c.signaturePSS)
+	if err != nil {
+		return err
+	}
+	tsa, err := c.timestampAuthority()
+	if err != nil {
+		return err
+	}
+	return signFile(&c.pkcs11path, &c.tokenSerial, pinVal, c.certificateIndex, c.args[0], opts, tsa, c.timestampFile)
+}
+
+// signFile writes to stdout the signature of the file made by the key of the
+// certificate at the index: PKCS#1 v1.5 or PSS for RSA, ASN.1 for ECDSA, like
+// "openssl dgst -sign" does. If tsa is not nil, the timestamp token of the
+// signature is written to the timestampFile.
+func signFile(pkcs11path, tokenSerial *string, pinVal string, index int, file string, opts crypto.SignerOpts, tsa *timestampAuthority, timestampFile string) error {
+	context, err := configureToken(*pkcs11path, *tokenSerial, pinVal, 0)
+	if err != nil {
+		return err
+	}
+	cert, err := pairedCertificate(context, index)
+	if err != nil {
+		return err
+	}
+	signer := cert.PrivateKey.(crypto.Signer)
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		if _, ok := signer.Public().(*rsa.PublicKey); !ok {
+			return errors.New("PSS signatures require an RSA key")
+		}
+	}
+	digest, err := hashFile(file, opts.HashFunc())
+	if err != nil {
+		return err
+	}
+	signature, err := signer.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		return err
+	}
+	if tsa != nil {
+		token, err := tsa.timestamp(signature)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(timestampFile, token, 0644); err != nil {
+			return err
+		}
+	}
+	_, err = os.Stdout.Write(signature)
+	return err
+}
+
+// runVerify checks the signature of the file given to verify.
+func runVerify(c *config) error {
+	pinVal, err := c.tokenPin()
+	if err != nil {
+		return err
+	}
+	opts, err := signatureOptions(c.signatureHash, c.signaturePSS)
+	if err != nil {
+		return err
+	}
+	return verifyFile(&c.pkcs11path, &c.tokenSerial, pinVal, c.certificateIndex, c.args[0], c.args[1], opts)
+}
+
+// verifyFile checks the signature of the file with the public key of the
+// certificate at the index.
+func verifyFile(pkcs11path, tokenSerial *string, pinVal string, index int, file, signatureFile string, opts crypto.SignerOpts) error {
+	context, err := configureToken(*pkcs11path, *tokenSerial, pinVal, 0)
+	if err != nil {
+		return err
+	}
+	cert, err := pairedCertificate(context, index)
+	if err != nil {
+		return err
+	}
+	signature, err := os.ReadFile(signatureFile)
+	if err != nil {
+		return err
+	}
+	digest, err := hashFile(file, opts.HashFunc())
+	if err != nil {
+		return err
+	}
+	if err := verifySignature(cert.Leaf, digest, signature, opts); err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	fmt.Printf("Valid signature of %s by %v\n", file, cert.Leaf.Subject)
+	return nil
+}
+
+func verifySignature(cert *x509.Certificate, digest, signature []byte, opts crypto.SignerOpts) error {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			return rsa.VerifyPSS(key, pss.Hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto})
+		}
+		return rsa.VerifyPKCS1v15(key, opts.HashFunc(), digest, signature)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest, signature) {
+			return errors.New("verification failed")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key %s", describePublicKey(cert.PublicKey))
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	smimePath           = "/.pkcs11-web-proxy/smime"
+	maxSMIMEContentSize = 32 << 20
+)
+
+var smimeMicalgs = map[crypto.Hash]string{
+	crypto.SHA1:   "sha-1",
+	crypto.SHA256: "sha-256",
+	crypto.SHA384: "sha-384",
+	crypto.SHA512: "sha-512",
+}
+
+// smimeSigner signs MIME content with a key of the token as S/MIME
+// multipart/signed messages, for the mail gateways sending mail with the
+// identity of the card.
+type smimeSigner struct {
+	signer crypto.Signer
+	chain  []*x509.Certificate
+	hash   crypto.Hash
+	tsa    *timestampAuthority
+	apiKey []byte
+}
+
+// canonicalMIME returns the content with CRLF line endings, as it is signed
+// and sent.
+func canonicalMIME(content []byte) []byte {
+	content = bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(content, []byte("\n"), []byte("\r\n"))
+}
+
+// splitMIMEHeaders splits a message into the headers of the mail, like From
+// or Subject, and the MIME entity to sign, with the Content-* headers and the
+// body. The MIME-Version header is dropped, the signed message has its own.
+func splitMIMEHeaders(message []byte) (mailHeaders, entity []byte, err error) {
+	var header, body []byte
+	if bytes.HasPrefix(message, []byte("\r\n")) {
+		body = message[2:]
+	} else {
+		end := bytes.Index(message, []byte("\r\n\r\n"))
+		if end < 0 {
+			return nil, nil, errors.New("the content must be a MIME entity: headers, an empty line and the body")
+		}
+		header, body = message[:end+2], message[end+4:]
+	}
+
+	var entityHeaders []byte
+	for len(header) > 0 {
+		// A field goes on until a line that is not a continuation.
+		end := bytes.Index(header, []byte("\r\n")) + 2
+		for end < len(header) && (header[end] == ' ' || header[end] == '\t') {
+			end += bytes.Index(header[end:], []byte("\r\n")) + 2
+		}
+		field := header[:end]
+		header = header[end:]
+		name, _, ok := bytes.Cut(field, []byte(":"))
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid MIME header %q", strings.TrimSpace(string(field)))
+		}
+		switch name := strings.ToLower(strings.TrimSpace(string(name))); {
+		case name == "mime-version":
+		case strings.HasPrefix(name, "content-"):
+			entityHeaders = append(entityHeaders, field...)
+		default:
+			mailHeaders = append(mailHeaders, field...)
+		}
+	}
+	return mailHeaders, append(append(entityHeaders, "\r\n"...), body...), nil
+}
+
+// sign returns the multipart/signed message of RFC 8551 made of the MIME
+// entity of the content and its detached CMS signature, with the mail
+// headers of the content.
+func (s *smimeSigner) sign(content []byte) ([]byte, error) {
+	mailHeaders, entity, err := splitMIMEHeaders(canonicalMIME(content))
+	if err != nil {
+		return nil, err
+	}
+	h := s.hash.New()
+	h.Write(entity)
+	signature, err := signedDataCMS(h.Sum(nil), nil, s.hash, s.signer, s.chain, s.tsa)
+	if err != nil {
+		return nil, err
+	}
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	boundary := "----" + hex.EncodeToString(random)
+
+	var message bytes.Buffer
+	message.Write(mailHeaders)
+	message.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; micalg=%s; boundary=\"%s\"\r\n\r\n", smimeMicalgs[s.hash], boundary)
+	message.WriteString("This is an S/MIME signed message\r\n\r\n")
+	fmt.Fprintf(&message, "--%s\r\n", boundary)
+	message.Write(entity)
+	fmt.Fprintf(&message, "\r\n--%s\r\n", boundary)
+	message.WriteString("Content-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\n")
+	message.WriteString("Content-Transfer-Encoding: base64\r\n")
+	message.WriteString("Content-Disposition: attachment; filename=\"smime.p7s\"\r\n\r\n")
+	encoded := base64.StdEncoding.EncodeToString(signature)
+	for len(encoded) > 76 {
+		message.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	message.WriteString(encoded + "\r\n")
+	fmt.Fprintf(&message, "\r\n--%s--\r\n", boundary)
+	return message.Bytes(), nil
+}
+
+func (s *smimeSigner) handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizedBearer(r, s.apiKey) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="pkcs11-web-proxy"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	content, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSMIMEContentSize))
+	if err != nil {
+		http.Error(w, "Invalid content", http.StatusBadRequest)
+		return
+	}
+	message, err := s.sign(content)
+	if err != nil {
+		timedLog(fmt.Sprintf("Unable to S/MIME sign for %s: %v", r.RemoteAddr, err))
+		http.Error(w, fmt.Sprintf("Unable to sign: %v", err), http.StatusBadRequest)
+		return
+	}
+	timedLog(fmt.Sprintf("S/MIME signed %d bytes for %s", len(content), r.RemoteAddr))
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Write(message)
+}
+
+// runSMIMESign prints the MIME content of the file argument of smime-sign,
+// S/MIME signed.
+func runSMIMESign(c *config) error {
+	pinVal, err := c.tokenPin()
+	if err != nil {
+		return err
+	}
+	opts, err := signatureOptions(c.signatureHash, false)
+	if err != nil {
+		return err
+	}
+	tsa, err := c.timestampAuthority()
+	if err != nil {
+		return err
+	}
+	return smimeSignFile(&c.pkcs11path, &c.tokenSerial, pinVal, c.certificateIndex, c.args[0], opts.HashFunc(), tsa)
+}
+
+// smimeSignFile writes to stdout the S/MIME signed message of the MIME
+// content of the file, signed by the key of the certificate at the index.
+func smimeSignFile(pkcs11path, tokenSerial *string, pinVal string, index int, file string, hash crypto.Hash, tsa *timestampAuthority) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	context, err := configureToken(*pkcs11path, *tokenSerial, pinVal, 0)
+	if err != nil {
+		return err
+	}
+	cert, err := pairedCertificate(context, index)
+	if err != nil {
+		return err
+	}
+	others, err := tokenCertificates(*pkcs11path, *tokenSerial)
+	if err != nil {
+		timedLog(fmt.Sprintf("Unable to look for the chain on the token: %v", err))
+	}
+	s := &smimeSigner{signer: cert.PrivateKey.(crypto.Signer), chain: certificateChain(cert.Leaf, others), hash: hash, tsa: tsa}
+	message, err := s.sign(content)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(message)
+	return err
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var errSSHAgentReadOnly = errors.New("the keys of the token cannot be added or removed through the agent")
+
+type sshAgentKey struct {
+	signer  ssh.Signer
+	comment string
+}
+
+// sshAgent is an SSH agent serving the keys of the certificates of the token,
+// so that SSH authenticates with the card unlocked by the proxy.
+type sshAgent struct {
+	keys []sshAgentKey
+
+	mu         sync.Mutex
+	passphrase []byte
+}
+
+func newSSHAgent(certificates []tls.Certificate) *sshAgent {
+	a := &sshAgent{}
+	for index, cert := range certificates {
+		signer, err := ssh.NewSignerFromSigner(cert.PrivateKey.(crypto.Signer))
+		if err != nil {
+			timedLog(fmt.Sprintf("Not serving the key of %v to SSH: %v", cert.Leaf.Subject, err))
+			continue
+		}
+		a.keys = append(a.keys, sshAgentKey{signer: signer, comment: fmt.Sprintf("%s (certificate index %d)", cert.Leaf.Subject.CommonName, index)})
+	}
+	return a
+}
+
+func (a *sshAgent) locked() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.passphrase != nil
+}
+
+func (a *sshAgent) List() ([]*agent.Key, error) {
+	if a.locked() {
+		return nil, nil
+	}
+	var keys []*agent.Key
+	for _, key := range a.keys {
+		public := key.signer.PublicKey()
+		keys = append(keys, &agent.Key{Format: public.Type(), Blob: public.Marshal(), Comment: key.comment})
+	}
+	return keys, nil
+}
+
+func (a *sshAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+func (a *sshAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	if a.locked() {
+		return nil, errors.New("the agent is locked")
+	}
+	for _, k := range a.keys {
+		if !bytes.Equal(k.signer.PublicKey().Marshal(), key.Marshal()) {
+			continue
+		}
+		timedLog(fmt.Sprintf("Signing an SSH authentication with %s", k.comment))
+		// The flags only select the hash of RSA signatures, the other keys
+		// ignore them like in OpenSSH.
+		algorithmSigner, ok := k.signer.(ssh.AlgorithmSigner)
+		ok = ok && k.signer.PublicKey().Type() == ssh.KeyAlgoRSA
+		switch {
+		case ok && flags&agent.SignatureFlagRsaSha256 != 0:
+			return algorithmSigner.SignWithAlgorithm(nil, data, ssh.KeyAlgoRSASHA256)
+		case ok && flags&agent.SignatureFlagRsaSha512 != 0:
+			return algorithmSigner.SignWithAlgorithm(nil, data, ssh.KeyAlgoRSASHA512)
+		}
+		return k.signer.Sign(nil, data)
+	}
+	return nil, errors.New("unknown key")
+}
+
+func (a *sshAgent) Signers() ([]ssh.Signer, error) {
+	if a.locked() {
+		return nil, nil
+	}
+	signers := make([]ssh.Signer, 0, len(a.keys))
+	for _, key := range a.keys {
+		signers = append(signers, key.signer)
+	}
+	return signers, nil
+}
+
+func (a *sshAgent) Lock(passphrase []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.passphrase != nil {
+		return errors.New("the agent is already locked")
+	}
+	a.passphrase = append([]byte{}, passphrase...)
+	return nil
+}
+
+func (a *sshAgent) Unlock(passphrase []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.passphrase == nil || subtle.ConstantTimeCompare(passphrase, a.passphrase) != 1 {
+		return errors.New("wrong passphrase")
+	}
+	a.passphrase = nil
+	return nil
+}
+
+func (a *sshAgent) Add(agent.AddedKey) error { return errSSHAgentReadOnly }
+
+func (a *sshAgent) Remove(ssh.PublicKey) error { return errSSHAgentReadOnly }
+
+func (a *sshAgent) RemoveAll() error { return errSSHAgentReadOnly }
+
+func (a *sshAgent) Extension(string, []byte) ([]byte, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
+
+// defaultSSHAgentSocket returns the path of the agent socket in the runtime
+// directory of the user, or in the temporary one.
+func defaultSSHAgentSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "pkcs11-web-proxy-ssh-agent.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("pkcs11-web-proxy-%d", os.Getuid()), "ssh-agent.sock")
+}
+
+// runSSHAgent serves the keys of the certificates of the token as an SSH
+// agent on ssh-agent-socket, until it fails.
+func runSSHAgent(c *config) error {
+	pinVal, err := c.tokenPin()
+	if err != nil {
+		return err
+	}
+	context, err := configureToken(c.pkcs11path, c.tokenSerial, pinVal, c.pkcs11MaxSessions)
+	if err != nil {
+		return err
+	}
+	certificates, err := context.FindAllPairedCertificates()
+	if err != nil {
+		return err
+	}
+	slots := newSignatureSlots(c.maxConcurrentSignatures)
+	for i := range certificates {
+		certificates[i].PrivateKey = tokenSigner(certificates[i].PrivateKey.(crypto.Signer), slots, c.signatureQueueTimeout, c.pkcs11PoolWaitTimeout, c.touch())
+	}
+	return serveSSHAgent(newSSHAgent(certificates), c.sshAgentSocket)
+}
+
+// serveSSHAgent serves the agent on a unix socket only the user can connect
+// to, in a directory of the user with mode 0700, replacing a stale socket left
+// by a previous run.
+func serveSSHAgent(a *sshAgent, socketPath string) error {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+		return err
+	}
+	if err := checkPrivateDirectory(filepath.Dir(socketPath)); err != nil {
+		return err
+	}
+	if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		return err
+	}
+	timedLog(fmt.Sprintf("Serving %d keys to SSH, run: export SSH_AUTH_SOCK=%s", len(a.keys), socketPath))
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			agent.ServeAgent(a, conn)
+		}()
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+// checkPrivateDirectory checks that the directory of the agent socket is a
+// directory only the user can access, which the unix permissions tell on
+// unix systems only.
+func checkPrivateDirectory(dir string) error {
+	return nil
+}
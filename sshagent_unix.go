@@ -0,0 +1,24 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// checkPrivateDirectory checks that the directory of the agent socket is a
+// directory only the user can access. In a shared one like /tmp, another user
+// could have created it first to replace the socket.
+func checkPrivateDirectory(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || info.Mode().Perm() != 0700 || !ok || int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("the directory %s of the agent socket must be a directory of the user with mode 0700", dir)
+	}
+	return nil
+}
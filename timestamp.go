@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// timestampTimeout bounds the requests to the timestamp authority.
+const timestampTimeout = 30 * time.Second
+
+var (
+	oidTimeStampToken = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 14}
+	oidTSTInfo        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+)
+
+// The structures of RFC 3161.
+type timestampRequest struct {
+	Version        int
+	MessageImprint timestampMessageImprint
+	Nonce          *big.Int
+	CertReq        bool
+}
+
+type timestampMessageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type timestampResponse struct {
+	Status         timestampStatus
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+type timestampStatus struct {
+	Status       int
+	StatusString []string       `asn1:"optional,utf8"`
+	FailInfo     asn1.BitString `asn1:"optional"`
+}
+
+// The beginning of the SignedData of a timestamp token, up to the TSTInfo.
+type timestampSignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	EncapContentInfo struct {
+		ContentType asn1.ObjectIdentifier
+		Content     []byte `asn1:"explicit,tag:0"`
+	}
+}
+
+type timestampInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint timestampMessageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time `asn1:"generalized"`
+}
+
+// timestampAuthority gets RFC 3161 timestamps of signatures from a TSA, so
+// that they can be verified after the expiration of the certificate.
+type timestampAuthority struct {
+	url    string
+	hash   crypto.Hash
+	client *http.Client
+}
+
+func newTimestampAuthority(url string, hash crypto.Hash) (*timestampAuthority, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("invalid TSA URL %s, it must be http:// or https://", url)
+	}
+	return &timestampAuthority{url: url, hash: hash, client: &http.Client{Timeout: timestampTimeout}}, nil
+}
+
+// timestamp returns the DER encoded timestamp token of the data, checking
+// that the TSA timestamped its digest in answer to this request.
+func (t *timestampAuthority) timestamp(data []byte) ([]byte, error) {
+	h := t.hash.New()
+	h.Write(data)
+	imprint := timestampMessageImprint{
+		HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidDigestAlgorithms[t.hash], Parameters: asn1.NullRawValue},
+		HashedMessage: h.Sum(nil),
+	}
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	// The certificate of the TSA is requested to verify the token without it.
+	request, err := asn1.Marshal(timestampRequest{Version: 1, MessageImprint: imprint, Nonce: nonce, CertReq: true})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.client.Post(t.url, "application/timestamp-query", bytes.NewReader(request))
+	if err != nil {
+		return nil, fmt.Errorf("TSA unreachable: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the TSA response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("TSA error: %s", resp.Status)
+	}
+
+	var response timestampResponse
+	if _, err := asn1.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("invalid TSA response: %v", err)
+	}
+	// 0 is granted, 1 granted with modifications.
+	if response.Status.Status > 1 || len(response.TimeStampToken.FullBytes) == 0 {
+		return nil, fmt.Errorf("the TSA rejected the request with status %d: %s", response.Status.Status, strings.Join(response.Status.StatusString, ", "))
+	}
+	genTime, err := checkTimestampToken(response.TimeStampToken.FullBytes, imprint, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp token: %v", err)
+	}
+	timedLog(fmt.Sprintf("Timestamped the signature by %s at %v", t.url, genTime))
+	return response.TimeStampToken.FullBytes, nil
+}
+
+// checkTimestampToken checks that the token timestamps the message imprint
+// with the nonce, and returns its time. The signature of the TSA is left to
+// the verifiers, which trust it or not.
+func checkTimestampToken(token []byte, imprint timestampMessageImprint, nonce *big.Int) (time.Time, error) {
+	var contentInfo cmsContentInfo
+	if _, err := asn1.Unmarshal(token, &contentInfo); err != nil {
+		return time.Time{}, err
+	}
+	if !contentInfo.ContentType.Equal(oidSignedData) {
+		return time.Time{}, errors.New("not a SignedData")
+	}
+	var signedData timestampSignedData
+	if _, err := asn1.Unmarshal(contentInfo.Content.Bytes, &signedData); err != nil {
+		return time.Time{}, err
+	}
+	if !signedData.EncapContentInfo.ContentType.Equal(oidTSTInfo) {
+		return time.Time{}, errors.New("not a TSTInfo")
+	}
+	var info timestampInfo
+	rest, err := asn1.Unmarshal(signedData.EncapContentInfo.Content, &info)
+	if err != nil || len(rest) > 0 {
+		return time.Time{}, fmt.Errorf("invalid TSTInfo: %v", err)
+	}
+	if !info.MessageImprint.HashAlgorithm.Algorithm.Equal(imprint.HashAlgorithm.Algorithm) || !bytes.Equal(info.MessageImprint.HashedMessage, imprint.HashedMessage) {
+		return time.Time{}, errors.New("it timestamps another digest")
+	}
+	// The nonce is the only INTEGER after the time, between the optional
+	// accuracy and ordering, and the tsa and extensions.
+	var fields asn1.RawValue
+	if _, err := asn1.Unmarshal(signedData.EncapContentInfo.Content, &fields); err != nil {
+		return time.Time{}, err
+	}
+	for remaining, index := fields.Bytes, 0; len(remaining) > 0; index++ {
+		var field asn1.RawValue
+		if remaining, err = asn1.Unmarshal(remaining, &field); err != nil {
+			return time.Time{}, err
+		}
+		if index > 4 && field.Class == asn1.ClassUniversal && field.Tag == asn1.TagInteger {
+			var tokenNonce *big.Int
+			if _, err := asn1.Unmarshal(field.FullBytes, &tokenNonce); err != nil {
+				return time.Time{}, err
+			}
+			if tokenNonce.Cmp(nonce) != 0 {
+				return time.Time{}, errors.New("it answers another request")
+			}
+			return info.GenTime, nil
+		}
+	}
+	return time.Time{}, errors.New("it has no nonce")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The responses in testdata are made by openssl with an ECDSA TSA key, with
+// accuracy, ordering and tsa_name set, to the queries of:
+//
+//	printf 'signature to timestamp' > data
+//	openssl ts -query -data data -sha256 -cert > query.tsq
+//	openssl ts -query -data data -sha256 -cert -no_nonce > query-no-nonce.tsq
+//	openssl ts -query -data data -sha1 -cert > query-rejected.tsq
+//	openssl ts -reply -queryfile query.tsq -config tsa.cnf
+var (
+	testTimestampData    = []byte("signature to timestamp")
+	testTimestampNonce   = new(big.Int).SetUint64(0x1eefee7f710f9bda)
+	testTimestampGenTime = time.Date(2026, 10, 14, 9, 54, 7, 0, time.UTC)
+)
+
+// readTimestampToken returns the token of the DER encoded response in the
+// file.
+func readTimestampToken(t *testing.T, file string) []byte {
+	t.Helper()
+	body, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response timestampResponse
+	if _, err := asn1.Unmarshal(body, &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Status.Status != 0 {
+		t.Fatalf("status %d", response.Status.Status)
+	}
+	return response.TimeStampToken.FullBytes
+}
+
+func TestCheckTimestampToken(t *testing.T) {
+	token := readTimestampToken(t, "testdata/timestamp-response.der")
+	digest := sha256.Sum256(testTimestampData)
+	imprint := timestampMessageImprint{
+		HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidDigestAlgorithms[crypto.SHA256], Parameters: asn1.NullRawValue},
+		HashedMessage: digest[:],
+	}
+	genTime, err := checkTimestampToken(token, imprint, testTimestampNonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !genTime.Equal(testTimestampGenTime) {
+		t.Errorf("time %v, want %v", genTime, testTimestampGenTime)
+	}
+
+	other := sha256.Sum256([]byte("another signature"))
+	tests := []struct {
+		name    string
+		token   []byte
+		imprint timestampMessageImprint
+		nonce   *big.Int
+		err     string
+	}{
+		{"wrong nonce", token, imprint, new(big.Int).Add(testTimestampNonce, big.NewInt(1)), "another request"},
+		{"wrong imprint", token, timestampMessageImprint{HashAlgorithm: imprint.HashAlgorithm, HashedMessage: other[:]}, testTimestampNonce, "another digest"},
+		{"wrong hash", token, timestampMessageImprint{HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidDigestAlgorithms[crypto.SHA512]}, HashedMessage: digest[:]}, testTimestampNonce, "another digest"},
+		{"no nonce", readTimestampToken(t, "testdata/timestamp-response-no-nonce.der"), imprint, testTimestampNonce, "no nonce"},
+		{"truncated", token[:len(token)/2], imprint, testTimestampNonce, ""},
+		{"not a token", imprint.HashedMessage, imprint, testTimestampNonce, ""},
+	}
+	for _, test := range tests {
+		if _, err := checkTimestampToken(test.token, test.imprint, test.nonce); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error %v, want one about %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestTimestampAuthority(t *testing.T) {
+	if _, err := newTimestampAuthority("ftp://timestamp.example.com", crypto.SHA256); err == nil {
+		t.Error("an ftp:// TSA is accepted")
+	}
+
+	response, err := os.ReadFile("testdata/timestamp-response.der")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The answer of the TSA to a query with SHA-1, which it does not support.
+	rejected, err := os.ReadFile("testdata/timestamp-response-rejected.der")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		status int
+		body   []byte
+		err    string
+	}{
+		// The response of another request, with the digest of the data but
+		// not the nonce.
+		{"replayed", http.StatusOK, response, "another request"},
+		{"rejected", http.StatusOK, rejected, "status 2: Message digest algorithm is not supported."},
+		{"invalid", http.StatusOK, []byte("not DER"), "invalid TSA response"},
+		{"error", http.StatusInternalServerError, nil, "500"},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			var request timestampRequest
+			if _, err := asn1.Unmarshal(body, &request); err != nil || r.Header.Get("Content-Type") != "application/timestamp-query" {
+				t.Errorf("%s: request %v", test.name, err)
+			}
+			if request.Nonce == nil || !request.CertReq || !request.MessageImprint.HashAlgorithm.Algorithm.Equal(oidDigestAlgorithms[crypto.SHA256]) {
+				t.Errorf("%s: request %+v", test.name, request)
+			}
+			w.WriteHeader(test.status)
+			w.Write(test.body)
+		}))
+		tsa, err := newTimestampAuthority(server.URL, crypto.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tsa.timestamp(testTimestampData); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error %v, want one about %q", test.name, err, test.err)
+		}
+		server.Close()
+	}
+}
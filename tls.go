@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/miekg/pkcs11"
+)
+
+// tokenCapabilities describes what the token can actually do with the
+// selected private key.
+type tokenCapabilities struct {
+	mechanisms map[uint]pkcs11.MechanismInfo
+	canSign    bool
+}
+
+func (c *tokenCapabilities) supports(mechanism uint) bool {
+	_, ok := c.mechanisms[mechanism]
+	return ok
+}
+
+// probeToken queries the token mechanisms and the attributes of the private key.
+func probeToken(context *crypto11.Context, pkcs11path, tokenSerial string, key crypto.PrivateKey) (*tokenCapabilities, error) {
+	if context == nil {
+		return nil, errors.New("the keys are not on a PKCS#11 token")
+	}
+	mechanisms, err := tokenMechanisms(pkcs11path, tokenSerial)
+	if err != nil {
+		return nil, err
+	}
+	capabilities := &tokenCapabilities{mechanisms: mechanisms, canSign: true}
+	attribute, err := context.GetAttribute(key, crypto11.CkaSign)
+	if err == nil && attribute != nil && len(attribute.Value) > 0 {
+		capabilities.canSign = attribute.Value[0] != 0
+	}
+	return capabilities, nil
+}
+
+// gateTLSFeatures adjusts the signature algorithms and TLS versions offered
+// with the certificate to what the token supports. A nil capabilities value
+// means the token could not be probed; rsaPSS ("auto", "yes" or "no") forces
+// the RSA-PSS decision regardless of the probe.
+func gateTLSFeatures(cert *tls.Certificate, config *tls.Config, capabilities *tokenCapabilities, rsaPSS string) {
+	if capabilities != nil && !capabilities.canSign {
+		timedLog("Warning: the private key is not marked for signing (CKA_SIGN), TLS client authentication will likely fail")
+	}
+
+	switch publicKey := cert.PrivateKey.(crypto.Signer).Public().(type) {
+	case *rsa.PublicKey:
+		pkcs1Supported, pssSupported := true, true
+		if capabilities != nil {
+			pkcs1Supported = capabilities.supports(pkcs11.CKM_RSA_PKCS)
+			pssSupported = capabilities.supports(pkcs11.CKM_RSA_PKCS_PSS)
+			checkKeySize(capabilities, pkcs11.CKM_RSA_PKCS, "RSA", publicKey.N.BitLen())
+		}
+		switch rsaPSS {
+		case "yes":
+			pssSupported = true
+		case "no":
+			pssSupported = false
+		}
+
+		var schemes []tls.SignatureScheme
+		if pssSupported {
+			schemes = append(schemes, tls.PSSWithSHA256, tls.PSSWithSHA384, tls.PSSWithSHA512)
+		} else {
+			timedLog("Token does not support RSA-PSS: capping TLS at 1.2")
+			config.MaxVersion = tls.VersionTLS12
+		}
+		if pkcs1Supported || !pssSupported {
+			schemes = append(schemes, tls.PKCS1WithSHA256, tls.PKCS1WithSHA384, tls.PKCS1WithSHA512, tls.PKCS1WithSHA1)
+		} else {
+			timedLog("Token does not support PKCS#1 v1.5 signatures: offering only RSA-PSS")
+		}
+		cert.SupportedSignatureAlgorithms = schemes
+		timedLog(fmt.Sprintf("Offering signature algorithms: %v", schemes))
+	case *ecdsa.PublicKey:
+		if capabilities != nil {
+			if !capabilities.supports(pkcs11.CKM_ECDSA) {
+				timedLog("Warning: the token does not advertise CKM_ECDSA, TLS client authentication will likely fail")
+			}
+			checkKeySize(capabilities, pkcs11.CKM_ECDSA, "EC", publicKey.Curve.Params().BitSize)
+		}
+	}
+}
+
+func checkKeySize(capabilities *tokenCapabilities, mechanism uint, keyType string, bits int) {
+	info, ok := capabilities.mechanisms[mechanism]
+	if !ok || info.MaxKeySize == 0 {
+		return
+	}
+	if uint(bits) < info.MinKeySize || uint(bits) > info.MaxKeySize {
+		timedLog(fmt.Sprintf("Warning: %d-bit %s key is outside the range supported by the token (%d-%d)", bits, keyType, info.MinKeySize, info.MaxKeySize))
+	}
+}
+
+// configureSessionResumption sets up the client session cache and records
+// whether each handshake with the upstream was resumed.
+func configureSessionResumption(config *tls.Config, cacheSize int) {
+	if cacheSize > 0 {
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(cacheSize)
+	}
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		recordHandshake(state.DidResume)
+		return nil
+	}
+}
+
+// enableHandshakeDiagnostics logs the client certificate requests received
+// from the upstream and the certificate offered in response, by
+// GetClientCertificate if set.
+func enableHandshakeDiagnostics(config *tls.Config) {
+	getClientCertificate := config.GetClientCertificate
+	if getClientCertificate == nil {
+		cert := config.Certificates[0]
+		getClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &cert, nil
+		}
+	}
+	config.GetClientCertificate = func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		timedLog(fmt.Sprintf("TLS: server requested a client certificate, acceptable CAs: %s", formatAcceptableCAs(info.AcceptableCAs)))
+		cert, err := getClientCertificate(info)
+		if err != nil {
+			return nil, err
+		}
+		if err := info.SupportsCertificate(cert); err != nil {
+			timedLog(fmt.Sprintf("TLS: the server may not accept the certificate: %v", err))
+		}
+		timedLog(fmt.Sprintf("TLS: offering certificate %v", cert.Leaf.Subject))
+		return cert, nil
+	}
+}
+
+func formatAcceptableCAs(acceptableCAs [][]byte) string {
+	if len(acceptableCAs) == 0 {
+		return "any"
+	}
+	names := make([]string, 0, len(acceptableCAs))
+	for _, raw := range acceptableCAs {
+		var rdn pkix.RDNSequence
+		if _, err := asn1.Unmarshal(raw, &rdn); err != nil {
+			names = append(names, fmt.Sprintf("<unparsable: %x>", raw))
+			continue
+		}
+		var name pkix.Name
+		name.FillFromRDNSequence(&rdn)
+		names = append(names, fmt.Sprintf("[%s]", name.String()))
+	}
+	return strings.Join(names, ", ")
+}
+
+// handshakeTrace returns a client trace logging the outcome of each TLS
+// handshake with the upstream.
+func handshakeTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				timedLog(fmt.Sprintf("TLS: handshake failed: %s", describeHandshakeError(err)))
+				return
+			}
+			timedLog(fmt.Sprintf("TLS: handshake with %s completed: %s, %s, resumed: %t, ALPN: %q",
+				state.ServerName, tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), state.DidResume, state.NegotiatedProtocol))
+		},
+	}
+}
+
+// handshakeMetricsTrace returns a client trace timing the TLS handshakes the
+// transport makes with the upstream for the request.
+func handshakeMetricsTrace() *httptrace.ClientTrace {
+	var start time.Time
+	return &httptrace.ClientTrace{
+		TLSHandshakeStart: func() {
+			start = time.Now()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			observeHandshake(time.Since(start), state.DidResume, err)
+		},
+	}
+}
+
+func describeHandshakeError(err error) string {
+	message := err.Error()
+	if alert, isRemote := strings.CutPrefix(message, "remote error: tls: "); isRemote {
+		return fmt.Sprintf("server sent alert %q (%s)", alert, message)
+	}
+	var unknownAuthority x509.UnknownAuthorityError
+	if errors.As(err, &unknownAuthority) {
+		return fmt.Sprintf("the upstream server certificate is not trusted (%s)", message)
+	}
+	return message
+}
+
+// upstreamFailure is the classification of an error reaching the upstream,
+// reported to the client and in the logs.
+type upstreamFailure struct {
+	kind    string
+	status  int
+	message string
+}
+
+// classifyUpstreamError tells apart the usual causes of a failed request to
+// the upstream, most of them in the TLS handshake, so that the client and the
+// operator know what to fix.
+func classifyUpstreamError(err error) upstreamFailure {
+	message := err.Error()
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	switch {
+	case strings.Contains(message, "tls: failed to sign"):
+		return upstreamFailure{"token_signing_failed", http.StatusBadGateway, "The token failed to sign the TLS handshake: check that it is inserted and unlocked."}
+	case strings.Contains(message, "remote error: tls: "):
+		alert := message[strings.Index(message, "remote error: tls: ")+len("remote error: tls: "):]
+		switch alert {
+		case "bad certificate", "unsupported certificate", "certificate revoked", "certificate expired",
+			"certificate unknown", "unknown certificate authority", "access denied", "certificate required":
+			return upstreamFailure{"client_certificate_rejected", http.StatusBadGateway, fmt.Sprintf("The upstream rejected the client certificate of the token (%s).", alert)}
+		}
+		return upstreamFailure{"tls_alert", http.StatusBadGateway, fmt.Sprintf("The upstream aborted the TLS handshake (%s).", alert)}
+	case errors.As(err, &unknownAuthority):
+		return upstreamFailure{"upstream_certificate_unknown_ca", http.StatusBadGateway, "The certificate of the upstream is signed by an unknown authority."}
+	case errors.As(err, &hostname), errors.As(err, &invalid):
+		return upstreamFailure{"upstream_certificate_invalid", http.StatusBadGateway, "The certificate of the upstream is not valid for it: " + message}
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return upstreamFailure{"timeout", http.StatusGatewayTimeout, "The upstream didn't answer in time."}
+	case errors.As(err, &dnsErr):
+		return upstreamFailure{"dns", http.StatusBadGateway, "The host name of the upstream could not be resolved."}
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return upstreamFailure{"connection_refused", http.StatusBadGateway, "The upstream refused the connection."}
+	}
+	return upstreamFailure{"error", http.StatusBadGateway, "The upstream could not be reached."}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+)
+
+// openToken loads the PKCS#11 module and finds the slot holding the token with
+// the given serial. It must be called after crypto11 has been configured, as it
+// tolerates the module being already initialized and never finalizes it.
+func openToken(pkcs11path, tokenSerial string) (*pkcs11.Ctx, uint, error) {
+	ctx := pkcs11.New(pkcs11path)
+	if ctx == nil {
+		return nil, 0, fmt.Errorf("could not load PKCS#11 module %s", pkcs11path)
+	}
+	if err := ctx.Initialize(); err != nil {
+		var p11Err pkcs11.Error
+		if !errors.As(err, &p11Err) || p11Err != pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED {
+			ctx.Destroy()
+			return nil, 0, err
+		}
+	}
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		ctx.Destroy()
+		return nil, 0, err
+	}
+	for _, slot := range slots {
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			continue
+		}
+		if info.SerialNumber == tokenSerial {
+			return ctx, slot, nil
+		}
+	}
+	ctx.Destroy()
+	return nil, 0, fmt.Errorf("token with serial %s not found", tokenSerial)
+}
+
+// tokenMechanisms returns the mechanisms supported by the token, along with
+// their key size limits and flags when the module reports them.
+func tokenMechanisms(pkcs11path, tokenSerial string) (map[uint]pkcs11.MechanismInfo, error) {
+	ctx, slot, err := openToken(pkcs11path, tokenSerial)
+	if err != nil {
+		return nil, err
+	}
+	defer ctx.Destroy()
+
+	mechanisms, err := ctx.GetMechanismList(slot)
+	if err != nil {
+		return nil, err
+	}
+	supported := make(map[uint]pkcs11.MechanismInfo, len(mechanisms))
+	for _, mechanism := range mechanisms {
+		info, _ := ctx.GetMechanismInfo(slot, []*pkcs11.Mechanism{mechanism})
+		supported[mechanism.Mechanism] = info
+	}
+	return supported, nil
+}
+
+// presentToken identifies a token inserted in a slot of the module.
+type presentToken struct {
+	serial string
+	label  string
+}
+
+// presentTokens returns the tokens inserted in the slots of the module, in
+// the order of the slots. Unlike openToken, it is called before crypto11 is
+// configured, and finalizes the module it initialized for crypto11 to
+// initialize it again.
+func presentTokens(pkcs11path string) ([]presentToken, error) {
+	ctx := pkcs11.New(pkcs11path)
+	if ctx == nil {
+		return nil, fmt.Errorf("could not load PKCS#11 module %s", pkcs11path)
+	}
+	defer ctx.Destroy()
+	if err := ctx.Initialize(); err != nil {
+		var p11Err pkcs11.Error
+		if !errors.As(err, &p11Err) || p11Err != pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED {
+			return nil, err
+		}
+	} else {
+		defer ctx.Finalize()
+	}
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []presentToken
+	for _, slot := range slots {
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			continue
+		}
+		tokens = append(tokens, presentToken{serial: info.SerialNumber, label: strings.TrimSpace(info.Label)})
+	}
+	return tokens, nil
+}
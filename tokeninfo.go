@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+)
+
+type pkcs11Flag struct {
+	flag uint
+	name string
+}
+
+var tokenFlags = []pkcs11Flag{
+	{pkcs11.CKF_TOKEN_INITIALIZED, "initialized"},
+	{pkcs11.CKF_LOGIN_REQUIRED, "login required"},
+	{pkcs11.CKF_USER_PIN_INITIALIZED, "user PIN initialized"},
+	{pkcs11.CKF_PROTECTED_AUTHENTICATION_PATH, "PIN pad"},
+	{pkcs11.CKF_RNG, "random number generator"},
+	{pkcs11.CKF_WRITE_PROTECTED, "write protected"},
+	{pkcs11.CKF_CLOCK_ON_TOKEN, "clock"},
+	{pkcs11.CKF_DUAL_CRYPTO_OPERATIONS, "dual crypto operations"},
+}
+
+var pinFlags = []pkcs11Flag{
+	{pkcs11.CKF_USER_PIN_COUNT_LOW, "user PIN: a wrong PIN was entered since the last successful login"},
+	{pkcs11.CKF_USER_PIN_FINAL_TRY, "user PIN: FINAL TRY, a wrong PIN will lock it"},
+	{pkcs11.CKF_USER_PIN_LOCKED, "user PIN: LOCKED"},
+	{pkcs11.CKF_USER_PIN_TO_BE_CHANGED, "user PIN: to be changed"},
+	{pkcs11.CKF_SO_PIN_COUNT_LOW, "SO PIN: a wrong PIN was entered since the last successful login"},
+	{pkcs11.CKF_SO_PIN_FINAL_TRY, "SO PIN: FINAL TRY, a wrong PIN will lock it"},
+	{pkcs11.CKF_SO_PIN_LOCKED, "SO PIN: LOCKED"},
+	{pkcs11.CKF_SO_PIN_TO_BE_CHANGED, "SO PIN: to be changed"},
+}
+
+var mechanismFlags = []pkcs11Flag{
+	{pkcs11.CKF_HW, "hw"},
+	{pkcs11.CKF_SIGN, "sign"},
+	{pkcs11.CKF_VERIFY, "verify"},
+	{pkcs11.CKF_ENCRYPT, "encrypt"},
+	{pkcs11.CKF_DECRYPT, "decrypt"},
+	{pkcs11.CKF_DIGEST, "digest"},
+	{pkcs11.CKF_GENERATE, "generate"},
+	{pkcs11.CKF_GENERATE_KEY_PAIR, "generate key pair"},
+	{pkcs11.CKF_WRAP, "wrap"},
+	{pkcs11.CKF_UNWRAP, "unwrap"},
+	{pkcs11.CKF_DERIVE, "derive"},
+}
+
+var mechanismNames = map[uint]string{
+	pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN:  "RSA_PKCS_KEY_PAIR_GEN",
+	pkcs11.CKM_RSA_PKCS:               "RSA_PKCS",
+	pkcs11.CKM_RSA_X_509:              "RSA_X_509",
+	pkcs11.CKM_RSA_PKCS_OAEP:          "RSA_PKCS_OAEP",
+	pkcs11.CKM_RSA_PKCS_PSS:           "RSA_PKCS_PSS",
+	pkcs11.CKM_SHA1_RSA_PKCS:          "SHA1_RSA_PKCS",
+	pkcs11.CKM_SHA256_RSA_PKCS:        "SHA256_RSA_PKCS",
+	pkcs11.CKM_SHA384_RSA_PKCS:        "SHA384_RSA_PKCS",
+	pkcs11.CKM_SHA512_RSA_PKCS:        "SHA512_RSA_PKCS",
+	pkcs11.CKM_SHA1_RSA_PKCS_PSS:      "SHA1_RSA_PKCS_PSS",
+	pkcs11.CKM_SHA256_RSA_PKCS_PSS:    "SHA256_RSA_PKCS_PSS",
+	pkcs11.CKM_SHA384_RSA_PKCS_PSS:    "SHA384_RSA_PKCS_PSS",
+	pkcs11.CKM_SHA512_RSA_PKCS_PSS:    "SHA512_RSA_PKCS_PSS",
+	pkcs11.CKM_EC_KEY_PAIR_GEN:        "EC_KEY_PAIR_GEN",
+	pkcs11.CKM_ECDSA:                  "ECDSA",
+	pkcs11.CKM_ECDSA_SHA1:             "ECDSA_SHA1",
+	pkcs11.CKM_ECDSA_SHA256:           "ECDSA_SHA256",
+	pkcs11.CKM_ECDSA_SHA384:           "ECDSA_SHA384",
+	pkcs11.CKM_ECDSA_SHA512:           "ECDSA_SHA512",
+	pkcs11.CKM_ECDH1_DERIVE:           "ECDH1_DERIVE",
+	pkcs11.CKM_SHA_1:                  "SHA_1",
+	pkcs11.CKM_SHA256:                 "SHA256",
+	pkcs11.CKM_SHA384:                 "SHA384",
+	pkcs11.CKM_SHA512:                 "SHA512",
+	pkcs11.CKM_AES_KEY_GEN:            "AES_KEY_GEN",
+	pkcs11.CKM_AES_ECB:                "AES_ECB",
+	pkcs11.CKM_AES_CBC:                "AES_CBC",
+	pkcs11.CKM_AES_CBC_PAD:            "AES_CBC_PAD",
+	pkcs11.CKM_AES_GCM:                "AES_GCM",
+	pkcs11.CKM_DES3_KEY_GEN:           "DES3_KEY_GEN",
+	pkcs11.CKM_DES3_CBC:               "DES3_CBC",
+	pkcs11.CKM_SHA256_HMAC:            "SHA256_HMAC",
+	pkcs11.CKM_GENERIC_SECRET_KEY_GEN: "GENERIC_SECRET_KEY_GEN",
+}
+
+func formatFlags(flags uint, names []pkcs11Flag) string {
+	var set []string
+	for _, f := range names {
+		if flags&f.flag != 0 {
+			set = append(set, f.name)
+		}
+	}
+	return strings.Join(set, ", ")
+}
+
+func formatCount(count uint) string {
+	if count == pkcs11.CK_UNAVAILABLE_INFORMATION {
+		return "unavailable"
+	}
+	return fmt.Sprint(count)
+}
+
+func formatMemory(free, total uint) string {
+	if free == pkcs11.CK_UNAVAILABLE_INFORMATION || total == pkcs11.CK_UNAVAILABLE_INFORMATION {
+		return "unavailable"
+	}
+	return fmt.Sprintf("%d bytes free of %d", free, total)
+}
+
+// runTokenInfo prints the information of token-info about the token.
+func runTokenInfo(c *config) error {
+	return printTokenInfo(c.pkcs11path, c.tokenSerial)
+}
+
+// printTokenInfo prints what the module reports about the slot, the token and
+// its mechanisms, without logging in, so that the state of the PIN can be
+// checked before risking a wrong one.
+func printTokenInfo(pkcs11path, tokenSerial string) error {
+	ctx, slot, err := openToken(pkcs11path, tokenSerial)
+	if err != nil {
+		return err
+	}
+	defer ctx.Destroy()
+
+	if info, err := ctx.GetInfo(); err == nil {
+		fmt.Printf("Module:           %s %s, version %d.%d, Cryptoki %d.%d\n", strings.TrimSpace(info.ManufacturerID), strings.TrimSpace(info.LibraryDescription),
+			info.LibraryVersion.Major, info.LibraryVersion.Minor, info.CryptokiVersion.Major, info.CryptokiVersion.Minor)
+	}
+	if info, err := ctx.GetSlotInfo(slot); err == nil {
+		fmt.Printf("Slot %d:           %s (%s), hardware %d.%d, firmware %d.%d\n", slot, strings.TrimSpace(info.SlotDescription), strings.TrimSpace(info.ManufacturerID),
+			info.HardwareVersion.Major, info.HardwareVersion.Minor, info.FirmwareVersion.Major, info.FirmwareVersion.Minor)
+	}
+	info, err := ctx.GetTokenInfo(slot)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Token:            %s\n", strings.TrimSpace(info.Label))
+	fmt.Printf("Manufacturer:     %s\n", strings.TrimSpace(info.ManufacturerID))
+	fmt.Printf("Model:            %s\n", strings.TrimSpace(info.Model))
+	fmt.Printf("Serial number:    %s\n", strings.TrimSpace(info.SerialNumber))
+	fmt.Printf("Hardware version: %d.%d\n", info.HardwareVersion.Major, info.HardwareVersion.Minor)
+	fmt.Printf("Firmware version: %d.%d\n", info.FirmwareVersion.Major, info.FirmwareVersion.Minor)
+	fmt.Printf("Flags:            %s\n", formatFlags(info.Flags, tokenFlags))
+	pinState := formatFlags(info.Flags, pinFlags)
+	if pinState == "" {
+		pinState = "no wrong PIN entered since the last successful login"
+	}
+	fmt.Printf("PIN state:        %s\n", pinState)
+	fmt.Printf("PIN length:       %d to %d\n", info.MinPinLen, info.MaxPinLen)
+	maxSessions, maxRwSessions := formatCount(info.MaxSessionCount), formatCount(info.MaxRwSessionCount)
+	if info.MaxSessionCount == pkcs11.CK_EFFECTIVELY_INFINITE {
+		maxSessions = "unlimited"
+	}
+	if info.MaxRwSessionCount == pkcs11.CK_EFFECTIVELY_INFINITE {
+		maxRwSessions = "unlimited"
+	}
+	fmt.Printf("Sessions:         %s open, at most %s (read-write: %s open, at most %s)\n", formatCount(info.SessionCount), maxSessions, formatCount(info.RwSessionCount), maxRwSessions)
+	fmt.Printf("Public memory:    %s\n", formatMemory(info.FreePublicMemory, info.TotalPublicMemory))
+	fmt.Printf("Private memory:   %s\n", formatMemory(info.FreePrivateMemory, info.TotalPrivateMemory))
+	if info.Flags&pkcs11.CKF_CLOCK_ON_TOKEN != 0 {
+		fmt.Printf("Clock:            %s\n", info.UTCTime)
+	}
+
+	mechanisms, err := tokenMechanisms(pkcs11path, tokenSerial)
+	if err != nil {
+		return err
+	}
+	ids := make([]uint, 0, len(mechanisms))
+	for id := range mechanisms {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	fmt.Printf("Mechanisms:\n")
+	for _, id := range ids {
+		name, ok := mechanismNames[id]
+		if !ok {
+			name = fmt.Sprintf("0x%08X", id)
+		}
+		mechanism := mechanisms[id]
+		keySize := ""
+		if mechanism.MaxKeySize > 0 {
+			keySize = fmt.Sprintf(", keys %d-%d", mechanism.MinKeySize, mechanism.MaxKeySize)
+		}
+		fmt.Printf("  %-24s %s%s\n", name, formatFlags(mechanism.Flags, mechanismFlags), keySize)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+var errTouchTimeout = errors.New("the token did not sign")
+
+// touchPolicy handles the tokens waiting for a physical touch before each
+// signature, like the YubiKeys with the touch policy always: a signature
+// taking longer than notifyAfter asks for the touch, and one taking longer
+// than timeout fails instead of blocking the request. The zero value waits
+// silently.
+type touchPolicy struct {
+	notifyAfter time.Duration
+	desktop     bool
+	timeout     time.Duration
+}
+
+// sign signs with the slot of the token held, releasing it once the token is
+// done, after sign returns if the signature is given up by the timeout.
+func (t touchPolicy) sign(signer crypto.Signer, rand io.Reader, digest []byte, opts crypto.SignerOpts, slots *signatureSlots) ([]byte, error) {
+	if t.notifyAfter <= 0 && t.timeout <= 0 {
+		defer slots.release()
+		return signer.Sign(rand, digest, opts)
+	}
+	type result struct {
+		signature []byte
+		err       error
+	}
+	// The signature and the timeout race to set the state: once abandoned,
+	// the signature goes on in the background, holding the slot.
+	const (
+		signing = iota
+		signed
+		abandoned
+	)
+	var state atomic.Int32
+	done := make(chan result, 1)
+	go func() {
+		signature, err := signer.Sign(rand, digest, opts)
+		if !state.CompareAndSwap(signing, signed) {
+			timedLog("The token completed the signature given up by the touch timeout")
+			slots.waiting.Add(-1)
+		}
+		slots.release()
+		done <- result{signature, err}
+	}()
+
+	var notify, timeout <-chan time.Time
+	if t.notifyAfter > 0 {
+		timer := time.NewTimer(t.notifyAfter)
+		defer timer.Stop()
+		notify = timer.C
+	}
+	if t.timeout > 0 {
+		timer := time.NewTimer(t.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		select {
+		case r := <-done:
+			return r.signature, r.err
+		case <-notify:
+			notify = nil
+			timedLog("Waiting for the token to sign: touch your key")
+			if t.desktop {
+				go desktopNotification("pkcs11-web-proxy", "Touch your key to sign")
+			}
+		case <-timeout:
+			// Until the token is done, new signatures fail instead of
+			// piling up behind this one.
+			slots.waiting.Add(1)
+			if !state.CompareAndSwap(signing, abandoned) {
+				// Signed just now.
+				slots.waiting.Add(-1)
+				r := <-done
+				return r.signature, r.err
+			}
+			timedLog(fmt.Sprintf("The token did not sign within %v, giving up", t.timeout))
+			return nil, fmt.Errorf("%w within %v: it may be waiting for a touch", errTouchTimeout, t.timeout)
+		}
+	}
+}
+
+// desktopNotification shows a notification on the desktop of the user, with
+// notify-send on Linux and the BSDs, and osascript on macOS.
+func desktopNotification(title, message string) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("osascript", "-e", fmt.Sprintf("display notification %q with title %q", message, title))
+	case "windows":
+		return
+	default:
+		cmd = exec.Command("notify-send", "--app-name", title, title, message)
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		timedLog(fmt.Sprintf("Unable to show the desktop notification: %v %s", err, output))
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// blockingSigner is a token signing once told to, like one waiting for a
+// touch.
+type blockingSigner struct {
+	crypto.Signer
+	started chan struct{}
+	touch   chan struct{}
+}
+
+func newBlockingSigner() *blockingSigner {
+	return &blockingSigner{started: make(chan struct{}, 16), touch: make(chan struct{})}
+}
+
+func (s *blockingSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.started <- struct{}{}
+	<-s.touch
+	return append([]byte("signature of "), digest...), nil
+}
+
+// sleepingSigner is a token taking a while to sign.
+type sleepingSigner struct {
+	crypto.Signer
+	duration time.Duration
+}
+
+func (s sleepingSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	time.Sleep(s.duration)
+	return append([]byte("signature of "), digest...), nil
+}
+
+// waitReleased waits for the signatures given up on the slots to be done.
+func waitReleased(t *testing.T, slots *signatureSlots) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); slots.waiting.Load() > 0 || len(slots.slots) > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the slots are still held: %d waiting, %d signing", slots.waiting.Load(), len(slots.slots))
+		}
+	}
+}
+
+func TestTouchTimeout(t *testing.T) {
+	for _, maxConcurrent := range []int{0, 1, 2} {
+		token := newBlockingSigner()
+		slots := newSignatureSlots(maxConcurrent)
+		signer := tokenSigner(token, slots, time.Second, 0, touchPolicy{timeout: 100 * time.Millisecond})
+
+		if _, err := signer.Sign(nil, []byte("first"), crypto.SHA256); !errors.Is(err, errTouchTimeout) {
+			t.Fatalf("%d slots: the untouched signature returned %v", maxConcurrent, err)
+		}
+		// The token still waits for the touch of the first signature: the
+		// next ones fail without reaching it.
+		if _, err := signer.Sign(nil, []byte("second"), crypto.SHA256); !errors.Is(err, errTouchTimeout) {
+			t.Errorf("%d slots: a signature during the abandoned one returned %v", maxConcurrent, err)
+		}
+		if len(token.started) != 1 {
+			t.Errorf("%d slots: %d signatures reached the token", maxConcurrent, len(token.started))
+		}
+		if maxConcurrent > 0 && len(slots.slots) != 1 {
+			t.Errorf("%d slots: the abandoned signature holds %d slots", maxConcurrent, len(slots.slots))
+		}
+
+		// The late touch completes it, and releases its slot.
+		token.touch <- struct{}{}
+		waitReleased(t, slots)
+		go func() { token.touch <- struct{}{} }()
+		if signature, err := signer.Sign(nil, []byte("third"), crypto.SHA256); err != nil || !bytes.Equal(signature, []byte("signature of third")) {
+			t.Errorf("%d slots: the signature after the late touch returned %q, %v", maxConcurrent, signature, err)
+		}
+		waitReleased(t, slots)
+	}
+}
+
+func TestTouchTimeoutRace(t *testing.T) {
+	// The signatures end about when the timeout fires: either they are
+	// returned, or given up and their slot released once done, never lost.
+	slots := newSignatureSlots(1)
+	signer := tokenSigner(sleepingSigner{duration: time.Millisecond}, slots, time.Second, 0, touchPolicy{timeout: time.Millisecond})
+	for i := 0; i < 200; i++ {
+		signature, err := signer.Sign(nil, []byte("digest"), crypto.SHA256)
+		switch {
+		case err == nil:
+			if !bytes.Equal(signature, []byte("signature of digest")) {
+				t.Fatalf("signature %q", signature)
+			}
+			// A returned signature left nothing behind.
+			if slots.waiting.Load() != 0 || len(slots.slots) != 0 {
+				t.Fatalf("the returned signature holds the slots: %d waiting, %d signing", slots.waiting.Load(), len(slots.slots))
+			}
+		case errors.Is(err, errTouchTimeout):
+			waitReleased(t, slots)
+		default:
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTouchNotification(t *testing.T) {
+	token := newBlockingSigner()
+	slots := newSignatureSlots(1)
+	signer := tokenSigner(token, slots, time.Second, 0, touchPolicy{notifyAfter: time.Millisecond})
+	go func() {
+		<-token.started
+		// Past the notification, the signature waits without timeout.
+		time.Sleep(30 * time.Millisecond)
+		token.touch <- struct{}{}
+	}()
+	if signature, err := signer.Sign(nil, []byte("digest"), crypto.SHA256); err != nil || !bytes.Equal(signature, []byte("signature of digest")) {
+		t.Errorf("signature %q, %v", signature, err)
+	}
+	if len(slots.slots) != 0 {
+		t.Error("the slot is not released")
+	}
+}
+
+func TestSignatureSlots(t *testing.T) {
+	token := newBlockingSigner()
+	slots := newSignatureSlots(1)
+	signer := tokenSigner(token, slots, 20*time.Millisecond, 0, touchPolicy{})
+	done := make(chan error)
+	go func() {
+		_, err := signer.Sign(nil, []byte("first"), crypto.SHA256)
+		done <- err
+	}()
+	<-token.started
+	// The token signs one at a time: the next signature waits for the slot
+	// in the queue, up to its timeout.
+	if _, err := signer.Sign(nil, []byte("second"), crypto.SHA256); err == nil || errors.Is(err, errTouchTimeout) {
+		t.Errorf("a signature beyond the slots returned %v", err)
+	}
+	token.touch <- struct{}{}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	go func() { token.touch <- struct{}{} }()
+	if _, err := signer.Sign(nil, []byte("third"), crypto.SHA256); err != nil {
+		t.Errorf("a signature after the release returned %v", err)
+	}
+}
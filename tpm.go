@@ -0,0 +1,223 @@
+//go:build tpm
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/miekg/pkcs11"
+)
+
+// tpmCertificates returns the certificate of certFile with its key in the
+// TPM of the device: the persistent one of keyHandle, or the one of the
+// tpm2_create publicFile and privateFile loaded under the persistent
+// parentHandle. The key is used with the auth value, empty if it has none.
+func tpmCertificates(device, keyHandle, publicFile, privateFile, parentHandle, certFile, auth string) ([]tls.Certificate, error) {
+	chain, err := readCertificates(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the TPM certificate: %v", err)
+	}
+	rwc, err := tpm2.OpenTPM(device)
+	if err != nil {
+		return nil, err
+	}
+
+	var handle tpmutil.Handle
+	if keyHandle != "" {
+		if handle, err = parseTPMHandle(keyHandle); err != nil {
+			rwc.Close()
+			return nil, err
+		}
+	} else {
+		parent, err := parseTPMHandle(parentHandle)
+		if err != nil {
+			rwc.Close()
+			return nil, err
+		}
+		public, private, err := readTPMKeyFiles(publicFile, privateFile)
+		if err != nil {
+			rwc.Close()
+			return nil, err
+		}
+		if handle, _, err = tpm2.Load(rwc, parent, "", public, private); err != nil {
+			rwc.Close()
+			return nil, fmt.Errorf("cannot load the key under the parent %s: %v", parentHandle, err)
+		}
+	}
+
+	public, _, _, err := tpm2.ReadPublic(rwc, handle)
+	if err != nil {
+		rwc.Close()
+		return nil, err
+	}
+	publicKey, err := public.Key()
+	if err != nil {
+		rwc.Close()
+		return nil, err
+	}
+	if !publicKeyEqual(publicKey, chain[0].PublicKey) {
+		rwc.Close()
+		return nil, errors.New("the TPM certificate is not the one of the key")
+	}
+	timedLog(fmt.Sprintf("Using the TPM key 0x%08x of %s with the certificate %v", uint32(handle), device, chain[0].Subject))
+
+	var raw [][]byte
+	for _, cert := range chain {
+		raw = append(raw, cert.Raw)
+	}
+	signer := &tpmSigner{rwc: rwc, handle: handle, auth: auth, public: publicKey, canSign: public.Attributes&tpm2.FlagSign != 0}
+	return []tls.Certificate{{Certificate: raw, Leaf: chain[0], PrivateKey: signer}}, nil
+}
+
+func parseTPMHandle(value string) (tpmutil.Handle, error) {
+	handle, err := strconv.ParseUint(value, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid TPM handle %q, like 0x81010002", value)
+	}
+	return tpmutil.Handle(handle), nil
+}
+
+// readTPMKeyFiles reads the public and private key files of tpm2_create,
+// checking that the public one holds a key.
+func readTPMKeyFiles(publicFile, privateFile string) ([]byte, []byte, error) {
+	public, err := readTPM2B(publicFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := tpm2.DecodePublic(public); err != nil {
+		return nil, nil, fmt.Errorf("%s is not a tpm2_create public key file: %v", publicFile, err)
+	}
+	private, err := readTPM2B(privateFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return public, private, nil
+}
+
+// readTPM2B reads a key file of tpm2_create, holding a size-prefixed TPM2B
+// structure, and returns its content.
+func readTPM2B(file string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 2 || int(binary.BigEndian.Uint16(data)) != len(data)-2 {
+		return nil, fmt.Errorf("%s is not a tpm2_create key file", file)
+	}
+	return data[2:], nil
+}
+
+// tpmSigner signs with a key of the TPM, one signature at a time.
+type tpmSigner struct {
+	mu      sync.Mutex
+	rwc     io.ReadWriteCloser
+	handle  tpmutil.Handle
+	auth    string
+	public  crypto.PublicKey
+	canSign bool
+}
+
+// tpmCapabilities describes what the TPM can sign with the key, like
+// probeToken does for the PKCS#11 tokens, from the algorithms it implements.
+func tpmCapabilities(key crypto.PrivateKey) (*tokenCapabilities, error) {
+	s, ok := key.(*tpmSigner)
+	if !ok {
+		return nil, errors.New("the key is not in a TPM")
+	}
+	s.mu.Lock()
+	values, _, err := tpm2.GetCapability(s.rwc, tpm2.CapabilityAlgs, 256, 0)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list the algorithms of the TPM: %v", err)
+	}
+	var algorithms []tpm2.Algorithm
+	for _, value := range values {
+		if description, ok := value.(tpm2.AlgorithmDescription); ok {
+			algorithms = append(algorithms, description.ID)
+		}
+	}
+	return &tokenCapabilities{mechanisms: tpmMechanisms(algorithms), canSign: s.canSign}, nil
+}
+
+// tpmMechanisms returns the PKCS#11 mechanisms of the signature schemes
+// among the algorithms of the TPM.
+func tpmMechanisms(algorithms []tpm2.Algorithm) map[uint]pkcs11.MechanismInfo {
+	schemes := map[tpm2.Algorithm]uint{
+		tpm2.AlgRSASSA: pkcs11.CKM_RSA_PKCS,
+		tpm2.AlgRSAPSS: pkcs11.CKM_RSA_PKCS_PSS,
+		tpm2.AlgECDSA:  pkcs11.CKM_ECDSA,
+	}
+	mechanisms := make(map[uint]pkcs11.MechanismInfo)
+	for _, algorithm := range algorithms {
+		if mechanism, ok := schemes[algorithm]; ok {
+			mechanisms[mechanism] = pkcs11.MechanismInfo{}
+		}
+	}
+	return mechanisms
+}
+
+func (s *tpmSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *tpmSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	scheme, err := tpmSignatureScheme(s.public, opts)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	signature, err := tpm2.Sign(s.rwc, s.handle, s.auth, digest, nil, scheme)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return encodeTPMSignature(signature)
+}
+
+// tpmSignatureScheme returns the TPM scheme of the signatures of opts with
+// the key.
+func tpmSignatureScheme(public crypto.PublicKey, opts crypto.SignerOpts) (*tpm2.SigScheme, error) {
+	hash, err := tpm2.HashToAlgorithm(opts.HashFunc())
+	if err != nil {
+		return nil, err
+	}
+	scheme := &tpm2.SigScheme{Hash: hash}
+	switch public.(type) {
+	case *rsa.PublicKey:
+		scheme.Alg = tpm2.AlgRSASSA
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			scheme.Alg = tpm2.AlgRSAPSS
+		}
+	case *ecdsa.PublicKey:
+		scheme.Alg = tpm2.AlgECDSA
+	default:
+		return nil, fmt.Errorf("unsupported TPM key %s", describePublicKey(public))
+	}
+	return scheme, nil
+}
+
+// encodeTPMSignature returns the signature of the TPM in the encoding of
+// crypto.Signer, ASN.1 for ECDSA.
+func encodeTPMSignature(signature *tpm2.Signature) ([]byte, error) {
+	if signature.RSA != nil {
+		return signature.RSA.Signature, nil
+	}
+	if signature.ECC != nil {
+		return asn1.Marshal(struct{ R, S *big.Int }{signature.ECC.R, signature.ECC.S})
+	}
+	return nil, errors.New("the TPM returned an unexpected signature")
+}
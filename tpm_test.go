@@ -0,0 +1,226 @@
+//go:build tpm
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/miekg/pkcs11"
+)
+
+func TestParseTPMHandle(t *testing.T) {
+	tests := []struct {
+		value  string
+		handle tpmutil.Handle
+		ok     bool
+	}{
+		{"0x81010002", 0x81010002, true},
+		{"0X81000001", 0x81000001, true},
+		{"2164326402", 0x81010002, true},
+		{"0x100000000", 0, false},
+		{"persistent", 0, false},
+		{"", 0, false},
+	}
+	for _, test := range tests {
+		handle, err := parseTPMHandle(test.value)
+		if (err == nil) != test.ok || handle != test.handle {
+			t.Errorf("parseTPMHandle(%q) = 0x%x, %v", test.value, uint32(handle), err)
+		}
+	}
+}
+
+// writeTPM2B writes content in a file like tpm2_create does, prefixed by its
+// size.
+func writeTPM2B(t *testing.T, name string, content []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, append(binary.BigEndian.AppendUint16(nil, uint16(len(content))), content...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadTPMKeyFiles(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The public areas of tpm2_create -G rsa2048 and -G ecc256.
+	attributes := tpm2.FlagSign | tpm2.FlagSensitiveDataOrigin | tpm2.FlagUserWithAuth | tpm2.FlagFixedTPM | tpm2.FlagFixedParent
+	publics := map[crypto.PublicKey]tpm2.Public{
+		&rsaKey.PublicKey: {
+			Type:          tpm2.AlgRSA,
+			NameAlg:       tpm2.AlgSHA256,
+			Attributes:    attributes,
+			RSAParameters: &tpm2.RSAParams{KeyBits: 2048, ModulusRaw: rsaKey.N.Bytes()},
+		},
+		&ecKey.PublicKey: {
+			Type:          tpm2.AlgECC,
+			NameAlg:       tpm2.AlgSHA256,
+			Attributes:    attributes,
+			ECCParameters: &tpm2.ECCParams{CurveID: tpm2.CurveNISTP256, Point: tpm2.ECPoint{XRaw: ecKey.X.FillBytes(make([]byte, 32)), YRaw: ecKey.Y.FillBytes(make([]byte, 32))}},
+		},
+	}
+	privateBlob := bytes.Repeat([]byte{0xa5}, 126)
+	privateFile := writeTPM2B(t, "key.priv", privateBlob)
+	for key, public := range publics {
+		encoded, err := public.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		publicBlob, private, err := readTPMKeyFiles(writeTPM2B(t, "key.pub", encoded), privateFile)
+		if err != nil {
+			t.Fatalf("%s: %v", describePublicKey(key), err)
+		}
+		if !bytes.Equal(private, privateBlob) {
+			t.Errorf("%s: private blob of %d bytes, want %d", describePublicKey(key), len(private), len(privateBlob))
+		}
+		decoded, err := tpm2.DecodePublic(publicBlob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decodedKey, err := decoded.Key(); err != nil || !publicKeyEqual(decodedKey, key) {
+			t.Errorf("%s: the public file holds %v, %v", describePublicKey(key), decodedKey, err)
+		}
+	}
+
+	encoded, _ := publics[&rsaKey.PublicKey].Encode()
+	dir := t.TempDir()
+	invalid := map[string][]byte{
+		"empty":     nil,
+		"one byte":  {0},
+		"too long":  append(binary.BigEndian.AppendUint16(nil, uint16(len(encoded)-1)), encoded...),
+		"too short": append(binary.BigEndian.AppendUint16(nil, uint16(len(encoded)+1)), encoded...),
+		"no prefix": encoded,
+	}
+	for name, content := range invalid {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := readTPMKeyFiles(path, privateFile); err == nil {
+			t.Errorf("the %s public file is accepted", name)
+		}
+		if _, _, err := readTPMKeyFiles(writeTPM2B(t, "key.pub", encoded), path); err == nil {
+			t.Errorf("the %s private file is accepted", name)
+		}
+	}
+	// The files swapped, as the private blob is no public area.
+	if _, _, err := readTPMKeyFiles(privateFile, writeTPM2B(t, "key.pub", encoded)); err == nil {
+		t.Error("the private file is accepted as the public one")
+	}
+	if _, _, err := readTPMKeyFiles(filepath.Join(dir, "missing"), privateFile); err == nil {
+		t.Error("a missing public file is accepted")
+	}
+}
+
+func TestTPMSignatureScheme(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		public crypto.PublicKey
+		opts   crypto.SignerOpts
+		alg    tpm2.Algorithm
+		hash   tpm2.Algorithm
+		ok     bool
+	}{
+		{"pkcs1", &rsaKey.PublicKey, crypto.SHA256, tpm2.AlgRSASSA, tpm2.AlgSHA256, true},
+		{"pss", &rsaKey.PublicKey, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA384}, tpm2.AlgRSAPSS, tpm2.AlgSHA384, true},
+		{"ecdsa", &ecKey.PublicKey, crypto.SHA512, tpm2.AlgECDSA, tpm2.AlgSHA512, true},
+		{"sha1", &ecKey.PublicKey, crypto.SHA1, tpm2.AlgECDSA, tpm2.AlgSHA1, true},
+		{"md5", &rsaKey.PublicKey, crypto.MD5, 0, 0, false},
+		{"ed25519", edKey, crypto.SHA256, 0, 0, false},
+	}
+	for _, test := range tests {
+		scheme, err := tpmSignatureScheme(test.public, test.opts)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: error %v", test.name, err)
+			continue
+		}
+		if test.ok && (scheme.Alg != test.alg || scheme.Hash != test.hash) {
+			t.Errorf("%s: scheme %v with %v, want %v with %v", test.name, scheme.Alg, scheme.Hash, test.alg, test.hash)
+		}
+	}
+}
+
+func TestEncodeTPMSignature(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("signed"))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := encodeTPMSignature(&tpm2.Signature{Alg: tpm2.AlgECDSA, ECC: &tpm2.SignatureECC{HashAlg: tpm2.AlgSHA256, R: r, S: s}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(&key.PublicKey, digest[:], signature) {
+		t.Error("the ECDSA signature does not verify")
+	}
+
+	rsaSignature := []byte{1, 2, 3}
+	if signature, err := encodeTPMSignature(&tpm2.Signature{Alg: tpm2.AlgRSASSA, RSA: &tpm2.SignatureRSA{HashAlg: tpm2.AlgSHA256, Signature: rsaSignature}}); err != nil || !bytes.Equal(signature, rsaSignature) {
+		t.Errorf("RSA signature %x, %v", signature, err)
+	}
+	if _, err := encodeTPMSignature(&tpm2.Signature{Alg: tpm2.AlgHMAC}); err == nil {
+		t.Error("a signature without value is accepted")
+	}
+}
+
+func TestTPMMechanisms(t *testing.T) {
+	// A TPM making RSA and ECDSA signatures, but not RSA-PSS ones.
+	mechanisms := tpmMechanisms([]tpm2.Algorithm{tpm2.AlgRSA, tpm2.AlgSHA256, tpm2.AlgRSASSA, tpm2.AlgECC, tpm2.AlgECDSA, tpm2.AlgHMAC})
+	if len(mechanisms) != 2 {
+		t.Errorf("mechanisms %v", mechanisms)
+	}
+	for _, mechanism := range []uint{pkcs11.CKM_RSA_PKCS, pkcs11.CKM_ECDSA} {
+		if _, ok := mechanisms[mechanism]; !ok {
+			t.Errorf("mechanism 0x%x missing", mechanism)
+		}
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{PrivateKey: &tpmSigner{public: &key.PublicKey, canSign: true}}
+	config := &tls.Config{}
+	gateTLSFeatures(&cert, config, &tokenCapabilities{mechanisms: mechanisms, canSign: true}, "auto")
+	if config.MaxVersion != tls.VersionTLS12 {
+		t.Errorf("without RSA-PSS in the TPM, TLS is capped at %x", config.MaxVersion)
+	}
+	if _, err := tpmCapabilities(key); err == nil {
+		t.Error("capabilities of a key out of the TPM")
+	}
+}
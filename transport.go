@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/proxy"
+)
+
+// upstreamOptions holds the settings of the connections to the upstream.
+type upstreamOptions struct {
+	http2                bool
+	http2ReadIdleTimeout time.Duration
+	http2PingTimeout     time.Duration
+	proxy                func(*http.Request) (*url.URL, error)
+	socks5               proxy.ContextDialer
+	resolve              map[string]string
+	resolver             upstreamResolver
+	ipFamily             string
+	sourceIP             net.IP
+	bindControl          func(network, address string, c syscall.RawConn) error
+
+	dialTimeout           time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	maxConnsPerHost     int
+	idleConnTimeout     time.Duration
+
+	proxyProtocol byte
+}
+
+// newTransport creates the transport used to reach the upstream with the
+// given TLS configuration.
+func newTransport(tlsConfig *tls.Config, options upstreamOptions) (*http.Transport, error) {
+	transport := &http.Transport{
+		Proxy:                 options.proxy,
+		DialContext:           options.dialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   options.tlsHandshakeTimeout,
+		ResponseHeaderTimeout: options.responseHeaderTimeout,
+		MaxIdleConns:          options.maxIdleConns,
+		MaxIdleConnsPerHost:   options.maxIdleConnsPerHost,
+		MaxConnsPerHost:       options.maxConnsPerHost,
+		IdleConnTimeout:       options.idleConnTimeout,
+	}
+	if options.proxyProtocol != 0 {
+		// The PROXY protocol header describes a single client, so the
+		// connections can't be reused for the others.
+		transport.DisableKeepAlives = true
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := options.dialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			if err := writeProxyProtocolHeader(ctx, conn, options.proxyProtocol); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
+	if options.http2 {
+		// A custom TLS configuration disables HTTP/2 unless explicitly requested.
+		transport.ForceAttemptHTTP2 = true
+		h2, err := http2.ConfigureTransports(transport)
+		if err != nil {
+			return nil, err
+		}
+		h2.ReadIdleTimeout = options.http2ReadIdleTimeout
+		h2.PingTimeout = options.http2PingTimeout
+	}
+	return transport, nil
+}
+
+// newHTTP2OnlyTransport creates a transport that fails rather than falling back
+// to HTTP/1.1, as required by gRPC.
+func newHTTP2OnlyTransport(tlsConfig *tls.Config, options upstreamOptions) *http2.Transport {
+	return &http2.Transport{
+		TLSClientConfig: tlsConfig,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			conn, err := options.dialUpstream(ctx, network, addr, "https")
+			if err != nil {
+				return nil, err
+			}
+			handshakeCtx := ctx
+			if options.tlsHandshakeTimeout > 0 {
+				var cancel context.CancelFunc
+				handshakeCtx, cancel = context.WithTimeout(ctx, options.tlsHandshakeTimeout)
+				defer cancel()
+			}
+			tlsConn := tls.Client(conn, cfg)
+			start := time.Now()
+			err = tlsConn.HandshakeContext(handshakeCtx)
+			observeHandshake(time.Since(start), tlsConn.ConnectionState().DidResume, err)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		},
+		ReadIdleTimeout: options.http2ReadIdleTimeout,
+		PingTimeout:     options.http2PingTimeout,
+		IdleConnTimeout: options.idleConnTimeout,
+	}
+}
+
+// newH2CTransport creates a transport speaking HTTP/2 without TLS (h2c) to the
+// upstream, as used by internal gRPC services.
+func newH2CTransport(options upstreamOptions) *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return options.dialUpstream(ctx, network, addr, "http")
+		},
+		ReadIdleTimeout: options.http2ReadIdleTimeout,
+		PingTimeout:     options.http2PingTimeout,
+		IdleConnTimeout: options.idleConnTimeout,
+	}
+}
+
+// newH3Transport creates a transport reaching the upstream over HTTP/3 (QUIC).
+func newH3Transport(tlsConfig *tls.Config, options upstreamOptions) (*http3.RoundTripper, error) {
+	if tlsConfig.MaxVersion != 0 && tlsConfig.MaxVersion < tls.VersionTLS13 {
+		return nil, errors.New("HTTP/3 requires TLS 1.3, which is not available with this token")
+	}
+	// QUIC dials a single address of a host name: resolve them all, to fall
+	// back across them like dialContext.
+	if options.resolver == nil {
+		options.resolver = systemResolver{}
+	}
+	return &http3.RoundTripper{
+		TLSClientConfig: tlsConfig,
+		QUICConfig: &quic.Config{
+			// Keep the connection alive, a new one costs a signature from the token.
+			KeepAlivePeriod:      15 * time.Second,
+			HandshakeIdleTimeout: options.tlsHandshakeTimeout,
+		},
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			addrs, err := options.resolveAddr(ctx, addr)
+			if err != nil {
+				return nil, err
+			}
+			var lastErr error
+			for _, addr := range addrs {
+				conn, err := quic.DialAddrEarly(ctx, addr, tlsCfg, cfg)
+				if err == nil {
+					return conn, nil
+				}
+				lastErr = err
+			}
+			return nil, lastErr
+		},
+	}, nil
+}
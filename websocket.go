@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/rand"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upgradeOptions holds the settings of upgraded (e.g. WebSocket) connections.
+type upgradeOptions struct {
+	idleTimeout  time.Duration
+	pingInterval time.Duration
+}
+
+// wrapUpgradedConnection applies the idle timeout and WebSocket keepalive
+// pings to the connection of a 101 Switching Protocols response. The reverse
+// proxy then copies data in both directions without buffering.
+func wrapUpgradedConnection(resp *http.Response, options upgradeOptions) {
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return
+	}
+	backConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		return
+	}
+	conn := &upgradedConn{ReadWriteCloser: backConn, done: make(chan struct{})}
+	if options.idleTimeout > 0 {
+		conn.idle = time.AfterFunc(options.idleTimeout, func() {
+			timedLog("Closing idle upgraded connection")
+			conn.Close()
+		})
+		conn.idleTimeout = options.idleTimeout
+	}
+	if options.pingInterval > 0 && strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		go conn.ping(options.pingInterval)
+	}
+	resp.Body = conn
+}
+
+// upgradedConn wraps the upstream side of an upgraded connection. Writes carry
+// the client to upstream stream, which is tracked frame by frame so that pings
+// can be injected without corrupting it.
+type upgradedConn struct {
+	io.ReadWriteCloser
+
+	mu        sync.Mutex
+	frames    websocketFrameTracker
+	lastWrite time.Time
+
+	idle        *time.Timer
+	idleTimeout time.Duration
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *upgradedConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *upgradedConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, err := c.ReadWriteCloser.Write(p)
+	c.frames.feed(p[:n])
+	c.lastWrite = time.Now()
+	c.touch()
+	return n, err
+}
+
+func (c *upgradedConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if c.idle != nil {
+			c.idle.Stop()
+		}
+		err = c.ReadWriteCloser.Close()
+	})
+	return err
+}
+
+func (c *upgradedConn) touch() {
+	if c.idle != nil {
+		c.idle.Reset(c.idleTimeout)
+	}
+}
+
+// ping sends an empty, masked WebSocket ping frame to the upstream whenever the
+// client has been silent for the given interval.
+func (c *upgradedConn) ping(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		c.mu.Lock()
+		if time.Since(c.lastWrite) >= interval && c.frames.atBoundary() {
+			frame := []byte{0x89, 0x80, 0, 0, 0, 0}
+			_, _ = rand.Read(frame[2:])
+			if _, err := c.ReadWriteCloser.Write(frame); err != nil {
+				c.mu.Unlock()
+				c.Close()
+				return
+			}
+			c.lastWrite = time.Now()
+		}
+		c.mu.Unlock()
+	}
+}
+
+// websocketFrameTracker follows the frame boundaries of a WebSocket stream.
+type websocketFrameTracker struct {
+	header    []byte
+	remaining uint64
+}
+
+func (t *websocketFrameTracker) feed(p []byte) {
+	for len(p) > 0 {
+		if t.remaining > 0 {
+			n := uint64(len(p))
+			if n > t.remaining {
+				n = t.remaining
+			}
+			t.remaining -= n
+			p = p[n:]
+			continue
+		}
+		t.header = append(t.header, p[0])
+		p = p[1:]
+		if size := websocketHeaderSize(t.header); size > 0 && len(t.header) == size {
+			t.remaining = websocketPayloadLength(t.header)
+			t.header = t.header[:0]
+		}
+	}
+}
+
+func (t *websocketFrameTracker) atBoundary() bool {
+	return t.remaining == 0 && len(t.header) == 0
+}
+
+// websocketHeaderSize returns the size of the frame header starting with the
+// given bytes, or 0 if not enough bytes are known yet.
+func websocketHeaderSize(header []byte) int {
+	if len(header) < 2 {
+		return 0
+	}
+	size := 2
+	switch header[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if header[1]&0x80 != 0 {
+		size += 4
+	}
+	return size
+}
+
+func websocketPayloadLength(header []byte) uint64 {
+	length := uint64(header[1] & 0x7f)
+	var extended []byte
+	switch length {
+	case 126:
+		extended = header[2:4]
+	case 127:
+		extended = header[2:10]
+	default:
+		return length
+	}
+	length = 0
+	for _, b := range extended {
+		length = length<<8 | uint64(b)
+	}
+	return length
+}